@@ -0,0 +1,133 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2" // imports as package "cli"
+
+	st "github.com/manetu/security-token/core"
+)
+
+// The completion scripts are adapted from those shipped with urfave/cli.  Each asks the program itself for
+// candidates via --generate-bash-completion, and treats ':' as part of a word so that serial numbers complete whole.
+
+const bashCompletion = `# bash completion for %[1]s
+_%[2]s_complete() {
+  local cur prev words cword opts
+  if declare -F _init_completion >/dev/null 2>&1; then
+    _init_completion -n "=:" || return
+  else
+    COMPREPLY=()
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    words=("${COMP_WORDS[@]}")
+    cword=$COMP_CWORD
+  fi
+  words=("${words[@]:0:$cword}")
+  if [[ "$cur" == "-"* ]]; then
+    opts=$("${words[@]}" "$cur" --generate-bash-completion 2>/dev/null)
+  else
+    opts=$("${words[@]}" --generate-bash-completion 2>/dev/null)
+  fi
+  COMPREPLY=($(compgen -W "${opts}" -- "${cur}"))
+  if declare -F __ltrim_colon_completions >/dev/null 2>&1; then
+    __ltrim_colon_completions "$cur"
+  fi
+  return 0
+}
+complete -o bashdefault -o default -F _%[2]s_complete %[1]s
+`
+
+const zshCompletion = `#compdef %[1]s
+
+_%[2]s_complete() {
+  local -a opts
+  local cur
+  cur=${words[-1]}
+  if [[ "$cur" == "-"* ]]; then
+    opts=("${(@f)$(${words[@]:0:#words[@]-1} ${cur} --generate-bash-completion 2>/dev/null)}")
+  else
+    opts=("${(@f)$(${words[@]:0:#words[@]-1} --generate-bash-completion 2>/dev/null)}")
+  fi
+
+  if [[ "${opts[1]}" != "" ]]; then
+    compadd -a opts
+  else
+    _files
+  fi
+}
+
+compdef _%[2]s_complete %[1]s
+`
+
+const fishCompletion = `# fish completion for %[1]s
+function __%[2]s_complete
+    set -l args (commandline -opc)
+    set -l cur (commandline -ct)
+    if string match -q -- '-*' $cur
+        $args $cur --generate-bash-completion 2>/dev/null
+    else
+        $args --generate-bash-completion 2>/dev/null
+    end
+end
+complete -c %[1]s -f -a '(__%[2]s_complete)'
+`
+
+var completionScripts = map[string]string{
+	"bash": bashCompletion,
+	"zsh":  zshCompletion,
+	"fish": fishCompletion,
+}
+
+// printCompletion writes the completion script for shell
+func printCompletion(name, shell string) error {
+	script, ok := completionScripts[shell]
+	if !ok {
+		return fmt.Errorf("unsupported shell %q (available: bash, zsh, fish)", shell)
+	}
+
+	fmt.Printf(script, name, strings.ReplaceAll(name, "-", "_"))
+	return nil
+}
+
+// completeTokens suggests the serial numbers and labels or realms of live tokens as the value of --serial or --realm,
+// and otherwise the flags of the command
+func completeTokens(ctx *st.Core) cli.BashCompleteFunc {
+	return func(c *cli.Context) {
+		var lastArg string
+		if len(os.Args) > 2 {
+			lastArg = os.Args[len(os.Args)-2]
+		}
+
+		var values []string
+		var err error
+		switch lastArg {
+		case "--serial":
+			ctx.SetQuiet(true)
+			values, err = ctx.Serials()
+			if err == nil {
+				var labels []string
+				labels, err = ctx.Labels()
+				values = append(values, labels...)
+			}
+		case "--realm", "--provider":
+			ctx.SetQuiet(true)
+			values, err = ctx.Realms()
+		default:
+			cli.DefaultCompleteWithFlags(c.Command)(c)
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		for _, v := range values {
+			fmt.Fprintln(c.App.Writer, v)
+		}
+	}
+}
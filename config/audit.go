@@ -0,0 +1,10 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package config
+
+type AuditConfiguration struct {
+	Path     string
+	Disabled bool
+}
@@ -0,0 +1,12 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package config
+
+type AwsKmsConfiguration struct {
+	Region          string
+	Endpoint        string
+	CertificatePath string
+	ParameterPrefix string
+}
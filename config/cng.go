@@ -0,0 +1,11 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package config
+
+type CngConfiguration struct {
+	Provider        string
+	MachineKey      bool
+	CertificatePath string
+}
@@ -5,5 +5,28 @@ Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
 package config
 
 type Configuration struct {
-	Pkcs11 Pkcs11Configuration
+	Backend       string
+	Pkcs11        Pkcs11Configuration
+	AwsKms        AwsKmsConfiguration
+	GcpKms        GcpKmsConfiguration
+	AzureKeyVault AzureKeyVaultConfiguration
+	Vault         VaultConfiguration
+	Piv           PivConfiguration
+	SecureEnclave SecureEnclaveConfiguration
+	Cng           CngConfiguration
+	Remote        RemoteConfiguration
+	Agent         AgentConfiguration
+	SoftKeys      SoftKeysConfiguration
+	Audit         AuditConfiguration
+	Webhooks      []WebhookConfiguration
+	Policy        PolicyConfiguration
+	Enroll        EnrollConfiguration
+	Tsa           TSAConfiguration
+	Login         LoginConfiguration
+	Plugins       map[string]PluginConfiguration
+	// Fips restricts operation to the algorithms and key sizes approved by FIPS 140-3
+	Fips bool
+	// ClockSkew corrects the clock of the host when issuing certificates and signing login assertions, being added
+	// to its time, such as "-90s" for a host running 90 seconds fast
+	ClockSkew string
 }
@@ -0,0 +1,15 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package config
+
+type EnrollConfiguration struct {
+	// Registrar is "manetu" (the default), "http" or one registered by the program
+	Registrar string
+	URL       string
+	// Token is the bearer token authorizing the registration, defaulting to MANETU_ENROLL_TOKEN
+	Token string
+	// Roles are posted to the registration service, to be granted to the identity
+	Roles []string
+}
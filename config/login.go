@@ -0,0 +1,10 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package config
+
+type LoginConfiguration struct {
+	// Http2 negotiates HTTP/2 with the token endpoint, so that concurrent logins share one connection
+	Http2 bool
+}
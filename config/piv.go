@@ -0,0 +1,16 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package config
+
+type PivConfiguration struct {
+	Reader string
+	Slot   string
+	// Pin is the PIN of the card, held as bytes so that it may be zeroized, as the PIN of Pkcs11Configuration is
+	Pin               []byte
+	ManagementKey     string
+	ManagementKeyType string
+	PinPolicy         string
+	TouchPolicy       string
+}
@@ -7,5 +7,17 @@ package config
 type Pkcs11Configuration struct {
 	Path       string
 	TokenLabel string
-	Pin        string
+	// Pin is the user PIN, held as bytes so that it reaches C_Login without a copy that cannot be zeroized
+	Pin []byte
+	// CacheTTL is the time for which the certificates enumerated from the token are reused, such as "30s" (the
+	// default) or "0" to enumerate afresh every time
+	CacheTTL string
+	// Timeout is the time allowed for each operation on the device, such as "1m" (the default) or "0" to wait
+	// indefinitely
+	Timeout string
+	// FipsCertificate is the number of the CMVP certificate validating the module under FIPS 140, asserted here since
+	// PKCS#11 has no means to report validation
+	FipsCertificate string
+	// Replicas lists further devices holding copies of the same keys, tried in order when the device above fails
+	Replicas []Pkcs11Configuration
 }
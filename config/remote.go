@@ -0,0 +1,13 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package config
+
+type RemoteConfiguration struct {
+	Address    string
+	CACert     string
+	ClientCert string
+	ClientKey  string
+	ServerName string
+}
@@ -0,0 +1,9 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package config
+
+type SoftKeysConfiguration struct {
+	Path string
+}
@@ -0,0 +1,14 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package config
+
+type TSAConfiguration struct {
+	// URL of the RFC 3161 time-stamping authority
+	URL string
+	// CACert names the PEM encoded certificates trusted to issue the certificate of the TSA
+	CACert string
+	// Policy requests timestamps under the TSA policy with this OID
+	Policy string
+}
@@ -0,0 +1,14 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package config
+
+type VaultConfiguration struct {
+	Address   string
+	Token     string
+	Namespace string
+	Mount     string
+	KvMount   string
+	KvPath    string
+}
@@ -0,0 +1,15 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package config
+
+type WebhookConfiguration struct {
+	URL string
+	// Format is "json" (the default) or "slack"
+	Format string
+	// Events lists the events posted to the webhook, or all events when empty
+	Events []string
+	// Secret, when set, signs the body of each request with HMAC-SHA256
+	Secret string
+}
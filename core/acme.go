@@ -0,0 +1,350 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// LetsEncryptURL is the ACME directory used when none is given
+const LetsEncryptURL = acme.LetsEncryptURL
+
+// ACMEOptions configures the certificate request of ACME
+type ACMEOptions struct {
+	// DirectoryURL is the directory of the ACME server, defaulting to Let's Encrypt
+	DirectoryURL string
+	// Domains lists the DNS names of the certificate, the first also serving as its common name
+	Domains []string
+	// Email is the contact of the ACME account, if any
+	Email string
+	// Challenge selects how control of the domains is proven: "http-01" (the default) or "dns-01"
+	Challenge string
+	// HTTPAddr is the address on which http-01 challenges are answered, defaulting to ":80"
+	HTTPAddr string
+	// Insecure allows insecure TLS to the ACME server
+	Insecure bool
+}
+
+// ACME obtains a certificate for the key of the token identified by serial from an ACME (RFC 8555) server, signing
+// the request with the token so the private key never leaves the keystore.  The account is held by a software key of
+// its own, one per directory, since ACME servers refuse a certificate for the key of the account.  The leaf replaces
+// the self-signed certificate of the token, which remains addressed by its original serial number; the issued chain
+// is returned, leaf first, and kept in $HOME/.manetu/certs/acme alongside the token.
+func (c *Core) ACME(serial string, opts ACMEOptions) ([]*x509.Certificate, error) {
+	if len(opts.Domains) == 0 {
+		return nil, classify(ExitConfig, errors.New("at least one --domain must be given"))
+	}
+	switch opts.Challenge {
+	case "":
+		opts.Challenge = "http-01"
+	case "http-01", "dns-01":
+	default:
+		return nil, classify(ExitConfig, fmt.Errorf("unknown challenge %q (available: http-01, dns-01)", opts.Challenge))
+	}
+	if opts.HTTPAddr == "" {
+		opts.HTTPAddr = ":80"
+	}
+	if opts.DirectoryURL == "" {
+		opts.DirectoryURL = LetsEncryptURL
+	}
+
+	// checked before anything is ordered, as the backend may be instrumented, hiding the optional interfaces
+	replacer, ok := c.getBackend().(certificateReplacer)
+	if !ok {
+		return nil, classify(ExitConfig, errors.New("the keystore backend cannot replace the certificate of a token (available with memory, pkcs11 and softkeys)"))
+	}
+
+	token, err := c.getToken(serial)
+	if err != nil {
+		return nil, err
+	}
+	id := token.Cert.SerialNumber.Bytes()
+
+	store, err := newFileCertStore("", "acme")
+	if err != nil {
+		return nil, err
+	}
+
+	accountKey, err := acmeAccountKey("", opts.DirectoryURL)
+	if err != nil {
+		return nil, fmt.Errorf("error loading the ACME account key: %w", err)
+	}
+
+	client := &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: opts.DirectoryURL,
+		HTTPClient:   newHTTPClient(opts.Insecure),
+		UserAgent:    "manetu-security-token",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	stop := c.startSpinner("Registering ACME account...")
+	account := &acme.Account{}
+	if opts.Email != "" {
+		account.Contact = []string{"mailto:" + opts.Email}
+	}
+	_, err = client.Register(ctx, account, acme.AcceptTOS)
+	stop()
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("error registering account with %s: %w", opts.DirectoryURL, err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(opts.Domains...))
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.acmeAuthorize(ctx, client, order, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	stop = c.startSpinner("Requesting certificate...")
+	defer stop()
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: opts.Domains[0]},
+		DNSNames: opts.Domains,
+	}, token.Signer)
+	if err != nil {
+		return nil, err
+	}
+
+	ders, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []*x509.Certificate
+	for _, der := range ders {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing the certificate issued by the ACME server: %w", err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("the ACME server returned no certificate")
+	}
+
+	err = checkKeyMatchesCert(token.Signer, chain[0])
+	if err != nil {
+		return nil, fmt.Errorf("the issued certificate does not carry the token's key: %w", err)
+	}
+
+	err = store.PutChain(id, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	err = replacer.ReplaceCertificate(id, chain[0])
+	c.audit("acme", token.Cert, err)
+	if err != nil {
+		return nil, fmt.Errorf("error importing the issued certificate onto the token: %w", err)
+	}
+
+	return chain, nil
+}
+
+// acmeAccountKey returns the account key for the ACME directory at url, kept in dir, defaulting to
+// $HOME/.manetu/acme, and generated upon first use
+func acmeAccountKey(dir, url string) (crypto.Signer, error) {
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(home, ".manetu", "acme")
+	}
+	sum := sha256.Sum256([]byte(url))
+	path := filepath.Join(dir, hex.EncodeToString(sum[:8])+".key")
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		defer LockSecret(data)()
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "PRIVATE KEY" {
+			return nil, fmt.Errorf("%s: no PEM encoded private key found", path)
+		}
+		defer LockSecret(block.Bytes)()
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%s: unsupported key type %T", path, key)
+		}
+		return signer, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer LockSecret(der)()
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	defer LockSecret(data)()
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// acmeAuthorize proves control of every domain of order still pending authorization
+func (c *Core) acmeAuthorize(ctx context.Context, client *acme.Client, order *acme.Order, opts ACMEOptions) error {
+	type pending struct {
+		authz *acme.Authorization
+		chal  *acme.Challenge
+	}
+
+	var todo []pending
+	for _, u := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, u)
+		if err != nil {
+			return err
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+
+		var chal *acme.Challenge
+		for _, ch := range authz.Challenges {
+			if ch.Type == opts.Challenge {
+				chal = ch
+				break
+			}
+		}
+		if chal == nil {
+			return fmt.Errorf("the ACME server offers no %s challenge for %s", opts.Challenge, authz.Identifier.Value)
+		}
+		todo = append(todo, pending{authz, chal})
+	}
+	if len(todo) == 0 {
+		return nil
+	}
+
+	if opts.Challenge == "http-01" {
+		responses := make(map[string]string)
+		for _, p := range todo {
+			resp, err := client.HTTP01ChallengeResponse(p.chal.Token)
+			if err != nil {
+				return err
+			}
+			responses[client.HTTP01ChallengePath(p.chal.Token)] = resp
+		}
+
+		shutdown, err := serveHTTP01(opts.HTTPAddr, responses)
+		if err != nil {
+			return err
+		}
+		defer shutdown()
+	} else {
+		fmt.Fprintf(os.Stderr, "Publish the following DNS records:\n")
+		for _, p := range todo {
+			record, err := client.DNS01ChallengeRecord(p.chal.Token)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "  _acme-challenge.%s. TXT %q\n", p.authz.Identifier.Value, record)
+		}
+
+		ok, err := confirm("Continue once the records are visible?")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("cancelled")
+		}
+	}
+
+	stop := c.startSpinner(fmt.Sprintf("Validating %d domain(s)...", len(todo)))
+	defer stop()
+
+	for _, p := range todo {
+		_, err := client.Accept(ctx, p.chal)
+		if err != nil {
+			return err
+		}
+		_, err = client.WaitAuthorization(ctx, p.authz.URI)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.authz.Identifier.Value, err)
+		}
+	}
+
+	return nil
+}
+
+// serveHTTP01 answers http-01 challenges on addr, with responses keyed by path, until shutdown is called
+func serveHTTP01(addr string, responses map[string]string) (shutdown func(), err error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for http-01 challenges: %w", err)
+	}
+
+	server := &http.Server{
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			resp, ok := responses[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = w.Write([]byte(resp))
+		}),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = server.Serve(l)
+	}()
+
+	return func() {
+		_ = server.Close()
+		wg.Wait()
+	}, nil
+}
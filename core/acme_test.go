@@ -0,0 +1,35 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/ecdsa"
+	"testing"
+)
+
+// TestACMEAccountKey keeps one account key per directory, reused by later requests to the same directory
+func TestACMEAccountKey(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := acmeAccountKey(dir, LetsEncryptURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := acmeAccountKey(dir, LetsEncryptURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Public().(*ecdsa.PublicKey).Equal(again.Public()) {
+		t.Error("the account key of the directory was not reused")
+	}
+
+	other, err := acmeAccountKey(dir, "https://acme-staging-v02.api.letsencrypt.org/directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Public().(*ecdsa.PublicKey).Equal(other.Public()) {
+		t.Error("two directories share an account key")
+	}
+}
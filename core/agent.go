@@ -0,0 +1,165 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/manetu/security-token/config"
+)
+
+func init() {
+	RegisterBackend("agent", newAgentBackend)
+}
+
+// AgentSocketEnv names the environment variable through which clients find the agent, as with SSH_AUTH_SOCK
+const AgentSocketEnv = "MANETU_AGENT_SOCK"
+
+// agentSocket returns the path of the agent socket: agent.socket from the configuration, else $MANETU_AGENT_SOCK,
+// else a socket within $XDG_RUNTIME_DIR or $HOME/.manetu
+func agentSocket(cfg *config.Configuration) (string, error) {
+	if cfg.Agent.Socket != "" {
+		return cfg.Agent.Socket, nil
+	}
+	if sock := os.Getenv(AgentSocketEnv); sock != "" {
+		return sock, nil
+	}
+	return runtimeSocket("agent.sock")
+}
+
+// runtimeSocket returns the path of the socket named name within $XDG_RUNTIME_DIR, or within $HOME/.manetu when that
+// is not set
+func runtimeSocket(name string) (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "manetu-security-token", name), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".manetu", name), nil
+}
+
+// agentBackend forwards every keystore operation to an agent over its Unix socket.  The agent speaks the same
+// RemoteSigner service as the remote backend, but without TLS, since access is controlled by the permissions of the
+// socket.
+type agentBackend struct {
+	*remoteBackend
+}
+
+func newAgentBackend(cfg *config.Configuration) (Backend, error) {
+	sock, err := agentSocket(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(sock); err != nil {
+		return nil, fmt.Errorf("no agent listening at %s; start one with the agent command", sock)
+	}
+
+	conn, err := grpc.Dial("unix:"+sock,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(remoteCodec{})))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", sock, err)
+	}
+
+	return &agentBackend{&remoteBackend{conn: conn}}, nil
+}
+
+// Agent holds the keystore open and serves it over a Unix socket, readable only by the current user, until
+// interrupted.  Short-lived processes using the agent backend thus skip the HSM login and never need the PIN.  Logins
+// requested through the agent use insecure TLS when insecure is set.
+func (c *Core) Agent(socket string, insecure bool) error {
+	// a daemon holding its locks must never wait upon the terminal
+	c.interactive = false
+
+	backend := c.getBackend()
+	if _, ok := backend.(*agentBackend); ok {
+		return classify(ExitConfig, errors.New("the agent cannot serve the agent backend; select a keystore with --backend"))
+	}
+
+	backend, stopMetrics, err := c.startMetrics(backend)
+	if err != nil {
+		return err
+	}
+	defer stopMetrics()
+
+	stopProfiling, err := c.startProfiling()
+	if err != nil {
+		return err
+	}
+	defer stopProfiling()
+
+	// a socket passed by systemd socket activation takes the place of our own
+	l, err := systemdListener()
+	if err != nil {
+		return err
+	}
+	if l != nil {
+		socket = l.Addr().String()
+	} else {
+		if socket == "" {
+			socket, err = agentSocket(&c.configuration)
+			if err != nil {
+				return err
+			}
+		}
+
+		l, err = listenPrivateSocket(socket, "an agent")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = os.Remove(socket)
+		}()
+	}
+
+	server := grpc.NewServer(grpc.ForceServerCodec(remoteCodec{}))
+	rs := newRemoteServer(c, backend, insecure)
+	rs.register(server)
+
+	stopRotation, err := rs.startRotation()
+	if err != nil {
+		return err
+	}
+	defer stopRotation()
+
+	fmt.Printf("%s=%s; export %s;\n", AgentSocketEnv, socket, AgentSocketEnv)
+	fmt.Printf("MANETU_BACKEND=agent; export MANETU_BACKEND;\n")
+
+	return serveUntilInterrupted(server, l, &rs.keystoreLock)
+}
+
+// listenPrivateSocket listens on the Unix socket at path, readable only by the current user, replacing a socket left
+// behind by a server that died.  what names the server in the error reported when another is still listening.
+func listenPrivateSocket(path string, what string) (net.Listener, error) {
+	err := privateDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%s is already listening at %s", what, path)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		_ = os.Remove(path)
+	}
+
+	// only the current user may connect
+	return listenUnix(path)
+}
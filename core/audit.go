@@ -0,0 +1,327 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// auditGenesis is the hash preceding the first entry of an audit log
+var auditGenesis = strings.Repeat("0", sha256.Size*2)
+
+// AuditEntry records one operation on a token.  Each entry carries the hash of its predecessor, so that removing,
+// reordering or altering any entry but the last breaks the chain.
+type AuditEntry struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Serial    string    `json:"serial,omitempty"`
+	MRN       string    `json:"mrn,omitempty"`
+	// Caller identifies the user, host and process performing the operation
+	Caller string `json:"caller"`
+	// Result is "ok" or "failed"
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+	Prev   string `json:"prev"`
+	Hash   string `json:"hash"`
+}
+
+// computeHash returns the hash of e, covering every field but the hash itself
+func (e AuditEntry) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// SetAuditLog selects the file recording the operations of c, or disables auditing when path is empty.  Cores made
+// with New record to audit.path of the configuration file, defaulting to $HOME/.manetu/audit.log; those made with
+// NewWithBackend record nothing unless given a log here.
+func (c *Core) SetAuditLog(path string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.auditPath = path
+	c.auditSet = true
+}
+
+// auditLog returns the path of the audit log, or "" when auditing is disabled
+func (c *Core) auditLog() (string, error) {
+	c.Lock()
+	set, path := c.auditSet, c.auditPath
+	c.Unlock()
+	if set {
+		return path, nil
+	}
+
+	// operations audit concurrently, so the settings are read under the lock that loadSettings fills them with
+	c.loadSettings()
+	c.Lock()
+	cfg := c.configuration.Audit
+	c.Unlock()
+
+	if cfg.Disabled {
+		return "", nil
+	}
+	if cfg.Path != "" {
+		return cfg.Path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".manetu", "audit.log"), nil
+}
+
+// auditCaller identifies the current user, host and process
+func auditCaller() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s@%s[%d]", name, host, os.Getpid())
+}
+
+// audit records the outcome of operation op on the token holding cert, which may be nil if unknown
+func (c *Core) audit(op string, cert *x509.Certificate, err error) {
+	c.auditSince(op, cert, time.Time{}, err)
+}
+
+// auditSince is audit for an operation begun at start, whose duration is logged along with its outcome
+func (c *Core) auditSince(op string, cert *x509.Certificate, start time.Time, err error) {
+	e := AuditEntry{Operation: op}
+	if cert != nil {
+		e.Serial = HexEncode(cert.SerialNumber.Bytes())
+		if len(cert.Subject.Organization) > 0 {
+			e.MRN = ComputeMRN(cert)
+		}
+	}
+	c.auditEntry(e, start, err)
+}
+
+// auditEntry completes and appends e to the audit log, and logs it at the info level along with the duration since
+// start, unless zero.  The operation has already happened by now, so a failure to record it is reported as a warning
+// rather than failing the operation.
+func (c *Core) auditEntry(e AuditEntry, start time.Time, err error) {
+	e.Result = "ok"
+	if err != nil {
+		e.Result = "failed"
+		e.Error = err.Error()
+	}
+
+	var duration interface{}
+	if !start.IsZero() {
+		duration = time.Since(start)
+	}
+	logInfo(e.Operation, "serial", e.Serial, "mrn", e.MRN, "duration", duration, "result", e.Result, "error", err)
+
+	werr := c.appendAudit(e)
+	if werr != nil {
+		logWarn("unable to record the operation in the audit log", "operation", e.Operation, "error", werr)
+	}
+}
+
+func (c *Core) appendAudit(e AuditEntry) error {
+	path, err := c.auditLog()
+	if err != nil || path == "" {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// other processes append to the same chain, so the last entry must not change until ours is written
+	err = lockFile(f)
+	if err != nil {
+		return err
+	}
+	defer unlockFile(f)
+
+	last, err := lastAuditEntry(f)
+	if err != nil {
+		return err
+	}
+
+	e.Prev = auditGenesis
+	if last != nil {
+		e.Seq = last.Seq + 1
+		e.Prev = last.Hash
+	}
+	e.Time = time.Now().UTC()
+	e.Caller = auditCaller()
+	e.Hash, err = e.computeHash()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// lastAuditEntry returns the final entry of the log f, or nil if it is empty
+func lastAuditEntry(f *os.File) (*AuditEntry, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// entries are far smaller than this, so the tail always holds the whole of the last one
+	size := fi.Size()
+	n := int64(64 * 1024)
+	if size < n {
+		n = size
+	}
+	tail := make([]byte, n)
+	_, err = f.ReadAt(tail, size-n)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	tail = bytes.TrimRight(tail, "\n")
+	if len(tail) == 0 {
+		return nil, nil
+	}
+	if i := bytes.LastIndexByte(tail, '\n'); i >= 0 {
+		tail = tail[i+1:]
+	}
+
+	var e AuditEntry
+	err = json.Unmarshal(tail, &e)
+	if err != nil {
+		return nil, fmt.Errorf("the last entry of the audit log is corrupt: %w", err)
+	}
+	return &e, nil
+}
+
+// readAudit reads every entry of the audit log
+func (c *Core) readAudit() (string, []AuditEntry, error) {
+	path, err := c.auditLog()
+	if err != nil {
+		return "", nil, err
+	}
+	if path == "" {
+		return "", nil, classify(ExitConfig, errors.New("auditing is disabled by audit.disabled"))
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return path, nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	var entries []AuditEntry
+	for i, line := range bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var e AuditEntry
+		err = json.Unmarshal(line, &e)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		entries = append(entries, e)
+	}
+	return path, entries, nil
+}
+
+// AuditShow prints the audit log as a table, or as JSON lines when output is "json"
+func (c *Core) AuditShow(output string) error {
+	_, entries, err := c.readAudit()
+	if err != nil {
+		return err
+	}
+
+	switch output {
+	case "", "table":
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"Seq", "Time", "Operation", "Serial", "Caller", "Result"})
+		table.SetAutoWrapText(false)
+		for _, e := range entries {
+			result := e.Result
+			if e.Error != "" {
+				result += ": " + e.Error
+			}
+			table.Append([]string{fmt.Sprint(e.Seq), e.Time.Format(time.RFC3339), e.Operation, e.Serial, e.Caller, result})
+		}
+		table.Render()
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range entries {
+			err = enc.Encode(e)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown output format %q (available: table, json)", output)
+	}
+
+	return nil
+}
+
+// AuditVerify checks the hash chain of the audit log, returning the number of entries and the hash of the last, which
+// may be recorded elsewhere so that truncation of the log can be detected too
+func (c *Core) AuditVerify() (int, string, error) {
+	path, entries, err := c.readAudit()
+	if err != nil {
+		return 0, "", err
+	}
+
+	prev := auditGenesis
+	for i, e := range entries {
+		if e.Seq != uint64(i) {
+			return 0, "", fmt.Errorf("%s: entry %d has sequence number %d; entries have been removed or reordered", path, i, e.Seq)
+		}
+		if e.Prev != prev {
+			return 0, "", fmt.Errorf("%s: entry %d does not follow entry %d; the chain is broken", path, e.Seq, i-1)
+		}
+		hash, err := e.computeHash()
+		if err != nil {
+			return 0, "", err
+		}
+		if hash != e.Hash {
+			return 0, "", fmt.Errorf("%s: entry %d has been altered", path, e.Seq)
+		}
+		prev = e.Hash
+	}
+
+	return len(entries), prev, nil
+}
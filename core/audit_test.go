@@ -0,0 +1,85 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestAuditTamper breaks the chain of the audit log when an entry in its middle is altered, even with its hash
+// recomputed, or removed
+func TestAuditTamper(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		tamper func(t *testing.T, line []byte) []byte
+	}{
+		{"altered", func(t *testing.T, line []byte) []byte {
+			return bytes.Replace(line, []byte(`"result":"failed"`), []byte(`"result":"ok"`), 1)
+		}},
+		{"altered and rehashed", func(t *testing.T, line []byte) []byte {
+			var e AuditEntry
+			err := json.Unmarshal(line, &e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.Result, e.Error = "ok", ""
+			e.Hash, err = e.computeHash()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return data
+		}},
+		{"removed", func(t *testing.T, line []byte) []byte {
+			return nil
+		}},
+	} {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		c := NewWithBackend(NewMemoryBackend())
+		c.SetAuditLog(path)
+
+		c.audit("generate", nil, nil)
+		c.audit("delete", nil, errors.New("denied"))
+		c.audit("generate", nil, nil)
+
+		n, _, err := c.AuditVerify()
+		if err != nil || n != 3 {
+			t.Fatalf("%s: AuditVerify = %d, %v; want 3 entries", tt.name, n, err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+		lines[1] = tt.tamper(t, lines[1])
+		var tampered []byte
+		for _, line := range lines {
+			if line != nil {
+				tampered = append(tampered, append(line, '\n')...)
+			}
+		}
+		if bytes.Equal(tampered, data) {
+			t.Fatalf("%s: the log was not tampered with", tt.name)
+		}
+		err = os.WriteFile(path, tampered, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = c.AuditVerify()
+		if err == nil {
+			t.Errorf("%s: AuditVerify succeeded on a tampered log", tt.name)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on f, shared with other processes, waiting for any other holder to release it
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(f *os.File) {
+	_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,461 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+func (c *awsCredentials) expired() bool {
+	return !c.Expiration.IsZero() && time.Now().Add(5*time.Minute).After(c.Expiration)
+}
+
+// awsClient is a minimal client for the AWS JSON 1.1 protocol used by KMS and SSM.  Credentials are resolved in the
+// same order as the AWS SDKs: environment, shared credentials file, web identity (EKS), container (ECS/EKS Pod
+// Identity) and finally the EC2 instance metadata service.
+type awsClient struct {
+	sync.Mutex
+	region     string
+	endpoints  map[string]string
+	httpClient *http.Client
+	creds      *awsCredentials
+}
+
+type awsError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (e *awsError) Error() string {
+	code := e.Type
+	if i := strings.LastIndex(code, "#"); i >= 0 {
+		code = code[i+1:]
+	}
+	return fmt.Sprintf("%s: %s", code, e.Message)
+}
+
+func newAwsClient(region string) (*awsClient, error) {
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		return nil, errors.New("no AWS region configured")
+	}
+
+	return &awsClient{
+		region:     region,
+		endpoints:  map[string]string{},
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (a *awsClient) endpoint(service string) string {
+	if e, ok := a.endpoints[service]; ok {
+		return e
+	}
+	return fmt.Sprintf("https://%s.%s.amazonaws.com/", service, a.region)
+}
+
+// call invokes the given action, e.g. "TrentService.Sign", marshalling in and unmarshalling the response into out
+func (a *awsClient) call(service, target string, in, out interface{}) error {
+	creds, err := a.credentials()
+	if err != nil {
+		return fmt.Errorf("resolving AWS credentials: %w", err)
+	}
+
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.endpoint(service), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	signV4(req, body, creds, a.region, service, time.Now())
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		e := &awsError{}
+		if json.Unmarshal(data, e) != nil || e.Type == "" {
+			return fmt.Errorf("%s: %s", target, resp.Status)
+		}
+		return e
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// signedHeaders are the headers signed by signV4 when present, in canonical order
+var signedHeaders = []string{"content-type", "host", "x-amz-date", "x-amz-security-token", "x-amz-target"}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to req.  Only requests without query parameters
+// are supported, which is all the JSON protocol requires.
+func signV4(req *http.Request, body []byte, creds *awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	var names []string
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		if value == "" {
+			continue
+		}
+		names = append(names, name)
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		"",
+		headers.String(),
+		signed,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonical))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func (a *awsClient) credentials() (*awsCredentials, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.creds != nil && !a.creds.expired() {
+		return a.creds, nil
+	}
+
+	for _, provider := range []func() (*awsCredentials, error){
+		envCredentials,
+		sharedCredentials,
+		a.webIdentityCredentials,
+		a.containerCredentials,
+		a.instanceCredentials,
+	} {
+		creds, err := provider()
+		if err != nil {
+			return nil, err
+		}
+		if creds != nil {
+			a.creds = creds
+			return creds, nil
+		}
+	}
+
+	return nil, errors.New("no AWS credentials found")
+}
+
+func envCredentials() (*awsCredentials, error) {
+	id := os.Getenv("AWS_ACCESS_KEY_ID")
+	secret := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return nil, nil
+	}
+
+	return &awsCredentials{
+		AccessKeyID:     id,
+		SecretAccessKey: secret,
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}, nil
+}
+
+func sharedCredentials() (*awsCredentials, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil
+	}
+
+	f, err := ini.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	section, err := f.GetSection(profile)
+	if err != nil {
+		return nil, nil
+	}
+
+	id := section.Key("aws_access_key_id").String()
+	secret := section.Key("aws_secret_access_key").String()
+	if id == "" || secret == "" {
+		return nil, nil
+	}
+
+	return &awsCredentials{
+		AccessKeyID:     id,
+		SecretAccessKey: secret,
+		SessionToken:    section.Key("aws_session_token").String(),
+	}, nil
+}
+
+func (a *awsClient) webIdentityCredentials() (*awsCredentials, error) {
+	tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	role := os.Getenv("AWS_ROLE_ARN")
+	if tokenFile == "" || role == "" {
+		return nil, nil
+	}
+
+	token, err := os.ReadFile(filepath.Clean(tokenFile))
+	if err != nil {
+		return nil, err
+	}
+
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = "manetu-security-token"
+	}
+
+	q := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+
+	resp, err := a.httpClient.Get(fmt.Sprintf("https://sts.%s.amazonaws.com/?%s", a.region, q.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("AssumeRoleWithWebIdentity: %s", resp.Status)
+	}
+
+	var result struct {
+		Credentials struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &awsCredentials{
+		AccessKeyID:     result.Credentials.AccessKeyId,
+		SecretAccessKey: result.Credentials.SecretAccessKey,
+		SessionToken:    result.Credentials.SessionToken,
+		Expiration:      result.Credentials.Expiration,
+	}, nil
+}
+
+type awsJSONCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func (c *awsJSONCredentials) credentials() *awsCredentials {
+	return &awsCredentials{
+		AccessKeyID:     c.AccessKeyId,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.Token,
+		Expiration:      c.Expiration,
+	}
+}
+
+func (a *awsClient) fetchJSONCredentials(req *http.Request) (*awsCredentials, error) {
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+
+	var c awsJSONCredentials
+	err = json.NewDecoder(resp.Body).Decode(&c)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.credentials(), nil
+}
+
+func (a *awsClient) containerCredentials() (*awsCredentials, error) {
+	var endpoint string
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		endpoint = "http://169.254.170.2" + uri
+	} else if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" {
+		endpoint = uri
+	} else {
+		return nil, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if file := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+		b, err := os.ReadFile(filepath.Clean(file))
+		if err != nil {
+			return nil, err
+		}
+		auth = strings.TrimSpace(string(b))
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	return a.fetchJSONCredentials(req)
+}
+
+const imdsEndpoint = "http://169.254.169.254"
+
+func (a *awsClient) instanceCredentials() (*awsCredentials, error) {
+	client := &http.Client{Timeout: 2 * time.Second}
+
+	req, err := http.NewRequest(http.MethodPut, imdsEndpoint+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// not running on EC2
+		return nil, nil
+	}
+	token, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequest(http.MethodGet, imdsEndpoint+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: %s", path, resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+	}
+
+	role, err := get("/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return nil, nil
+	}
+
+	data, err := get("/latest/meta-data/iam/security-credentials/" + strings.TrimSpace(string(role)))
+	if err != nil {
+		return nil, err
+	}
+
+	var c awsJSONCredentials
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.credentials(), nil
+}
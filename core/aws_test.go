@@ -0,0 +1,178 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/manetu/security-token/config"
+)
+
+// TestSignV4 checks signV4 against the cases of the AWS Signature Version 4 test suite that it supports, those
+// without query parameters, whose credentials sign for the service "service" of us-east-1 on 2015-08-30
+func TestSignV4(t *testing.T) {
+	creds := &awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name    string
+		method  string
+		path    string
+		headers map[string]string
+		body    string
+		want    string
+	}{
+		{
+			name:   "get-vanilla",
+			method: http.MethodGet,
+			path:   "/",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+				"SignedHeaders=host;x-amz-date, " +
+				"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:   "post-vanilla",
+			method: http.MethodPost,
+			path:   "/",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+				"SignedHeaders=host;x-amz-date, " +
+				"Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			name:    "post-x-www-form-urlencoded",
+			method:  http.MethodPost,
+			path:    "/",
+			headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			body:    "Param1=value1",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+				"SignedHeaders=content-type;host;x-amz-date, " +
+				"Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, "https://example.amazonaws.com"+tc.path, bytes.NewReader([]byte(tc.body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+
+			signV4(req, []byte(tc.body), creds, "us-east-1", "service", now)
+
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("X-Amz-Date = %s, want 20150830T123600Z", got)
+			}
+			if got := req.Header.Get("Authorization"); got != tc.want {
+				t.Errorf("Authorization =\n  %s\nwant\n  %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// fakeKMS serves the KMS actions used by Generate, failing the action named by fail, and records the actions called
+type fakeKMS struct {
+	sync.Mutex
+	fail    string
+	pub     []byte
+	actions []string
+	// scheduled holds the requests to schedule the deletion of keys
+	scheduled []map[string]interface{}
+}
+
+func (k *fakeKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "TrentService.")
+	var in map[string]interface{}
+	_ = json.NewDecoder(r.Body).Decode(&in)
+
+	k.Lock()
+	defer k.Unlock()
+	k.actions = append(k.actions, action)
+
+	if action == k.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"__type": "KMSInternalException", "message": "injected"}`))
+		return
+	}
+	switch action {
+	case "CreateKey":
+		_, _ = w.Write([]byte(`{"KeyMetadata": {"KeyId": "key-1"}}`))
+	case "GetPublicKey":
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"PublicKey": k.pub})
+	case "ScheduleKeyDeletion":
+		k.scheduled = append(k.scheduled, in)
+		_, _ = w.Write([]byte(`{}`))
+	default:
+		_, _ = w.Write([]byte(`{}`))
+	}
+}
+
+// TestAwsKmsGenerateCleanup schedules the deletion of a key whose generation fails after KMS created it
+func TestAwsKmsGenerateCleanup(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		fail        string
+		wantActions string
+	}{
+		{"", "CreateKey CreateAlias GetPublicKey"},
+		{"CreateAlias", "CreateKey CreateAlias ScheduleKeyDeletion"},
+		{"GetPublicKey", "CreateKey CreateAlias GetPublicKey DeleteAlias ScheduleKeyDeletion"},
+	} {
+		kms := &fakeKMS{fail: tt.fail, pub: pub}
+		server := httptest.NewServer(kms)
+		backend, err := newAwsKmsBackend(&config.Configuration{AwsKms: config.AwsKmsConfiguration{
+			Region:          "us-east-1",
+			Endpoint:        server.URL,
+			CertificatePath: t.TempDir(),
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signer, err := backend.Generate([]byte{0x01})
+		server.Close()
+		if tt.fail == "" {
+			if err != nil || !key.PublicKey.Equal(signer.Public()) {
+				t.Errorf("Generate = %v, %v; want the key created", signer, err)
+			}
+		} else if err == nil {
+			t.Errorf("Generate failing %s succeeded", tt.fail)
+		}
+
+		if got := strings.Join(kms.actions, " "); got != tt.wantActions {
+			t.Errorf("failing %q: actions = %s; want %s", tt.fail, got, tt.wantActions)
+		}
+		if tt.fail != "" && (len(kms.scheduled) != 1 || kms.scheduled[0]["KeyId"] != "key-1" ||
+			kms.scheduled[0]["PendingWindowInDays"] != float64(7)) {
+			t.Errorf("failing %s: scheduled %v; want the deletion of key-1 in 7 days", tt.fail, kms.scheduled)
+		}
+	}
+}
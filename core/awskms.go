@@ -0,0 +1,309 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/manetu/security-token/config"
+)
+
+func init() {
+	RegisterBackend("awskms", newAwsKmsBackend)
+}
+
+const awsKmsAliasPrefix = "alias/manetu-security-token/"
+
+// awsKmsBackend keeps the signing key in AWS KMS as an asymmetric ECC_NIST_P256 key, addressed by an alias derived
+// from the token id.  KMS cannot hold certificates, so these live in a local directory or in SSM Parameter Store.
+type awsKmsBackend struct {
+	client *awsClient
+	certs  certStore
+}
+
+func newAwsKmsBackend(cfg *config.Configuration) (Backend, error) {
+	client, err := newAwsClient(cfg.AwsKms.Region)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AwsKms.Endpoint != "" {
+		client.endpoints["kms"] = cfg.AwsKms.Endpoint
+	}
+
+	var certs certStore
+	if cfg.AwsKms.ParameterPrefix != "" {
+		certs = &ssmCertStore{client: client, prefix: strings.TrimSuffix(cfg.AwsKms.ParameterPrefix, "/")}
+	} else {
+		certs, err = newFileCertStore(cfg.AwsKms.CertificatePath, "awskms")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &awsKmsBackend{client: client, certs: certs}, nil
+}
+
+func awsKmsAlias(id []byte) string {
+	return awsKmsAliasPrefix + hex.EncodeToString(id)
+}
+
+func (b *awsKmsBackend) Generate(id []byte) (crypto.Signer, error) {
+	var created struct {
+		KeyMetadata struct {
+			KeyId string
+		}
+	}
+	err := b.client.call("kms", "TrentService.CreateKey", map[string]interface{}{
+		"KeySpec":     "ECC_NIST_P256",
+		"KeyUsage":    "SIGN_VERIFY",
+		"Description": "Manetu security token " + HexEncode(id),
+	}, &created)
+	if err != nil {
+		return nil, err
+	}
+	keyID := created.KeyMetadata.KeyId
+
+	signer, err := b.completeKey(id, keyID)
+	if err != nil {
+		// a key that is not usable as a token would otherwise be left, and billed, without an alias to find it by
+		derr := b.scheduleKeyDeletion(keyID)
+		if derr != nil {
+			logWarn("unable to schedule the deletion of a key left by a failed generate", "key", keyID, "error", derr)
+		}
+		return nil, err
+	}
+	return signer, nil
+}
+
+// completeKey aliases the new key keyID for id, returning its signer
+func (b *awsKmsBackend) completeKey(id []byte, keyID string) (crypto.Signer, error) {
+	err := b.client.call("kms", "TrentService.CreateAlias", map[string]string{
+		"AliasName":   awsKmsAlias(id),
+		"TargetKeyId": keyID,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var pub struct {
+		PublicKey []byte
+	}
+	err = b.client.call("kms", "TrentService.GetPublicKey", map[string]string{
+		"KeyId": keyID,
+	}, &pub)
+	if err == nil {
+		var key crypto.PublicKey
+		key, err = x509.ParsePKIXPublicKey(pub.PublicKey)
+		if err == nil {
+			return &awsKmsSigner{client: b.client, keyID: keyID, pub: key}, nil
+		}
+		err = fmt.Errorf("error parsing the public key of %s: %w", keyID, err)
+	}
+
+	derr := b.client.call("kms", "TrentService.DeleteAlias", map[string]string{
+		"AliasName": awsKmsAlias(id),
+	}, nil)
+	if derr != nil {
+		logWarn("unable to delete the alias of a key left by a failed generate", "alias", awsKmsAlias(id), "error", derr)
+	}
+	return nil, err
+}
+
+// scheduleKeyDeletion schedules the deletion of keyID.  KMS never deletes keys immediately; seven days is the shortest
+// waiting period permitted.
+func (b *awsKmsBackend) scheduleKeyDeletion(keyID string) error {
+	return b.client.call("kms", "TrentService.ScheduleKeyDeletion", map[string]interface{}{
+		"KeyId":               keyID,
+		"PendingWindowInDays": 7,
+	}, nil)
+}
+
+func (b *awsKmsBackend) ImportCertificate(id []byte, cert *x509.Certificate) error {
+	return b.certs.Put(id, cert)
+}
+
+func (b *awsKmsBackend) Certificates() ([]*x509.Certificate, error) {
+	return b.certs.List()
+}
+
+func (b *awsKmsBackend) FindToken(id []byte) (*Token, error) {
+	cert, err := b.certs.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return nil, nil
+	}
+
+	return &Token{
+		Signer: &awsKmsSigner{client: b.client, keyID: awsKmsAlias(id), pub: cert.PublicKey},
+		Cert:   cert,
+	}, nil
+}
+
+func (b *awsKmsBackend) Delete(id []byte) error {
+	err := b.certs.Delete(id)
+	if err != nil {
+		return err
+	}
+
+	var described struct {
+		KeyMetadata struct {
+			KeyId string
+		}
+	}
+	err = b.client.call("kms", "TrentService.DescribeKey", map[string]string{
+		"KeyId": awsKmsAlias(id),
+	}, &described)
+	if err != nil {
+		return err
+	}
+
+	err = b.client.call("kms", "TrentService.DeleteAlias", map[string]string{
+		"AliasName": awsKmsAlias(id),
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	return b.scheduleKeyDeletion(described.KeyMetadata.KeyId)
+}
+
+func (b *awsKmsBackend) Close() error {
+	return nil
+}
+
+// awsKmsSigner implements crypto.Signer by delegating to the KMS Sign API
+type awsKmsSigner struct {
+	client *awsClient
+	keyID  string
+	pub    crypto.PublicKey
+}
+
+func (s *awsKmsSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *awsKmsSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+	}
+
+	var signed struct {
+		Signature []byte
+	}
+	err := s.client.call("kms", "TrentService.Sign", map[string]interface{}{
+		"KeyId":            s.keyID,
+		"Message":          digest,
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": "ECDSA_SHA_256",
+	}, &signed)
+	if err != nil {
+		return nil, err
+	}
+
+	// KMS returns a DER encoded ECDSA signature, as crypto.Signer requires
+	return signed.Signature, nil
+}
+
+// ssmCertStore keeps certificates in SSM Parameter Store under <prefix>/<hex id>
+type ssmCertStore struct {
+	client *awsClient
+	prefix string
+}
+
+type ssmParameter struct {
+	Name  string
+	Value string
+}
+
+func (s *ssmCertStore) name(id []byte) string {
+	return s.prefix + "/" + hex.EncodeToString(id)
+}
+
+func isAwsNotFound(err error) bool {
+	var e *awsError
+	return errors.As(err, &e) && (strings.HasSuffix(e.Type, "ParameterNotFound") || strings.HasSuffix(e.Type, "NotFoundException"))
+}
+
+func (s *ssmCertStore) Put(id []byte, cert *x509.Certificate) error {
+	return s.client.call("ssm", "AmazonSSM.PutParameter", map[string]interface{}{
+		"Name":      s.name(id),
+		"Value":     ExportCert(cert),
+		"Type":      "String",
+		"Overwrite": true,
+	}, nil)
+}
+
+func (s *ssmCertStore) Get(id []byte) (*x509.Certificate, error) {
+	var out struct {
+		Parameter ssmParameter
+	}
+	err := s.client.call("ssm", "AmazonSSM.GetParameter", map[string]string{
+		"Name": s.name(id),
+	}, &out)
+	if isAwsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCertPEM([]byte(out.Parameter.Value))
+}
+
+func (s *ssmCertStore) List() ([]*x509.Certificate, error) {
+	var (
+		certs []*x509.Certificate
+		next  string
+	)
+
+	for {
+		in := map[string]interface{}{
+			"Path": s.prefix,
+		}
+		if next != "" {
+			in["NextToken"] = next
+		}
+
+		var out struct {
+			Parameters []ssmParameter
+			NextToken  string
+		}
+		err := s.client.call("ssm", "AmazonSSM.GetParametersByPath", in, &out)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range out.Parameters {
+			cert, err := parseCertPEM([]byte(p.Value))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", p.Name, err)
+			}
+			certs = append(certs, cert)
+		}
+
+		if out.NextToken == "" {
+			return certs, nil
+		}
+		next = out.NextToken
+	}
+}
+
+func (s *ssmCertStore) Delete(id []byte) error {
+	err := s.client.call("ssm", "AmazonSSM.DeleteParameter", map[string]string{
+		"Name": s.name(id),
+	}, nil)
+	if isAwsNotFound(err) {
+		return nil
+	}
+	return err
+}
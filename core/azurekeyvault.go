@@ -0,0 +1,447 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/manetu/security-token/config"
+)
+
+func init() {
+	RegisterBackend("azurekeyvault", newAzureKeyVaultBackend)
+}
+
+const (
+	azureKeyVaultAPIVersion = "7.4"
+	azureKeyVaultPrefix     = "mst-"
+)
+
+// azureKeyVaultBackend keeps the signing key in Azure Key Vault, or a Managed HSM, authenticating with the managed
+// identity of the host.  In a Key Vault the certificate is created as a Key Vault certificate backed by the key, so
+// both live together.  Managed HSMs cannot hold certificates, so these are kept in a local directory instead.
+type azureKeyVaultBackend struct {
+	vault  string
+	client *http.Client
+	certs  certStore
+}
+
+type azureError struct {
+	Error struct {
+		Code    string
+		Message string
+	}
+}
+
+// azureManagedIdentity is an oauth2.TokenSource for the managed identity of an Azure VM, AKS pod or App Service
+type azureManagedIdentity struct {
+	resource string
+	clientID string
+}
+
+func (m *azureManagedIdentity) Token() (*oauth2.Token, error) {
+	var req *http.Request
+	var err error
+
+	q := url.Values{"resource": {m.resource}}
+	if m.clientID != "" {
+		q.Set("client_id", m.clientID)
+	}
+
+	if endpoint := os.Getenv("IDENTITY_ENDPOINT"); endpoint != "" {
+		// App Service, Functions and Container Apps
+		q.Set("api-version", "2019-08-01")
+		req, err = http.NewRequest(http.MethodGet, endpoint+"?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+	} else {
+		q.Set("api-version", "2018-02-01")
+		req, err = http.NewRequest(http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata", "true")
+	}
+
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("contacting managed identity endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("managed identity endpoint: %s", resp.Status)
+	}
+
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&t)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &oauth2.Token{AccessToken: t.AccessToken, TokenType: "Bearer"}
+	if secs, err := strconv.ParseInt(t.ExpiresOn, 10, 64); err == nil {
+		token.Expiry = time.Unix(secs, 0)
+	}
+
+	return token, nil
+}
+
+func isManagedHSM(vault string) bool {
+	u, err := url.Parse(vault)
+	return err == nil && strings.HasSuffix(u.Hostname(), ".managedhsm.azure.net")
+}
+
+func newAzureKeyVaultBackend(cfg *config.Configuration) (Backend, error) {
+	vault := strings.TrimSuffix(cfg.AzureKeyVault.Vault, "/")
+	if vault == "" {
+		return nil, errors.New("azurekeyvault.vault must be configured")
+	}
+
+	resource := "https://vault.azure.net"
+	if isManagedHSM(vault) {
+		resource = "https://managedhsm.azure.net"
+	}
+
+	ts := oauth2.ReuseTokenSource(nil, &azureManagedIdentity{resource: resource, clientID: cfg.AzureKeyVault.ClientID})
+
+	b := &azureKeyVaultBackend{
+		vault: vault,
+		client: &http.Client{
+			Transport: &oauth2.Transport{Source: ts},
+			Timeout:   30 * time.Second,
+		},
+	}
+
+	if isManagedHSM(vault) {
+		certs, err := newFileCertStore(cfg.AzureKeyVault.CertificatePath, "azurekeyvault")
+		if err != nil {
+			return nil, err
+		}
+		b.certs = certs
+	}
+
+	return b, nil
+}
+
+func azureKeyVaultName(id []byte) string {
+	return azureKeyVaultPrefix + hex.EncodeToString(id)
+}
+
+// do issues a REST call against the vault.  It returns errNotFound for 404 responses.
+func (b *azureKeyVaultBackend) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	u := path
+	if !strings.HasPrefix(u, "https://") {
+		u = b.vault + path
+	}
+	if !strings.Contains(u, "api-version=") {
+		sep := "?"
+		if strings.Contains(u, "?") {
+			sep = "&"
+		}
+		u += sep + "api-version=" + azureKeyVaultAPIVersion
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e := &azureError{}
+		if json.Unmarshal(data, e) != nil || e.Error.Message == "" {
+			return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return fmt.Errorf("%s: %s", e.Error.Code, e.Error.Message)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+type azureJWK struct {
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *azureJWK) publicKey() (crypto.PublicKey, error) {
+	if k.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}, nil
+}
+
+func (b *azureKeyVaultBackend) Generate(id []byte) (crypto.Signer, error) {
+	name := azureKeyVaultName(id)
+
+	if b.certs == nil {
+		// Creating a certificate with an "Unknown" issuer generates a non-exportable key of the same name and
+		// leaves the certificate pending until ImportCertificate merges the self-signed certificate.
+		err := b.do(http.MethodPost, "/certificates/"+name+"/create", map[string]interface{}{
+			"policy": map[string]interface{}{
+				"key_props": map[string]interface{}{
+					"kty":        "EC-HSM",
+					"crv":        "P-256",
+					"exportable": false,
+				},
+				"x509_props": map[string]interface{}{
+					"subject": "CN=" + hex.EncodeToString(id),
+				},
+				"issuer": map[string]string{
+					"name": "Unknown",
+				},
+			},
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := b.do(http.MethodPost, "/keys/"+name+"/create", map[string]interface{}{
+			"kty":     "EC-HSM",
+			"crv":     "P-256",
+			"key_ops": []string{"sign", "verify"},
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var key struct {
+		Key azureJWK `json:"key"`
+	}
+	err := b.do(http.MethodGet, "/keys/"+name, nil, &key)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := key.Key.publicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &azureKeyVaultSigner{backend: b, kid: key.Key.Kid, pub: pub}, nil
+}
+
+func (b *azureKeyVaultBackend) ImportCertificate(id []byte, cert *x509.Certificate) error {
+	if b.certs != nil {
+		return b.certs.Put(id, cert)
+	}
+
+	return b.do(http.MethodPost, "/certificates/"+azureKeyVaultName(id)+"/pending/merge", map[string]interface{}{
+		"x5c": []string{base64.StdEncoding.EncodeToString(cert.Raw)},
+	}, nil)
+}
+
+type azureCertificate struct {
+	ID  string `json:"id"`
+	Cer string `json:"cer"`
+}
+
+func (b *azureKeyVaultBackend) getCertificate(name string) (*x509.Certificate, error) {
+	var c azureCertificate
+	err := b.do(http.MethodGet, "/certificates/"+name, nil, &c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Cer == "" {
+		// still pending
+		return nil, errNotFound
+	}
+
+	der, err := base64.StdEncoding.DecodeString(c.Cer)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+func (b *azureKeyVaultBackend) Certificates() ([]*x509.Certificate, error) {
+	if b.certs != nil {
+		return b.certs.List()
+	}
+
+	var certs []*x509.Certificate
+
+	next := "/certificates"
+	for next != "" {
+		var page struct {
+			Value    []azureCertificate `json:"value"`
+			NextLink string             `json:"nextLink"`
+		}
+		err := b.do(http.MethodGet, next, nil, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range page.Value {
+			name := c.ID[strings.LastIndex(c.ID, "/")+1:]
+			if !strings.HasPrefix(name, azureKeyVaultPrefix) {
+				continue
+			}
+
+			cert, err := b.getCertificate(name)
+			if errors.Is(err, errNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+
+		next = page.NextLink
+	}
+
+	return certs, nil
+}
+
+func (b *azureKeyVaultBackend) FindToken(id []byte) (*Token, error) {
+	var (
+		cert *x509.Certificate
+		err  error
+	)
+
+	if b.certs != nil {
+		cert, err = b.certs.Get(id)
+	} else {
+		cert, err = b.getCertificate(azureKeyVaultName(id))
+		if errors.Is(err, errNotFound) {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return nil, nil
+	}
+
+	return &Token{
+		Signer: &azureKeyVaultSigner{backend: b, kid: b.vault + "/keys/" + azureKeyVaultName(id), pub: cert.PublicKey},
+		Cert:   cert,
+	}, nil
+}
+
+func (b *azureKeyVaultBackend) Delete(id []byte) error {
+	name := azureKeyVaultName(id)
+
+	if b.certs != nil {
+		err := b.certs.Delete(id)
+		if err != nil {
+			return err
+		}
+		return b.do(http.MethodDelete, "/keys/"+name, nil, nil)
+	}
+
+	// deleting a certificate also deletes its backing key, subject to the vault's soft-delete policy
+	return b.do(http.MethodDelete, "/certificates/"+name, nil, nil)
+}
+
+func (b *azureKeyVaultBackend) Close() error {
+	return nil
+}
+
+// azureKeyVaultSigner implements crypto.Signer by delegating to the Key Vault sign operation
+type azureKeyVaultSigner struct {
+	backend *azureKeyVaultBackend
+	kid     string
+	pub     crypto.PublicKey
+}
+
+func (s *azureKeyVaultSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *azureKeyVaultSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+	}
+
+	var signed struct {
+		Value string `json:"value"`
+	}
+	err := s.backend.do(http.MethodPost, s.kid+"/sign", map[string]string{
+		"alg":   "ES256",
+		"value": base64.RawURLEncoding.EncodeToString(digest),
+	}, &signed)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(signed.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	// Key Vault returns the JOSE r||s encoding, whereas crypto.Signer requires DER
+	return derSignature(raw)
+}
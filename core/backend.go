@@ -0,0 +1,204 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/manetu/security-token/config"
+)
+
+// Backend is a keystore holding the key pairs and certificates that make up security tokens.  Tokens are
+// identified by the raw bytes of their certificate serial number.
+type Backend interface {
+	// Generate creates a new P-256 key pair identified by id
+	Generate(id []byte) (crypto.Signer, error)
+	// ImportCertificate stores the certificate for the key pair identified by id
+	ImportCertificate(id []byte, cert *x509.Certificate) error
+	// Certificates enumerates the certificates of all tokens held by the keystore
+	Certificates() ([]*x509.Certificate, error)
+	// FindToken returns the token identified by id, or nil if it does not exist
+	FindToken(id []byte) (*Token, error)
+	// Delete removes the key pair and certificate identified by id
+	Delete(id []byte) error
+	// Close releases any resources held by the keystore
+	Close() error
+}
+
+// keyExporter is implemented by backends able to release the private key of a token, which allows the token to be
+// migrated to another backend without changing its MRN
+type keyExporter interface {
+	ExportKey(id []byte) (crypto.PrivateKey, error)
+}
+
+// certificateStreamer is implemented by backends able to deliver certificates as they are enumerated, so that a large
+// inventory is processed while it is still being fetched
+type certificateStreamer interface {
+	StreamCertificates(fn func(*x509.Certificate)) error
+}
+
+// streamCertificates returns the certificates of backend, passing each to fn as it is enumerated where the backend is
+// able to, or once all have been otherwise
+func streamCertificates(backend Backend, fn func(*x509.Certificate)) ([]*x509.Certificate, error) {
+	streamer, ok := backend.(certificateStreamer)
+	if !ok {
+		certs, err := backend.Certificates()
+		if err != nil {
+			return nil, err
+		}
+		for _, cert := range certs {
+			fn(cert)
+		}
+		return certs, nil
+	}
+
+	var certs []*x509.Certificate
+	err := streamer.StreamCertificates(func(cert *x509.Certificate) {
+		certs = append(certs, cert)
+		fn(cert)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// keyImporter is implemented by backends able to take custody of an existing private key
+type keyImporter interface {
+	ImportKey(id []byte, key crypto.PrivateKey) error
+}
+
+// labeler is implemented by backends whose tokens may carry a label, the CKA_LABEL of a PKCS#11 key pair, by which a
+// user may know a token rather than by its serial
+type labeler interface {
+	// GenerateLabeled is Generate labelling the key pair with label
+	GenerateLabeled(id []byte, label string) (crypto.Signer, error)
+	// Labels returns the labels of the labelled tokens, keyed by the hex encoding of their id
+	Labels() (map[string]string, error)
+}
+
+// tokenLabels returns the labels of the tokens of backend, keyed by the hex encoding of their id, or none when it
+// cannot label them
+func tokenLabels(backend Backend) (map[string]string, error) {
+	l, ok := backend.(labeler)
+	if !ok {
+		return nil, nil
+	}
+	return l.Labels()
+}
+
+// tokenLabel returns the label of the token holding cert within backend, or "" when it has none or cannot be read,
+// so that a token taking its place may carry it on
+func tokenLabel(backend Backend, cert *x509.Certificate) string {
+	labels, err := tokenLabels(backend)
+	if err != nil {
+		return ""
+	}
+	return labels[hex.EncodeToString(cert.SerialNumber.Bytes())]
+}
+
+// objectDescriber is implemented by backends able to name the objects that hold a token, so that --dry-run may report
+// exactly what would be created or removed.  id is nil for a token that has yet to be generated.
+type objectDescriber interface {
+	DescribeObjects(id []byte) []string
+}
+
+// describeObjects names the objects holding the token id within backend
+func describeObjects(backend Backend, id []byte) []string {
+	if d, ok := backend.(objectDescriber); ok {
+		return d.DescribeObjects(id)
+	}
+	return []string{"P-256 key pair " + describeID(id), "certificate " + describeID(id)}
+}
+
+func describeID(id []byte) string {
+	if id == nil {
+		return "<new random id>"
+	}
+	return hex.EncodeToString(id)
+}
+
+// errNotFound is returned by REST based backends when the requested object does not exist
+var errNotFound = errors.New("not found")
+
+// BackendFactory instantiates a Backend from the configuration
+type BackendFactory func(cfg *config.Configuration) (Backend, error)
+
+var backends = map[string]BackendFactory{}
+
+// RegisterBackend makes a keystore backend available under the given name
+func RegisterBackend(name string, factory BackendFactory) {
+	backends[name] = factory
+}
+
+// NewBackend returns the keystore backend registered under name, configured by cfg, for use with NewWithBackend by
+// programs and integration tests that do not read a configuration file
+func NewBackend(name string, cfg *config.Configuration) (Backend, error) {
+	return newBackend(name, cfg)
+}
+
+// Backends returns the names of all registered keystore backends
+func Backends() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newBackend(name string, cfg *config.Configuration) (Backend, error) {
+	if name == "" {
+		name = "pkcs11"
+	}
+
+	factory, ok := backends[name]
+	if !ok {
+		return newPluginBackend(name, cfg)
+	}
+
+	return factory(cfg)
+}
+
+// derSignature converts a raw r||s P-256 signature, as produced by many keystores, into the DER encoding that
+// crypto.Signer requires
+func derSignature(raw []byte) ([]byte, error) {
+	if len(raw) != 64 {
+		return nil, fmt.Errorf("unexpected signature length %d", len(raw))
+	}
+
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		R: new(big.Int).SetBytes(raw[:32]),
+		S: new(big.Int).SetBytes(raw[32:]),
+	})
+}
+
+// rawSignature converts a DER encoded ECDSA signature into the raw r||s form of JOSE and COSE, each of size bytes
+func rawSignature(der []byte, size int) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 || sig.R.BitLen() > 8*size || sig.S.BitLen() > 8*size {
+		return nil, errors.New("malformed ECDSA signature")
+	}
+
+	raw := make([]byte, 2*size)
+	sig.R.FillBytes(raw[:size])
+	sig.S.FillBytes(raw[size:])
+	return raw, nil
+}
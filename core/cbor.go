@@ -0,0 +1,85 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import "encoding/binary"
+
+// The CBOR (RFC 8949) major types used by COSE
+const (
+	cborUnsigned = 0
+	cborNegative = 1
+	cborBytes    = 2
+	cborText     = 3
+	cborArray    = 4
+	cborMap      = 5
+	cborTag      = 6
+)
+
+// cborNull is the simple value null
+var cborNull = []byte{0xf6}
+
+// cborHead encodes the head of an item of the major type, with the argument n, in its shortest form as deterministic
+// encoding requires
+func cborHead(major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return []byte{major | byte(n)}
+	case n <= 0xff:
+		return []byte{major | 24, byte(n)}
+	case n <= 0xffff:
+		head := []byte{major | 25, 0, 0}
+		binary.BigEndian.PutUint16(head[1:], uint16(n))
+		return head
+	case n <= 0xffffffff:
+		head := []byte{major | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(head[1:], uint32(n))
+		return head
+	default:
+		head := []byte{major | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(head[1:], n)
+		return head
+	}
+}
+
+// cborInt encodes an integer, negative or not
+func cborInt(n int64) []byte {
+	if n < 0 {
+		return cborHead(cborNegative, uint64(-1-n))
+	}
+	return cborHead(cborUnsigned, uint64(n))
+}
+
+func cborByteString(b []byte) []byte {
+	return append(cborHead(cborBytes, uint64(len(b))), b...)
+}
+
+func cborTextString(s string) []byte {
+	return append(cborHead(cborText, uint64(len(s))), s...)
+}
+
+// cborArrayOf encodes an array of encoded items
+func cborArrayOf(items ...[]byte) []byte {
+	out := cborHead(cborArray, uint64(len(items)))
+	for _, item := range items {
+		out = append(out, item...)
+	}
+	return out
+}
+
+// cborMapOf encodes a map of encoded keys, each followed by its value, in the order given.  Deterministic encoding
+// requires the keys to be given sorted by their encodings.
+func cborMapOf(pairs ...[]byte) []byte {
+	out := cborHead(cborMap, uint64(len(pairs)/2))
+	for _, item := range pairs {
+		out = append(out, item...)
+	}
+	return out
+}
+
+// cborTagged tags an encoded item
+func cborTagged(tag uint64, item []byte) []byte {
+	return append(cborHead(cborTag, tag), item...)
+}
@@ -0,0 +1,58 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// TestCBOR encodes the examples of RFC 8949, Appendix A, that the encoder can express
+func TestCBOR(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{"0", cborInt(0), "00"},
+		{"23", cborInt(23), "17"},
+		{"24", cborInt(24), "1818"},
+		{"100", cborInt(100), "1864"},
+		{"1000", cborInt(1000), "1903e8"},
+		{"1000000", cborInt(1000000), "1a000f4240"},
+		{"1000000000000", cborInt(1000000000000), "1b000000e8d4a51000"},
+		{"18446744073709551615", cborHead(cborUnsigned, 18446744073709551615), "1bffffffffffffffff"},
+		{"-1", cborInt(-1), "20"},
+		{"-10", cborInt(-10), "29"},
+		{"-100", cborInt(-100), "3863"},
+		{"-1000", cborInt(-1000), "3903e7"},
+		{"-9223372036854775808", cborInt(-9223372036854775808), "3b7fffffffffffffff"},
+		{"h''", cborByteString(nil), "40"},
+		{"h'01020304'", cborByteString([]byte{1, 2, 3, 4}), "4401020304"},
+		{`""`, cborTextString(""), "60"},
+		{`"a"`, cborTextString("a"), "6161"},
+		{`"IETF"`, cborTextString("IETF"), "6449455446"},
+		{`"ü"`, cborTextString("ü"), "62c3bc"},
+		{"[]", cborArrayOf(), "80"},
+		{"[1, 2, 3]", cborArrayOf(cborInt(1), cborInt(2), cborInt(3)), "83010203"},
+		{"[1, [2, 3], [4, 5]]", cborArrayOf(cborInt(1), cborArrayOf(cborInt(2), cborInt(3)), cborArrayOf(cborInt(4), cborInt(5))), "8301820203820405"},
+		{"{}", cborMapOf(), "a0"},
+		{"{1: 2, 3: 4}", cborMapOf(cborInt(1), cborInt(2), cborInt(3), cborInt(4)), "a201020304"},
+		{`{"a": 1, "b": [2, 3]}`, cborMapOf(cborTextString("a"), cborInt(1), cborTextString("b"), cborArrayOf(cborInt(2), cborInt(3))), "a26161016162820203"},
+		{"1(1363896240)", cborTagged(1, cborInt(1363896240)), "c11a514b67b0"},
+		{"23(h'01020304')", cborTagged(23, cborByteString([]byte{1, 2, 3, 4})), "d74401020304"},
+		{"null", cborNull, "f6"},
+	} {
+		if got := hex.EncodeToString(tt.got); got != tt.want {
+			t.Errorf("%s = %s; want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// a length needing two bytes
+	long := cborByteString(make([]byte, 256))
+	if got := hex.EncodeToString(long[:3]); got != "590100" || len(long) != 259 {
+		t.Errorf("the head of 256 bytes = %s; want 590100", got)
+	}
+}
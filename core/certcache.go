@@ -0,0 +1,55 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/x509"
+	"sync"
+	"time"
+)
+
+// defaultCertCacheTTL bounds how stale an enumeration may be when tokens are added or removed by another process
+const defaultCertCacheTTL = 30 * time.Second
+
+// certCache holds the certificates enumerated from a keystore for a while, since enumerating a network HSM holding
+// many objects takes seconds, yet list, getToken and the daemons enumerate repeatedly.  The backend invalidates it
+// whenever it adds or removes a token itself.
+type certCache struct {
+	sync.Mutex
+	// ttl is the time for which an enumeration is reused; zero disables the cache
+	ttl   time.Duration
+	certs []*x509.Certificate
+	at    time.Time
+}
+
+// get returns the cached certificates, enumerating them with load when the cache is empty or stale.  Concurrent
+// callers wait on a single enumeration rather than each making their own.
+func (cc *certCache) get(load func() ([]*x509.Certificate, error)) ([]*x509.Certificate, error) {
+	if cc.ttl <= 0 {
+		return load()
+	}
+
+	cc.Lock()
+	defer cc.Unlock()
+
+	if cc.certs == nil || time.Since(cc.at) >= cc.ttl {
+		certs, err := load()
+		if err != nil {
+			return nil, err
+		}
+		cc.certs, cc.at = certs, time.Now()
+	}
+
+	// callers may sort or filter the slice they are given
+	return append([]*x509.Certificate{}, cc.certs...), nil
+}
+
+// invalidate discards the cached certificates, so that the next enumeration reaches the keystore
+func (cc *certCache) invalidate() {
+	cc.Lock()
+	defer cc.Unlock()
+
+	cc.certs = nil
+}
@@ -0,0 +1,127 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// certStore persists certificates for backends whose keystore cannot hold them alongside the key
+type certStore interface {
+	Put(id []byte, cert *x509.Certificate) error
+	// Get returns the certificate identified by id, or nil if it does not exist
+	Get(id []byte) (*x509.Certificate, error)
+	List() ([]*x509.Certificate, error)
+	Delete(id []byte) error
+}
+
+func parseCertPEM(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// fileCertStore keeps one PEM file per certificate, named by the hex encoded id
+type fileCertStore struct {
+	dir string
+}
+
+// newFileCertStore returns a store rooted at dir, defaulting to $HOME/.manetu/certs/<name>
+func newFileCertStore(dir, name string) (*fileCertStore, error) {
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(home, ".manetu", "certs", name)
+	}
+
+	return &fileCertStore{dir: filepath.Clean(dir)}, nil
+}
+
+func (s *fileCertStore) path(id []byte) string {
+	return filepath.Join(s.dir, hex.EncodeToString(id)+".pem")
+}
+
+func (s *fileCertStore) Put(id []byte, cert *x509.Certificate) error {
+	err := os.MkdirAll(s.dir, 0700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path(id), []byte(ExportCert(cert)), 0600)
+}
+
+// PutChain stores chain, leaf first, under id, of which Get returns the leaf
+func (s *fileCertStore) PutChain(id []byte, chain []*x509.Certificate) error {
+	err := os.MkdirAll(s.dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	for _, cert := range chain {
+		data = append(data, ExportCert(cert)...)
+	}
+	return os.WriteFile(s.path(id), data, 0600)
+}
+
+func (s *fileCertStore) Get(id []byte) (*x509.Certificate, error) {
+	data, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseCertPEM(data)
+}
+
+func (s *fileCertStore) List() ([]*x509.Certificate, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	var certs []*x509.Certificate
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".pem") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		cert, err := parseCertPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+func (s *fileCertStore) Delete(id []byte) error {
+	err := os.Remove(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
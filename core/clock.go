@@ -0,0 +1,74 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+// Clock tells the time at which certificates are issued and login assertions are signed
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock is the clock of the host, used unless another is given with SetClock
+var SystemClock Clock = systemClock{}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+// FixedClock returns a Clock frozen at t, such as for tests comparing the validity of certificates or the claims of
+// assertions against known times
+func FixedClock(t time.Time) Clock {
+	return fixedClock(t)
+}
+
+// skewedClock is a Clock corrected by skew, which is added to its time
+type skewedClock struct {
+	Clock
+	skew time.Duration
+}
+
+func (c skewedClock) Now() time.Time {
+	return c.Clock.Now().Add(c.skew)
+}
+
+// SetClock replaces the clock of the host with clock, to which the clockskew of the configuration file still applies
+func (c *Core) SetClock(clock Clock) {
+	c.clock = clock
+}
+
+// getClock returns the clock set by SetClock, or that of the host, corrected by the clockskew of the configuration
+// file.  It reads the configuration when that has not yet been done, so it must not be called with c locked.
+func (c *Core) getClock() (Clock, error) {
+	c.loadSettings()
+
+	c.Lock()
+	skew := c.configuration.ClockSkew
+	clock := c.clock
+	c.Unlock()
+
+	if clock == nil {
+		clock = SystemClock
+	}
+	if skew == "" {
+		return clock, nil
+	}
+	d, err := ParseDuration(skew)
+	if err != nil {
+		return nil, classify(ExitConfig, fmt.Errorf("clockskew: %w", err))
+	}
+	return skewedClock{Clock: clock, skew: d}, nil
+}
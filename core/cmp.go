@@ -0,0 +1,820 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// OIDs of CMP (RFC 4210) and CRMF (RFC 4211)
+var (
+	oidPasswordBasedMAC = asn1.ObjectIdentifier{1, 2, 840, 113533, 7, 66, 13}
+	oidPBMHMACWithSHA1  = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 8, 1, 2}
+	oidRegCtrlOldCertID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 5, 1, 5}
+	oidSHA256WithRSA    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidExtensionReason  = asn1.ObjectIdentifier{2, 5, 29, 21}
+)
+
+// The PKIBody choices of the messages exchanged by the client
+const (
+	cmpBodyIR       = 0
+	cmpBodyIP       = 1
+	cmpBodyCP       = 3
+	cmpBodyKUR      = 7
+	cmpBodyKUP      = 8
+	cmpBodyRR       = 11
+	cmpBodyRP       = 12
+	cmpBodyPKIConf  = 19
+	cmpBodyError    = 23
+	cmpBodyCertConf = 24
+)
+
+// The PKIStatus of responses
+const (
+	cmpAccepted          = 0
+	cmpGrantedWithMods   = 1
+	cmpRejection         = 2
+	cmpWaiting           = 3
+	cmpRevocationWarning = 4
+	cmpRevocationNotice  = 5
+)
+
+// cmpFailInfo names the bits of PKIFailureInfo
+var cmpFailInfo = []string{
+	"badAlg", "badMessageCheck", "badRequest", "badTime", "badCertId", "badDataFormat", "wrongAuthority",
+	"incorrectData", "missingTimeStamp", "badPOP", "certRevoked", "certConfirmed", "wrongIntegrity",
+	"badRecipientNonce", "timeNotAvailable", "unacceptedPolicy", "unacceptedExtension", "addInfoNotAvailable",
+	"badSenderNonce", "badCertTemplate", "signerNotTrusted", "transactionIdInUse", "unsupportedVersion",
+	"notAuthorized", "systemUnavail", "systemFailure", "duplicateCertReq",
+}
+
+// CMPOptions configures certificate management with a CMP (RFC 4210) server over HTTP (RFC 6712)
+type CMPOptions struct {
+	// URL of the server, such as http://ca.example.com:8080/ejbca/publicweb/cmp/alias
+	URL string
+	// CACert names the PEM encoded certificates of the CA, by which signed responses are authenticated
+	CACert string
+	// Reference and Secret protect messages with a password-based MAC, as issued by the CA for initial registration;
+	// otherwise messages are signed by the token
+	Reference string
+	Secret    string
+	// CommonName and DNSNames form the subject of an initial registration, the common name defaulting to the MRN
+	CommonName string
+	DNSNames   []string
+	// Reason is the CRL reason code of a revocation, if any
+	Reason   int
+	Insecure bool
+}
+
+// cmpClient carries the state of one CMP transaction
+type cmpClient struct {
+	opts          CMPOptions
+	client        *http.Client
+	caCerts       []*x509.Certificate
+	signer        crypto.Signer
+	cert          *x509.Certificate
+	transactionID []byte
+	recipNonce    []byte
+}
+
+type cmpHeader struct {
+	Pvno          int
+	Sender        asn1.RawValue
+	Recipient     asn1.RawValue
+	MessageTime   time.Time                `asn1:"generalized,explicit,optional,tag:0"`
+	ProtectionAlg pkix.AlgorithmIdentifier `asn1:"explicit,optional,tag:1"`
+	SenderKID     []byte                   `asn1:"explicit,optional,omitempty,tag:2"`
+	RecipKID      []byte                   `asn1:"explicit,optional,omitempty,tag:3"`
+	TransactionID []byte                   `asn1:"explicit,optional,omitempty,tag:4"`
+	SenderNonce   []byte                   `asn1:"explicit,optional,omitempty,tag:5"`
+	RecipNonce    []byte                   `asn1:"explicit,optional,omitempty,tag:6"`
+	FreeText      asn1.RawValue            `asn1:"optional,tag:7"`
+	GeneralInfo   asn1.RawValue            `asn1:"optional,tag:8"`
+}
+
+type cmpMessage struct {
+	Header     asn1.RawValue
+	Body       asn1.RawValue
+	Protection asn1.RawValue `asn1:"optional,tag:0"`
+	ExtraCerts asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmpProtectedPart struct {
+	Header asn1.RawValue
+	Body   asn1.RawValue
+}
+
+type pbmParameter struct {
+	Salt           []byte
+	OWF            pkix.AlgorithmIdentifier
+	IterationCount int
+	MAC            pkix.AlgorithmIdentifier
+}
+
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []string       `asn1:"optional"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+type certResponse struct {
+	CertReqID        int
+	Status           pkiStatusInfo
+	CertifiedKeyPair asn1.RawValue `asn1:"optional"`
+}
+
+type certRepMessage struct {
+	CAPubs   asn1.RawValue `asn1:"optional,tag:1"`
+	Response []certResponse
+}
+
+type certifiedKeyPair struct {
+	CertOrEncCert asn1.RawValue
+}
+
+type revRepContent struct {
+	Status []pkiStatusInfo
+}
+
+type errorMsgContent struct {
+	Status pkiStatusInfo
+}
+
+type certStatus struct {
+	CertHash  []byte
+	CertReqID int
+}
+
+type cmpControl struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type certID struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+// CMP registers the key of the token identified by serial with a CMP server: "ir" requests its first certificate,
+// "kur" updates the certificate issued before, and "rr" revokes it.  The key of the token never changes; the token
+// remains identified by its self-signed certificate.  The chain issued by ir and kur is returned, leaf first, and
+// kept in $HOME/.manetu/certs/cmp alongside the token.
+func (c *Core) CMP(serial, operation string, opts CMPOptions) (chain []*x509.Certificate, err error) {
+	if opts.URL == "" {
+		return nil, classify(ExitConfig, errors.New("the URL of the CMP server must be given"))
+	}
+	switch operation {
+	case "ir", "kur", "rr":
+	default:
+		return nil, classify(ExitConfig, fmt.Errorf("unknown CMP operation %q (available: ir, kur, rr)", operation))
+	}
+
+	token, err := c.getToken(serial)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		c.audit("cmp-"+operation, token.Cert, err)
+	}()
+	id := token.Cert.SerialNumber.Bytes()
+
+	store, err := newFileCertStore("", "cmp")
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &cmpClient{opts: opts, signer: token.Signer, cert: token.Cert}
+	cc.client = newHTTPClient(opts.Insecure)
+	cc.client.Timeout = 60 * time.Second
+	if opts.CACert != "" {
+		data, err := os.ReadFile(opts.CACert)
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range decodePEMBlocks(data, "CERTIFICATE") {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("cmp: error parsing %s: %w", opts.CACert, err)
+			}
+			cc.caCerts = append(cc.caCerts, cert)
+		}
+		if len(cc.caCerts) == 0 {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CACert)
+		}
+	} else if opts.Secret == "" {
+		return nil, classify(ExitConfig, errors.New("--ca-cert is required to authenticate the CA unless --secret is given"))
+	}
+
+	var previous *x509.Certificate
+	if operation != "ir" {
+		previous, err = store.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if previous == nil {
+			return nil, classify(ExitNotFound, errors.New("no certificate has been issued to the token by CMP; register it with ir first"))
+		}
+		// subsequent messages are authenticated by the certificate issued by the CA
+		cc.cert = previous
+	}
+	cc.transactionID = make([]byte, 16)
+	_, err = rand.Read(cc.transactionID)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := c.startSpinner("Contacting the CA...")
+	defer stop()
+
+	if operation == "rr" {
+		err = cc.revoke(previous)
+		if err != nil {
+			return nil, err
+		}
+		return nil, store.Delete(id)
+	}
+
+	cert, caPubs, err := cc.request(operation, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err = leafFirst(append([]*x509.Certificate{cert}, append(caPubs, cc.caCerts...)...), token.Signer)
+	if err != nil {
+		return nil, fmt.Errorf("the issued certificate does not carry the token's key: %w", err)
+	}
+
+	err = store.PutChain(id, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	return chain, nil
+}
+
+// request sends an ir or kur for the key of the token, confirming the certificate issued in response
+func (cc *cmpClient) request(operation string, previous *x509.Certificate) (*x509.Certificate, []*x509.Certificate, error) {
+	template := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: firstNonEmpty(cc.opts.CommonName, ComputeMRN(cc.cert))},
+		DNSNames: cc.opts.DNSNames,
+	}
+	if previous != nil {
+		template = &x509.CertificateRequest{
+			Subject:        previous.Subject,
+			DNSNames:       previous.DNSNames,
+			EmailAddresses: previous.EmailAddresses,
+			IPAddresses:    previous.IPAddresses,
+			URIs:           previous.URIs,
+		}
+	}
+	// let crypto/x509 encode the subject and extensions of the template
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, cc.signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cmp: error parsing the certificate request: %w", err)
+	}
+
+	fields := [][]byte{explicitTag(5, csr.RawSubject), implicitTag(6, csr.RawSubjectPublicKeyInfo)}
+	if len(csr.Extensions) > 0 {
+		extensions, err := asn1.Marshal(csr.Extensions)
+		if err != nil {
+			return nil, nil, err
+		}
+		fields = append(fields, implicitTag(9, extensions))
+	}
+	certTemplate := sequence(fields...)
+
+	reqID, err := asn1.Marshal(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	certReqFields := [][]byte{reqID, certTemplate}
+	if previous != nil {
+		oldCertID, err := asn1.Marshal(certID{
+			Issuer:       asn1.RawValue{FullBytes: explicitTag(4, previous.RawIssuer)},
+			SerialNumber: previous.SerialNumber,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		controls, err := asn1.Marshal([]cmpControl{{Type: oidRegCtrlOldCertID, Value: asn1.RawValue{FullBytes: oldCertID}}})
+		if err != nil {
+			return nil, nil, err
+		}
+		certReqFields = append(certReqFields, controls)
+	}
+	certReq := sequence(certReqFields...)
+
+	// proof of possession: the token signs the certificate request
+	alg, hash, err := cmpSignatureAlgorithm(cc.signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := hash.New()
+	h.Write(certReq)
+	signature, err := cc.signer.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	popo, err := asn1.Marshal(struct {
+		AlgorithmIdentifier pkix.AlgorithmIdentifier
+		Signature           asn1.BitString
+	}{alg, asn1.BitString{Bytes: signature, BitLength: len(signature) * 8}})
+	if err != nil {
+		return nil, nil, err
+	}
+	certReqMessages := sequence(sequence(certReq, implicitTag(1, popo)))
+
+	reqBody, respBody := cmpBodyIR, cmpBodyIP
+	if operation == "kur" {
+		reqBody, respBody = cmpBodyKUR, cmpBodyKUP
+	}
+	body, err := cc.exchange(reqBody, certReqMessages)
+	if err != nil {
+		return nil, nil, err
+	}
+	if body.Tag != respBody && !(respBody == cmpBodyIP && body.Tag == cmpBodyCP) {
+		return nil, nil, fmt.Errorf("unexpected CMP response body %d", body.Tag)
+	}
+
+	var rep certRepMessage
+	_, err = asn1.Unmarshal(body.Bytes, &rep)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cmp: %w", err)
+	}
+	if len(rep.Response) != 1 {
+		return nil, nil, fmt.Errorf("cmp: %d responses to one request", len(rep.Response))
+	}
+	resp := rep.Response[0]
+	err = cmpStatusError(resp.Status)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var pair certifiedKeyPair
+	_, err = asn1.Unmarshal(resp.CertifiedKeyPair.FullBytes, &pair)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cmp: %w", err)
+	}
+	if pair.CertOrEncCert.Tag != 0 {
+		return nil, nil, errors.New("cmp: the certificate was issued encrypted, which is not supported")
+	}
+	cert, err := x509.ParseCertificate(pair.CertOrEncCert.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cmp: error parsing the issued certificate: %w", err)
+	}
+	var caPubs []*x509.Certificate
+	if len(rep.CAPubs.Bytes) > 0 {
+		var seq asn1.RawValue
+		_, err = asn1.Unmarshal(rep.CAPubs.Bytes, &seq)
+		if err == nil {
+			caPubs, _ = x509.ParseCertificates(seq.Bytes)
+		}
+	}
+
+	// confirm acceptance of the certificate, per RFC 4210, section 5.3.18
+	certHash := crypto.SHA256
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384:
+		certHash = crypto.SHA384
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512:
+		certHash = crypto.SHA512
+	}
+	h = certHash.New()
+	h.Write(cert.Raw)
+	confirm, err := asn1.Marshal([]certStatus{{CertHash: h.Sum(nil), CertReqID: resp.CertReqID}})
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err = cc.exchange(cmpBodyCertConf, confirm)
+	if err != nil {
+		return nil, nil, err
+	}
+	if body.Tag != cmpBodyPKIConf {
+		return nil, nil, fmt.Errorf("unexpected CMP response body %d to the confirmation", body.Tag)
+	}
+
+	return cert, caPubs, nil
+}
+
+// revoke sends an rr for cert
+func (cc *cmpClient) revoke(cert *x509.Certificate) error {
+	serial, err := asn1.Marshal(cert.SerialNumber)
+	if err != nil {
+		return err
+	}
+	// serialNumber [1] IMPLICIT INTEGER, issuer [3] Name
+	serial[0] = 0x81
+	details := [][]byte{sequence(serial, explicitTag(3, cert.RawIssuer))}
+	if cc.opts.Reason > 0 {
+		reason, err := asn1.Marshal(asn1.Enumerated(cc.opts.Reason))
+		if err != nil {
+			return err
+		}
+		extensions, err := asn1.Marshal([]pkix.Extension{{Id: oidExtensionReason, Value: reason}})
+		if err != nil {
+			return err
+		}
+		details = append(details, extensions)
+	}
+
+	body, err := cc.exchange(cmpBodyRR, sequence(sequence(details...)))
+	if err != nil {
+		return err
+	}
+	if body.Tag != cmpBodyRP {
+		return fmt.Errorf("unexpected CMP response body %d", body.Tag)
+	}
+
+	var rep revRepContent
+	_, err = asn1.Unmarshal(body.Bytes, &rep)
+	if err != nil {
+		return fmt.Errorf("cmp: %w", err)
+	}
+	if len(rep.Status) != 1 {
+		return fmt.Errorf("cmp: %d statuses for one revocation", len(rep.Status))
+	}
+	if rep.Status[0].Status == cmpRevocationWarning || rep.Status[0].Status == cmpRevocationNotice {
+		return nil
+	}
+	return cmpStatusError(rep.Status[0])
+}
+
+// exchange sends content within the body of type bodyType, protected, and returns the verified body of the response
+func (cc *cmpClient) exchange(bodyType int, content []byte) (*asn1.RawValue, error) {
+	senderNonce := make([]byte, 16)
+	_, err := rand.Read(senderNonce)
+	if err != nil {
+		return nil, err
+	}
+
+	recipient := explicitTag(4, sequence())
+	if len(cc.caCerts) > 0 {
+		recipient = explicitTag(4, cc.caCerts[0].RawSubject)
+	}
+	header := cmpHeader{
+		Pvno:          2,
+		Sender:        asn1.RawValue{FullBytes: explicitTag(4, cc.cert.RawSubject)},
+		Recipient:     asn1.RawValue{FullBytes: recipient},
+		MessageTime:   time.Now().UTC().Truncate(time.Second),
+		TransactionID: cc.transactionID,
+		SenderNonce:   senderNonce,
+		RecipNonce:    cc.recipNonce,
+	}
+
+	var pbm *pbmParameter
+	if cc.opts.Secret != "" {
+		salt := make([]byte, 16)
+		_, err = rand.Read(salt)
+		if err != nil {
+			return nil, err
+		}
+		pbm = &pbmParameter{
+			Salt:           salt,
+			OWF:            pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			IterationCount: 10000,
+			MAC:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256},
+		}
+		params, err := asn1.Marshal(*pbm)
+		if err != nil {
+			return nil, err
+		}
+		header.ProtectionAlg = pkix.AlgorithmIdentifier{Algorithm: oidPasswordBasedMAC, Parameters: asn1.RawValue{FullBytes: params}}
+		header.SenderKID = []byte(cc.opts.Reference)
+	} else {
+		header.ProtectionAlg, _, err = cmpSignatureAlgorithm(cc.signer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	headerDER, err := asn1.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	msg := cmpMessage{
+		Header: asn1.RawValue{FullBytes: headerDER},
+		Body:   asn1.RawValue{FullBytes: explicitTag(bodyType, content)},
+	}
+	protected, err := asn1.Marshal(cmpProtectedPart{msg.Header, msg.Body})
+	if err != nil {
+		return nil, err
+	}
+
+	var protection []byte
+	if pbm != nil {
+		protection, err = pbmMAC(cc.opts.Secret, *pbm, protected)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		_, hash, _ := cmpSignatureAlgorithm(cc.signer)
+		h := hash.New()
+		h.Write(protected)
+		protection, err = cc.signer.Sign(rand.Reader, h.Sum(nil), hash)
+		if err != nil {
+			return nil, err
+		}
+		msg.ExtraCerts = asn1.RawValue{FullBytes: explicitTag(1, sequence(cc.cert.Raw))}
+	}
+	bits, err := asn1.Marshal(asn1.BitString{Bytes: protection, BitLength: len(protection) * 8})
+	if err != nil {
+		return nil, err
+	}
+	msg.Protection = asn1.RawValue{FullBytes: explicitTag(0, bits)}
+
+	der, err := asn1.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, cc.opts.URL, bytes.NewReader(der))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/pkixcmp")
+	// RFC 6712, section 3.4: servers may close the connection after each response
+	req.Close = true
+
+	resp, err := cc.client.Do(req)
+	if err != nil {
+		return nil, classify(ExitUnreachable, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	return cc.verify(data, senderNonce)
+}
+
+// verify checks the protection, transaction and nonce of the response data, returning its body
+func (cc *cmpClient) verify(data, senderNonce []byte) (*asn1.RawValue, error) {
+	var msg cmpMessage
+	_, err := asn1.Unmarshal(data, &msg)
+	if err != nil {
+		return nil, fmt.Errorf("cmp: %w", err)
+	}
+	var header cmpHeader
+	_, err = asn1.Unmarshal(msg.Header.FullBytes, &header)
+	if err != nil {
+		return nil, fmt.Errorf("cmp: %w", err)
+	}
+	var body asn1.RawValue
+	_, err = asn1.Unmarshal(msg.Body.FullBytes, &body)
+	if err != nil {
+		return nil, fmt.Errorf("cmp: %w", err)
+	}
+	// the content of the explicitly tagged body
+	content := asn1.RawValue{Tag: body.Tag, Bytes: body.Bytes}
+
+	if len(msg.Protection.Bytes) == 0 {
+		if body.Tag == cmpBodyError {
+			return nil, cmpErrorMessage(body.Bytes)
+		}
+		return nil, errors.New("cmp: the response is not protected")
+	}
+	var protection asn1.BitString
+	_, err = asn1.Unmarshal(msg.Protection.Bytes, &protection)
+	if err != nil {
+		return nil, fmt.Errorf("cmp: %w", err)
+	}
+	protected, err := asn1.Marshal(cmpProtectedPart{msg.Header, msg.Body})
+	if err != nil {
+		return nil, err
+	}
+
+	if header.ProtectionAlg.Algorithm.Equal(oidPasswordBasedMAC) {
+		if cc.opts.Secret == "" {
+			return nil, errors.New("cmp: the response is protected by a MAC, but no --secret was given")
+		}
+		var pbm pbmParameter
+		_, err = asn1.Unmarshal(header.ProtectionAlg.Parameters.FullBytes, &pbm)
+		if err != nil {
+			return nil, fmt.Errorf("cmp: %w", err)
+		}
+		mac, err := pbmMAC(cc.opts.Secret, pbm, protected)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(mac, protection.Bytes) {
+			return nil, classify(ExitAuth, errors.New("cmp: the protection of the response is invalid"))
+		}
+	} else {
+		err = cc.verifySignature(msg, header, protected, protection.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !bytes.Equal(header.TransactionID, cc.transactionID) {
+		return nil, errors.New("cmp: the response answers another transaction")
+	}
+	if !bytes.Equal(header.RecipNonce, senderNonce) {
+		return nil, errors.New("cmp: the response does not answer this request")
+	}
+	cc.recipNonce = header.SenderNonce
+
+	if body.Tag == cmpBodyError {
+		return nil, cmpErrorMessage(body.Bytes)
+	}
+	return &content, nil
+}
+
+// verifySignature checks that the response is signed by the CA, or by a certificate it issued
+func (cc *cmpClient) verifySignature(msg cmpMessage, header cmpHeader, protected, signature []byte) error {
+	if len(cc.caCerts) == 0 {
+		return classify(ExitConfig, errors.New("cmp: --ca-cert is required to authenticate a signed response"))
+	}
+
+	var extraCerts []*x509.Certificate
+	if len(msg.ExtraCerts.Bytes) > 0 {
+		var seq asn1.RawValue
+		_, err := asn1.Unmarshal(msg.ExtraCerts.Bytes, &seq)
+		if err != nil {
+			return fmt.Errorf("cmp: %w", err)
+		}
+		extraCerts, err = x509.ParseCertificates(seq.Bytes)
+		if err != nil {
+			return fmt.Errorf("cmp: %w", err)
+		}
+	}
+
+	// the protection certificate comes first among the extra certificates, or may be the CA itself
+	signer := cc.caCerts[0]
+	if len(extraCerts) > 0 {
+		signer = extraCerts[0]
+		roots := x509.NewCertPool()
+		for _, cert := range cc.caCerts {
+			roots.AddCert(cert)
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range extraCerts[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := signer.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return classify(ExitAuth, fmt.Errorf("cmp: the response is not signed by the CA: %w", err))
+		}
+	}
+
+	var alg x509.SignatureAlgorithm
+	for a, oid := range map[x509.SignatureAlgorithm]asn1.ObjectIdentifier{
+		x509.ECDSAWithSHA256: oidECDSAWithSHA256,
+		x509.ECDSAWithSHA384: oidECDSAWithSHA384,
+		x509.ECDSAWithSHA512: oidECDSAWithSHA512,
+		x509.SHA256WithRSA:   oidSHA256WithRSA,
+		x509.SHA384WithRSA:   {1, 2, 840, 113549, 1, 1, 12},
+		x509.SHA512WithRSA:   {1, 2, 840, 113549, 1, 1, 13},
+	} {
+		if header.ProtectionAlg.Algorithm.Equal(oid) {
+			alg = a
+		}
+	}
+	if alg == x509.UnknownSignatureAlgorithm {
+		return fmt.Errorf("cmp: unsupported protection algorithm %s", header.ProtectionAlg.Algorithm)
+	}
+
+	err := signer.CheckSignature(alg, protected, signature)
+	if err != nil {
+		return classify(ExitAuth, fmt.Errorf("cmp: the protection of the response is invalid: %w", err))
+	}
+	return nil
+}
+
+// cmpSignatureAlgorithm returns the algorithm with which signer protects messages and proves possession of its key
+func cmpSignatureAlgorithm(signer crypto.Signer) (pkix.AlgorithmIdentifier, crypto.Hash, error) {
+	switch signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, crypto.SHA256, nil
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue}, crypto.SHA256, nil
+	}
+	return pkix.AlgorithmIdentifier{}, 0, fmt.Errorf("unsupported key %T", signer.Public())
+}
+
+// pbmMAC computes the password-based MAC of RFC 4211, section 4.4, over data
+func pbmMAC(secret string, params pbmParameter, data []byte) ([]byte, error) {
+	var owf, mac crypto.Hash
+	for h, oid := range digestOIDs {
+		if params.OWF.Algorithm.Equal(oid) {
+			owf = h
+		}
+	}
+	switch {
+	case params.MAC.Algorithm.Equal(oidHMACWithSHA1), params.MAC.Algorithm.Equal(oidPBMHMACWithSHA1):
+		mac = crypto.SHA1
+	case params.MAC.Algorithm.Equal(oidHMACWithSHA256):
+		mac = crypto.SHA256
+	case params.MAC.Algorithm.Equal(oidHMACWithSHA384):
+		mac = crypto.SHA384
+	case params.MAC.Algorithm.Equal(oidHMACWithSHA512):
+		mac = crypto.SHA512
+	}
+	if owf == 0 || mac == 0 {
+		return nil, fmt.Errorf("cmp: unsupported password-based MAC %s/%s", params.OWF.Algorithm, params.MAC.Algorithm)
+	}
+	if params.IterationCount < 1 || params.IterationCount > 1<<20 {
+		return nil, fmt.Errorf("cmp: invalid iteration count %d", params.IterationCount)
+	}
+
+	h := owf.New()
+	h.Write([]byte(secret))
+	h.Write(params.Salt)
+	key := h.Sum(nil)
+	for i := 1; i < params.IterationCount; i++ {
+		h.Reset()
+		h.Write(key)
+		key = h.Sum(nil)
+	}
+	m := hmac.New(mac.New, key)
+	m.Write(data)
+	return m.Sum(nil), nil
+}
+
+func cmpStatusError(status pkiStatusInfo) error {
+	switch status.Status {
+	case cmpAccepted, cmpGrantedWithMods:
+		return nil
+	case cmpWaiting:
+		return errors.New("the CMP server is holding the request for approval; run the command again once approved")
+	}
+
+	var reasons []string
+	for i, name := range cmpFailInfo {
+		if status.FailInfo.At(i) == 1 {
+			reasons = append(reasons, name)
+		}
+	}
+	reasons = append(reasons, status.StatusString...)
+	err := fmt.Errorf("the CMP server rejected the request (status %d)", status.Status)
+	if len(reasons) > 0 {
+		err = fmt.Errorf("the CMP server rejected the request: %s", strings.Join(reasons, "; "))
+	}
+	if status.Status == cmpRejection {
+		return classify(ExitAuth, err)
+	}
+	return err
+}
+
+func cmpErrorMessage(content []byte) error {
+	var msg errorMsgContent
+	_, err := asn1.Unmarshal(content, &msg)
+	if err != nil {
+		return fmt.Errorf("cmp: %w", err)
+	}
+	err = cmpStatusError(msg.Status)
+	if err == nil {
+		err = errors.New("the CMP server returned an error")
+	}
+	return err
+}
+
+// sequence encodes the DER encoded fields as a SEQUENCE
+func sequence(fields ...[]byte) []byte {
+	der, _ := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: bytes.Join(fields, nil)})
+	return der
+}
+
+// explicitTag wraps der in the context-specific tag
+func explicitTag(tag int, der []byte) []byte {
+	out, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: der})
+	return out
+}
+
+// implicitTag replaces the tag of the constructed value der with the context-specific tag
+func implicitTag(tag int, der []byte) []byte {
+	var v asn1.RawValue
+	_, _ = asn1.Unmarshal(der, &v)
+	out, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: v.Bytes})
+	return out
+}
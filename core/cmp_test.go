@@ -0,0 +1,495 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPBMMAC checks the password-based MAC of RFC 4211 against digests and HMACs computed by openssl dgst
+func TestPBMMAC(t *testing.T) {
+	salt := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	tests := []struct {
+		name   string
+		params pbmParameter
+		want   string
+	}{
+		{
+			"SHA-256 twice, HMAC-SHA256",
+			pbmParameter{salt, pkix.AlgorithmIdentifier{Algorithm: oidSHA256}, 2, pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256}},
+			"f63ca2152c675c1fc1b5f2c65c81e229646f0d287dc4da02140cf333517f76b7",
+		},
+		{
+			"SHA-1 once, the HMAC-SHA1 of RFC 4210",
+			pbmParameter{salt, pkix.AlgorithmIdentifier{Algorithm: oidSHA1}, 1, pkix.AlgorithmIdentifier{Algorithm: oidPBMHMACWithSHA1}},
+			"b72c0b8c026ce5e75f443e59c2581132a3718e0c",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mac, err := pbmMAC("sesame", tt.params, []byte("protected part"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(mac); got != tt.want {
+				t.Errorf("pbmMAC = %s; want %s", got, tt.want)
+			}
+		})
+	}
+
+	_, err := pbmMAC("sesame", pbmParameter{salt, pkix.AlgorithmIdentifier{Algorithm: oidSHA256}, 0, pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256}}, nil)
+	if err == nil {
+		t.Error("pbmMAC accepted an iteration count of zero")
+	}
+	_, err = pbmMAC("sesame", pbmParameter{salt, pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption}, 1, pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256}}, nil)
+	if err == nil {
+		t.Error("pbmMAC accepted an unknown one-way function")
+	}
+}
+
+func TestCMPStatusError(t *testing.T) {
+	badPOP := asn1.BitString{Bytes: []byte{0x00, 0x40}, BitLength: 10}
+	tests := []struct {
+		status pkiStatusInfo
+		code   int
+		want   string
+	}{
+		{pkiStatusInfo{Status: cmpAccepted}, ExitOK, ""},
+		{pkiStatusInfo{Status: cmpGrantedWithMods}, ExitOK, ""},
+		{pkiStatusInfo{Status: cmpRejection, FailInfo: badPOP}, ExitAuth, "the CMP server rejected the request: badPOP"},
+		{pkiStatusInfo{Status: cmpRejection, StatusString: []string{"unknown user"}}, ExitAuth, "the CMP server rejected the request: unknown user"},
+		{pkiStatusInfo{Status: cmpWaiting}, ExitFailure, "the CMP server is holding the request for approval; run the command again once approved"},
+	}
+	for _, tt := range tests {
+		err := cmpStatusError(tt.status)
+		if ExitCode(err) != tt.code {
+			t.Errorf("cmpStatusError(%d) = %v; want exit code %d", tt.status.Status, err, tt.code)
+		}
+		if err != nil && err.Error() != tt.want {
+			t.Errorf("cmpStatusError(%d) = %q; want %q", tt.status.Status, err, tt.want)
+		}
+	}
+}
+
+// cmpServer is a fake CMP server over HTTP in the manner of EJBCA, whose CA issues a certificate for each ir and kur,
+// protecting its responses as each request was protected: by the password-based MAC of the secret, or signed by the CA
+type cmpServer struct {
+	*httptest.Server
+
+	caKey     *rsa.PrivateKey
+	ca        *x509.Certificate
+	reference string
+	secret    string
+
+	sync.Mutex
+	// issued holds the certificates issued, and revoked the serial numbers of those revoked
+	issued  []*x509.Certificate
+	revoked []*big.Int
+}
+
+func newCMPServer(t *testing.T) *cmpServer {
+	t.Helper()
+
+	s := &cmpServer{reference: "token-ref", secret: "sesame"}
+	s.caKey, s.ca = testCA(t, "CMP Test CA")
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// caFile writes the certificate of the CA to a PEM file, as given to --ca-cert
+func (s *cmpServer) caFile(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.ca.Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func (s *cmpServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/pkixcmp" {
+		http.Error(w, "expected a PKI message", http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := s.respond(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkixcmp")
+	_, _ = w.Write(resp)
+}
+
+// respond answers the PKIMessage data
+func (s *cmpServer) respond(data []byte) ([]byte, error) {
+	var msg cmpMessage
+	_, err := asn1.Unmarshal(data, &msg)
+	if err != nil {
+		return nil, err
+	}
+	var header cmpHeader
+	_, err = asn1.Unmarshal(msg.Header.FullBytes, &header)
+	if err != nil {
+		return nil, err
+	}
+	var body asn1.RawValue
+	_, err = asn1.Unmarshal(msg.Body.FullBytes, &body)
+	if err != nil {
+		return nil, err
+	}
+	var protection asn1.BitString
+	_, err = asn1.Unmarshal(msg.Protection.Bytes, &protection)
+	if err != nil {
+		return nil, err
+	}
+	protected, err := asn1.Marshal(cmpProtectedPart{msg.Header, msg.Body})
+	if err != nil {
+		return nil, err
+	}
+
+	// the certificate signing a request, which a kur and rr must present, as that issued before
+	var sender *x509.Certificate
+	mac := header.ProtectionAlg.Algorithm.Equal(oidPasswordBasedMAC)
+	if mac {
+		var pbm pbmParameter
+		_, err = asn1.Unmarshal(header.ProtectionAlg.Parameters.FullBytes, &pbm)
+		if err != nil {
+			return nil, err
+		}
+		want, err := pbmMAC(s.secret, pbm, protected)
+		if err != nil {
+			return nil, err
+		}
+		if string(header.SenderKID) != s.reference || string(want) != string(protection.Bytes) {
+			return s.reply(header, cmpBodyError, sequence(cmpStatus(cmpRejection, 1)), false)
+		}
+	} else {
+		var seq asn1.RawValue
+		_, err = asn1.Unmarshal(msg.ExtraCerts.Bytes, &seq)
+		if err != nil {
+			return nil, err
+		}
+		sender, err = x509.ParseCertificate(seq.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		err = sender.CheckSignature(x509.ECDSAWithSHA256, protected, protection.Bytes)
+		if err != nil {
+			return s.reply(header, cmpBodyError, sequence(cmpStatus(cmpRejection, 1)), false)
+		}
+	}
+
+	switch body.Tag {
+	case cmpBodyIR, cmpBodyKUR:
+		if body.Tag == cmpBodyKUR && !s.wasIssued(sender) {
+			return s.reply(header, cmpBodyError, sequence(cmpStatus(cmpRejection, 20)), mac)
+		}
+		cert, err := s.issue(body.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		response := sequence(sequence(mustMarshal(0), cmpStatus(cmpAccepted, -1), sequence(explicitTag(0, cert.Raw))))
+		return s.reply(header, body.Tag+1, sequence(explicitTag(1, sequence(s.ca.Raw)), response), mac)
+	case cmpBodyCertConf:
+		return s.reply(header, cmpBodyPKIConf, asn1.NullBytes, mac)
+	case cmpBodyRR:
+		if !s.wasIssued(sender) {
+			return s.reply(header, cmpBodyError, sequence(cmpStatus(cmpRejection, 20)), mac)
+		}
+		s.Lock()
+		s.revoked = append(s.revoked, sender.SerialNumber)
+		s.Unlock()
+		return s.reply(header, cmpBodyRP, sequence(sequence(cmpStatus(cmpAccepted, -1))), mac)
+	}
+	return nil, fmt.Errorf("unexpected body %d", body.Tag)
+}
+
+// wasIssued reports whether cert was issued by the CA
+func (s *cmpServer) wasIssued(cert *x509.Certificate) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, issued := range s.issued {
+		if cert != nil && issued.Equal(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+// issue issues the certificate requested by the CertReqMessages content, once its proof of possession verifies
+func (s *cmpServer) issue(content []byte) (*x509.Certificate, error) {
+	var msgs []struct {
+		CertReq asn1.RawValue
+		POPO    asn1.RawValue
+	}
+	_, err := asn1.Unmarshal(content, &msgs)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, errors.New("expected one request")
+	}
+	var certReq struct {
+		ID       int
+		Template asn1.RawValue
+		Controls asn1.RawValue `asn1:"optional"`
+	}
+	_, err = asn1.Unmarshal(msgs[0].CertReq.FullBytes, &certReq)
+	if err != nil {
+		return nil, err
+	}
+
+	var subject pkix.RDNSequence
+	var pub crypto.PublicKey
+	for rest := certReq.Template.Bytes; len(rest) > 0; {
+		var field asn1.RawValue
+		rest, err = asn1.Unmarshal(rest, &field)
+		if err != nil {
+			return nil, err
+		}
+		switch field.Tag {
+		case 5:
+			_, err = asn1.Unmarshal(field.Bytes, &subject)
+		case 6:
+			pub, err = x509.ParsePKIXPublicKey(retag(field.FullBytes))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pub == nil {
+		return nil, errors.New("the template has no public key")
+	}
+
+	var popo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		Signature asn1.BitString
+	}
+	_, err = asn1.Unmarshal(retag(msgs[0].POPO.FullBytes), &popo)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(msgs[0].CertReq.FullBytes)
+	if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], popo.Signature.Bytes) {
+		return nil, errors.New("the proof of possession does not verify")
+	}
+
+	var name pkix.Name
+	name.FillFromRDNSequence(&subject)
+	s.Lock()
+	serial := big.NewInt(int64(100 + len(s.issued)))
+	s.Unlock()
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      name,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, s.ca, pub, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	s.issued = append(s.issued, cert)
+	s.Unlock()
+	return cert, nil
+}
+
+// reply returns a response to a request of header, protected by the MAC of the secret when mac is set, or signed by
+// the CA otherwise.  Errors rejecting a request's protection are not protected.
+func (s *cmpServer) reply(request cmpHeader, bodyType int, content []byte, mac bool) ([]byte, error) {
+	header := cmpHeader{
+		Pvno:          2,
+		Sender:        asn1.RawValue{FullBytes: explicitTag(4, s.ca.RawSubject)},
+		Recipient:     request.Sender,
+		MessageTime:   time.Now().UTC().Truncate(time.Second),
+		TransactionID: request.TransactionID,
+		SenderNonce:   []byte("0123456789abcdef"),
+		RecipNonce:    request.SenderNonce,
+	}
+	unprotected := bodyType == cmpBodyError && !mac
+	var pbm pbmParameter
+	if mac {
+		pbm = pbmParameter{
+			Salt:           []byte("saltsalt"),
+			OWF:            pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			IterationCount: 500,
+			MAC:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256},
+		}
+		header.ProtectionAlg = pkix.AlgorithmIdentifier{Algorithm: oidPasswordBasedMAC, Parameters: asn1.RawValue{FullBytes: mustMarshal(pbm)}}
+	} else if !unprotected {
+		header.ProtectionAlg = pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue}
+	}
+
+	msg := cmpMessage{
+		Header: asn1.RawValue{FullBytes: mustMarshal(header)},
+		Body:   asn1.RawValue{FullBytes: explicitTag(bodyType, content)},
+	}
+	if !unprotected {
+		protected := mustMarshal(cmpProtectedPart{msg.Header, msg.Body})
+		var protection []byte
+		var err error
+		if mac {
+			protection, err = pbmMAC(s.secret, pbm, protected)
+		} else {
+			digest := sha256.Sum256(protected)
+			protection, err = s.caKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+		}
+		if err != nil {
+			return nil, err
+		}
+		msg.Protection = asn1.RawValue{FullBytes: explicitTag(0, mustMarshal(asn1.BitString{Bytes: protection, BitLength: len(protection) * 8}))}
+	}
+	return asn1.Marshal(msg)
+}
+
+// cmpStatus encodes a PKIStatusInfo of status, with the failure bit failInfo unless it is negative
+func cmpStatus(status, failInfo int) []byte {
+	info := pkiStatusInfo{Status: status}
+	if failInfo >= 0 {
+		info.FailInfo = asn1.BitString{Bytes: make([]byte, failInfo/8+1), BitLength: failInfo + 1}
+		info.FailInfo.Bytes[failInfo/8] = 0x80 >> (failInfo % 8)
+	}
+	return mustMarshal(info)
+}
+
+// retag gives the implicitly tagged constructed value der the tag of a SEQUENCE
+func retag(der []byte) []byte {
+	out := append([]byte{}, der...)
+	out[0] = 0x30
+	return out
+}
+
+func mustMarshal(v interface{}) []byte {
+	der, err := asn1.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return der
+}
+
+// TestCMP registers a token with a fake CMP server, updates its certificate and revokes it
+func TestCMP(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	server := newCMPServer(t)
+
+	c := NewWithBackend(NewMemoryBackend())
+	c.SetQuiet(true)
+	defer c.Close()
+	cert, err := c.Generate("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := HexEncode(cert.SerialNumber.Bytes())
+
+	// the initial registration is authorized by the secret issued by the CA
+	chain, err := c.CMP(serial, "ir", CMPOptions{
+		URL:       server.URL,
+		Reference: server.reference,
+		Secret:    server.secret,
+		DNSNames:  []string{"svc.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("CMP ir: %v", err)
+	}
+	if len(chain) != 2 || !chain[1].Equal(server.ca) {
+		t.Fatalf("CMP ir returned %d certificates; want the leaf and the CA", len(chain))
+	}
+	if chain[0].Subject.CommonName != ComputeMRN(cert) || !cert.PublicKey.(*ecdsa.PublicKey).Equal(chain[0].PublicKey) {
+		t.Errorf("ir issued %v; want the MRN and the key of the token", chain[0].Subject)
+	}
+
+	// the update is signed by the token under the certificate issued to it, and answered signed by the CA
+	opts := CMPOptions{URL: server.URL, CACert: server.caFile(t)}
+	updated, err := c.CMP(serial, "kur", opts)
+	if err != nil {
+		t.Fatalf("CMP kur: %v", err)
+	}
+	if updated[0].SerialNumber.Cmp(chain[0].SerialNumber) == 0 || updated[0].Subject.CommonName != chain[0].Subject.CommonName {
+		t.Errorf("kur issued %v, serial %s; want a new certificate for %v", updated[0].Subject, updated[0].SerialNumber, chain[0].Subject)
+	}
+
+	_, err = c.CMP(serial, "rr", opts)
+	if err != nil {
+		t.Fatalf("CMP rr: %v", err)
+	}
+	if len(server.revoked) != 1 || server.revoked[0].Cmp(updated[0].SerialNumber) != 0 {
+		t.Errorf("revoked %v; want [%s]", server.revoked, updated[0].SerialNumber)
+	}
+	_, err = c.CMP(serial, "kur", opts)
+	if ExitCode(err) != ExitNotFound {
+		t.Errorf("CMP kur after rr = %v; want exit code %d", err, ExitNotFound)
+	}
+}
+
+func TestCMPRefused(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	server := newCMPServer(t)
+	other := newCMPServer(t)
+
+	c := NewWithBackend(NewMemoryBackend())
+	c.SetQuiet(true)
+	defer c.Close()
+	cert, err := c.Generate("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := HexEncode(cert.SerialNumber.Bytes())
+
+	tests := []struct {
+		name      string
+		operation string
+		opts      CMPOptions
+		code      int
+	}{
+		{"a wrong secret", "ir", CMPOptions{URL: server.URL, Reference: server.reference, Secret: "wrong"}, ExitAuth},
+		{"a response signed by another CA", "ir", CMPOptions{URL: server.URL, CACert: other.caFile(t)}, ExitAuth},
+		{"neither a secret nor a CA", "ir", CMPOptions{URL: server.URL}, ExitConfig},
+		{"an update before registration", "kur", CMPOptions{URL: server.URL, CACert: server.caFile(t)}, ExitNotFound},
+		{"an unknown operation", "cr", CMPOptions{URL: server.URL}, ExitConfig},
+		{"no URL", "ir", CMPOptions{}, ExitConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.CMP(serial, tt.operation, tt.opts)
+			if ExitCode(err) != tt.code {
+				t.Errorf("CMP %s = %v; want exit code %d", tt.operation, err, tt.code)
+			}
+		})
+	}
+}
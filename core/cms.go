@@ -0,0 +1,87 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"time"
+)
+
+var oidAttributeSigningTime = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+
+// CMSOptions configures SignCMS
+type CMSOptions struct {
+	// Detached leaves the content out of the SignedData, for the verifier to supply, as in a .p7s signature
+	Detached bool
+	// Digest names the digest of the content: "sha256", "sha384" or "sha512", defaulting to that matched to the key
+	Digest string
+	// Certificate names a PEM file holding a certificate issued to the token, followed by its chain, identifying the
+	// signer in place of the token's self-signed certificate
+	Certificate string
+	// Output is "der" (the default) or "pem"
+	Output string
+	// Timestamp, when set, embeds a timestamp over the signature from the TSA it selects, so that the signature remains
+	// verifiable after the certificate has expired
+	Timestamp *TimestampOptions
+}
+
+// SignCMS signs content with the key of the token identified by serial as a CMS (PKCS#7) SignedData, with the
+// certificate of the token and its chain, for the S/MIME-era tools that verify with "openssl cms" or its kin
+func (c *Core) SignCMS(serial string, content []byte, opts CMSOptions) (msg []byte, err error) {
+	output := orDefault(opts.Output, "der")
+	err = checkOutput(output, "der", "pem")
+	if err != nil {
+		return nil, err
+	}
+	token, err := c.getToken(serial)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := signDigest(opts.Digest, token.Signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	chain, err := exportChain(token, opts.Certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		c.audit("cms-sign", token.Cert, err)
+	}()
+
+	signingTime, err := newAttribute(oidAttributeSigningTime, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	msg, err = signData(content, opts.Detached, token.Signer, chain[0], hash, []cmsAttribute{signingTime}, chain)
+	if err != nil {
+		return nil, fmt.Errorf("signing failed: %w", err)
+	}
+
+	if opts.Timestamp != nil {
+		msg, err = setUnsignedAttributes(msg, func(si signerInfo) ([]cmsAttribute, error) {
+			_, token, _, err := c.timestamp(si.EncryptedDigest, *opts.Timestamp)
+			if err != nil {
+				return nil, err
+			}
+			attr, err := newAttribute(oidAttributeTimeStampToken, asn1.RawValue{FullBytes: token})
+			if err != nil {
+				return nil, err
+			}
+			return []cmsAttribute{attr}, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if output == "pem" {
+		return pem.EncodeToMemory(&pem.Block{Type: "CMS", Bytes: msg}), nil
+	}
+	return msg, nil
+}
@@ -0,0 +1,266 @@
+//go:build windows
+
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"syscall"
+	"unsafe"
+
+	"github.com/manetu/security-token/config"
+)
+
+func init() {
+	RegisterBackend("cng", newCngBackend)
+}
+
+var (
+	ncrypt = syscall.NewLazyDLL("ncrypt.dll")
+
+	ncryptOpenStorageProvider = ncrypt.NewProc("NCryptOpenStorageProvider")
+	ncryptCreatePersistedKey  = ncrypt.NewProc("NCryptCreatePersistedKey")
+	ncryptFinalizeKey         = ncrypt.NewProc("NCryptFinalizeKey")
+	ncryptOpenKey             = ncrypt.NewProc("NCryptOpenKey")
+	ncryptExportKey           = ncrypt.NewProc("NCryptExportKey")
+	ncryptSignHash            = ncrypt.NewProc("NCryptSignHash")
+	ncryptDeleteKey           = ncrypt.NewProc("NCryptDeleteKey")
+	ncryptFreeObject          = ncrypt.NewProc("NCryptFreeObject")
+)
+
+const (
+	cngDefaultProvider = "Microsoft Software Key Storage Provider"
+	cngMachineKeyFlag  = 0x20
+	cngEccP256Magic    = 0x31534345 // BCRYPT_ECDSA_PUBLIC_P256_MAGIC
+
+	nteBadKeyset = 0x80090016
+)
+
+// cngError is a SECURITY_STATUS returned by the NCrypt API
+type cngError uint32
+
+func (e cngError) Error() string {
+	return fmt.Sprintf("%v (0x%08x)", syscall.Errno(e), uint32(e))
+}
+
+func ncryptCall(proc *syscall.LazyProc, args ...uintptr) error {
+	r, _, _ := proc.Call(args...)
+	if r != 0 {
+		return cngError(r)
+	}
+	return nil
+}
+
+// cngBackend keeps non-exportable P-256 keys in a Windows CNG key storage provider, which may be the TPM backed
+// Microsoft Platform Crypto Provider.  Keys are named after the token id, and certificates are kept in a local
+// directory.
+type cngBackend struct {
+	provider uintptr
+	flags    uintptr
+	certs    certStore
+}
+
+func newCngBackend(cfg *config.Configuration) (Backend, error) {
+	c := cfg.Cng
+
+	name, err := syscall.UTF16PtrFromString(orDefault(c.Provider, cngDefaultProvider))
+	if err != nil {
+		return nil, err
+	}
+
+	certs, err := newFileCertStore(c.CertificatePath, "cng")
+	if err != nil {
+		return nil, err
+	}
+
+	b := &cngBackend{certs: certs}
+	if c.MachineKey {
+		b.flags = cngMachineKeyFlag
+	}
+
+	err = ncryptCall(ncryptOpenStorageProvider, uintptr(unsafe.Pointer(&b.provider)), uintptr(unsafe.Pointer(name)), 0)
+	if err != nil {
+		return nil, fmt.Errorf("error opening key storage provider: %w", err)
+	}
+
+	return b, nil
+}
+
+func cngKeyName(id []byte) string {
+	return "mst-" + hex.EncodeToString(id)
+}
+
+// openKey returns a handle to the persisted key for id, which the caller must free
+func (b *cngBackend) openKey(id []byte) (uintptr, error) {
+	name, err := syscall.UTF16PtrFromString(cngKeyName(id))
+	if err != nil {
+		return 0, err
+	}
+
+	var key uintptr
+	err = ncryptCall(ncryptOpenKey, b.provider, uintptr(unsafe.Pointer(&key)), uintptr(unsafe.Pointer(name)), 0, b.flags)
+	if err != nil {
+		return 0, err
+	}
+
+	return key, nil
+}
+
+// cngPublicKey exports the public half of key as a BCRYPT_ECCKEY_BLOB
+func cngPublicKey(key uintptr) (*ecdsa.PublicKey, error) {
+	blobType, err := syscall.UTF16PtrFromString("ECCPUBLICBLOB")
+	if err != nil {
+		return nil, err
+	}
+
+	var size uint32
+	blob := make([]byte, 8+64)
+	err = ncryptCall(ncryptExportKey, key, 0, uintptr(unsafe.Pointer(blobType)), 0,
+		uintptr(unsafe.Pointer(&blob[0])), uintptr(len(blob)), uintptr(unsafe.Pointer(&size)), 0)
+	if err != nil {
+		return nil, fmt.Errorf("error exporting public key: %w", err)
+	}
+
+	magic := uint32(blob[0]) | uint32(blob[1])<<8 | uint32(blob[2])<<16 | uint32(blob[3])<<24
+	if magic != cngEccP256Magic || size != uint32(len(blob)) {
+		return nil, errors.New("unexpected public key blob")
+	}
+
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(blob[8:40]),
+		Y:     new(big.Int).SetBytes(blob[40:72]),
+	}, nil
+}
+
+func (b *cngBackend) Generate(id []byte) (crypto.Signer, error) {
+	algorithm, err := syscall.UTF16PtrFromString("ECDSA_P256")
+	if err != nil {
+		return nil, err
+	}
+	name, err := syscall.UTF16PtrFromString(cngKeyName(id))
+	if err != nil {
+		return nil, err
+	}
+
+	// keys are not exportable unless an export policy is set before finalizing
+	var key uintptr
+	err = ncryptCall(ncryptCreatePersistedKey, b.provider, uintptr(unsafe.Pointer(&key)),
+		uintptr(unsafe.Pointer(algorithm)), uintptr(unsafe.Pointer(name)), 0, b.flags)
+	if err != nil {
+		return nil, fmt.Errorf("error creating key: %w", err)
+	}
+	defer ncryptFreeObject.Call(key)
+
+	err = ncryptCall(ncryptFinalizeKey, key, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error finalizing key: %w", err)
+	}
+
+	pub, err := cngPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cngSigner{backend: b, id: id, pub: pub}, nil
+}
+
+func (b *cngBackend) ImportCertificate(id []byte, cert *x509.Certificate) error {
+	return b.certs.Put(id, cert)
+}
+
+func (b *cngBackend) Certificates() ([]*x509.Certificate, error) {
+	return b.certs.List()
+}
+
+func (b *cngBackend) FindToken(id []byte) (*Token, error) {
+	cert, err := b.certs.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return nil, nil
+	}
+
+	return &Token{
+		Signer: &cngSigner{backend: b, id: id, pub: cert.PublicKey},
+		Cert:   cert,
+	}, nil
+}
+
+func (b *cngBackend) Delete(id []byte) error {
+	err := b.certs.Delete(id)
+	if err != nil {
+		return err
+	}
+
+	key, err := b.openKey(id)
+	var e cngError
+	if errors.As(err, &e) && e == nteBadKeyset {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// NCryptDeleteKey frees the handle when it succeeds
+	err = ncryptCall(ncryptDeleteKey, key, 0)
+	if err != nil {
+		ncryptFreeObject.Call(key)
+		return err
+	}
+
+	return nil
+}
+
+func (b *cngBackend) Close() error {
+	return ncryptCall(ncryptFreeObject, b.provider)
+}
+
+// cngSigner implements crypto.Signer by opening the persisted key for each signature
+type cngSigner struct {
+	backend *cngBackend
+	id      []byte
+	pub     crypto.PublicKey
+}
+
+func (s *cngSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *cngSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+	}
+	if len(digest) != crypto.SHA256.Size() {
+		return nil, errors.New("invalid digest length")
+	}
+
+	key, err := s.backend.openKey(s.id)
+	if err != nil {
+		return nil, fmt.Errorf("error opening key: %w", err)
+	}
+	defer ncryptFreeObject.Call(key)
+
+	var size uint32
+	raw := make([]byte, 64)
+	err = ncryptCall(ncryptSignHash, key, 0, uintptr(unsafe.Pointer(&digest[0])), uintptr(len(digest)),
+		uintptr(unsafe.Pointer(&raw[0])), uintptr(len(raw)), uintptr(unsafe.Pointer(&size)), 0)
+	if err != nil {
+		return nil, fmt.Errorf("error signing: %w", err)
+	}
+
+	// CNG returns the r||s encoding, whereas crypto.Signer requires DER
+	return derSignature(raw[:size])
+}
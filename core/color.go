@@ -0,0 +1,59 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"os"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// expiringWithin is the remaining validity below which list highlights a certificate as expiring
+const expiringWithin = 30 * 24 * time.Hour
+
+const (
+	ansiRed   = "\033[31m"
+	ansiReset = "\033[0m"
+)
+
+// SetColor enables color output, which is only ever written to a terminal
+func (c *Core) SetColor(enabled bool) {
+	c.color = enabled
+}
+
+// useColor reports whether color may be written to f
+func (c *Core) useColor(f *os.File) bool {
+	return c.color && terminal.IsTerminal(int(f.Fd()))
+}
+
+// FormatError returns the message of err, in red when stderr is a terminal and color is enabled
+func (c *Core) FormatError(err error) string {
+	if !c.useColor(os.Stderr) {
+		return err.Error()
+	}
+	return ansiRed + err.Error() + ansiReset
+}
+
+// expiryColors returns the colors highlighting a table row for a certificate that has expired (red) or will expire
+// within expiringWithin (yellow), or nil
+func expiryColors(info *TokenInfo, columns int, now time.Time) []tablewriter.Colors {
+	var color int
+	switch {
+	case now.After(info.NotAfter):
+		color = tablewriter.FgRedColor
+	case now.Add(expiringWithin).After(info.NotAfter):
+		color = tablewriter.FgYellowColor
+	default:
+		return nil
+	}
+
+	colors := make([]tablewriter.Colors, columns)
+	for i := range colors {
+		colors[i] = tablewriter.Colors{color}
+	}
+	return colors
+}
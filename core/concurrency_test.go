@@ -0,0 +1,110 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core_test
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/manetu/security-token/core"
+	"github.com/manetu/security-token/testutil"
+)
+
+// TestConcurrentCore shares each Core between goroutines that Generate, Login and List at once, as the daemon modes
+// do, while others read the configuration file.  Run it with "go test -race" to check that the Core is safe to share.
+func TestConcurrentCore(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		core func() (*core.Core, error)
+	}{
+		{"memory", func() (*core.Core, error) { return core.NewWithBackend(core.NewMemoryBackend()), nil }},
+		{"simulated pkcs11", testutil.SimulatedCore},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+			err := os.MkdirAll(filepath.Join(home, ".manetu"), 0700)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(filepath.Join(home, ".manetu", "security-tokens.yml"), []byte("pkcs11:\n  tokenlabel: test\n"), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := testutil.NewTokenServer(t)
+
+			// List prints its tokens, which the test discards
+			stdout := os.Stdout
+			devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			os.Stdout = devnull
+			defer func() {
+				os.Stdout = stdout
+				_ = devnull.Close()
+			}()
+
+			c, err := tt.core()
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.SetQuiet(true)
+			defer c.Close()
+
+			const workers = 8
+			errs := make(chan error, 4*workers)
+			var wg sync.WaitGroup
+			for i := 0; i < workers; i++ {
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+
+					cert, err := c.Generate("acme")
+					if err != nil {
+						errs <- err
+						return
+					}
+					server.Register(cert)
+					jwt, err := c.LoginPKCS11(server.URL, false, core.HexEncode(cert.SerialNumber.Bytes()))
+					if err != nil {
+						errs <- err
+						return
+					}
+					if jwt != testutil.AccessToken(cert) {
+						t.Errorf("Login = %q; want %q", jwt, testutil.AccessToken(cert))
+					}
+					errs <- c.List(core.ListOptions{Output: "json"})
+				}()
+				go func() {
+					defer wg.Done()
+
+					// reads the configuration file, which holds no webhooks
+					err := c.WebhookTest()
+					if core.ExitCode(err) != core.ExitConfig {
+						t.Errorf("WebhookTest = %v; want exit code %d", err, core.ExitConfig)
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Error(err)
+				}
+			}
+
+			serials, err := c.Serials()
+			if err != nil || len(serials) != workers {
+				t.Errorf("Serials = %d serials, %v; want %d", len(serials), err, workers)
+			}
+			if server.Logins() != workers {
+				t.Errorf("the token endpoint granted %d logins; want %d", server.Logins(), workers)
+			}
+		})
+	}
+}
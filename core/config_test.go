@@ -0,0 +1,69 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// TestDecodePIN decodes the PINs of the configuration file, of PKCS#11 tokens and of PIV cards, into the bytes of their
+// text, however YAML parses them
+func TestDecodePIN(t *testing.T) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	defer viper.Reset()
+
+	for _, tt := range []struct {
+		yaml string
+		want string
+	}{
+		{"pkcs11:\n  pin: \"0042\"\n", "0042"},
+		{"pkcs11:\n  pin: 1234\n", "1234"},
+		{"pkcs11:\n  pin: a,b\n", "a,b"},
+		{"pkcs11:\n  tokenlabel: test\n", ""},
+		{"pkcs11:\n  pin: \"1234\"\n  replicas:\n    - pin: 5678\n", "1234"},
+		{"pkcs11:\n  pin: \"0042\"\npiv:\n  pin: 123456\n", "0042"},
+	} {
+		viper.Reset()
+		viper.SetConfigType("yaml")
+		err := viper.ReadConfig(strings.NewReader(tt.yaml))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := decodeConfiguration("")
+		if err != nil {
+			t.Errorf("%q: %v", tt.yaml, err)
+			continue
+		}
+		if string(cfg.Pkcs11.Pin) != tt.want {
+			t.Errorf("%q: pin = %q; want %q", tt.yaml, cfg.Pkcs11.Pin, tt.want)
+		}
+		if len(cfg.Pkcs11.Replicas) > 0 && string(cfg.Pkcs11.Replicas[0].Pin) != "5678" {
+			t.Errorf("%q: pin of the replica = %q; want %q", tt.yaml, cfg.Pkcs11.Replicas[0].Pin, "5678")
+		}
+		if len(cfg.Piv.Pin) > 0 && string(cfg.Piv.Pin) != "123456" {
+			t.Errorf("%q: pin of the PIV card = %q; want %q", tt.yaml, cfg.Piv.Pin, "123456")
+		}
+	}
+}
+
+// TestSecretString views a PIN as a string that is zeroized along with it
+func TestSecretString(t *testing.T) {
+	pin := []byte("1234")
+	s := secretString(pin)
+	if s != "1234" {
+		t.Errorf("secretString = %q; want %q", s, "1234")
+	}
+	Zeroize(pin)
+	if s != "\x00\x00\x00\x00" {
+		t.Errorf("secretString after Zeroize = %q; want the zeroized PIN", s)
+	}
+	if secretString(nil) != "" {
+		t.Error("secretString of no PIN is not empty")
+	}
+}
@@ -5,11 +5,13 @@ Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
 package core
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -17,18 +19,23 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"math/big"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/ThalesIgnite/crypto11"
-	"github.com/olekukonko/tablewriter"
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ssh/terminal"
 	"software.sslmate.com/src/go-pkcs12"
 
 	"github.com/manetu/security-token/config"
@@ -63,6 +70,30 @@ func HexEncode(b []byte) string {
 	return buf.String()
 }
 
+// normalizeSerial returns serial as uppercase hex without colons, accepting it as pasted from other tools: in either
+// case, with or without colons, prefixed with 0x and surrounded by whitespace
+func normalizeSerial(serial string) string {
+	serial = strings.TrimSpace(serial)
+	if strings.HasPrefix(serial, "0x") || strings.HasPrefix(serial, "0X") {
+		serial = serial[2:]
+	}
+	return strings.ToUpper(strings.ReplaceAll(serial, ":", ""))
+}
+
+// decimalSerial parses serial as a decimal integer, returning nil unless it is made of digits alone: colons or a 0x
+// prefix mark it as hex
+func decimalSerial(serial string) *big.Int {
+	serial = strings.TrimSpace(serial)
+	if serial == "" || strings.Trim(serial, "0123456789") != "" {
+		return nil
+	}
+	n, ok := new(big.Int).SetString(serial, 10)
+	if !ok {
+		return nil
+	}
+	return n
+}
+
 func importHexencode(serial string) []byte {
 	reg, err := regexp.Compile(":")
 	Check(err)
@@ -79,10 +110,40 @@ func ExportCert(cert *x509.Certificate) string {
 	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
 }
 
+// Core performs the operations of the security token against the configured keystore.  Once configured, a Core may be
+// shared by goroutines, as the daemon modes do: its operations, such as Generate, Sign, CheckToken and the Login
+// methods, are safe to call concurrently, and several Cores may be used at once.  The methods configuring it,
+// UseProfile, UseBackend and the Set methods, are not, and must be called before it is shared; nor may Close be called
+// while operations are under way.
 type Core struct {
 	sync.Mutex
 	configuration config.Configuration
-	pkcs11Ctx     *crypto11.Context
+	// configured is set once configuration has been read from the configuration file
+	configured  bool
+	profile     string
+	backendName string
+	quiet       bool
+	dryRun      bool
+	interactive bool
+	fips        bool
+	clock       Clock
+	color       bool
+	backend     Backend
+	stdin       []byte
+	auditPath   string
+	auditSet    bool
+	// settingsLoaded is set once loadSettings has read the configuration
+	settingsLoaded bool
+	metricsAddr    string
+	pprofAddr      string
+	metrics        *metricsRegistry
+	tracerProvider trace.TracerProvider
+	policyPath     string
+	policySet      bool
+	policy         *Policy
+	rotation       RotationOptions
+	// assertionDigest is the digest of the assertions of login, or zero for that matched to the key
+	assertionDigest crypto.Hash
 }
 
 func New() *Core {
@@ -91,14 +152,72 @@ func New() *Core {
 	return core
 }
 
-// get crypto config on need and store it
-func (c *Core) getCryptoCtx() *crypto11.Context {
-	c.Lock()
-	defer c.Unlock()
+// NewWithBackend returns a Core using the given keystore rather than one selected by the configuration file, such
+// as the memory backend in tests.  Such a Core keeps no audit log unless given one with SetAuditLog, and applies no
+// policy unless given one with SetPolicy.
+func NewWithBackend(backend Backend) *Core {
+	return &Core{backend: backend, auditSet: true, policySet: true}
+}
+
+// UseProfile selects a named profile whose settings override the top-level configuration
+func (c *Core) UseProfile(profile string) {
+	c.profile = profile
+}
+
+// UseBackend selects the keystore backend by name, overriding the backend set by the configuration file or profile
+func (c *Core) UseBackend(name string) {
+	c.backendName = name
+}
+
+// SetQuiet suppresses decorative output, leaving only the essential result of each command
+func (c *Core) SetQuiet(quiet bool) {
+	c.quiet = quiet
+}
 
-	if c.pkcs11Ctx != nil {
-		return c.pkcs11Ctx
+// SetAssertionDigest selects the digest with which login signs its assertions: "sha256", "sha384" or "sha512".  RSA
+// keys may sign with any; EC keys sign with that matched to their curve, which is also the default.
+func (c *Core) SetAssertionDigest(name string) error {
+	if name == "" {
+		c.assertionDigest = 0
+		return nil
+	}
+	hash, err := signDigest(name, nil)
+	if err != nil {
+		return err
 	}
+	c.assertionDigest = hash
+	return nil
+}
+
+// SetInteractive allows a command given no serial, and with no default token, to ask the user to choose among several
+// tokens with a picker on the terminal.  It is off by default, so that programs using the core never have the terminal
+// switched to raw mode beneath them, and the daemon modes turn it off whatever was set.
+func (c *Core) SetInteractive(interactive bool) {
+	c.interactive = interactive
+}
+
+// SetDryRun makes mutating operations report the objects they would create or remove, without touching the keystore
+func (c *Core) SetDryRun(dryRun bool) {
+	c.dryRun = dryRun
+}
+
+// printPlan reports the objects that an operation would create or remove in dry-run mode
+func printPlan(action string, objects []string) {
+	fmt.Printf("Would %s:\n", action)
+	for _, o := range objects {
+		fmt.Printf("  %s\n", o)
+	}
+}
+
+// configMu serializes the use of the global viper instance, which is not safe for concurrent use, so that several
+// Cores may read the configuration file at once
+var configMu sync.Mutex
+
+// loadConfig reads the security-tokens configuration file into c.configuration, applying the selected profile.  c must
+// be locked; readConfig locks it.
+func (c *Core) loadConfig() error {
+	configMu.Lock()
+	defer configMu.Unlock()
 
 	viper.SetConfigName("security-tokens")
 	viper.AddConfigPath(".")
@@ -106,135 +225,622 @@ func (c *Core) getCryptoCtx() *crypto11.Context {
 	viper.AddConfigPath("/etc/manetu/")
 
 	err := viper.ReadInConfig()
-	Check(err)
+	if err != nil {
+		return err
+	}
+
+	c.configuration, err = decodeConfiguration(c.profile)
+	c.configured = err == nil
+	return err
+}
 
-	err = viper.Unmarshal(&c.configuration)
+// readConfig is loadConfig for callers not holding the lock of c, returning a copy of the configuration read
+func (c *Core) readConfig() (config.Configuration, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	err := c.loadConfig()
+	return c.configuration, err
+}
+
+// loadSettings reads the configuration file, if present and not yet read, for the settings that apply without the
+// keystore, such as the audit log, the clock, FIPS mode and HTTP/2 for logins, to operations such as PEM logins that
+// never open it
+func (c *Core) loadSettings() {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.backend == nil && !c.settingsLoaded {
+		_ = c.loadConfig()
+	}
+	c.settingsLoaded = true
+}
+
+// configFileUsed returns the path of the configuration file last read
+func configFileUsed() string {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	return viper.ConfigFileUsed()
+}
+
+// profileConfiguration decodes the configuration file that has been read, applying the named profile, if any
+func profileConfiguration(profile string) (config.Configuration, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	return decodeConfiguration(profile)
+}
+
+// decodeConfiguration is profileConfiguration with configMu held
+func decodeConfiguration(profile string) (config.Configuration, error) {
+	var cfg config.Configuration
+	err := viper.Unmarshal(&cfg, decodeSecrets)
 	if err != nil {
-		log.Fatalf("unable to decode into struct, %v", err)
+		return cfg, fmt.Errorf("unable to decode into struct, %w", err)
 	}
 
-	// Configure PKCS#11 library via configuration file
-	c.pkcs11Ctx, err = crypto11.Configure(&crypto11.Config{
-		Path:       c.configuration.Pkcs11.Path,
-		TokenLabel: c.configuration.Pkcs11.TokenLabel,
-		Pin:        c.configuration.Pkcs11.Pin,
-	})
+	if profile != "" {
+		sub := viper.Sub("profiles." + profile)
+		if sub == nil {
+			return cfg, fmt.Errorf("profile %q not found in %s", profile, viper.ConfigFileUsed())
+		}
 
-	Check(err)
+		err = sub.Unmarshal(&cfg, decodeSecrets)
+		if err != nil {
+			return cfg, fmt.Errorf("unable to decode profile %q into struct, %w", profile, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// decodeSecrets adds secretBytesHook ahead of the decode hooks of viper
+var decodeSecrets = viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+	secretBytesHook,
+	mapstructure.StringToTimeDurationHookFunc(),
+	mapstructure.StringToSliceHookFunc(","),
+))
+
+// secretBytesHook decodes a PIN, which YAML parses as a string or a number, into the bytes of its text
+func secretBytesHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != reflect.TypeOf([]byte(nil)) || from.Kind() == reflect.Slice {
+		return data, nil
+	}
+	return []byte(fmt.Sprint(data)), nil
+}
+
+// get the keystore backend on need and store it
+func (c *Core) getBackend() Backend {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.backend != nil {
+		return c.backend
+	}
+
+	err := c.loadConfig()
+	Check(classify(ExitConfig, err))
+
+	name := c.configuration.Backend
+	if c.backendName != "" {
+		name = c.backendName
+	}
 
-	fmt.Fprintf(os.Stderr, "Using config file: %s\n", viper.ConfigFileUsed())
+	c.backend, err = newBackend(name, &c.configuration)
+	Check(classify(ExitUnreachable, err))
 
-	return c.pkcs11Ctx
+	if !c.quiet {
+		fmt.Fprintf(os.Stderr, "Using config file: %s\n", configFileUsed())
+	}
+
+	return c.backend
 }
 
 func (c *Core) Close() error {
 	c.Lock()
 	defer c.Unlock()
 
-	if c.pkcs11Ctx == nil {
+	if c.backend == nil {
 		return nil
 	}
 
-	return c.pkcs11Ctx.Close()
+	return c.backend.Close()
 }
 
 type Token struct {
-	Signer crypto11.Signer
+	Signer crypto.Signer
 	Cert   *x509.Certificate
 }
 
+// getToken returns the token identified by serial or, when serial is empty, the default token recorded by Use.  Failing
+// both, the only token is used, or else the user is asked to choose one when interactive.  In FIPS mode, a token whose
+// key is not approved is refused, and the signer of any other refuses digests that are not.
 func (c *Core) getToken(serial string) (*Token, error) {
+	start := time.Now()
+	token, err := c.lookupToken(serial)
+	if err != nil {
+		logDebug("finding the token", "serial", serial, "duration", time.Since(start), "error", err)
+		return nil, err
+	}
+	logDebug("found the token", "serial", HexEncode(token.Cert.SerialNumber.Bytes()), "duration", time.Since(start))
+	return c.fipsToken(token)
+}
+
+func (c *Core) lookupToken(serial string) (*Token, error) {
 
 	var id []byte
 
+	isDefault := false
 	if serial == "" {
-		certs, err := c.getCryptoCtx().FindAllPairedCertificates()
+		def, err := c.DefaultToken()
+		if err != nil {
+			return nil, err
+		}
+		serial = def
+		isDefault = serial != ""
+	}
+
+	if serial == "" {
+		certs, err := c.getBackend().Certificates()
 		if err != nil {
 			return nil, err
 		}
 
 		if len(certs) < 1 {
-			return nil, errors.New("no security-tokens found")
+			return nil, classify(ExitNotFound, errors.New("no security-tokens found"))
 		}
 
-		id = certs[0].Leaf.SerialNumber.Bytes()
+		cert, err := c.selectToken(certs)
+		if err != nil {
+			return nil, err
+		}
+		id = cert.SerialNumber.Bytes()
 	} else {
-		id = importHexencode(serial)
+		return c.findToken(serial, isDefault)
 	}
 
-	signer, err := c.getCryptoCtx().FindKeyPair(id, nil)
+	token, err := c.getBackend().FindToken(id)
 	if err != nil {
 		return nil, err
 	}
-	if signer == nil {
-		return nil, errors.New("invalid serial number")
+	if token == nil {
+		return nil, classify(ExitNotFound, errors.New("invalid serial number"))
+	}
+
+	return token, nil
+}
+
+// findToken returns the token whose serial is serial or, failing an exact match, begins with serial, in the manner of
+// git short hashes.  Case and colons are ignored, so that "3efd" matches "3E:FD:B0:...".
+func (c *Core) findToken(serial string, isDefault bool) (*Token, error) {
+	prefix := normalizeSerial(serial)
+	if prefix == "" || strings.Trim(prefix, "0123456789ABCDEF") != "" {
+		return c.findLabeledToken(serial)
+	}
+
+	var token *Token
+	if len(prefix)%2 == 0 {
+		var err error
+		token, err = c.getBackend().FindToken(importHexencode(prefix))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if token == nil && !isDefault {
+		certs, err := c.getBackend().Certificates()
+		if err != nil {
+			return nil, err
+		}
+
+		var matches []string
+		var id []byte
+		for _, cert := range certs {
+			name := HexEncode(cert.SerialNumber.Bytes())
+			if strings.HasPrefix(strings.ReplaceAll(name, ":", ""), prefix) {
+				matches = append(matches, name)
+				id = cert.SerialNumber.Bytes()
+			}
+		}
+
+		switch {
+		case len(matches) > 1:
+			return nil, classify(ExitNotFound, fmt.Errorf("serial prefix %s matches %d security tokens: %s",
+				serial, len(matches), strings.Join(matches, ", ")))
+		case len(matches) == 1:
+			token, err = c.getBackend().FindToken(id)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	cert, err := c.getCryptoCtx().FindCertificate(id, nil, nil)
+	// digits alone that name no token in hex may be the serial number in decimal, which must then be given in full
+	if n := decimalSerial(serial); token == nil && n != nil {
+		var err error
+		token, err = c.getBackend().FindToken(n.Bytes())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if token == nil && isDefault {
+		return nil, classify(ExitNotFound, fmt.Errorf("default token %s not found; select another with use", serial))
+	}
+	if token == nil {
+		return c.findLabeledToken(serial)
+	}
+
+	return token, nil
+}
+
+// findLabeledToken returns the token labelled label, which must be the label of one token alone
+func (c *Core) findLabeledToken(label string) (*Token, error) {
+	labels, err := tokenLabels(c.getBackend())
 	if err != nil {
 		return nil, err
 	}
-	if cert == nil {
-		return nil, errors.New("certificate not found")
+
+	var ids []string
+	for id, l := range labels {
+		if l == label {
+			ids = append(ids, id)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return nil, classify(ExitNotFound, fmt.Errorf("invalid serial number %q", label))
+	case 1:
+	default:
+		return nil, classify(ExitNotFound, fmt.Errorf("label %q names %d security tokens; give the serial instead", label, len(ids)))
 	}
 
-	return &Token{
-		Signer: signer,
-		Cert:   cert,
-	}, nil
+	id, err := hex.DecodeString(ids[0])
+	if err != nil {
+		return nil, err
+	}
+	token, err := c.getBackend().FindToken(id)
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, classify(ExitNotFound, fmt.Errorf("the token labelled %q has no certificate", label))
+	}
+	return token, nil
 }
 
-func (c *Core) Show(serial string) error {
+// Show displays the certificate of the token as PEM, or as JSON when output is "json"
+func (c *Core) Show(serial string, output string) error {
+	err := checkOutput(output, "pem", "json", "text")
+	if err != nil {
+		return err
+	}
+
 	token, err := c.getToken(serial)
 	if err != nil {
 		return err
 	}
 
+	switch output {
+	case "json":
+		info := NewTokenInfo(token.Cert)
+		info.Certificate = ExportCert(token.Cert)
+		info.Label = tokenLabel(c.getBackend(), token.Cert)
+		return writeJSON(info)
+	case "text":
+		writeText(os.Stdout, token.Cert)
+		return nil
+	}
+
+	if !c.quiet {
+		info := NewTokenInfo(token.Cert)
+		fmt.Fprintf(os.Stderr, "SHA256 Fingerprint: %s\n", info.Fingerprints.SHA256)
+		fmt.Fprintf(os.Stderr, "SHA1 Fingerprint: %s\n", info.Fingerprints.SHA1)
+	}
+
 	fmt.Printf("%s\n", ExportCert(token.Cert))
 	return nil
 }
 
-func (c *Core) List() error {
-	certs, err := c.getCryptoCtx().FindAllPairedCertificates()
+// ListOptions controls the output of List
+type ListOptions struct {
+	// Output is one of "table" (the default), "json" or "csv"
+	Output string
+	// Columns selects the columns of table or CSV output, defaulting to serial, realm, mrn and notBefore for a table and
+	// to all columns for CSV
+	Columns []string
+	// Realm, when set, lists only tokens issued for the realm
+	Realm string
+	// ExpiresWithin, when set, lists only tokens that expire within the duration, including those already expired
+	ExpiresWithin time.Duration
+	// KeyType, when set, lists only tokens with keys of the type: "ec", "rsa" or "ed25519"
+	KeyType string
+	// Sort orders the tokens by "created" (the default), "expiry", "provider" or "serial"
+	Sort string
+	// Reverse inverts the order
+	Reverse bool
+	// Fingerprints adds the SHA-256 and SHA-1 fingerprints to the columns
+	Fingerprints bool
+}
+
+// List enumerates the tokens in the requested format
+func (c *Core) List(opts ListOptions) error {
+	if opts.Output == "" {
+		opts.Output = "table"
+	}
+	err := checkOutput(opts.Output, "table", "json", "csv")
+	if err != nil {
+		return err
+	}
+
+	names := opts.Columns
+	if opts.Output == "table" && len(names) == 0 {
+		names = defaultTableColumns
+	}
+	columns, err := selectColumns(names)
+	if err != nil {
+		return err
+	}
+	if opts.Fingerprints {
+		for _, name := range []string{"sha256", "sha1"} {
+			if !hasColumn(columns, name) {
+				col, _ := selectColumns([]string{name})
+				columns = append(columns, col...)
+			}
+		}
+	}
+
+	err = checkKeyType(opts.KeyType)
+	if err != nil {
+		return err
+	}
+
+	if opts.Sort == "" {
+		opts.Sort = "created"
+	}
+	err = checkSort(opts.Sort)
+	if err != nil {
+		return err
+	}
+
+	backend := c.getBackend()
+	tick, stop := c.startCounter("Enumerating security tokens...")
+	certs, err := streamCertificates(backend, func(*x509.Certificate) { tick() })
+	stop()
 	if err != nil {
 		return err
 	}
+	certs = filterCertificates(certs, &opts)
+	sortCertificates(certs, opts.Sort, opts.Reverse)
 
-	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"Serial", "Realm", "Created"})
+	if !c.quiet {
+		for _, cert := range certs {
+			if warning := foreignCertificate(cert); warning != "" {
+				fmt.Fprintf(os.Stderr, "WARNING: %s: %s\n", HexEncode(cert.SerialNumber.Bytes()), warning)
+			}
+		}
+	}
 
-	for _, x := range certs {
-		cert := x.Leaf
-		// there may multiple realms in future ?
-		realms := cert.Subject.Organization[0]
-		for i := 1; i < len(cert.Subject.Organization); i++ {
-			realms += "," + cert.Subject.Organization[i]
+	if c.quiet && opts.Output == "table" {
+		for _, cert := range certs {
+			fmt.Println(HexEncode(cert.SerialNumber.Bytes()))
 		}
-		table.Append([]string{HexEncode(cert.SerialNumber.Bytes()), realms, cert.NotBefore.String()})
+		return nil
 	}
-	table.Render() // Send output
+
+	var labels map[string]string
+	if opts.Output == "json" || hasColumn(columns, "label") {
+		labels, err = tokenLabels(backend)
+		if err != nil {
+			return err
+		}
+	}
+
+	infos := make([]TokenInfo, 0, len(certs))
+	for _, cert := range certs {
+		info := NewTokenInfo(cert)
+		info.Label = labels[hex.EncodeToString(cert.SerialNumber.Bytes())]
+		infos = append(infos, info)
+	}
+
+	switch opts.Output {
+	case "csv":
+		return writeCSV(infos, columns)
+	case "json":
+		return writeJSON(infos)
+	}
+
+	writeTable(infos, columns, c.useColor(os.Stdout))
 	return nil
 }
 
-// ComputeMRN computes MRN given certificate
+// Serials returns the serial numbers of all tokens, for shell completion
+func (c *Core) Serials() ([]string, error) {
+	certs, err := c.getBackend().Certificates()
+	if err != nil {
+		return nil, err
+	}
+
+	serials := make([]string, 0, len(certs))
+	for _, cert := range certs {
+		serials = append(serials, HexEncode(cert.SerialNumber.Bytes()))
+	}
+	return serials, nil
+}
+
+// Labels returns the labels of all labelled tokens, for shell completion
+func (c *Core) Labels() ([]string, error) {
+	labels, err := tokenLabels(c.getBackend())
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]string, 0, len(labels))
+	for _, label := range labels {
+		values = append(values, label)
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// Realms returns the distinct realms of all tokens, for shell completion
+func (c *Core) Realms() ([]string, error) {
+	certs, err := c.getBackend().Certificates()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var realms []string
+	for _, cert := range certs {
+		for _, org := range cert.Subject.Organization {
+			if !seen[org] {
+				seen[org] = true
+				realms = append(realms, org)
+			}
+		}
+	}
+	return realms, nil
+}
+
+// ComputeMRN computes MRN given certificate, or returns "" for a foreign certificate, such as another application's
+// on a shared token, whose subject has no organization to identify the realm
 func ComputeMRN(cert *x509.Certificate) string {
+	if len(cert.Subject.Organization) == 0 {
+		return ""
+	}
 	hash := sha256.Sum256(cert.Raw)
 	return "mrn:iam:" + cert.Subject.Organization[0] + ":identity:" + hex.EncodeToString(hash[:])
 }
 
+// MRN computes the MRN of the token identified by serial or, when certPath is set, of the PEM encoded certificate
+// within the file
+func (c *Core) MRN(serial string, certPath string) (string, error) {
+	cert, err := c.tokenOrCert(serial, certPath)
+	if err != nil {
+		return "", err
+	}
+
+	if len(cert.Subject.Organization) == 0 {
+		return "", errors.New("certificate subject has no organization to identify the realm")
+	}
+
+	return ComputeMRN(cert), nil
+}
+
+// tokenOrCert returns the certificate of the token identified by serial or, when certPath is set, the PEM encoded
+// certificate within the file
+func (c *Core) tokenOrCert(serial string, certPath string) (*x509.Certificate, error) {
+	if certPath == "" {
+		token, err := c.getToken(serial)
+		if err != nil {
+			return nil, err
+		}
+		return token.Cert, nil
+	}
+
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := parseCertPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", certPath, err)
+	}
+	return cert, nil
+}
+
+// Generate creates a new token for realm.  In dry-run mode, it reports the objects that would be created and returns
+// a nil certificate.
 func (c *Core) Generate(realm string) (*x509.Certificate, error) {
+	return c.GenerateValidFor(realm, 0)
+}
+
+// GenerateValidFor is Generate issuing the certificate of the token for validity, or for the default of ten years,
+// limited by the policy, when zero
+func (c *Core) GenerateValidFor(realm string, validity time.Duration) (*x509.Certificate, error) {
+	return c.GenerateLabeled(realm, "", validity)
+}
+
+// GenerateLabeled is GenerateValidFor labelling the key pair of the token with label, its CKA_LABEL, by which it may
+// then be selected in place of its serial.  Backends without labels refuse a label.
+func (c *Core) GenerateLabeled(realm string, label string, validity time.Duration) (*x509.Certificate, error) {
+	backend := c.getBackend()
+	if _, ok := backend.(labeler); label != "" && !ok {
+		return nil, classify(ExitConfig, errors.New("the keystore cannot label tokens"))
+	}
+	err := c.checkPolicy(PolicyGenerate, realm)
+	if err != nil {
+		return nil, err
+	}
+	err = c.checkLabel(label)
+	if err != nil {
+		return nil, err
+	}
+	validity, err = c.checkValidity(validity)
+	if err != nil {
+		return nil, err
+	}
+
+	clock, err := c.getClock()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.dryRun {
+		printPlan(fmt.Sprintf("create a token for realm %q, valid for %s", realm, validity),
+			describeObjects(backend, nil))
+		return nil, nil
+	}
+
+	stop := c.startSpinner("Generating key pair...")
+	defer stop()
+
+	start := time.Now()
+	cert, err := generateToken(backend, realm, label, validity, clock)
+	c.auditSince("generate", cert, start, err)
+	if err == nil {
+		c.notify(WebhookTokenCreated, cert)
+	}
+	return cert, err
+}
+
+// generateToken creates a new key pair within backend, labelled with label where the backend labels tokens, along
+// with a self-signed certificate for realm, valid for validity from the time of clock
+func generateToken(backend Backend, realm string, label string, validity time.Duration, clock Clock) (*x509.Certificate, error) {
 	id, err := randomID()
 	if err != nil {
 		return nil, err
 	}
 
-	signer, err := c.getCryptoCtx().GenerateECDSAKeyPair(id, elliptic.P256())
+	var signer crypto.Signer
+	if l, ok := backend.(labeler); ok && label != "" {
+		signer, err = l.GenerateLabeled(id, label)
+	} else {
+		signer, err = backend.Generate(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := selfSignToken(signer, id, realm, validity, clock)
+	if err != nil {
+		return nil, err
+	}
+
+	err = backend.ImportCertificate(id, cert)
 	if err != nil {
 		return nil, err
 	}
 
-	now := time.Now()
-	duration := time.Hour * 24 * 3650
+	return cert, nil
+}
+
+// selfSignToken issues the self-signed certificate of the token id for realm, whose serial number is the id, valid for
+// validity from the time of clock
+func selfSignToken(signer crypto.Signer, id []byte, realm string, validity time.Duration, clock Clock) (*x509.Certificate, error) {
+	now := clock.Now()
 	template := x509.Certificate{
 		SerialNumber: new(big.Int).SetBytes(id),
 		Subject: pkix.Name{
@@ -242,7 +848,7 @@ func (c *Core) Generate(realm string) (*x509.Certificate, error) {
 			SerialNumber: HexEncode(id),
 		},
 		NotBefore:             now,
-		NotAfter:              now.Add(duration),
+		NotAfter:              now.Add(validity),
 		BasicConstraintsValid: true,
 		IsCA:                  false,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
@@ -251,12 +857,12 @@ func (c *Core) Generate(realm string) (*x509.Certificate, error) {
 
 	der, err := x509.CreateCertificate(rand.Reader, &template, &template, signer.Public(), signer)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error signing the certificate of serial %s: %w", HexEncode(id), err)
 	}
 
 	cert, err := x509.ParseCertificate(der)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error parsing the certificate of serial %s: %w", HexEncode(id), err)
 	}
 
 	cp := x509.NewCertPool()
@@ -269,113 +875,257 @@ func (c *Core) Generate(realm string) (*x509.Certificate, error) {
 		return nil, err
 	}
 
-	err = c.getCryptoCtx().ImportCertificate(id, cert)
-	if err != nil {
-		return nil, err
+	return cert, nil
+}
+
+// confirm asks the user a yes/no question on the terminal, refusing when there is no terminal to ask
+func confirm(question string) (bool, error) {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return false, errors.New("confirmation required; use --force when not running interactively")
 	}
 
-	return cert, nil
+	fmt.Fprintf(os.Stderr, "%s [y/N]: ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
 }
 
-func (c *Core) Delete(serial string) error {
-	id := importHexencode(serial)
+// Login acquires an access token for the identity of cert, whose private key is held by signer.  When x5c is given,
+// the login assertion carries those certificates, leaf first, within its x5c header.
+func (c *Core) Login(tokenUrl string, insecure bool, signer crypto.Signer, cert *x509.Certificate, x5c ...*x509.Certificate) (string, error) {
+	return c.LoginContext(context.Background(), tokenUrl, insecure, signer, cert, x5c...)
+}
 
-	err := c.getCryptoCtx().DeleteCertificate(id, nil, nil)
-	if err != nil {
-		return err
+// LoginContext is Login recording its span, and that of the token request, within the trace of ctx
+func (c *Core) LoginContext(ctx context.Context, tokenUrl string, insecure bool, signer crypto.Signer, cert *x509.Certificate, x5c ...*x509.Certificate) (jwt string, err error) {
+	ctx, span := c.tracer().Start(ctx, "login")
+	if ts, ok := signer.(*tracedSigner); ok {
+		// nest the signature of the assertion within the login
+		ts.ctx = ctx
 	}
+	start := time.Now()
+	defer func() {
+		endSpan(span, err)
+		c.auditSince("login", cert, start, err)
+
+		result := "ok"
+		if err != nil {
+			result = "failed"
+		}
+		c.metrics.observe("manetu_login_duration_seconds", labels("result", result), start)
+	}()
 
-	signer, err := c.getCryptoCtx().FindKeyPair(id, nil)
+	clock, err := c.getClock()
 	if err != nil {
-		return err
+		return "", err
 	}
-
-	if signer == nil {
-		_, _ = fmt.Fprint(os.Stderr, "ERROR: Invalid serial number")
-		return nil
+	now := clock.Now()
+	if now.After(cert.NotAfter) {
+		return "", classify(ExitExpired, fmt.Errorf("certificate expired at %s", cert.NotAfter.UTC().Format(time.RFC3339)))
+	}
+	if now.Before(cert.NotBefore) {
+		return "", classify(ExitExpired, fmt.Errorf("certificate is not valid until %s", cert.NotBefore.UTC().Format(time.RFC3339)))
 	}
 
-	return signer.Delete()
-}
+	err = c.checkFIPSKey(cert.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	if c.assertionDigest != 0 {
+		err = c.checkFIPSDigest(c.assertionDigest)
+		if err != nil {
+			return "", err
+		}
+	}
 
-func (c *Core) Login(tokenUrl string, insecure bool, signer crypto.Signer, cert *x509.Certificate) (string, error) {
 	mrn := ComputeMRN(cert)
-	tokenUrl, err := url.JoinPath(tokenUrl, "/oauth/token")
+	span.SetAttributes(attribute.String("manetu.mrn", mrn))
+	tokenUrl, err = url.JoinPath(tokenUrl, "/oauth/token")
 	if err != nil {
 		return "", err
 	}
-	cajwt, err := createJWT(signer, mrn, tokenUrl)
+	cajwt, err := createJWT(clock, signer, c.assertionDigest, mrn, tokenUrl, x5c...)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("signing the login assertion: %w", err)
 	}
 
-	jwt, err := login(cajwt, mrn, tokenUrl, insecure)
+	jwt, err = login(ctx, cajwt, mrn, tokenUrl, insecure, c.loginHTTP2())
 	if err != nil {
-		return "", err
+		return "", classifyLogin(fmt.Errorf("requesting an access token: %w", err))
 	}
 
 	return jwt, err
 }
 
+// loginHTTP2 reports whether login negotiates HTTP/2 with the token endpoint, as set by login.http2 of the
+// configuration file.  It reads the configuration when that has not yet been done, so it must not be called with c
+// locked.
+func (c *Core) loginHTTP2() bool {
+	c.loadSettings()
+
+	c.Lock()
+	defer c.Unlock()
+
+	return c.configuration.Login.Http2
+}
+
 func (c *Core) LoginPKCS11(url string, insecure bool, serial string) (string, error) {
+	return c.LoginPKCS11Context(context.Background(), url, insecure, serial)
+}
+
+// LoginPKCS11Context is LoginPKCS11 recording spans of the token lookup and signature on the HSM, along with those of
+// LoginContext, within the trace of ctx
+func (c *Core) LoginPKCS11Context(ctx context.Context, url string, insecure bool, serial string) (string, error) {
+	tracer := c.tracer()
+	_, span := tracer.Start(ctx, "hsm.find_token")
 	token, err := c.getToken(serial)
+	endSpan(span, err)
 	if err != nil {
 		return "", err
 	}
 
-	return c.Login(url, insecure, token.Signer, token.Cert)
+	signer := &tracedSigner{Signer: token.Signer, ctx: ctx, tracer: tracer}
+	return c.LoginContext(ctx, url, insecure, signer, token.Cert)
 }
 
+// pathToBytes reads the file at path, or standard input when path is "-".  Standard input is read only once, so that
+// the key and certificate may be piped in together.
 func (c *Core) pathToBytes(path string) ([]byte, error) {
+	if path == "-" {
+		c.Lock()
+		defer c.Unlock()
+
+		if c.stdin == nil {
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return nil, fmt.Errorf("error reading stdin: %w", err)
+			}
+			c.stdin = data
+		}
+		return c.stdin, nil
+	}
 	return os.ReadFile(filepath.Clean(path))
 }
 
-func (c *Core) LoginX509(url string, insecure bool, key string, cert string, path bool) (string, error) {
+// lockInput locks data, a secret read by pathToBytes from path, returning a function that zeroizes it as LockSecret
+// does.  Standard input is then forgotten, so that no later read is handed the zeroized buffer.
+func (c *Core) lockInput(path string, data []byte) func() {
+	unlock := LockSecret(data)
+	if path != "-" {
+		return unlock
+	}
+	return func() {
+		unlock()
+
+		c.Lock()
+		c.stdin = nil
+		c.Unlock()
+	}
+}
+
+// decodePEMBlocks returns every PEM block within data whose type ends with suffix
+func decodePEMBlocks(data []byte, suffix string) []*pem.Block {
+	var blocks []*pem.Block
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return blocks
+		}
+		if strings.HasSuffix(block.Type, suffix) {
+			blocks = append(blocks, block)
+		}
+	}
+}
+
+// decodePEMBlock returns the first PEM block within data whose type ends with suffix, skipping any others, such as
+// the certificate when the key and certificate were read from the same input
+func decodePEMBlock(data []byte, suffix string) *pem.Block {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil || strings.HasSuffix(block.Type, suffix) {
+			return block
+		}
+	}
+}
+
+// X509LoginOptions selects the key and certificate used by LoginX509
+type X509LoginOptions struct {
+	// Key and Cert are PEM encoded, or paths to PEM files when Path is set.  "-" reads either from stdin.
+	Key  string
+	Cert string
+	Path bool
+	// Passphrase supplies the passphrase of an encrypted key
+	Passphrase PassphraseFunc
+	// Algorithm selects the signature of the assertion for an RSA key: "RS256" (the default) or "PS256"
+	Algorithm string
+	// Chain includes the certificates of Cert within the x5c header of the assertion, leaf first, for when Cert is a
+	// bundle of the leaf and its issuers
+	Chain bool
+}
+
+// LoginX509 logs in with a PEM encoded key and certificate
+func (c *Core) LoginX509(url string, insecure bool, opts X509LoginOptions) (string, error) {
 	var (
 		kBytes []byte
 		cBytes []byte
 		err    error
 	)
 
-	if path {
-		kBytes, err = c.pathToBytes(key)
-		if err != nil {
-			return "", err
-		}
-		cBytes, err = c.pathToBytes(cert)
-		if err != nil {
-			return "", err
+	switch opts.Algorithm {
+	case "", "RS256", "PS256":
+	default:
+		return "", fmt.Errorf("unknown algorithm %q (available: RS256, PS256)", opts.Algorithm)
+	}
+
+	// "-" reads from stdin even without --path, since it cannot be PEM
+	load := func(v string) ([]byte, error) {
+		if opts.Path || v == "-" {
+			return c.pathToBytes(v)
 		}
-	} else {
-		kBytes = []byte(key)
-		cBytes = []byte(cert)
+		return []byte(v), nil
+	}
+
+	kBytes, err = load(opts.Key)
+	if err != nil {
+		return "", err
+	}
+	defer c.lockInput(opts.Key, kBytes)()
+	cBytes, err = load(opts.Cert)
+	if err != nil {
+		return "", err
 	}
 
 	getSigner := func(key []byte) (crypto.Signer, error) {
-		block, _ := pem.Decode(key)
+		block := decodePEMBlock(key, "PRIVATE KEY")
 		if block == nil {
 			return nil, fmt.Errorf("error decoding key")
 		}
-
-		//try as EC block
-		signer, inerr := x509.ParseECPrivateKey(block.Bytes)
+		der, err := c.decryptPEMBlock(block, opts.Passphrase)
 		if err != nil {
-			return nil, fmt.Errorf("unsupported private key: %s", inerr)
+			return nil, err
 		}
+		defer LockSecret(der)()
+		defer LockSecret(block.Bytes)()
 
-		if signer == nil {
-			//fall back to generic
-			a, err := x509.ParsePKCS8PrivateKey(block.Bytes)
-			if err != nil {
-				return nil, err
-			}
-			var (
-				ok bool
-			)
+		signer, err := parsePrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
 
-			if signer, ok = a.(*ecdsa.PrivateKey); !ok {
-				return nil, fmt.Errorf("unsupported private key")
+		switch signer.(type) {
+		case *ecdsa.PrivateKey:
+		case *rsa.PrivateKey:
+			if opts.Algorithm == "PS256" {
+				return pssSigner{signer}, nil
 			}
+		default:
+			return nil, fmt.Errorf("unsupported private key type %T", signer)
 		}
 		return signer, nil
 	}
@@ -384,20 +1134,48 @@ func (c *Core) LoginX509(url string, insecure bool, key string, cert string, pat
 	if err != nil {
 		return "", err
 	}
+	defer zeroizeKey(signer)
+
+	var certs []*x509.Certificate
+	for _, block := range decodePEMBlocks(cBytes, "CERTIFICATE") {
+		xCert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("error parsing cert: %w", err)
+		}
+		certs = append(certs, xCert)
+	}
+	if len(certs) == 0 {
+		return "", fmt.Errorf("error decoding cert")
+	}
+
+	// the leaf is whichever certificate of a bundle holds our key, regardless of the order of the bundle
+	leaf := 0
+	for i, xCert := range certs {
+		if checkKeyMatchesCert(signer, xCert) == nil {
+			leaf = i
+			break
+		}
+	}
+	xCert := certs[leaf]
 
-	certB, _ := pem.Decode(cBytes)
-	xCert, err := x509.ParseCertificate(certB.Bytes)
+	err = checkKeyMatchesCert(signer, xCert)
 	if err != nil {
-		return "", fmt.Errorf("error parsing cert: %s", err)
+		return "", err
+	}
+
+	var x5c []*x509.Certificate
+	if opts.Chain {
+		x5c = append([]*x509.Certificate{xCert}, certs[:leaf]...)
+		x5c = append(x5c, certs[leaf+1:]...)
 	}
 
-	return c.Login(url, insecure, signer, xCert)
+	return c.Login(url, insecure, signer, xCert, x5c...)
 }
 
 func decodeP12(p12Data []byte, password string) (*x509.Certificate, crypto.Signer, error) {
 	privateKey, cert, err := pkcs12.Decode(p12Data, password)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error decoding PKCS#12 file: %v", err)
+		return nil, nil, fmt.Errorf("error decoding PKCS#12 file: %w", err)
 	}
 
 	signer, ok := privateKey.(crypto.Signer)
@@ -414,21 +1192,33 @@ func decodeP12(p12Data []byte, password string) (*x509.Certificate, crypto.Signe
 
 func (c *Core) LoginPKCS12(url string, insecure bool, p12 string, password string, path bool) (string, error) {
 	var p12Bytes []byte
-	var err error
+
+	// the encryption of a PKCS#12 file is commonly RC2 or 3DES, and is not exposed by the decoder to be checked
+	err := c.checkFIPS("PKCS#12 login")
+	if err != nil {
+		return "", err
+	}
 
 	if path {
 		p12Bytes, err = c.pathToBytes(p12)
 		if err != nil {
-			return "", fmt.Errorf("failed to read .p12 file: %v", err)
+			return "", fmt.Errorf("failed to read .p12 file: %w", err)
 		}
 	} else {
 		p12Bytes = []byte(p12)
 	}
+	defer c.lockInput(p12, p12Bytes)()
 
 	cert, signer, err := decodeP12(p12Bytes, password)
 	if err != nil {
 		return "", err
 	}
+	defer zeroizeKey(signer)
+
+	err = checkKeyMatchesCert(signer, cert)
+	if err != nil {
+		return "", err
+	}
 
 	return c.Login(url, insecure, signer, cert)
 }
@@ -0,0 +1,187 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// COSE header parameters and algorithms (RFC 9052, 9053, 9360 and 8812), and CWT claims (RFC 8392)
+const (
+	coseHeaderAlg           = 1
+	coseHeaderKid           = 4
+	coseHeaderX5Chain       = 33
+	coseSign1Tag            = 18
+	cwtTag                  = 61
+	cwtClaimIss             = 1
+	cwtClaimSub             = 2
+	cwtClaimAud             = 3
+	cwtClaimExp             = 4
+	cwtClaimNbf             = 5
+	cwtClaimIat             = 6
+	cwtClaimCti             = 7
+	coseAlgES256      int64 = -7
+	coseAlgEdDSA      int64 = -8
+	coseAlgES384      int64 = -35
+	coseAlgES512      int64 = -36
+	coseAlgRS256      int64 = -257
+)
+
+// CWTClaims are the claims of a CBOR Web Token signed by SignCOSE
+type CWTClaims struct {
+	Issuer string
+	// Subject defaults to the MRN of the token
+	Subject  string
+	Audience string
+	// TTL is the lifetime of the CWT, defaulting to an hour
+	TTL time.Duration
+}
+
+// COSEOptions configures SignCOSE
+type COSEOptions struct {
+	// Claims, when set, signs a CWT holding them instead of the payload
+	Claims *CWTClaims
+	// Detached omits the payload from the COSE_Sign1, for the verifier to supply
+	Detached bool
+	// CWTTag wraps a CWT in the CWT tag, as some consumers expect
+	CWTTag bool
+}
+
+// SignCOSE signs payload, or a CWT of opts.Claims, with the key of the token identified by serial as a tagged
+// COSE_Sign1 (RFC 9052) message, for the IoT and EAT attestation consumers that expect CBOR rather than JOSE.  The
+// certificate of the token is included as x5chain, and its serial number as kid.
+func (c *Core) SignCOSE(serial string, payload []byte, opts COSEOptions) ([]byte, error) {
+	token, err := c.getToken(serial)
+	if err != nil {
+		return nil, err
+	}
+
+	alg, hash, err := coseAlgorithm(token.Signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Claims != nil {
+		payload, err = cwtPayload(token, opts.Claims)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	protected := cborMapOf(cborInt(coseHeaderAlg), cborInt(alg))
+	unprotected := cborMapOf(
+		cborInt(coseHeaderKid), cborByteString(token.Cert.SerialNumber.Bytes()),
+		cborInt(coseHeaderX5Chain), cborByteString(token.Cert.Raw),
+	)
+	toBeSigned := cborArrayOf(
+		cborTextString("Signature1"),
+		cborByteString(protected),
+		cborByteString(nil),
+		cborByteString(payload),
+	)
+
+	digest := toBeSigned
+	if hash != 0 {
+		h := hash.New()
+		h.Write(toBeSigned)
+		digest = h.Sum(nil)
+	}
+	sig, err := token.Signer.Sign(rand.Reader, digest, hash)
+	c.audit("cose-sign", token.Cert, err)
+	if err != nil {
+		return nil, err
+	}
+	if pub, ok := token.Signer.Public().(*ecdsa.PublicKey); ok {
+		sig, err = rawSignature(sig, (pub.Curve.Params().BitSize+7)/8)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	encodedPayload := cborByteString(payload)
+	if opts.Detached {
+		encodedPayload = cborNull
+	}
+	msg := cborTagged(coseSign1Tag, cborArrayOf(
+		cborByteString(protected),
+		unprotected,
+		encodedPayload,
+		cborByteString(sig),
+	))
+	if opts.Claims != nil && opts.CWTTag {
+		msg = cborTagged(cwtTag, msg)
+	}
+
+	return msg, nil
+}
+
+// coseAlgorithm returns the COSE algorithm with which pub signs, and the digest it signs
+func coseAlgorithm(pub crypto.PublicKey) (int64, crypto.Hash, error) {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve.Params().Name {
+		case "P-256":
+			return coseAlgES256, crypto.SHA256, nil
+		case "P-384":
+			return coseAlgES384, crypto.SHA384, nil
+		case "P-521":
+			return coseAlgES512, crypto.SHA512, nil
+		}
+		return 0, 0, fmt.Errorf("unsupported curve %s", pub.Curve.Params().Name)
+	case *rsa.PublicKey:
+		return coseAlgRS256, crypto.SHA256, nil
+	case ed25519.PublicKey:
+		return coseAlgEdDSA, 0, nil
+	default:
+		return 0, 0, fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// cwtPayload encodes the claims of a CWT, issued now, with the keys in deterministic order
+func cwtPayload(token *Token, claims *CWTClaims) ([]byte, error) {
+	if claims.TTL < 0 {
+		return nil, errors.New("the lifetime of a CWT must be positive")
+	}
+	ttl := claims.TTL
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	subject := claims.Subject
+	if subject == "" {
+		if len(token.Cert.Subject.Organization) == 0 {
+			return nil, errors.New("certificate subject has no organization to identify the realm")
+		}
+		subject = ComputeMRN(token.Cert)
+	}
+	cti, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var pairs [][]byte
+	if claims.Issuer != "" {
+		pairs = append(pairs, cborInt(cwtClaimIss), cborTextString(claims.Issuer))
+	}
+	pairs = append(pairs, cborInt(cwtClaimSub), cborTextString(subject))
+	if claims.Audience != "" {
+		pairs = append(pairs, cborInt(cwtClaimAud), cborTextString(claims.Audience))
+	}
+	pairs = append(pairs,
+		cborInt(cwtClaimExp), cborInt(now.Add(ttl).Unix()),
+		cborInt(cwtClaimNbf), cborInt(now.Unix()),
+		cborInt(cwtClaimIat), cborInt(now.Unix()),
+		cborInt(cwtClaimCti), cborByteString(cti),
+	)
+
+	return cborMapOf(pairs...), nil
+}
@@ -0,0 +1,254 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// cborTagValue is a tagged item decoded by decodeCBOR
+type cborTagValue struct {
+	tag  uint64
+	item interface{}
+}
+
+// decodeCBOR decodes the one item of data, of the subset of CBOR that the encoder writes, into int64, []byte,
+// string, []interface{}, map[interface{}]interface{}, cborTagValue or nil
+func decodeCBOR(data []byte) (interface{}, error) {
+	item, rest, err := decodeCBORItem(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%d bytes follow the item", len(rest))
+	}
+	return item, nil
+}
+
+func decodeCBORItem(data []byte) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("truncated")
+	}
+	if data[0] == 0xf6 {
+		return nil, data[1:], nil
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return nil, nil, fmt.Errorf("truncated")
+		}
+		var buf [8]byte
+		copy(buf[8-size:], data[:size])
+		n, data = binary.BigEndian.Uint64(buf[:]), data[size:]
+		// deterministic encoding requires the shortest head
+		if n < 24 || (size > 1 && n < 1<<(4*size)) {
+			return nil, nil, fmt.Errorf("head of %d is not in its shortest form", n)
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported head %#x", info)
+	}
+
+	switch major {
+	case cborUnsigned:
+		return int64(n), data, nil
+	case cborNegative:
+		return -1 - int64(n), data, nil
+	case cborBytes, cborText:
+		if uint64(len(data)) < n {
+			return nil, nil, fmt.Errorf("truncated")
+		}
+		if major == cborText {
+			return string(data[:n]), data[n:], nil
+		}
+		return data[:n], data[n:], nil
+	case cborArray:
+		var items []interface{}
+		for i := uint64(0); i < n; i++ {
+			item, rest, err := decodeCBORItem(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			items, data = append(items, item), rest
+		}
+		return items, data, nil
+	case cborMap:
+		m := map[interface{}]interface{}{}
+		for i := uint64(0); i < n; i++ {
+			key, rest, err := decodeCBORItem(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			value, rest, err := decodeCBORItem(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key], data = value, rest
+		}
+		return m, data, nil
+	case cborTag:
+		item, rest, err := decodeCBORItem(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cborTagValue{tag: n, item: item}, rest, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported major type %d", major)
+}
+
+// checkCOSESign1 decodes msg as a tagged COSE_Sign1 signed by the key of the certificate of token, verifying its
+// headers and signature over payload, or the payload it carries when payload is nil, which it returns
+func checkCOSESign1(t *testing.T, msg interface{}, token *Token, payload []byte) []byte {
+	t.Helper()
+
+	tagged, ok := msg.(cborTagValue)
+	if !ok || tagged.tag != coseSign1Tag {
+		t.Fatalf("the message is not tagged as a COSE_Sign1: %v", msg)
+	}
+	parts, ok := tagged.item.([]interface{})
+	if !ok || len(parts) != 4 {
+		t.Fatalf("a COSE_Sign1 is an array of 4: %v", tagged.item)
+	}
+	protected, ok := parts[0].([]byte)
+	if !ok {
+		t.Fatal("the protected header is not a byte string")
+	}
+	headers, err := decodeCBOR(protected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alg := headers.(map[interface{}]interface{})[int64(coseHeaderAlg)]; alg != coseAlgES256 {
+		t.Errorf("alg = %v; want ES256", alg)
+	}
+	unprotected := parts[1].(map[interface{}]interface{})
+	if kid, _ := unprotected[int64(coseHeaderKid)].([]byte); !bytes.Equal(kid, token.Cert.SerialNumber.Bytes()) {
+		t.Errorf("kid = %x; want the serial number of the token", kid)
+	}
+	if x5chain, _ := unprotected[int64(coseHeaderX5Chain)].([]byte); !bytes.Equal(x5chain, token.Cert.Raw) {
+		t.Error("x5chain is not the certificate of the token")
+	}
+
+	if payload == nil {
+		payload, ok = parts[2].([]byte)
+		if !ok {
+			t.Fatalf("the payload is not a byte string: %v", parts[2])
+		}
+	} else if parts[2] != nil {
+		t.Errorf("the payload of a detached message = %v; want null", parts[2])
+	}
+
+	// the Sig_structure of RFC 9052, section 4.4, assembled by hand
+	var toBeSigned bytes.Buffer
+	toBeSigned.Write([]byte{0x84, 0x6a})
+	toBeSigned.WriteString("Signature1")
+	toBeSigned.Write(cborHead(cborBytes, uint64(len(protected))))
+	toBeSigned.Write(protected)
+	toBeSigned.WriteByte(0x40)
+	toBeSigned.Write(cborHead(cborBytes, uint64(len(payload))))
+	toBeSigned.Write(payload)
+	digest := sha256.Sum256(toBeSigned.Bytes())
+
+	sig, _ := parts[3].([]byte)
+	if len(sig) != 64 {
+		t.Fatalf("the ES256 signature is %d bytes; want r || s of 64", len(sig))
+	}
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(token.Cert.PublicKey.(*ecdsa.PublicKey), digest[:], r, s) {
+		t.Error("the signature does not verify")
+	}
+	return payload
+}
+
+func TestSignCOSE(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	c := NewWithBackend(NewMemoryBackend())
+	c.SetQuiet(true)
+	defer c.Close()
+
+	cert, err := c.Generate("acme")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	serial := HexEncode(cert.SerialNumber.Bytes())
+	token, err := c.getToken(serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := []byte("attested")
+	msg, err := c.SignCOSE(serial, payload, COSEOptions{})
+	if err != nil {
+		t.Fatalf("SignCOSE: %v", err)
+	}
+	decoded, err := decodeCBOR(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := checkCOSESign1(t, decoded, token, nil); !bytes.Equal(got, payload) {
+		t.Errorf("payload = %q; want %q", got, payload)
+	}
+
+	msg, err = c.SignCOSE(serial, payload, COSEOptions{Detached: true})
+	if err != nil {
+		t.Fatalf("SignCOSE detached: %v", err)
+	}
+	decoded, err = decodeCBOR(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCOSESign1(t, decoded, token, payload)
+
+	msg, err = c.SignCOSE(serial, nil, COSEOptions{Claims: &CWTClaims{Audience: "service"}, CWTTag: true})
+	if err != nil {
+		t.Fatalf("SignCOSE of a CWT: %v", err)
+	}
+	decoded, err = decodeCBOR(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagged, ok := decoded.(cborTagValue)
+	if !ok || tagged.tag != cwtTag {
+		t.Fatalf("the CWT is not tagged: %v", decoded)
+	}
+	claims, err := decodeCBOR(checkCOSESign1(t, tagged.item, token, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := claims.(map[interface{}]interface{})
+	if m[int64(cwtClaimSub)] != ComputeMRN(cert) {
+		t.Errorf("sub = %v; want %s", m[int64(cwtClaimSub)], ComputeMRN(cert))
+	}
+	if m[int64(cwtClaimAud)] != "service" {
+		t.Errorf("aud = %v; want service", m[int64(cwtClaimAud)])
+	}
+	if _, ok := m[int64(cwtClaimIss)]; ok {
+		t.Error("iss is present though not given")
+	}
+	iat, _ := m[int64(cwtClaimIat)].(int64)
+	exp, _ := m[int64(cwtClaimExp)].(int64)
+	if exp-iat != int64(time.Hour/time.Second) {
+		t.Errorf("the CWT lives %ds; want an hour", exp-iat)
+	}
+	if cti, _ := m[int64(cwtClaimCti)].([]byte); len(cti) == 0 {
+		t.Error("cti is missing")
+	}
+
+	_, err = c.SignCOSE(serial, nil, COSEOptions{Claims: &CWTClaims{TTL: -time.Minute}})
+	if err == nil {
+		t.Error("a CWT of negative lifetime was signed")
+	}
+}
@@ -0,0 +1,176 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// DeleteOptions selects the tokens removed by Delete, either a single token by Serial or every token matching the
+// filters
+type DeleteOptions struct {
+	Serial string
+	// Realm, when set, deletes every token issued for the realm
+	Realm string
+	// Expired, when set, deletes every token whose certificate has expired
+	Expired bool
+	// Force skips the confirmation
+	Force bool
+	// DryRun lists the tokens that would be deleted without deleting them
+	DryRun bool
+}
+
+// Delete removes the selected tokens, after asking the user to confirm unless force is set
+func (c *Core) Delete(opts DeleteOptions) error {
+	opts.DryRun = opts.DryRun || c.dryRun
+
+	filtered := opts.Realm != "" || opts.Expired
+	if opts.Serial != "" && filtered {
+		return errors.New("serial may not be combined with realm or expired")
+	}
+	if opts.Serial == "" && !filtered {
+		def, err := c.DefaultToken()
+		if err != nil {
+			return err
+		}
+		if def == "" {
+			return errors.New("one of serial, realm or expired must be provided, or a default token selected with use")
+		}
+		opts.Serial = def
+	}
+
+	if opts.Serial != "" {
+		return c.deleteOne(opts)
+	}
+
+	backend := c.getBackend()
+	stop := c.startSpinner("Enumerating security tokens...")
+	certs, err := backend.Certificates()
+	stop()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var selected []*x509.Certificate
+	for _, cert := range certs {
+		if opts.Expired && !cert.NotAfter.Before(now) {
+			continue
+		}
+		if opts.Realm != "" && !(&ListOptions{Realm: opts.Realm}).matches(cert, now) {
+			continue
+		}
+		selected = append(selected, cert)
+	}
+	sortCertificates(selected, "serial", false)
+
+	if len(selected) == 0 {
+		fmt.Fprintf(os.Stderr, "No matching security tokens\n")
+		return nil
+	}
+
+	for _, cert := range selected {
+		err = c.checkTokenPolicy(PolicyDelete, cert)
+		if err != nil {
+			return fmt.Errorf("%s: %w", HexEncode(cert.SerialNumber.Bytes()), err)
+		}
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Serial", "Realm", "MRN", "Expires"})
+	for _, cert := range selected {
+		table.Append([]string{HexEncode(cert.SerialNumber.Bytes()), strings.Join(cert.Subject.Organization, ","),
+			ComputeMRN(cert), cert.NotAfter.String()})
+	}
+	table.Render()
+
+	if opts.DryRun {
+		var objects []string
+		for _, cert := range selected {
+			objects = append(objects, describeObjects(c.getBackend(), cert.SerialNumber.Bytes())...)
+		}
+		printPlan("remove", objects)
+		fmt.Fprintf(os.Stderr, "%d security token(s) would be deleted\n", len(selected))
+		return nil
+	}
+
+	if !opts.Force {
+		ok, err := confirm(fmt.Sprintf("Permanently delete these %d security token(s) and their private keys?", len(selected)))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("cancelled")
+		}
+	}
+
+	stop = c.startSpinner(fmt.Sprintf("Deleting %d security token(s)...", len(selected)))
+	defer stop()
+
+	for _, cert := range selected {
+		err = backend.Delete(cert.SerialNumber.Bytes())
+		c.audit("delete", cert, err)
+		if err != nil {
+			return fmt.Errorf("%s: %w", HexEncode(cert.SerialNumber.Bytes()), err)
+		}
+		c.notify(WebhookTokenDeleted, cert)
+	}
+
+	return nil
+}
+
+func (c *Core) deleteOne(opts DeleteOptions) error {
+	token, err := c.getToken(opts.Serial)
+	if err != nil {
+		return err
+	}
+
+	err = c.checkTokenPolicy(PolicyDelete, token.Cert)
+	if err != nil {
+		return err
+	}
+
+	details := fmt.Sprintf("Serial: %s\nRealm: %s\nMRN: %s\n", HexEncode(token.Cert.SerialNumber.Bytes()),
+		strings.Join(token.Cert.Subject.Organization, ","), ComputeMRN(token.Cert))
+
+	if opts.DryRun {
+		fmt.Fprint(os.Stderr, details)
+		printPlan("remove", describeObjects(c.getBackend(), token.Cert.SerialNumber.Bytes()))
+		return nil
+	}
+
+	if !opts.Force {
+		ok, err := confirm(details + "Permanently delete this security token and its private key?")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("cancelled")
+		}
+	}
+
+	stop := c.startSpinner("Deleting security token...")
+	err = c.getBackend().Delete(token.Cert.SerialNumber.Bytes())
+	stop()
+	c.audit("delete", token.Cert, err)
+	if err != nil {
+		return err
+	}
+	c.notify(WebhookTokenDeleted, token.Cert)
+
+	// forget the default token once it is gone
+	def, err := c.DefaultToken()
+	if err == nil && def == HexEncode(token.Cert.SerialNumber.Bytes()) {
+		return c.ClearDefault()
+	}
+	return nil
+}
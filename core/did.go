@@ -0,0 +1,190 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// DIDOptions selects the DID method of a DID document
+type DIDOptions struct {
+	// Method is "key" (the default), deriving the DID from the public key itself, or "web", naming a document served
+	// by Domain
+	Method string
+	// Domain is the host, with an optional port, serving the document of a did:web
+	Domain string
+	// Path locates the document below the domain, as in did:web:example.com:users:alice, instead of /.well-known
+	Path string
+}
+
+// DIDVerificationMethod is the public key of the token within a DID document
+type DIDVerificationMethod struct {
+	ID                 string `json:"id"`
+	Type               string `json:"type"`
+	Controller         string `json:"controller"`
+	PublicKeyMultibase string `json:"publicKeyMultibase,omitempty"`
+	PublicKeyJwk       *JWK   `json:"publicKeyJwk,omitempty"`
+}
+
+// DIDDocument is a W3C DID document holding the public key of a token, also known by its MRN
+type DIDDocument struct {
+	Context              []string                `json:"@context"`
+	ID                   string                  `json:"id"`
+	AlsoKnownAs          []string                `json:"alsoKnownAs"`
+	VerificationMethod   []DIDVerificationMethod `json:"verificationMethod"`
+	Authentication       []string                `json:"authentication"`
+	AssertionMethod      []string                `json:"assertionMethod"`
+	CapabilityInvocation []string                `json:"capabilityInvocation"`
+	CapabilityDelegation []string                `json:"capabilityDelegation"`
+}
+
+// didKeyCodecs are the multicodec prefixes of the public keys of a did:key, as unsigned varints
+var didKeyCodecs = map[string][]byte{
+	"P-256":   {0x80, 0x24},
+	"P-384":   {0x81, 0x24},
+	"P-521":   {0x82, 0x24},
+	"Ed25519": {0xed, 0x01},
+	"RSA":     {0x85, 0x24},
+}
+
+// DID writes the DID document of the token identified by serial, so that the identity may take part in decentralized
+// identity flows alongside its MRN.  A did:web document is to be served from the location printed on stderr.
+func (c *Core) DID(serial string, opts DIDOptions) error {
+	token, err := c.getToken(serial)
+	if err != nil {
+		return err
+	}
+
+	doc, err := NewDIDDocument(token.Cert, opts)
+	if err != nil {
+		return classify(ExitConfig, err)
+	}
+
+	if opts.Method == "web" && !c.quiet {
+		fmt.Fprintf(os.Stderr, "Serve this document from %s\n", didWebLocation(opts))
+	}
+	return writeJSON(doc)
+}
+
+// NewDIDDocument returns the DID document of the token holding cert
+func NewDIDDocument(cert *x509.Certificate, opts DIDOptions) (DIDDocument, error) {
+	var did string
+	vm := DIDVerificationMethod{}
+
+	switch orDefault(opts.Method, "key") {
+	case "key":
+		multibase, err := didKeyMultibase(cert)
+		if err != nil {
+			return DIDDocument{}, err
+		}
+		did = "did:key:" + multibase
+		vm.ID = did + "#" + multibase
+		vm.Type = "Multikey"
+		vm.PublicKeyMultibase = multibase
+	case "web":
+		if opts.Domain == "" {
+			return DIDDocument{}, errors.New("a did:web requires the domain serving the document, given with --domain")
+		}
+		jwk, err := NewJWK(cert.PublicKey)
+		if err != nil {
+			return DIDDocument{}, err
+		}
+		// the colon of a port would otherwise separate path segments
+		did = "did:web:" + strings.ReplaceAll(url.PathEscape(opts.Domain), ":", "%3A")
+		for _, segment := range strings.Split(strings.Trim(opts.Path, "/"), "/") {
+			if segment != "" {
+				did += ":" + url.PathEscape(segment)
+			}
+		}
+		vm.ID = did + "#" + strings.ToLower(strings.ReplaceAll(HexEncode(cert.SerialNumber.Bytes()), ":", ""))
+		vm.Type = "JsonWebKey2020"
+		vm.PublicKeyJwk = &jwk
+	default:
+		return DIDDocument{}, fmt.Errorf("unsupported DID method %q (available: key, web)", opts.Method)
+	}
+	vm.Controller = did
+
+	context := []string{"https://www.w3.org/ns/did/v1", "https://w3id.org/security/multikey/v1"}
+	if vm.PublicKeyJwk != nil {
+		context[1] = "https://w3id.org/security/suites/jws-2020/v1"
+	}
+	refs := []string{vm.ID}
+
+	return DIDDocument{
+		Context:              context,
+		ID:                   did,
+		AlsoKnownAs:          []string{ComputeMRN(cert)},
+		VerificationMethod:   []DIDVerificationMethod{vm},
+		Authentication:       refs,
+		AssertionMethod:      refs,
+		CapabilityInvocation: refs,
+		CapabilityDelegation: refs,
+	}, nil
+}
+
+// didKeyMultibase encodes the public key of cert as the base58btc multibase of its multicodec form
+func didKeyMultibase(cert *x509.Certificate) (string, error) {
+	var codec, key []byte
+	switch pub := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		codec = didKeyCodecs[pub.Curve.Params().Name]
+		key = elliptic.MarshalCompressed(pub.Curve, pub.X, pub.Y)
+	case ed25519.PublicKey:
+		codec = didKeyCodecs["Ed25519"]
+		key = pub
+	case *rsa.PublicKey:
+		codec = didKeyCodecs["RSA"]
+		key = x509.MarshalPKCS1PublicKey(pub)
+	}
+	if codec == nil {
+		return "", fmt.Errorf("a %s key cannot be expressed as a did:key", keyType(cert))
+	}
+
+	return "z" + base58Encode(append(codec, key...)), nil
+}
+
+// didWebLocation returns the URL from which the document of a did:web is resolved
+func didWebLocation(opts DIDOptions) string {
+	path := strings.Trim(opts.Path, "/")
+	if path == "" {
+		path = ".well-known"
+	}
+	return "https://" + opts.Domain + "/" + path + "/did.json"
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// base58Encode encodes data with the Bitcoin alphabet, as multibase base58btc
+func base58Encode(data []byte) string {
+	var out []byte
+	n := new(big.Int).SetBytes(data)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	// leading zero bytes are encoded as leading ones
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
@@ -0,0 +1,223 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/pkcs11"
+
+	"github.com/manetu/security-token/config"
+)
+
+// checklist prints the outcome of each diagnostic step, to w unless it is nil, and remembers whether any of them failed
+type checklist struct {
+	w      io.Writer
+	failed bool
+}
+
+func (l *checklist) printf(format string, a ...interface{}) {
+	if l.w == nil {
+		fmt.Printf(format, a...)
+		return
+	}
+	fmt.Fprintf(l.w, format, a...)
+}
+
+func (l *checklist) report(step string, err error, detail string) bool {
+	if err != nil {
+		l.failed = true
+		l.printf("[FAIL] %s: %v\n", step, err)
+		return false
+	}
+	l.printf("[PASS] %s: %s\n", step, detail)
+	return true
+}
+
+func (l *checklist) skip(steps ...string) {
+	for _, step := range steps {
+		l.printf("[SKIP] %s\n", step)
+	}
+}
+
+var pkcs11Steps = []string{
+	"Load PKCS#11 module",
+	"Enumerate slots",
+	"Open session",
+	"Log in with PIN",
+}
+
+var backendSteps = []string{
+	"Open keystore",
+	"Enumerate tokens",
+}
+
+// Doctor walks through each step required to use a security token, printing a pass/fail checklist.  The steps are
+// those of the configured backend: the PKCS#11 module is probed step by step, while other backends are opened and
+// asked for their tokens.  The endpoint reachability check is skipped when tokenUrl is empty.
+func (c *Core) Doctor(tokenUrl string, insecure bool) error {
+	l := &checklist{}
+
+	c.Lock()
+	backend := c.backend
+	c.Unlock()
+
+	var cfg config.Configuration
+	var err error
+	if backend == nil {
+		cfg, err = c.readConfig()
+	}
+
+	switch {
+	case backend != nil:
+		// given by NewWithBackend, without any configuration file
+		l.report("Read configuration", nil, "keystore given by the program")
+		c.doctorBackend(l, backend)
+	case l.report("Read configuration", err, configFileUsed()):
+		name := orDefault(orDefault(c.backendName, cfg.Backend), "pkcs11")
+		if name == "pkcs11" {
+			c.doctorPKCS11(l, cfg.Pkcs11)
+			break
+		}
+		backend, err := newBackend(name, &cfg)
+		if !l.report(backendSteps[0], err, name+" backend") {
+			l.skip(backendSteps[1:]...)
+			break
+		}
+		c.doctorBackend(l, backend)
+		_ = backend.Close()
+	default:
+		l.skip(pkcs11Steps...)
+	}
+
+	if tokenUrl == "" {
+		l.skip("Reach token endpoint (no --url specified)")
+	} else {
+		detail, err := checkEndpoint(tokenUrl, insecure)
+		l.report("Reach token endpoint", err, detail)
+	}
+
+	if l.failed {
+		return errors.New("one or more checks failed")
+	}
+
+	return nil
+}
+
+// doctorBackend enumerates the tokens of a backend other than PKCS#11, which reaches its keystore and presents its
+// credentials, and in FIPS mode checks their keys
+func (c *Core) doctorBackend(l *checklist, backend Backend) {
+	certs, err := backend.Certificates()
+	if !l.report(backendSteps[1], err, fmt.Sprintf("%d security token(s)", len(certs))) {
+		return
+	}
+
+	if c.fipsMode() {
+		for _, cert := range certs {
+			err = c.checkFIPSKey(cert.PublicKey)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", HexEncode(cert.SerialNumber.Bytes()), err)
+				break
+			}
+		}
+		l.report("Keys approved for FIPS", err, fmt.Sprintf("%d key(s) checked", len(certs)))
+	}
+}
+
+// doctorPKCS11 probes the module and token of cfg step by step, within pkcs11.timeout
+func (c *Core) doctorPKCS11(l *checklist, cfg config.Pkcs11Configuration) {
+	// the steps are reported once the module has completed them, rather than by a module abandoned part way
+	var out strings.Builder
+	probe := &checklist{w: &out}
+	err := withModule(cfg, "probing the token", func(p *pkcs11.Ctx) error {
+		c.doctorToken(probe, p, cfg)
+		return nil
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		l.report("Respond within pkcs11.timeout", err, "")
+		l.skip(pkcs11Steps...)
+		return
+	}
+	if !l.report(pkcs11Steps[0], err, cfg.Path) {
+		l.skip(pkcs11Steps[1:]...)
+		return
+	}
+	l.printf("%s", out.String())
+	l.failed = l.failed || probe.failed
+}
+
+// doctorToken checks the token of cfg within the module p
+func (c *Core) doctorToken(l *checklist, p *pkcs11.Ctx, cfg config.Pkcs11Configuration) {
+	slot, err := findSlot(p, cfg.TokenLabel)
+	if !l.report(pkcs11Steps[1], err, fmt.Sprintf("token %q in slot %d", cfg.TokenLabel, slot)) {
+		l.skip(pkcs11Steps[2:]...)
+		return
+	}
+
+	if c.fipsMode() {
+		c.doctorFIPS(l, p, slot, cfg.FipsCertificate)
+	}
+
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if !l.report(pkcs11Steps[2], err, "ok") {
+		l.skip(pkcs11Steps[3:]...)
+		return
+	}
+	defer func() {
+		_ = p.CloseSession(session)
+	}()
+
+	if l.report(pkcs11Steps[3], p.Login(session, pkcs11.CKU_USER, secretString(cfg.Pin)), "ok") {
+		_ = p.Logout(session)
+	}
+}
+
+// doctorFIPS checks that the FIPS validation of the module is asserted by certificate, and that slot offers the
+// mechanisms it would cover
+func (c *Core) doctorFIPS(l *checklist, p *pkcs11.Ctx, slot uint, certificate string) {
+	const step = "Module claims FIPS validation"
+
+	infos, err := mechanismInfos(p, slot)
+	if err != nil {
+		l.report(step, err, "")
+		return
+	}
+
+	claim, err := fipsClaim(certificate, infos)
+	switch {
+	case err != nil:
+		err = fmt.Errorf("%s: %w", claim, err)
+	case claim == "":
+		err = errors.New("no validation is asserted: set pkcs11.fipscertificate to the CMVP certificate of the module")
+	}
+	l.report(step, err, describeFIPSClaim(claim, nil))
+}
+
+// checkEndpoint verifies that the oauth token endpoint answers HTTP requests.  Any HTTP response, including an
+// error status, counts as reachable since we do not present credentials.
+func checkEndpoint(tokenUrl string, insecure bool) (string, error) {
+	tokenUrl, err := url.JoinPath(tokenUrl, "/oauth/token")
+	if err != nil {
+		return "", err
+	}
+
+	client := newHTTPClient(insecure)
+	client.Timeout = 10 * time.Second
+
+	resp, err := client.Post(tokenUrl, "application/x-www-form-urlencoded", http.NoBody)
+	if err != nil {
+		return "", err
+	}
+	_ = resp.Body.Close()
+
+	return fmt.Sprintf("%s responded with %s", tokenUrl, resp.Status), nil
+}
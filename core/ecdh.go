@@ -0,0 +1,135 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// keyAgreer is implemented by backends able to perform ECDH with the private key of a token, within the keystore
+type keyAgreer interface {
+	// ECDH returns the x-coordinate of the point shared between the key pair identified by id and peer
+	ECDH(id []byte, peer *ecdsa.PublicKey) ([]byte, error)
+}
+
+// ECDHOptions configures the derivation of a symmetric key from the secret shared by ECDH
+type ECDHOptions struct {
+	// Salt and Info are the inputs of HKDF-SHA256, Info binding the key to its purpose
+	Salt []byte
+	Info []byte
+	// Length is the size of the key in bytes, defaulting to 32
+	Length int
+}
+
+// ECDH agrees a symmetric key between the token identified by serial and the holder of peer, which each derive the same
+// key with HKDF-SHA256 from the secret they share.  The private key never leaves the keystore, except where the backend
+// holds it in software anyway.
+func (c *Core) ECDH(serial string, peer crypto.PublicKey, opts ECDHOptions) (key []byte, err error) {
+	token, err := c.getToken(serial)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		c.audit("ecdh", token.Cert, err)
+	}()
+
+	shared, err := c.sharedSecret(token, peer)
+	if err != nil {
+		return nil, err
+	}
+	defer LockSecret(shared)()
+
+	return DeriveKey(shared, opts)
+}
+
+// sharedSecret performs ECDH between the key of token and peer, within the keystore where it is able
+func (c *Core) sharedSecret(token *Token, peer crypto.PublicKey) ([]byte, error) {
+	pub, ok := token.Cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key agreement requires an EC key, not %s", keyType(token.Cert))
+	}
+	peerKey, ok := peer.(*ecdsa.PublicKey)
+	if !ok || peerKey.Curve != pub.Curve {
+		return nil, fmt.Errorf("the peer key must be an EC key on %s", pub.Curve.Params().Name)
+	}
+	if !pub.Curve.IsOnCurve(peerKey.X, peerKey.Y) {
+		return nil, errors.New("the peer key is not a point on the curve")
+	}
+
+	id := token.Cert.SerialNumber.Bytes()
+	switch b := c.getBackend().(type) {
+	case keyAgreer:
+		return b.ECDH(id, peerKey)
+	case keyExporter:
+		key, err := b.ExportKey(id)
+		if err != nil {
+			return nil, err
+		}
+		priv, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return ecdhShared(priv, peerKey), nil
+	default:
+		return nil, fmt.Errorf("the %s backend does not support key agreement", c.backendInUse())
+	}
+}
+
+// ecdhShared returns the x-coordinate of the point shared between priv and peer, padded to the size of the curve
+func ecdhShared(priv *ecdsa.PrivateKey, peer *ecdsa.PublicKey) []byte {
+	d := priv.D.Bytes()
+	defer LockSecret(d)()
+	x, _ := priv.Curve.ScalarMult(peer.X, peer.Y, d)
+	return x.FillBytes(make([]byte, (priv.Curve.Params().BitSize+7)/8))
+}
+
+// DeriveKey derives a symmetric key from the secret shared by ECDH, as does ECDH itself, for the peer performing its
+// half of the agreement in software
+func DeriveKey(shared []byte, opts ECDHOptions) ([]byte, error) {
+	if opts.Length == 0 {
+		opts.Length = 32
+	}
+	if opts.Length < 16 || opts.Length > 255*sha256.Size {
+		return nil, fmt.Errorf("unsupported key length %d", opts.Length)
+	}
+
+	key := make([]byte, opts.Length)
+	_, err := io.ReadFull(hkdf.New(sha256.New, shared, opts.Salt, opts.Info), key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ParsePublicKey returns the public key within PEM encoded data, holding either a certificate or a public key
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded certificate or public key found")
+	}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing the peer certificate: %w", err)
+		}
+		return cert.PublicKey, nil
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+const (
+	// eciesPEMType armors the messages sealed by Encrypt
+	eciesPEMType = "MANETU ENCRYPTED MESSAGE"
+	// eciesInfo binds the keys derived by ECIES to their purpose, and to this version of the scheme
+	eciesInfo = "manetu-security-token ecies v1"
+	// MaxEncryptSize limits Encrypt to the small payloads, such as secrets and keys, that ECIES is meant for
+	MaxEncryptSize = 1 << 20
+)
+
+// Encrypt seals plaintext to the holder of the EC public key to, typically from the certificate of a token, which alone
+// may Decrypt it.  An ephemeral key agrees a secret with to by ECDH, from which HKDF-SHA256 derives an AES-256-GCM key.
+// The message is PEM armored, and holds the ephemeral public key, the nonce and the ciphertext.
+func Encrypt(to crypto.PublicKey, plaintext []byte) ([]byte, error) {
+	pub, ok := to.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("messages may only be encrypted to EC keys, not %T", to)
+	}
+	if len(plaintext) > MaxEncryptSize {
+		return nil, fmt.Errorf("messages are limited to %d bytes; encrypt a key for larger ones", MaxEncryptSize)
+	}
+
+	ephemeral, err := ecdsa.GenerateKey(pub.Curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	point := elliptic.Marshal(pub.Curve, ephemeral.X, ephemeral.Y)
+
+	shared := ecdhShared(ephemeral, pub)
+	defer LockSecret(shared)()
+	zeroizeKey(ephemeral)
+	aead, err := eciesAEAD(shared, point, pub)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, 0, len(point)+len(nonce)+len(plaintext)+aead.Overhead())
+	body = append(append(body, point...), nonce...)
+	body = aead.Seal(body, nonce, plaintext, point)
+	return pem.EncodeToMemory(&pem.Block{Type: eciesPEMType, Bytes: body}), nil
+}
+
+// Decrypt opens a message sealed by Encrypt to the token identified by serial, performing ECDH within the keystore
+func (c *Core) Decrypt(serial string, message []byte) (plaintext []byte, err error) {
+	if block, _ := pem.Decode(message); block != nil && block.Type == eciesPEMType {
+		message = block.Bytes
+	}
+
+	token, err := c.getToken(serial)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := token.Cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("messages may only be encrypted to EC keys, not %s", keyType(token.Cert))
+	}
+
+	defer func() {
+		c.audit("decrypt", token.Cert, err)
+	}()
+
+	size := 1 + 2*((pub.Curve.Params().BitSize+7)/8)
+	if len(message) < size {
+		return nil, errors.New("malformed message")
+	}
+	point := message[:size]
+	x, y := elliptic.Unmarshal(pub.Curve, point)
+	if x == nil {
+		return nil, errors.New("malformed message, or one encrypted to another curve")
+	}
+
+	shared, err := c.sharedSecret(token, &ecdsa.PublicKey{Curve: pub.Curve, X: x, Y: y})
+	if err != nil {
+		return nil, err
+	}
+	defer LockSecret(shared)()
+	aead, err := eciesAEAD(shared, point, pub)
+	if err != nil {
+		return nil, err
+	}
+
+	rest := message[size:]
+	if len(rest) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("malformed message")
+	}
+	plaintext, err = aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], point)
+	if err != nil {
+		return nil, errors.New("the message was not encrypted to this security token, or has been altered")
+	}
+	return plaintext, nil
+}
+
+// eciesAEAD returns the AES-256-GCM cipher keyed from the shared secret, bound to both the ephemeral and the recipient
+// public keys
+func eciesAEAD(shared, ephemeral []byte, recipient *ecdsa.PublicKey) (cipher.AEAD, error) {
+	info := append([]byte(eciesInfo), ephemeral...)
+	info = append(info, elliptic.Marshal(recipient.Curve, recipient.X, recipient.Y)...)
+
+	key, err := DeriveKey(shared, ECDHOptions{Info: info})
+	if err != nil {
+		return nil, err
+	}
+	defer LockSecret(key)()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,258 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/manetu/security-token/config"
+)
+
+// EnrollOptions selects the token to enroll and the registrar with which its identity is registered
+type EnrollOptions struct {
+	// Serial names an existing token to register; otherwise a new token is generated for Realm, valid for Validity
+	// and labelled with Label
+	Serial   string
+	Realm    string
+	Validity time.Duration
+	Label    string
+	// Registrar, URL, Token and Roles default to those of the enroll section of the configuration file
+	Registrar string
+	URL       string
+	Token     string
+	Roles     []string
+	// Name of the identity, defaulting to the serial number of the token
+	Name     string
+	Insecure bool
+}
+
+// EnrollRegistrar registers the identity of cert with the registrar described by opts
+type EnrollRegistrar func(client *http.Client, opts EnrollOptions, cert *x509.Certificate) error
+
+// enrollRegistrars holds the manetu and http registrars, and those given to RegisterEnrollRegistrar
+var enrollRegistrars = map[string]EnrollRegistrar{
+	"manetu": registerManetu,
+	"http":   registerHTTP,
+}
+
+// RegisterEnrollRegistrar makes a registrar of identities available to enroll under the given name
+func RegisterEnrollRegistrar(name string, registrar EnrollRegistrar) {
+	enrollRegistrars[name] = registrar
+}
+
+// Enroll generates a token, or takes the existing token named by opts.Serial, and registers its certificate with the
+// registrar in one step, so that it may log in without a separate visit to the console.  A token generated here is
+// kept when its registration fails, and may be registered again by its serial number.
+func (c *Core) Enroll(opts EnrollOptions) (*x509.Certificate, error) {
+	registrar, opts, err := c.enrollment(opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.URL == "" {
+		return nil, classify(ExitConfig, errors.New("--url, enroll.url or MANETU_URL must be given"))
+	}
+	if opts.Serial == "" && opts.Realm == "" {
+		return nil, classify(ExitConfig, errors.New("--realm is required to generate a token; use --serial to enroll an existing one"))
+	}
+
+	var (
+		cert      *x509.Certificate
+		generated bool
+	)
+	if opts.Serial != "" {
+		t, err := c.getToken(opts.Serial)
+		if err != nil {
+			return nil, err
+		}
+		if warning := foreignCertificate(t.Cert); warning != "" {
+			return nil, classify(ExitConfig, fmt.Errorf("the token %s cannot be enrolled: %s", opts.Serial, warning))
+		}
+		cert = t.Cert
+	} else {
+		cert, err = c.GenerateLabeled(opts.Realm, opts.Label, opts.Validity)
+		if err != nil {
+			return nil, err
+		}
+		generated = true
+	}
+
+	if c.dryRun {
+		what := "the new token"
+		if cert != nil {
+			what = HexEncode(cert.SerialNumber.Bytes())
+		}
+		printPlan(fmt.Sprintf("register %s with the %s registrar", what, opts.Registrar), []string{opts.URL})
+		return cert, nil
+	}
+
+	stop := c.startSpinner("Registering identity...")
+	err = c.register(registrar, opts, cert)
+	stop()
+	if err != nil {
+		if generated {
+			err = fmt.Errorf("%w; the token %s was generated but not registered, retry with --serial", err, HexEncode(cert.SerialNumber.Bytes()))
+		}
+		return cert, err
+	}
+
+	return cert, nil
+}
+
+// enrollment returns the registrar of opts, whose unset fields are filled from the enroll section of the configuration
+// and then the environment.  A Core given its keystore by NewWithBackend reads no configuration file, leaving only the
+// environment.  opts.URL is left empty when none is given.
+func (c *Core) enrollment(opts EnrollOptions) (EnrollRegistrar, EnrollOptions, error) {
+	c.getBackend()
+
+	var cfg config.EnrollConfiguration
+	c.Lock()
+	if c.configured {
+		cfg = c.configuration.Enroll
+	}
+	c.Unlock()
+
+	opts.Registrar = firstNonEmpty(opts.Registrar, cfg.Registrar, "manetu")
+	opts.URL = firstNonEmpty(opts.URL, cfg.URL, os.Getenv("MANETU_URL"))
+	opts.Token = firstNonEmpty(opts.Token, cfg.Token, os.Getenv("MANETU_ENROLL_TOKEN"))
+	if len(opts.Roles) == 0 {
+		opts.Roles = cfg.Roles
+	}
+
+	registrar, ok := enrollRegistrars[opts.Registrar]
+	if !ok {
+		var names []string
+		for name := range enrollRegistrars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, opts, classify(ExitConfig, fmt.Errorf("unknown enroll registrar %q (available: %s)", opts.Registrar, strings.Join(names, ", ")))
+	}
+	return registrar, opts, nil
+}
+
+// register registers the identity of cert with registrar, naming it by its serial number unless opts.Name is set
+func (c *Core) register(registrar EnrollRegistrar, opts EnrollOptions, cert *x509.Certificate) error {
+	if opts.Name == "" {
+		opts.Name = HexEncode(cert.SerialNumber.Bytes())
+	}
+
+	client := newHTTPClient(opts.Insecure)
+	client.Timeout = 30 * time.Second
+	err := registrar(client, opts, cert)
+	c.audit("enroll", cert, err)
+	return err
+}
+
+// postEnrollment posts body as JSON to url, authorized by token, and decodes the response into result when not nil
+func postEnrollment(client *http.Client, url, token string, body interface{}, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return classify(ExitUnreachable, err)
+	}
+	defer resp.Body.Close()
+
+	data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return classify(ExitAuth, err)
+		}
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+
+	return json.Unmarshal(data, result)
+}
+
+// registerManetu creates a Service Account of the realm of cert, holding cert as its credential, by the
+// create_service_account mutation of the GraphQL API of Manetu at opts.URL, authorized by a personal access token
+func registerManetu(client *http.Client, opts EnrollOptions, cert *x509.Certificate) error {
+	if opts.Token == "" {
+		return classify(ExitConfig, errors.New("the manetu registrar requires --token, enroll.token or MANETU_ENROLL_TOKEN"))
+	}
+	if len(cert.Subject.Organization) == 0 {
+		return classify(ExitConfig, errors.New("the certificate of the token names no realm"))
+	}
+	endpoint, err := url.JoinPath(opts.URL, "/graphql")
+	if err != nil {
+		return classify(ExitConfig, err)
+	}
+
+	body := map[string]interface{}{
+		"query": `mutation enroll($realm: String!, $data: ServiceAccountInput!) {
+  create_service_account(realm: $realm, data: $data) { mrn }
+}`,
+		"variables": map[string]interface{}{
+			"realm": cert.Subject.Organization[0],
+			"data": map[string]interface{}{
+				"name":        opts.Name,
+				"description": "Enrolled by manetu-security-token",
+				"roles":       opts.Roles,
+				"x509":        ExportCert(cert),
+			},
+		},
+	}
+
+	var result struct {
+		Errors []struct {
+			Message string
+		}
+	}
+	err = postEnrollment(client, endpoint, opts.Token, body, &result)
+	if err != nil {
+		return err
+	}
+	if len(result.Errors) > 0 {
+		var msgs []string
+		for _, e := range result.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		return fmt.Errorf("manetu: %s", strings.Join(msgs, "; "))
+	}
+
+	return nil
+}
+
+// registerHTTP posts the identity of cert to a registration service of the user's own
+func registerHTTP(client *http.Client, opts EnrollOptions, cert *x509.Certificate) error {
+	return postEnrollment(client, opts.URL, opts.Token, map[string]interface{}{
+		"name":        opts.Name,
+		"serial":      HexEncode(cert.SerialNumber.Bytes()),
+		"mrn":         ComputeMRN(cert),
+		"realm":       cert.Subject.Organization[0],
+		"roles":       opts.Roles,
+		"certificate": ExportCert(cert),
+	}, nil)
+}
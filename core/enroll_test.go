@@ -0,0 +1,110 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEnroll(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("MANETU_URL", "")
+	t.Setenv("MANETU_ENROLL_TOKEN", "")
+	r := &registry{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	c := NewWithBackend(NewMemoryBackend())
+	c.SetQuiet(true)
+	defer c.Close()
+
+	tests := []struct {
+		name string
+		opts EnrollOptions
+		code int
+	}{
+		{"without a URL", EnrollOptions{Realm: "acme"}, ExitConfig},
+		{"without a realm or serial", EnrollOptions{URL: server.URL}, ExitConfig},
+		{"with an unknown registrar", EnrollOptions{Realm: "acme", URL: server.URL, Registrar: "ldap"}, ExitConfig},
+		{"with the manetu registrar and no token", EnrollOptions{Realm: "acme", URL: server.URL}, ExitConfig},
+		{"with the http registrar", EnrollOptions{Realm: "acme", URL: server.URL, Registrar: "http"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := c.Enroll(tt.opts)
+			if ExitCode(err) != tt.code {
+				t.Fatalf("Enroll = %v; want exit code %d", err, tt.code)
+			}
+			if err != nil {
+				return
+			}
+			if len(r.mrns) != 1 || r.mrns[0] != ComputeMRN(cert) {
+				t.Errorf("registered %v; want [%s]", r.mrns, ComputeMRN(cert))
+			}
+		})
+	}
+}
+
+// TestEnrollManetu creates a Service Account holding the certificate of the token through the GraphQL API of Manetu
+func TestEnrollManetu(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("MANETU_URL", "")
+	t.Setenv("MANETU_ENROLL_TOKEN", "")
+
+	var got struct {
+		Query     string
+		Variables struct {
+			Realm string
+			Data  struct {
+				Name  string
+				Roles []string
+				X509  string
+			}
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/graphql" || r.Header.Get("Authorization") != "Bearer pat" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		err := json.NewDecoder(r.Body).Decode(&got)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if got.Variables.Data.Name == "taken" {
+			_, _ = w.Write([]byte(`{"errors": [{"message": "name already in use"}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data": {"create_service_account": {"mrn": "mrn:iam:acme:service-account:build"}}}`))
+	}))
+	defer server.Close()
+
+	c := NewWithBackend(NewMemoryBackend())
+	c.SetQuiet(true)
+	defer c.Close()
+
+	cert, err := c.Enroll(EnrollOptions{Realm: "acme", URL: server.URL, Token: "pat", Name: "build", Roles: []string{"service"}})
+	if err != nil {
+		t.Fatalf("Enroll: %v", err)
+	}
+	if !strings.Contains(got.Query, "create_service_account") || got.Variables.Realm != "acme" ||
+		got.Variables.Data.Name != "build" || len(got.Variables.Data.Roles) != 1 || got.Variables.Data.X509 != ExportCert(cert) {
+		t.Errorf("posted %+v; want a Service Account of realm acme holding the certificate", got)
+	}
+
+	_, err = c.Enroll(EnrollOptions{Serial: HexEncode(cert.SerialNumber.Bytes()), URL: server.URL, Token: "pat", Name: "taken"})
+	if err == nil || !strings.Contains(err.Error(), "name already in use") {
+		t.Errorf("Enroll with a name in use = %v; want the error of the API", err)
+	}
+	_, err = c.Enroll(EnrollOptions{Realm: "acme", URL: server.URL, Token: "expired"})
+	if ExitCode(err) != ExitAuth {
+		t.Errorf("Enroll with a refused token = %v; want exit code %d", err, ExitAuth)
+	}
+}
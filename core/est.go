@@ -0,0 +1,217 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ESTOptions configures enrollment with an EST (RFC 7030) server
+type ESTOptions struct {
+	// URL of the server, such as https://est.example.com, to which /.well-known/est is appended
+	URL string
+	// Label selects one of several CAs served by the server, if any
+	Label string
+	// Username and Password authenticate the initial enrollment with HTTP basic authentication, if required
+	Username string
+	Password string
+	// CACert names the PEM encoded trust anchors of the server, defaulting to the system roots
+	CACert string
+	// CommonName and DNSNames form the subject of an initial enrollment, the common name defaulting to the MRN
+	CommonName string
+	DNSNames   []string
+	// Reenroll renews the certificate previously issued to the token, authenticating with it over TLS
+	Reenroll bool
+	Insecure bool
+}
+
+// EST obtains a certificate for the key of the token identified by serial from an EST server, by simpleenroll or, to
+// renew the certificate it issued before, simplereenroll.  The token remains identified by its self-signed
+// certificate; the issued chain is returned, leaf first, and kept in $HOME/.manetu/certs/est alongside the token.
+func (c *Core) EST(serial string, opts ESTOptions) (chain []*x509.Certificate, err error) {
+	if opts.URL == "" {
+		return nil, classify(ExitConfig, errors.New("the URL of the EST server must be given"))
+	}
+
+	token, err := c.getToken(serial)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		c.audit("est", token.Cert, err)
+	}()
+	id := token.Cert.SerialNumber.Bytes()
+
+	store, err := newFileCertStore("", "est")
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := estTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: firstNonEmpty(opts.CommonName, ComputeMRN(token.Cert))},
+		DNSNames: opts.DNSNames,
+	}
+	operation := "simpleenroll"
+	if opts.Reenroll {
+		previous, err := store.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if previous == nil {
+			return nil, classify(ExitNotFound, errors.New("no certificate has been issued to the token by EST; enroll it first"))
+		}
+		// RFC 7030, section 4.2.2: the subject and subjectAltName of a renewal match the current certificate
+		template = &x509.CertificateRequest{
+			Subject:        previous.Subject,
+			DNSNames:       previous.DNSNames,
+			EmailAddresses: previous.EmailAddresses,
+			IPAddresses:    previous.IPAddresses,
+			URIs:           previous.URIs,
+		}
+		tlsConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{previous.Raw}, PrivateKey: token.Signer, Leaf: previous}}
+		operation = "simplereenroll"
+	} else if opts.Username == "" {
+		// without other credentials, offer the self-signed certificate of the token for the server to authorize
+		tlsConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{token.Cert.Raw}, PrivateKey: token.Signer, Leaf: token.Cert}}
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, token.Signer)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := c.startSpinner("Requesting certificate...")
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}, Timeout: 60 * time.Second}
+	certs, err := estRequest(client, opts, operation, csr)
+	stop()
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err = leafFirst(certs, token.Signer)
+	if err != nil {
+		return nil, fmt.Errorf("the issued certificate does not carry the token's key: %w", err)
+	}
+
+	err = store.PutChain(id, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	return chain, nil
+}
+
+// ESTCACerts returns the current CA certificates of the EST server
+func (c *Core) ESTCACerts(opts ESTOptions) ([]*x509.Certificate, error) {
+	if opts.URL == "" {
+		return nil, classify(ExitConfig, errors.New("the URL of the EST server must be given"))
+	}
+	tlsConfig, err := estTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}, Timeout: 60 * time.Second}
+	return estRequest(client, opts, "cacerts", nil)
+}
+
+func estTLSConfig(opts ESTOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		// #nosec: G402 this is users choice, typically in a dev/test setting
+		InsecureSkipVerify: opts.Insecure,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if opts.CACert != "" {
+		data, err := os.ReadFile(opts.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CACert)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// estRequest performs operation, posting the DER encoded csr when set, and returns the certificates of the
+// certs-only response
+func estRequest(client *http.Client, opts ESTOptions, operation string, csr []byte) ([]*x509.Certificate, error) {
+	url := strings.TrimSuffix(opts.URL, "/") + "/.well-known/est/"
+	if opts.Label != "" {
+		url += strings.Trim(opts.Label, "/") + "/"
+	}
+	url += operation
+
+	var (
+		req *http.Request
+		err error
+	)
+	if csr == nil {
+		req, err = http.NewRequest(http.MethodGet, url, nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, url, strings.NewReader(base64.StdEncoding.EncodeToString(csr)))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/pkcs10")
+			req.Header.Set("Content-Transfer-Encoding", "base64")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.Username != "" {
+		req.SetBasicAuth(opts.Username, opts.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, classify(ExitUnreachable, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusAccepted:
+		return nil, fmt.Errorf("the EST server is holding the request for approval; retry after %s seconds",
+			orDefault(resp.Header.Get("Retry-After"), "some"))
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, classify(ExitAuth, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data))))
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	return parseCertsOnly(decodeBase64Body(data))
+}
+
+// decodeBase64Body returns the DER within the base64 encoded body of an EST or SCEP response, tolerating servers that
+// send it unencoded
+func decodeBase64Body(data []byte) []byte {
+	der, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(data), nil)))
+	if err != nil {
+		return data
+	}
+	return der
+}
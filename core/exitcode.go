@@ -0,0 +1,134 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+
+	"github.com/miekg/pkcs11"
+	"golang.org/x/oauth2"
+)
+
+// Exit codes reported by the CLI for each class of failure.  Scripts rely on these, so they must never be renumbered.
+const (
+	ExitOK = 0
+	// ExitFailure is any failure not covered by a more specific code
+	ExitFailure = 1
+	// ExitConfig is a missing or invalid configuration file or profile
+	ExitConfig = 2
+	// ExitUnreachable is a keystore, HSM or Manetu endpoint that could not be reached or initialized
+	ExitUnreachable = 3
+	// ExitNotFound is a security token that does not exist
+	ExitNotFound = 4
+	// ExitAuth is a rejected PIN or credential, whether by the keystore or by Manetu
+	ExitAuth = 5
+	// ExitExpired is a certificate that has expired or is not yet valid
+	ExitExpired = 6
+	// ExitDenied is an operation forbidden by the local policy
+	ExitDenied = 7
+)
+
+// exitClasses names each failure class within machine-readable error output, and hints at its usual remedy
+var exitClasses = map[int]struct{ name, hint string }{
+	ExitFailure:     {"failure", ""},
+	ExitConfig:      {"config", "check security-tokens.yml, or select a profile with --profile"},
+	ExitUnreachable: {"unreachable", "check that the keystore, HSM or Manetu endpoint is available; doctor may help"},
+	ExitNotFound:    {"not_found", "run list to see the available security tokens"},
+	ExitAuth:        {"auth", "check the PIN, passphrase or credentials"},
+	ExitExpired:     {"expired", "generate a new security token and register it with Manetu"},
+	ExitDenied:      {"denied", "the local policy forbids the operation; see policy show"},
+}
+
+// ErrorJSON formats err as a single line JSON object of its failure class, message and a hint at its remedy
+func ErrorJSON(err error) string {
+	class := exitClasses[ExitCode(err)]
+	data, _ := json.Marshal(struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		Hint    string `json:"hint,omitempty"`
+	}{class.name, err.Error(), class.hint})
+	return string(data)
+}
+
+// classifiedError associates an error with the exit code of its failure class
+type classifiedError struct {
+	code int
+	err  error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// classify assigns err to the failure class code, unless it already belongs to a more specific one
+func classify(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var ce *classifiedError
+	if errors.As(err, &ce) {
+		return err
+	}
+
+	if isAuthError(err) {
+		code = ExitAuth
+	}
+
+	return &classifiedError{code: code, err: err}
+}
+
+// isAuthError reports whether err is a PIN or credential rejected by a PKCS#11 token or the Manetu token endpoint
+func isAuthError(err error) bool {
+	var perr pkcs11.Error
+	if errors.As(err, &perr) {
+		switch perr {
+		case pkcs11.CKR_PIN_INCORRECT, pkcs11.CKR_PIN_INVALID, pkcs11.CKR_PIN_LEN_RANGE, pkcs11.CKR_PIN_EXPIRED,
+			pkcs11.CKR_PIN_LOCKED, pkcs11.CKR_USER_NOT_LOGGED_IN:
+			return true
+		}
+	}
+
+	var rerr *oauth2.RetrieveError
+	if errors.As(err, &rerr) && rerr.Response != nil {
+		return rerr.Response.StatusCode == 400 || rerr.Response.StatusCode == 401 || rerr.Response.StatusCode == 403
+	}
+
+	return false
+}
+
+// classifyLogin assigns a failed exchange with the Manetu token endpoint to its failure class
+func classifyLogin(err error) error {
+	var uerr *url.Error
+	var nerr net.Error
+	if errors.As(err, &uerr) || errors.As(err, &nerr) {
+		return classify(ExitUnreachable, err)
+	}
+	return classify(ExitFailure, err)
+}
+
+// ExitCode returns the exit code for the failure class of err
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+
+	var ce *classifiedError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	if isAuthError(err) {
+		return ExitAuth
+	}
+
+	return ExitFailure
+}
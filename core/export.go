@@ -0,0 +1,95 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// WindowsStoreOptions selects where the certificate of a token is registered in the Windows certificate store, and
+// the key to which it is linked
+type WindowsStoreOptions struct {
+	// Machine registers the certificate in the LocalMachine rather than the CurrentUser store
+	Machine bool
+	// Certificate names a PEM file holding a certificate issued to the token, followed by its chain, registered in
+	// place of the token's self-signed certificate
+	Certificate string
+	// Provider and Container name the key storage provider and key of the token, defaulting to those of the cng
+	// backend; tokens of other backends are linked through a vendor's PKCS#11 backed provider
+	Provider  string
+	Container string
+}
+
+// backendInUse returns the name of the keystore backend in use
+func (c *Core) backendInUse() string {
+	c.getBackend()
+	return orDefault(orDefault(c.backendName, c.configuration.Backend), "pkcs11")
+}
+
+// exportChain returns the chain to export for token: its self-signed certificate or, when path is set, the
+// certificate issued to the token read from path, leaf first
+func exportChain(token *Token, path string) ([]*x509.Certificate, error) {
+	if path == "" {
+		return []*x509.Certificate{token.Cert}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for _, block := range decodePEMBlocks(data, "CERTIFICATE") {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	chain, err := leafFirst(certs, token.Signer)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not issued to the token: %w", path, err)
+	}
+	return chain, nil
+}
+
+// ExportWindowsStore registers the certificate of the token identified by serial in the personal ("MY") store,
+// linked to the key of the token so that Windows-native applications may use it for client authentication.  Any
+// intermediate certificates given with opts.Certificate are added to the intermediate ("CA") store.
+func (c *Core) ExportWindowsStore(serial string, opts WindowsStoreOptions) (err error) {
+	token, err := c.getToken(serial)
+	if err != nil {
+		return err
+	}
+
+	chain, err := exportChain(token, opts.Certificate)
+	if err != nil {
+		return err
+	}
+
+	if c.dryRun {
+		where := "CurrentUser"
+		if opts.Machine {
+			where = "LocalMachine"
+		}
+		printPlan(fmt.Sprintf("register %s in the %s certificate store", HexEncode(token.Cert.SerialNumber.Bytes()), where), nil)
+		return nil
+	}
+
+	defer func() {
+		c.audit("export-windows-store", token.Cert, err)
+	}()
+
+	if c.backendInUse() != "cng" && (opts.Provider == "" || opts.Container == "") {
+		return classify(ExitConfig, errors.New("the key of the token can only be linked through a key storage provider given with --provider and --container"))
+	}
+
+	return addToWindowsStore(c.configuration.Cng, token.Cert.SerialNumber.Bytes(), chain, opts)
+}
@@ -0,0 +1,138 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseDuration extends time.ParseDuration with the units "d" (days) and "w" (weeks), as in "30d"
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// keyTypes maps the names accepted by --key-type to the prefix of the KeyType reported for a token
+var keyTypes = map[string]string{
+	"ec":      "ECDSA",
+	"ecdsa":   "ECDSA",
+	"rsa":     "RSA",
+	"ed25519": "Ed25519",
+}
+
+func checkKeyType(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := keyTypes[strings.ToLower(name)]; !ok {
+		return fmt.Errorf("unknown key type %q (available: ec, rsa, ed25519)", name)
+	}
+	return nil
+}
+
+// matches reports whether cert satisfies every filter set within opts
+func (opts *ListOptions) matches(cert *x509.Certificate, now time.Time) bool {
+	if opts.Realm != "" {
+		found := false
+		for _, org := range cert.Subject.Organization {
+			if org == opts.Realm {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if opts.ExpiresWithin > 0 && cert.NotAfter.After(now.Add(opts.ExpiresWithin)) {
+		return false
+	}
+
+	if opts.KeyType != "" && !strings.HasPrefix(keyType(cert), keyTypes[strings.ToLower(opts.KeyType)]) {
+		return false
+	}
+
+	return true
+}
+
+// filterCertificates returns the certificates matching the filters within opts
+func filterCertificates(certs []*x509.Certificate, opts *ListOptions) []*x509.Certificate {
+	now := time.Now()
+
+	var filtered []*x509.Certificate
+	for _, cert := range certs {
+		if opts.matches(cert, now) {
+			filtered = append(filtered, cert)
+		}
+	}
+	return filtered
+}
+
+// sortKeys are the orderings accepted by --sort, each comparing two certificates
+var sortKeys = map[string]func(a, b *x509.Certificate) int{
+	"created": func(a, b *x509.Certificate) int { return compareTime(a.NotBefore, b.NotBefore) },
+	"expiry":  func(a, b *x509.Certificate) int { return compareTime(a.NotAfter, b.NotAfter) },
+	"provider": func(a, b *x509.Certificate) int {
+		return strings.Compare(strings.Join(a.Subject.Organization, ","), strings.Join(b.Subject.Organization, ","))
+	},
+	"serial": compareSerial,
+}
+
+func compareTime(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareSerial(a, b *x509.Certificate) int {
+	return a.SerialNumber.Cmp(b.SerialNumber)
+}
+
+func checkSort(key string) error {
+	if _, ok := sortKeys[key]; !ok {
+		return fmt.Errorf("unknown sort key %q (available: created, expiry, provider, serial)", key)
+	}
+	return nil
+}
+
+// sortCertificates orders certs by key, breaking ties by serial number so that the order is stable between runs
+func sortCertificates(certs []*x509.Certificate, key string, reverse bool) {
+	compare := sortKeys[key]
+	sort.SliceStable(certs, func(i, j int) bool {
+		c := compare(certs[i], certs[j])
+		if c == 0 {
+			c = compareSerial(certs[i], certs[j])
+		}
+		if reverse {
+			return c > 0
+		}
+		return c < 0
+	})
+}
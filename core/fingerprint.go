@@ -0,0 +1,76 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+)
+
+// KeyFingerprints identifies the public key of a security token, rather than its certificate, so that a token keeps
+// them when its certificate is renewed.  Allowlisting systems key on these: JOSE and OAuth on the JWK thumbprint,
+// certificate pinning (curl --pinnedpubkey, Envoy, HPKP) on the digest of the SubjectPublicKeyInfo.
+type KeyFingerprints struct {
+	// JWKThumbprint is the RFC 7638 thumbprint of the JWK of the key
+	JWKThumbprint string `json:"jwkThumbprint"`
+	// SPKISHA256 is the SHA-256 digest of the DER encoded SubjectPublicKeyInfo, hex encoded as are certificate
+	// fingerprints
+	SPKISHA256 string `json:"spkiSha256"`
+	// SPKIPin is the same digest base64 encoded, as pinning configuration expects
+	SPKIPin string `json:"spkiPin"`
+}
+
+// NewKeyFingerprints computes the fingerprints of pub
+func NewKeyFingerprints(pub crypto.PublicKey) (KeyFingerprints, error) {
+	jwk, err := NewJWK(pub)
+	if err != nil {
+		return KeyFingerprints{}, err
+	}
+	thumbprint, err := jwk.Thumbprint()
+	if err != nil {
+		return KeyFingerprints{}, err
+	}
+
+	spki, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return KeyFingerprints{}, err
+	}
+	sum := sha256.Sum256(spki)
+
+	return KeyFingerprints{
+		JWKThumbprint: thumbprint,
+		SPKISHA256:    HexEncode(sum[:]),
+		SPKIPin:       base64.StdEncoding.EncodeToString(sum[:]),
+	}, nil
+}
+
+// Fingerprint prints the fingerprints of the key of the token identified by serial or, when certPath is set, of that
+// of the PEM encoded certificate within the file, as text or JSON
+func (c *Core) Fingerprint(serial string, certPath string, output string) error {
+	err := checkOutput(output, "text", "json")
+	if err != nil {
+		return err
+	}
+
+	cert, err := c.tokenOrCert(serial, certPath)
+	if err != nil {
+		return err
+	}
+	fp, err := NewKeyFingerprints(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	if output == "json" {
+		return writeJSON(fp)
+	}
+	fmt.Printf("JWK Thumbprint: %s\n", fp.JWKThumbprint)
+	fmt.Printf("SPKI SHA256: %s\n", fp.SPKISHA256)
+	fmt.Printf("SPKI Pin: sha256//%s\n", fp.SPKIPin)
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+// fipsCurves are the curves approved by FIPS 186-5 for ECDSA
+var fipsCurves = map[string]bool{
+	"P-256": true,
+	"P-384": true,
+	"P-521": true,
+}
+
+// fipsMinRSABits is the smallest RSA modulus approved by SP 800-131A for signatures
+const fipsMinRSABits = 2048
+
+// SetFIPS restricts operation to the algorithms and key sizes approved by FIPS 140-3, in addition to the fips setting
+// of the configuration file
+func (c *Core) SetFIPS(fips bool) {
+	c.fips = fips
+}
+
+// fipsMode reports whether FIPS mode was selected by SetFIPS or the configuration file.  It reads the configuration
+// when that has not yet been done, so it must not be called with c locked.
+func (c *Core) fipsMode() bool {
+	if c.fips {
+		return true
+	}
+	c.loadSettings()
+
+	c.Lock()
+	defer c.Unlock()
+
+	return c.configuration.Fips
+}
+
+// checkFIPSKey refuses, in FIPS mode, a public key whose algorithm or size is not approved
+func (c *Core) checkFIPSKey(pub crypto.PublicKey) error {
+	if !c.fipsMode() {
+		return nil
+	}
+
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		name := pub.Curve.Params().Name
+		if !fipsCurves[name] {
+			return classify(ExitDenied, fmt.Errorf("FIPS mode: curve %s is not approved (allowed: P-256, P-384, P-521)", name))
+		}
+	case *rsa.PublicKey:
+		if bits := pub.N.BitLen(); bits < fipsMinRSABits {
+			return classify(ExitDenied, fmt.Errorf("FIPS mode: RSA-%d is not approved (at least %d bits are required)", bits, fipsMinRSABits))
+		}
+	case ed25519.PublicKey:
+	default:
+		return classify(ExitDenied, fmt.Errorf("FIPS mode: %T keys are not approved", pub))
+	}
+	return nil
+}
+
+// checkFIPSDigest refuses, in FIPS mode, a digest other than those of SHA-2 approved for signatures
+func (c *Core) checkFIPSDigest(hash crypto.Hash) error {
+	if !c.fipsMode() {
+		return nil
+	}
+	return fipsDigest(hash)
+}
+
+// fipsDigest refuses a digest other than those of SHA-2 approved for signatures
+func fipsDigest(hash crypto.Hash) error {
+	switch hash {
+	case crypto.SHA256, crypto.SHA384, crypto.SHA512:
+		return nil
+	}
+	return classify(ExitDenied, fmt.Errorf("FIPS mode: digest %s is not approved (allowed: SHA-256, SHA-384, SHA-512)", hash))
+}
+
+// fipsToken refuses, in FIPS mode, a token whose key is not approved, and otherwise returns it with a signer that
+// refuses digests that are not, so that every signature made with the token is checked however it is requested
+func (c *Core) fipsToken(token *Token) (*Token, error) {
+	if token == nil || !c.fipsMode() {
+		return token, nil
+	}
+
+	err := c.checkFIPSKey(token.Cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Token{Signer: &fipsSigner{Signer: token.Signer}, Cert: token.Cert}, nil
+}
+
+// fipsSigner signs only digests approved by FIPS mode, or whole messages with Ed25519
+type fipsSigner struct {
+	crypto.Signer
+}
+
+func (s *fipsSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash := opts.HashFunc()
+	if _, ok := s.Public().(ed25519.PublicKey); !ok || hash != 0 {
+		err := fipsDigest(hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.Signer.Sign(rand, digest, opts)
+}
+
+// checkFIPS refuses, in FIPS mode, an operation whose algorithms cannot be made compliant, naming what it uses
+func (c *Core) checkFIPS(what string) error {
+	if !c.fipsMode() {
+		return nil
+	}
+	return fipsRefusal(what)
+}
+
+// fipsRefusal is the error refusing, in FIPS mode, what is named
+func fipsRefusal(what string) error {
+	return classify(ExitDenied, fmt.Errorf("FIPS mode: %s is not approved", what))
+}
+
+// fipsMechanisms are the mechanisms with which the tool generates and signs with keys on a PKCS#11 token, and which
+// a FIPS validation of the module must therefore cover
+var fipsMechanisms = []struct {
+	mechanism uint
+	flag      uint
+}{
+	{pkcs11.CKM_EC_KEY_PAIR_GEN, pkcs11.CKF_GENERATE_KEY_PAIR},
+	{pkcs11.CKM_ECDSA, pkcs11.CKF_SIGN},
+}
+
+// fipsClaim returns the FIPS validation asserted for a PKCS#11 module by the number of its CMVP certificate, given by
+// pkcs11.fipscertificate since PKCS#11 has no means to report validation, or "" when none is asserted.  It fails should
+// the mechanisms of the slot, as the module reports them, not offer what the tool uses: P-256 key generation and
+// ECDSA signatures.
+func fipsClaim(certificate string, mechanisms map[uint]pkcs11.MechanismInfo) (string, error) {
+	if certificate == "" {
+		return "", nil
+	}
+	claim := fmt.Sprintf("CMVP certificate #%s", strings.TrimPrefix(certificate, "#"))
+
+	for _, m := range fipsMechanisms {
+		info, ok := mechanisms[m.mechanism]
+		if !ok || info.Flags&m.flag == 0 {
+			return claim, fmt.Errorf("the slot does not offer %s", mechanismName(m.mechanism))
+		}
+	}
+	if gen := mechanisms[pkcs11.CKM_EC_KEY_PAIR_GEN]; gen.MinKeySize > 256 || gen.MaxKeySize < 256 {
+		return claim, errors.New("the slot does not generate P-256 keys")
+	}
+	return claim, nil
+}
+
+// describeFIPSClaim reports a claim returned by fipsClaim, as hsm info and doctor print it
+func describeFIPSClaim(claim string, err error) string {
+	switch {
+	case err != nil:
+		return fmt.Sprintf("claimed (%s), but %v", claim, err)
+	case claim == "":
+		return "not claimed (set pkcs11.fipscertificate)"
+	}
+	return fmt.Sprintf("claimed (%s)", claim)
+}
@@ -0,0 +1,115 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" // #nosec G505 only to check that FIPS mode refuses it
+	"crypto/sha256"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+// TestFIPSClaim bases the claim on the certificate asserted and the mechanisms the slot reports, not on descriptions
+func TestFIPSClaim(t *testing.T) {
+	approved := map[uint]pkcs11.MechanismInfo{
+		pkcs11.CKM_EC_KEY_PAIR_GEN: {MinKeySize: 256, MaxKeySize: 521, Flags: pkcs11.CKF_GENERATE_KEY_PAIR},
+		pkcs11.CKM_ECDSA:           {MinKeySize: 256, MaxKeySize: 521, Flags: pkcs11.CKF_SIGN | pkcs11.CKF_VERIFY},
+	}
+
+	for _, tt := range []struct {
+		name        string
+		certificate string
+		mechanisms  map[uint]pkcs11.MechanismInfo
+		wantClaim   string
+		wantErr     bool
+	}{
+		{"not asserted", "", approved, "", false},
+		{"asserted", "4466", approved, "CMVP certificate #4466", false},
+		{"asserted with #", "#4466", approved, "CMVP certificate #4466", false},
+		{"no ECDSA", "4466", map[uint]pkcs11.MechanismInfo{
+			pkcs11.CKM_EC_KEY_PAIR_GEN: approved[pkcs11.CKM_EC_KEY_PAIR_GEN],
+		}, "CMVP certificate #4466", true},
+		{"ECDSA verify only", "4466", map[uint]pkcs11.MechanismInfo{
+			pkcs11.CKM_EC_KEY_PAIR_GEN: approved[pkcs11.CKM_EC_KEY_PAIR_GEN],
+			pkcs11.CKM_ECDSA:           {MinKeySize: 256, MaxKeySize: 521, Flags: pkcs11.CKF_VERIFY},
+		}, "CMVP certificate #4466", true},
+		{"no P-256", "4466", map[uint]pkcs11.MechanismInfo{
+			pkcs11.CKM_EC_KEY_PAIR_GEN: {MinKeySize: 384, MaxKeySize: 521, Flags: pkcs11.CKF_GENERATE_KEY_PAIR},
+			pkcs11.CKM_ECDSA:           approved[pkcs11.CKM_ECDSA],
+		}, "CMVP certificate #4466", true},
+	} {
+		claim, err := fipsClaim(tt.certificate, tt.mechanisms)
+		if claim != tt.wantClaim || (err != nil) != tt.wantErr {
+			t.Errorf("%s: fipsClaim = %q, %v; want %q, error %v", tt.name, claim, err, tt.wantClaim, tt.wantErr)
+		}
+	}
+}
+
+// TestFIPSToken refuses tokens whose keys are not approved, and has the signers of the others refuse digests that are
+// not, whether the signature is requested locally or through a RemoteSigner
+func TestFIPSToken(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &keyBackend{Backend: NewMemoryBackend(), tokens: map[string]*Token{}}
+	backend.add(t, []byte{0x01}, ecKey)
+	backend.add(t, []byte{0x02}, edKey)
+	backend.add(t, []byte{0x03}, weakKey)
+
+	c := NewWithBackend(backend)
+	c.SetQuiet(true)
+	c.SetFIPS(true)
+
+	sha256Digest := sha256.Sum256([]byte("payload"))
+	sha1Digest := sha1.Sum([]byte("payload")) // #nosec G401 only to check that FIPS mode refuses it
+	for _, tt := range []struct {
+		name     string
+		id       byte
+		digest   []byte
+		opts     crypto.SignerOpts
+		wantExit int
+	}{
+		{"ECDSA SHA-256", 0x01, sha256Digest[:], crypto.SHA256, ExitOK},
+		{"ECDSA SHA-1", 0x01, sha1Digest[:], crypto.SHA1, ExitDenied},
+		{"Ed25519", 0x02, []byte("payload"), crypto.Hash(0), ExitOK},
+		{"RSA-1024", 0x03, sha256Digest[:], crypto.SHA256, ExitDenied},
+	} {
+		token, err := c.fipsToken(backend.tokens[string([]byte{tt.id})])
+		if err == nil {
+			_, err = token.Signer.Sign(rand.Reader, tt.digest, tt.opts)
+		}
+		if ExitCode(err) != tt.wantExit {
+			t.Errorf("%s: Sign = %v; want exit code %d", tt.name, err, tt.wantExit)
+		}
+	}
+
+	server := newRemoteServer(c, backend, false)
+	_, err = server.sign(&remoteSignRequest{ID: []byte{0x01}, Digest: sha256Digest[:], Hash: "SHA-256"})
+	if err != nil {
+		t.Errorf("remote Sign: %v", err)
+	}
+	_, err = server.sign(&remoteSignRequest{ID: []byte{0x03}, Digest: sha256Digest[:], Hash: "SHA-256"})
+	if ExitCode(err) != ExitDenied {
+		t.Errorf("remote Sign with RSA-1024 = %v; want exit code %d", err, ExitDenied)
+	}
+}
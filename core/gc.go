@@ -0,0 +1,98 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Orphan is a private key without a certificate, or a certificate without a private key, such as is left behind by an
+// interrupted generate or delete
+type Orphan struct {
+	ID []byte
+	// Kind is "private key" or "certificate"
+	Kind string
+	// Object names the orphan within the keystore, as does DescribeObjects
+	Object string
+}
+
+// orphanCollector is implemented by backends able to enumerate their keys and certificates independently, and thus
+// to find and remove orphans
+type orphanCollector interface {
+	Orphans() ([]Orphan, error)
+	RemoveOrphan(orphan Orphan) error
+}
+
+// GC removes the orphaned keys and certificates within the keystore, after asking the user to confirm unless force
+// is set
+func (c *Core) GC(force bool) error {
+	backend := c.getBackend()
+	err := c.checkPolicy(PolicyGC, "")
+	if err != nil {
+		return err
+	}
+
+	collector, ok := backend.(orphanCollector)
+	if !ok {
+		return errors.New("the keystore backend does not support gc (available with pkcs11 and softkeys)")
+	}
+
+	stop := c.startSpinner("Searching for orphaned objects...")
+	orphans, err := collector.Orphans()
+	stop()
+	if err != nil {
+		return err
+	}
+
+	if len(orphans) == 0 {
+		if !c.quiet {
+			fmt.Fprintf(os.Stderr, "No orphaned objects\n")
+		}
+		return nil
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"ID", "Object"})
+	table.SetAutoWrapText(false)
+	for _, o := range orphans {
+		table.Append([]string{describeID(o.ID), o.Object})
+	}
+	table.Render()
+
+	if c.dryRun {
+		var objects []string
+		for _, o := range orphans {
+			objects = append(objects, o.Object)
+		}
+		printPlan("remove", objects)
+		return nil
+	}
+
+	if !force {
+		ok, err := confirm(fmt.Sprintf("Permanently remove these %d orphaned object(s)?", len(orphans)))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("cancelled")
+		}
+	}
+
+	stop = c.startSpinner(fmt.Sprintf("Removing %d orphaned object(s)...", len(orphans)))
+	defer stop()
+
+	for _, o := range orphans {
+		err = collector.RemoveOrphan(o)
+		if err != nil {
+			return fmt.Errorf("%s: %w", o.Object, err)
+		}
+	}
+
+	return nil
+}
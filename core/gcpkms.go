@@ -0,0 +1,248 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2/google"
+
+	"github.com/manetu/security-token/config"
+)
+
+func init() {
+	RegisterBackend("gcpkms", newGcpKmsBackend)
+}
+
+const gcpKmsEndpoint = "https://cloudkms.googleapis.com/v1/"
+
+// gcpKmsBackend keeps the signing key in Google Cloud KMS as an EC_SIGN_P256_SHA256 crypto key within the
+// configured key ring.  Certificates are kept in a local directory since Cloud KMS cannot hold them.
+type gcpKmsBackend struct {
+	keyRing         string
+	protectionLevel string
+	client          *http.Client
+	certs           certStore
+}
+
+type gcpError struct {
+	Error struct {
+		Code    int
+		Message string
+		Status  string
+	}
+}
+
+func newGcpKmsBackend(cfg *config.Configuration) (Backend, error) {
+	if cfg.GcpKms.KeyRing == "" {
+		return nil, errors.New("gcpkms.keyring must be configured")
+	}
+
+	// Application Default Credentials: GOOGLE_APPLICATION_CREDENTIALS, gcloud or the GCE/GKE metadata server
+	client, err := google.DefaultClient(context.Background(), "https://www.googleapis.com/auth/cloudkms")
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = 30 * time.Second
+
+	certs, err := newFileCertStore(cfg.GcpKms.CertificatePath, "gcpkms")
+	if err != nil {
+		return nil, err
+	}
+
+	level := cfg.GcpKms.ProtectionLevel
+	if level == "" {
+		level = "HSM"
+	}
+
+	return &gcpKmsBackend{
+		keyRing:         cfg.GcpKms.KeyRing,
+		protectionLevel: level,
+		client:          client,
+		certs:           certs,
+	}, nil
+}
+
+// do issues a REST call against the Cloud KMS API, relative to the v1 endpoint
+func (b *gcpKmsBackend) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, gcpKmsEndpoint+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		e := &gcpError{}
+		if json.Unmarshal(data, e) != nil || e.Error.Message == "" {
+			return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return fmt.Errorf("%s: %s", e.Error.Status, e.Error.Message)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// keyVersion returns the resource name of the (only) version of the crypto key for id.  Crypto key ids are limited
+// to 63 characters, too short for a hex encoded serial, so we use unpadded base64url instead.
+func (b *gcpKmsBackend) keyVersion(id []byte) string {
+	return fmt.Sprintf("%s/cryptoKeys/%s/cryptoKeyVersions/1", b.keyRing, base64.RawURLEncoding.EncodeToString(id))
+}
+
+func (b *gcpKmsBackend) Generate(id []byte) (crypto.Signer, error) {
+	path := fmt.Sprintf("%s/cryptoKeys?cryptoKeyId=%s", b.keyRing, base64.RawURLEncoding.EncodeToString(id))
+	err := b.do(http.MethodPost, path, map[string]interface{}{
+		"purpose": "ASYMMETRIC_SIGN",
+		"versionTemplate": map[string]string{
+			"algorithm":       "EC_SIGN_P256_SHA256",
+			"protectionLevel": b.protectionLevel,
+		},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	version := b.keyVersion(id)
+
+	// HSM protected keys are generated asynchronously
+	for i := 0; ; i++ {
+		var v struct {
+			State string
+		}
+		err = b.do(http.MethodGet, version, nil, &v)
+		if err != nil {
+			return nil, err
+		}
+		if v.State == "ENABLED" {
+			break
+		}
+		if v.State != "PENDING_GENERATION" || i >= 60 {
+			return nil, fmt.Errorf("key version %s is in state %s", version, v.State)
+		}
+		time.Sleep(time.Second)
+	}
+
+	var pub struct {
+		Pem string
+	}
+	err = b.do(http.MethodGet, version+"/publicKey", nil, &pub)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(pub.Pem))
+	if block == nil {
+		return nil, errors.New("error decoding public key")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the public key: %w", err)
+	}
+
+	return &gcpKmsSigner{backend: b, version: version, pub: key}, nil
+}
+
+func (b *gcpKmsBackend) ImportCertificate(id []byte, cert *x509.Certificate) error {
+	return b.certs.Put(id, cert)
+}
+
+func (b *gcpKmsBackend) Certificates() ([]*x509.Certificate, error) {
+	return b.certs.List()
+}
+
+func (b *gcpKmsBackend) FindToken(id []byte) (*Token, error) {
+	cert, err := b.certs.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return nil, nil
+	}
+
+	return &Token{
+		Signer: &gcpKmsSigner{backend: b, version: b.keyVersion(id), pub: cert.PublicKey},
+		Cert:   cert,
+	}, nil
+}
+
+func (b *gcpKmsBackend) Delete(id []byte) error {
+	err := b.certs.Delete(id)
+	if err != nil {
+		return err
+	}
+
+	// Cloud KMS never deletes crypto keys; destroying the version schedules the key material for destruction
+	return b.do(http.MethodPost, b.keyVersion(id)+":destroy", map[string]string{}, nil)
+}
+
+func (b *gcpKmsBackend) Close() error {
+	return nil
+}
+
+// gcpKmsSigner implements crypto.Signer by delegating to the Cloud KMS asymmetricSign API
+type gcpKmsSigner struct {
+	backend *gcpKmsBackend
+	version string
+	pub     crypto.PublicKey
+}
+
+func (s *gcpKmsSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *gcpKmsSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+	}
+
+	var signed struct {
+		Signature []byte
+	}
+	err := s.backend.do(http.MethodPost, s.version+":asymmetricSign", map[string]interface{}{
+		"digest": map[string][]byte{
+			"sha256": digest,
+		},
+	}, &signed)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cloud KMS returns a DER encoded ECDSA signature, as crypto.Signer requires
+	return signed.Signature, nil
+}
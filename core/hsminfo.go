@@ -0,0 +1,224 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+	"github.com/olekukonko/tablewriter"
+)
+
+var mechanismNames = map[uint]string{
+	pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN: "CKM_RSA_PKCS_KEY_PAIR_GEN",
+	pkcs11.CKM_RSA_PKCS:              "CKM_RSA_PKCS",
+	pkcs11.CKM_RSA_PKCS_OAEP:         "CKM_RSA_PKCS_OAEP",
+	pkcs11.CKM_RSA_PKCS_PSS:          "CKM_RSA_PKCS_PSS",
+	pkcs11.CKM_SHA256_RSA_PKCS:       "CKM_SHA256_RSA_PKCS",
+	pkcs11.CKM_SHA384_RSA_PKCS:       "CKM_SHA384_RSA_PKCS",
+	pkcs11.CKM_SHA512_RSA_PKCS:       "CKM_SHA512_RSA_PKCS",
+	pkcs11.CKM_SHA256_RSA_PKCS_PSS:   "CKM_SHA256_RSA_PKCS_PSS",
+	pkcs11.CKM_SHA384_RSA_PKCS_PSS:   "CKM_SHA384_RSA_PKCS_PSS",
+	pkcs11.CKM_SHA512_RSA_PKCS_PSS:   "CKM_SHA512_RSA_PKCS_PSS",
+	pkcs11.CKM_EC_KEY_PAIR_GEN:       "CKM_EC_KEY_PAIR_GEN",
+	pkcs11.CKM_ECDSA:                 "CKM_ECDSA",
+	pkcs11.CKM_ECDSA_SHA1:            "CKM_ECDSA_SHA1",
+	pkcs11.CKM_ECDSA_SHA256:          "CKM_ECDSA_SHA256",
+	pkcs11.CKM_ECDSA_SHA384:          "CKM_ECDSA_SHA384",
+	pkcs11.CKM_ECDSA_SHA512:          "CKM_ECDSA_SHA512",
+	pkcs11.CKM_ECDH1_DERIVE:          "CKM_ECDH1_DERIVE",
+	pkcs11.CKM_AES_KEY_GEN:           "CKM_AES_KEY_GEN",
+	pkcs11.CKM_AES_KEY_WRAP:          "CKM_AES_KEY_WRAP",
+	pkcs11.CKM_AES_KEY_WRAP_PAD:      "CKM_AES_KEY_WRAP_PAD",
+	pkcs11.CKM_AES_CBC_PAD:           "CKM_AES_CBC_PAD",
+	pkcs11.CKM_AES_GCM:               "CKM_AES_GCM",
+	pkcs11.CKM_SHA256:                "CKM_SHA256",
+	pkcs11.CKM_SHA384:                "CKM_SHA384",
+	pkcs11.CKM_SHA512:                "CKM_SHA512",
+}
+
+func mechanismName(m uint) string {
+	if name, ok := mechanismNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%08X", m)
+}
+
+func mechanismFlags(flags uint) string {
+	var names []string
+	for _, f := range []struct {
+		flag uint
+		name string
+	}{
+		{pkcs11.CKF_ENCRYPT, "encrypt"},
+		{pkcs11.CKF_DECRYPT, "decrypt"},
+		{pkcs11.CKF_DIGEST, "digest"},
+		{pkcs11.CKF_SIGN, "sign"},
+		{pkcs11.CKF_VERIFY, "verify"},
+		{pkcs11.CKF_GENERATE, "generate"},
+		{pkcs11.CKF_GENERATE_KEY_PAIR, "generate-key-pair"},
+		{pkcs11.CKF_WRAP, "wrap"},
+		{pkcs11.CKF_UNWRAP, "unwrap"},
+		{pkcs11.CKF_DERIVE, "derive"},
+	} {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ecCurves returns the NIST curves whose sizes fall within the advertised EC key size range
+func ecCurves(info pkcs11.MechanismInfo) []string {
+	var curves []string
+	for _, curve := range []struct {
+		bits uint
+		name string
+	}{
+		{256, "P-256"},
+		{384, "P-384"},
+		{521, "P-521"},
+	} {
+		if curve.bits >= info.MinKeySize && curve.bits <= info.MaxKeySize {
+			curves = append(curves, curve.name)
+		}
+	}
+	return curves
+}
+
+func orNone(values []string) string {
+	if len(values) == 0 {
+		return "none"
+	}
+	return strings.Join(values, ", ")
+}
+
+// HSMInfo reports the available slots and tokens, along with the mechanisms each supports
+func (c *Core) HSMInfo() error {
+	cfg, err := c.readConfig()
+	if err != nil {
+		return classify(ExitConfig, err)
+	}
+
+	// the report is printed only once complete, rather than by a module abandoned part way
+	var out strings.Builder
+	err = withModule(cfg.Pkcs11, "reading the slots", func(p *pkcs11.Ctx) error {
+		info, err := p.GetInfo()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(&out, "Library: %s (%s) v%d.%d, Cryptoki %d.%d\n",
+			strings.TrimSpace(info.LibraryDescription), strings.TrimSpace(info.ManufacturerID),
+			info.LibraryVersion.Major, info.LibraryVersion.Minor,
+			info.CryptokiVersion.Major, info.CryptokiVersion.Minor)
+
+		slots, err := p.GetSlotList(true)
+		if err != nil {
+			return err
+		}
+
+		for _, slot := range slots {
+			err = printSlotInfo(&out, p, slot, cfg.Pkcs11.FipsCertificate)
+			if err != nil {
+				return fmt.Errorf("slot %d: %w", slot, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(out.String())
+	return nil
+}
+
+// mechanismInfos returns the information of each mechanism that slot offers
+func mechanismInfos(p *pkcs11.Ctx, slot uint) (map[uint]pkcs11.MechanismInfo, error) {
+	mechanisms, err := p.GetMechanismList(slot)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := map[uint]pkcs11.MechanismInfo{}
+	for _, m := range mechanisms {
+		mi, err := p.GetMechanismInfo(slot, []*pkcs11.Mechanism{m})
+		if err != nil {
+			return nil, err
+		}
+		infos[m.Mechanism] = mi
+	}
+	return infos, nil
+}
+
+// printSlotInfo prints the token and mechanisms of slot, along with the FIPS validation asserted by fipsCertificate
+func printSlotInfo(w io.Writer, p *pkcs11.Ctx, slot uint, fipsCertificate string) error {
+	slotInfo, err := p.GetSlotInfo(slot)
+	if err != nil {
+		return err
+	}
+
+	tokenInfo, err := p.GetTokenInfo(slot)
+	if err != nil {
+		return err
+	}
+
+	mechanisms, err := p.GetMechanismList(slot)
+	if err != nil {
+		return err
+	}
+
+	var (
+		curves []string
+		rsa    []string
+		wrap   []string
+		infos  = map[uint]pkcs11.MechanismInfo{}
+	)
+
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"Mechanism", "Min Key", "Max Key", "Flags"})
+
+	for _, m := range mechanisms {
+		mi, err := p.GetMechanismInfo(slot, []*pkcs11.Mechanism{m})
+		if err != nil {
+			return err
+		}
+		infos[m.Mechanism] = mi
+
+		switch m.Mechanism {
+		case pkcs11.CKM_EC_KEY_PAIR_GEN:
+			curves = ecCurves(mi)
+		case pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN:
+			rsa = []string{fmt.Sprintf("%d-%d bits", mi.MinKeySize, mi.MaxKeySize)}
+		}
+		if mi.Flags&pkcs11.CKF_WRAP != 0 {
+			wrap = append(wrap, mechanismName(m.Mechanism))
+		}
+
+		table.Append([]string{
+			mechanismName(m.Mechanism),
+			fmt.Sprintf("%d", mi.MinKeySize),
+			fmt.Sprintf("%d", mi.MaxKeySize),
+			mechanismFlags(mi.Flags),
+		})
+	}
+
+	fmt.Fprintf(w, "\nSlot %d: %s\n", slot, strings.TrimSpace(slotInfo.SlotDescription))
+	fmt.Fprintf(w, "  Token:    %s (%s %s, serial %s)\n",
+		strings.TrimSpace(tokenInfo.Label), strings.TrimSpace(tokenInfo.ManufacturerID),
+		strings.TrimSpace(tokenInfo.Model), strings.TrimSpace(tokenInfo.SerialNumber))
+	fmt.Fprintf(w, "  Firmware: %d.%d\n", tokenInfo.FirmwareVersion.Major, tokenInfo.FirmwareVersion.Minor)
+	fmt.Fprintf(w, "  Hardware: %d.%d\n", tokenInfo.HardwareVersion.Major, tokenInfo.HardwareVersion.Minor)
+	fmt.Fprintf(w, "  ECDSA:    %s\n", orNone(curves))
+	fmt.Fprintf(w, "  RSA:      %s\n", orNone(rsa))
+	fmt.Fprintf(w, "  Wrap:     %s\n", orNone(wrap))
+	fmt.Fprintf(w, "  FIPS:     %s\n", describeFIPSClaim(fipsClaim(fipsCertificate, infos)))
+	table.Render()
+
+	return nil
+}
@@ -0,0 +1,76 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// JWK is the public JSON Web Key (RFC 7517) of a security token
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// NewJWK returns the JWK of an ECDSA, RSA or Ed25519 public key
+func NewJWK(pub crypto.PublicKey) (JWK, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return JWK{
+			Kty: "EC",
+			Crv: pub.Curve.Params().Name,
+			X:   b64(pub.X.FillBytes(make([]byte, size))),
+			Y:   b64(pub.Y.FillBytes(make([]byte, size))),
+		}, nil
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			N:   b64(pub.N.Bytes()),
+			E:   b64(big.NewInt(int64(pub.E)).Bytes()),
+		}, nil
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: b64(pub)}, nil
+	default:
+		return JWK{}, fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of the key: the base64url encoded SHA-256 digest of its required members,
+// serialized in lexicographic order without whitespace
+func (j JWK) Thumbprint() (string, error) {
+	members := map[string]string{"kty": j.Kty}
+	switch j.Kty {
+	case "EC":
+		members["crv"], members["x"], members["y"] = j.Crv, j.X, j.Y
+	case "RSA":
+		members["e"], members["n"] = j.E, j.N
+	case "OKP":
+		members["crv"], members["x"] = j.Crv, j.X
+	default:
+		return "", fmt.Errorf("unsupported key type %q", j.Kty)
+	}
+
+	// encoding/json orders the keys of maps, and the members hold no characters that it would escape
+	data, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,147 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// JWSOptions configures SignJWS
+type JWSOptions struct {
+	// Headers are added to the protected header.  They may not set alg, which follows the key of the token.
+	Headers map[string]interface{}
+	// X5C includes the certificate of the token in the protected header
+	X5C bool
+	// Detached omits the payload from the JWS (RFC 7515 appendix F), for the verifier to supply
+	Detached bool
+	// Unencoded signs the payload as is rather than base64url encoded (RFC 7797), as some detached request signing
+	// schemes require.  It implies Detached.
+	Unencoded bool
+	// Format is "compact" (the default) or "json", the general JSON serialization
+	Format string
+}
+
+// jwsGeneral is the general JSON serialization of a JWS (RFC 7515 section 7.2.1)
+type jwsGeneral struct {
+	Payload    *string               `json:"payload,omitempty"`
+	Signatures []jwsGeneralSignature `json:"signatures"`
+}
+
+type jwsGeneralSignature struct {
+	Protected string `json:"protected"`
+	Signature string `json:"signature"`
+}
+
+// SignJWS signs payload with the key of the token identified by serial as a JWS, for webhook and API request signing
+// schemes as well as the assertions of login
+func (c *Core) SignJWS(serial string, payload []byte, opts JWSOptions) (string, error) {
+	format := orDefault(opts.Format, "compact")
+	if format != "compact" && format != "json" {
+		return "", classify(ExitConfig, fmt.Errorf("unsupported JWS format %q (available: compact, json)", opts.Format))
+	}
+	if _, ok := opts.Headers["alg"]; ok {
+		return "", classify(ExitConfig, errors.New("the alg header follows the key of the token and may not be set"))
+	}
+
+	token, err := c.getToken(serial)
+	if err != nil {
+		return "", err
+	}
+	alg, hasher, signOpts, err := jwsAlgorithm(token.Signer, 0)
+	if err != nil {
+		return "", err
+	}
+
+	header := map[string]interface{}{}
+	for k, v := range opts.Headers {
+		header[k] = v
+	}
+	header["alg"] = alg
+	if opts.X5C {
+		header["x5c"] = []string{base64.StdEncoding.EncodeToString(token.Cert.Raw)}
+	}
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	if opts.Unencoded {
+		opts.Detached = true
+		header["b64"] = false
+		header["crit"] = appendCrit(header["crit"], "b64")
+		encodedPayload = string(payload)
+	}
+
+	head, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(head)
+
+	sig, err := jwsSignature(token.Signer, hasher, signOpts, []byte(protected+"."+encodedPayload))
+	c.audit("jws-sign", token.Cert, err)
+	if err != nil {
+		return "", err
+	}
+	signature := base64.RawURLEncoding.EncodeToString(sig)
+
+	if opts.Detached {
+		encodedPayload = ""
+	}
+	if format == "compact" {
+		return protected + "." + encodedPayload + "." + signature, nil
+	}
+
+	general := jwsGeneral{Signatures: []jwsGeneralSignature{{Protected: protected, Signature: signature}}}
+	if !opts.Detached {
+		general.Payload = &encodedPayload
+	}
+	data, err := json.MarshalIndent(general, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// appendCrit adds name to the crit header given, keeping any others
+func appendCrit(crit interface{}, name string) []string {
+	var names []string
+	switch v := crit.(type) {
+	case []interface{}:
+		for _, n := range v {
+			names = append(names, fmt.Sprint(n))
+		}
+	case string:
+		names = strings.Split(v, ",")
+	}
+	for _, n := range names {
+		if n == name {
+			return names
+		}
+	}
+	return append(names, name)
+}
+
+// jwsSignature signs the JWS signing input data with signer, converting an ECDSA signature from DER to the raw r||s
+// form that JWS requires (RFC 7518 section 3.4)
+func jwsSignature(signer crypto.Signer, hasher crypto.Hash, opts crypto.SignerOpts, data []byte) ([]byte, error) {
+	h := hasher.New()
+	h.Write(data)
+
+	sig, err := signer.Sign(rand.Reader, h.Sum(nil), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, ok := signer.Public().(*ecdsa.PublicKey)
+	if !ok {
+		// RSA signatures are used as is
+		return sig, nil
+	}
+	return rawSignature(sig, (pub.Params().BitSize+7)/8)
+}
@@ -0,0 +1,139 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/sha1" // #nosec G505 the JKS integrity check is defined with SHA-1
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// KeystoreOptions selects the format and destination of a Java keystore
+type KeystoreOptions struct {
+	// Format is "jks" or "pkcs12-truststore"
+	Format string
+	// Out names the file written
+	Out string
+	// Password protects the integrity of the keystore, defaulting to "changeit" as do the JDK's own truststores
+	Password string
+	// Alias of the certificate of the token, defaulting to one naming the token; its chain follows as <alias>-ca1 ...
+	Alias string
+	// Certificate names a PEM file holding a certificate issued to the token, followed by its chain, exported in place
+	// of the token's self-signed certificate
+	Certificate string
+}
+
+// ExportKeystore writes the certificate of the token identified by serial, with its chain, as trusted certificate
+// entries of a keystore that JVM applications load with KeyStore.getInstance("JKS") or ("PKCS12"), such as the
+// javax.net.ssl.trustStore of a service accepting Manetu identities.  The private key never leaves the token, so no key
+// entry is written; JVM applications reach the key of a PKCS#11 token through the SunPKCS11 provider.
+func (c *Core) ExportKeystore(serial string, opts KeystoreOptions) (err error) {
+	if opts.Format != "jks" && opts.Format != "pkcs12-truststore" {
+		return classify(ExitConfig, fmt.Errorf("unsupported keystore format %q (available: jks, pkcs12-truststore)", opts.Format))
+	}
+	if opts.Format == "jks" {
+		err = c.checkFIPS("the SHA-1 integrity check of a JKS keystore")
+		if err != nil {
+			return err
+		}
+	}
+	if opts.Out == "" {
+		return classify(ExitConfig, errors.New("the keystore must be written to a file given with --out"))
+	}
+
+	token, err := c.getToken(serial)
+	if err != nil {
+		return err
+	}
+	chain, err := exportChain(token, opts.Certificate)
+	if err != nil {
+		return err
+	}
+
+	alias := strings.ToLower(orDefault(opts.Alias, "manetu-"+strings.ReplaceAll(HexEncode(token.Cert.SerialNumber.Bytes()), ":", "")))
+	password := orDefault(opts.Password, "changeit")
+	aliases := make([]string, len(chain))
+	for i := range chain {
+		aliases[i] = alias
+		if i > 0 {
+			aliases[i] = fmt.Sprintf("%s-ca%d", alias, i)
+		}
+	}
+
+	if c.dryRun {
+		printPlan(fmt.Sprintf("write a %s keystore to %s holding", opts.Format, opts.Out), aliases)
+		return nil
+	}
+
+	defer func() {
+		c.audit("export-keystore", token.Cert, err)
+	}()
+
+	var data []byte
+	if opts.Format == "jks" {
+		data, err = encodeJKS(chain, aliases, password)
+	} else {
+		entries := make([]pkcs12.TrustStoreEntry, len(chain))
+		for i, cert := range chain {
+			entries[i] = pkcs12.TrustStoreEntry{Cert: cert, FriendlyName: aliases[i]}
+		}
+		data, err = pkcs12.Modern.EncodeTrustStoreEntries(entries, password)
+	}
+	if err != nil {
+		return err
+	}
+
+	// #nosec G306 a truststore holds only public certificates
+	return os.WriteFile(opts.Out, data, 0644)
+}
+
+// encodeJKS encodes certs as the trusted certificate entries of a JKS keystore, named by aliases
+func encodeJKS(certs []*x509.Certificate, aliases []string, password string) ([]byte, error) {
+	var buf bytes.Buffer
+	write := func(v interface{}) {
+		_ = binary.Write(&buf, binary.BigEndian, v)
+	}
+	writeUTF := func(s string) {
+		write(uint16(len(s)))
+		buf.WriteString(s)
+	}
+
+	write(uint32(0xfeedfeed))
+	write(uint32(2))
+	write(uint32(len(certs)))
+	now := time.Now().UnixMilli()
+	for i, cert := range certs {
+		if len(aliases[i]) > 0xffff {
+			return nil, fmt.Errorf("alias %q is too long", aliases[i])
+		}
+		// a trustedCertEntry
+		write(uint32(2))
+		writeUTF(aliases[i])
+		write(now)
+		writeUTF("X.509")
+		write(uint32(len(cert.Raw)))
+		buf.Write(cert.Raw)
+	}
+
+	// the keyed digest over the password, as UTF-16BE, a fixed whitener and the entries
+	h := sha1.New() // #nosec G401
+	for _, c := range utf16.Encode([]rune(password)) {
+		h.Write([]byte{byte(c >> 8), byte(c)})
+	}
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(buf.Bytes())
+	buf.Write(h.Sum(nil))
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,198 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/sha1" // #nosec G505 the JKS integrity check is defined with SHA-1
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// decodeJKS reads the trusted certificate entries of a JKS keystore, as the JDK's KeyStore.load does, returning the
+// aliases and certificates of its entries after checking its integrity with password
+func decodeJKS(data []byte, password string) ([]string, [][]byte, error) {
+	if len(data) < sha1.Size {
+		return nil, nil, errors.New("truncated")
+	}
+	body, digest := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	h := sha1.New() // #nosec G401
+	for _, c := range utf16.Encode([]rune(password)) {
+		h.Write([]byte{byte(c >> 8), byte(c)})
+	}
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(body)
+	if !bytes.Equal(h.Sum(nil), digest) {
+		return nil, nil, errors.New("keystore was tampered with, or password was incorrect")
+	}
+
+	r := bytes.NewReader(body)
+	var header struct{ Magic, Version, Count uint32 }
+	err := binary.Read(r, binary.BigEndian, &header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header.Magic != 0xfeedfeed || header.Version != 2 {
+		return nil, nil, fmt.Errorf("not a JKS keystore: magic %#x, version %d", header.Magic, header.Version)
+	}
+	readUTF := func() (string, error) {
+		var n uint16
+		err := binary.Read(r, binary.BigEndian, &n)
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		_, err = r.Read(b)
+		return string(b), err
+	}
+
+	var aliases []string
+	var certs [][]byte
+	for i := uint32(0); i < header.Count; i++ {
+		var tag uint32
+		err = binary.Read(r, binary.BigEndian, &tag)
+		if err != nil {
+			return nil, nil, err
+		}
+		if tag != 2 {
+			return nil, nil, fmt.Errorf("entry %d is not a trustedCertEntry", i)
+		}
+		alias, err := readUTF()
+		if err != nil {
+			return nil, nil, err
+		}
+		var created int64
+		err = binary.Read(r, binary.BigEndian, &created)
+		if err != nil {
+			return nil, nil, err
+		}
+		certType, err := readUTF()
+		if err != nil || certType != "X.509" {
+			return nil, nil, fmt.Errorf("entry %d holds a certificate of type %q", i, certType)
+		}
+		var n uint32
+		err = binary.Read(r, binary.BigEndian, &n)
+		if err != nil {
+			return nil, nil, err
+		}
+		der := make([]byte, n)
+		_, err = r.Read(der)
+		if err != nil {
+			return nil, nil, err
+		}
+		aliases, certs = append(aliases, alias), append(certs, der)
+	}
+	if r.Len() != 0 {
+		return nil, nil, fmt.Errorf("%d bytes follow the entries", r.Len())
+	}
+	return aliases, certs, nil
+}
+
+func TestEncodeJKS(t *testing.T) {
+	_, root := testCA(t, "Root")
+	_, other := testCA(t, "Other")
+	certs := []*x509.Certificate{root, other}
+
+	for _, password := range []string{"changeit", "pässwörd", ""} {
+		data, err := encodeJKS(certs, []string{"leaf", "leaf-ca1"}, password)
+		if err != nil {
+			t.Fatalf("encodeJKS: %v", err)
+		}
+		aliases, ders, err := decodeJKS(data, password)
+		if err != nil {
+			t.Fatalf("decodeJKS with %q: %v", password, err)
+		}
+		if len(aliases) != 2 || aliases[0] != "leaf" || aliases[1] != "leaf-ca1" {
+			t.Errorf("aliases = %v; want [leaf leaf-ca1]", aliases)
+		}
+		for i := range ders {
+			if !bytes.Equal(ders[i], certs[i].Raw) {
+				t.Errorf("certificate %d differs from that encoded", i)
+			}
+		}
+
+		_, _, err = decodeJKS(data, password+"x")
+		if err == nil {
+			t.Errorf("the keystore protected by %q loaded with another password", password)
+		}
+	}
+
+	_, err := encodeJKS(certs[:1], []string{string(make([]byte, 0x10000))}, "changeit")
+	if err == nil {
+		t.Error("an alias too long for the keystore was encoded")
+	}
+}
+
+func TestExportKeystore(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	c := NewWithBackend(NewMemoryBackend())
+	c.SetQuiet(true)
+	defer c.Close()
+
+	cert, err := c.Generate("acme")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	serial := HexEncode(cert.SerialNumber.Bytes())
+	dir := t.TempDir()
+
+	out := filepath.Join(dir, "truststore.jks")
+	err = c.ExportKeystore(serial, KeystoreOptions{Format: "jks", Out: out, Alias: "Billing"})
+	if err != nil {
+		t.Fatalf("ExportKeystore jks: %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliases, ders, err := decodeJKS(data, "changeit")
+	if err != nil {
+		t.Fatalf("decodeJKS: %v", err)
+	}
+	// the JDK lowercases the aliases of a JKS keystore
+	if len(aliases) != 1 || aliases[0] != "billing" || !bytes.Equal(ders[0], cert.Raw) {
+		t.Errorf("the keystore holds %v; want the certificate of the token as billing", aliases)
+	}
+
+	out = filepath.Join(dir, "truststore.p12")
+	err = c.ExportKeystore(serial, KeystoreOptions{Format: "pkcs12-truststore", Out: out, Password: "secret"})
+	if err != nil {
+		t.Fatalf("ExportKeystore pkcs12-truststore: %v", err)
+	}
+	data, err = os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := pkcs12.DecodeTrustStore(data, "secret")
+	if err != nil {
+		t.Fatalf("DecodeTrustStore: %v", err)
+	}
+	if len(trusted) != 1 || !trusted[0].Equal(cert) {
+		t.Errorf("the truststore holds %d certificates; want the certificate of the token", len(trusted))
+	}
+
+	err = c.ExportKeystore(serial, KeystoreOptions{Format: "jceks", Out: out})
+	if ExitCode(err) != ExitConfig {
+		t.Errorf("ExportKeystore of an unknown format = %v; want exit code %d", err, ExitConfig)
+	}
+	err = c.ExportKeystore(serial, KeystoreOptions{Format: "jks"})
+	if ExitCode(err) != ExitConfig {
+		t.Errorf("ExportKeystore without --out = %v; want exit code %d", err, ExitConfig)
+	}
+
+	c.SetFIPS(true)
+	err = c.ExportKeystore(serial, KeystoreOptions{Format: "jks", Out: filepath.Join(dir, "fips.jks")})
+	if ExitCode(err) != ExitDenied {
+		t.Errorf("ExportKeystore jks in FIPS mode = %v; want exit code %d", err, ExitDenied)
+	}
+}
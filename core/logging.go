@@ -0,0 +1,127 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel selects which diagnostics are logged to stderr, each level including those before it
+type LogLevel int
+
+const (
+	// LogWarn logs only conditions worth attention that do not fail the operation, such as a failover.  This is the
+	// default.
+	LogWarn LogLevel = iota
+	// LogInfo also logs each operation on a token, with its serial, duration and result
+	LogInfo
+	// LogDebug also logs each step taken against the keystore and each HTTP request, with their durations
+	LogDebug
+)
+
+var logLevelNames = []string{"warn", "info", "debug"}
+
+func (l LogLevel) String() string {
+	if l < 0 || int(l) >= len(logLevelNames) {
+		return strconv.Itoa(int(l))
+	}
+	return logLevelNames[l]
+}
+
+// logger writes entries as single lines of logfmt, "time=... level=... msg=... key=value ...", so that they may be
+// read or parsed alike.  Backends log without a Core, so there is one logger for the process.
+type logger struct {
+	sync.Mutex
+	w     io.Writer
+	level LogLevel
+}
+
+var logs = &logger{w: os.Stderr, level: LogWarn}
+
+// SetLogLevel selects which diagnostics are logged, for the whole process
+func SetLogLevel(level LogLevel) {
+	logs.Lock()
+	defer logs.Unlock()
+
+	logs.level = level
+}
+
+// SetLogOutput directs the log, written to stderr by default, to w
+func SetLogOutput(w io.Writer) {
+	logs.Lock()
+	defer logs.Unlock()
+
+	logs.w = w
+}
+
+// logEnabled reports whether entries of level are logged, so that callers may skip preparing them
+func logEnabled(level LogLevel) bool {
+	logs.Lock()
+	defer logs.Unlock()
+
+	return level <= logs.level
+}
+
+func logWarn(msg string, kv ...interface{}) {
+	logs.log(LogWarn, msg, kv)
+}
+
+func logInfo(msg string, kv ...interface{}) {
+	logs.log(LogInfo, msg, kv)
+}
+
+func logDebug(msg string, kv ...interface{}) {
+	logs.log(LogDebug, msg, kv)
+}
+
+// log writes msg at level, along with kv, alternating keys and values.  A nil or empty value, such as the error
+// of an operation that succeeded, is omitted.
+func (l *logger) log(level LogLevel, msg string, kv []interface{}) {
+	if !logEnabled(level) {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "time=%s level=%s msg=%s", time.Now().UTC().Format(time.RFC3339Nano), level, logValue(msg))
+	for i := 0; i+1 < len(kv); i += 2 {
+		if kv[i+1] == nil || kv[i+1] == "" {
+			continue
+		}
+		fmt.Fprintf(&b, " %v=%s", kv[i], logValue(kv[i+1]))
+	}
+	b.WriteByte('\n')
+
+	l.Lock()
+	defer l.Unlock()
+
+	_, _ = io.WriteString(l.w, b.String())
+}
+
+// logValue formats v for logfmt, quoting it when it is empty or holds spaces, quotes or equals signs
+func logValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	case time.Duration:
+		s = v.Round(time.Microsecond).String()
+	case time.Time:
+		s = v.UTC().Format(time.RFC3339)
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
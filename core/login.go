@@ -8,14 +8,16 @@ import (
 	"context"
 	"crypto"
 	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
-	"encoding/asn1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"math/big"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -24,36 +26,55 @@ import (
 
 	//lint:ignore SA1019 has dependency with clientcredentials
 	"golang.org/x/oauth2/jws"
-
-	"log"
 )
 
-func jwsHasher(pub crypto.PublicKey) (string, crypto.Hash, *elliptic.CurveParams) {
-	switch pub := pub.(type) {
+// pssSigner marks an RSA key that signs the assertion with RSASSA-PSS (PS256) rather than PKCS #1 v1.5 (RS256)
+type pssSigner struct {
+	crypto.Signer
+}
+
+// jwsAlgorithm selects the alg parameter, hash function and signing options for signer, per RFC7518.  hash, when set,
+// selects the digest of an RSA key; that of an EC key is fixed by its curve, which hash must then match.
+func jwsAlgorithm(signer crypto.Signer, hash crypto.Hash) (string, crypto.Hash, crypto.SignerOpts, error) {
+	if hash == 0 {
+		hash = matchedDigest(signer.Public())
+	}
+	bits := map[crypto.Hash]string{crypto.SHA256: "256", crypto.SHA384: "384", crypto.SHA512: "512"}[hash]
+	if bits == "" {
+		return "", 0, nil, fmt.Errorf("unsupported digest %s", hash)
+	}
+
+	switch pub := signer.Public().(type) {
 	case *ecdsa.PublicKey:
-		switch pub.Params().Name {
-		case "P-256":
-			return "ES256", crypto.SHA256, pub.Params()
-		default:
-			log.Fatal("unsupported curve " + pub.Params().Name)
+		if matched := matchedDigest(pub); hash != matched {
+			return "", 0, nil, classify(ExitConfig, fmt.Errorf("%s keys sign JWTs with %s", pub.Params().Name, matched))
+		}
+		return "ES" + bits, hash, hash, nil
+	case *rsa.PublicKey:
+		if _, ok := signer.(pssSigner); ok {
+			return "PS" + bits, hash, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash}, nil
 		}
+		return "RS" + bits, hash, hash, nil
 	default:
-		log.Fatal("unsupported signer type")
+		return "", 0, nil, fmt.Errorf("unsupported signer type %T", pub)
 	}
-
-	return "", 0, nil
 }
 
-func createJWT(signer crypto.Signer, subject, audience string) (string, error) {
-	// Select alg parameter, hash function and signature size based on RFC7518
-	alg, hasher, params := jwsHasher(signer.Public())
+// createJWT creates the assertion for subject, issued at the time of clock and signed by signer over the digest hash,
+// or that matched to its key when zero.  When x5c is given, it is included in the header as the base64 encoded DER
+// certificates of the signer and its chain, leaf first, per RFC7515.
+func createJWT(clock Clock, signer crypto.Signer, hash crypto.Hash, subject, audience string, x5c ...*x509.Certificate) (string, error) {
+	alg, hasher, opts, err := jwsAlgorithm(signer, hash)
+	if err != nil {
+		return "", err
+	}
 
 	uuid, err := uuid.NewRandom()
 	if err != nil {
 		return "", err
 	}
 
-	now := time.Now()
+	now := clock.Now()
 	duration, _ := time.ParseDuration("30s")
 	grace := time.Duration(-5) * time.Second
 	cs := &jws.ClaimSet{
@@ -71,44 +92,87 @@ func createJWT(signer crypto.Signer, subject, audience string) (string, error) {
 		Typ:       "JWT",
 	}
 
-	// Sign signs digest with the private key, possibly using entropy from
-	// rand. For an RSA key, the resulting signature should be either a
-	// PKCS #1 v1.5 or PSS signature (as indicated by opts). For an (EC)DSA
-	// key, it should be a DER-serialised, ASN.1 signature structure.
-	//
-	// This provides a wrapper around crypto.Signer to adapt to
-	// golang.org/x/oauth2/jws.Signer expected by EncodeWithSigner.
 	f := func(data []byte) ([]byte, error) {
-		h := hasher.New()
-		h.Write(data)
+		return jwsSignature(signer, hasher, opts, data)
+	}
 
-		s, err := signer.Sign(rand.Reader, h.Sum(nil), hasher)
-		if err != nil {
-			return nil, err
-		}
+	if len(x5c) == 0 {
+		return jws.EncodeWithSigner(hdr, cs, f)
+	}
 
-		var rs struct {
-			R, S *big.Int
-		}
-		_, err = asn1.Unmarshal(s, &rs)
-		if err != nil {
-			return nil, err
-		}
+	// jws.Header has no x5c, so sign the encoded claims again beneath a header of our own
+	unsigned, err := jws.EncodeWithSigner(hdr, cs, func([]byte) ([]byte, error) { return nil, nil })
+	if err != nil {
+		return "", err
+	}
+	claims := strings.Split(unsigned, ".")[1]
 
-		size := (params.BitSize + 7) / 8
-		sig := make([]byte, size*2)
+	certs := make([]string, len(x5c))
+	for i, cert := range x5c {
+		certs[i] = base64.StdEncoding.EncodeToString(cert.Raw)
+	}
+	head, err := json.Marshal(struct {
+		Algorithm string   `json:"alg"`
+		Typ       string   `json:"typ"`
+		X5C       []string `json:"x5c"`
+	}{alg, "JWT", certs})
+	if err != nil {
+		return "", err
+	}
 
-		rBytes := rs.R.Bytes()
-		sBytes := rs.S.Bytes()
-		copy(sig[size-len(rBytes):], rBytes)
-		copy(sig[(size*2)-len(sBytes):], sBytes)
-		return sig, nil
+	ss := base64.RawURLEncoding.EncodeToString(head) + "." + claims
+	sig, err := f([]byte(ss))
+	if err != nil {
+		return "", err
 	}
+	return ss + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
 
-	return jws.EncodeWithSigner(hdr, cs, f)
+// transportKey distinguishes the shared transports by the options of their connections
+type transportKey struct {
+	insecure bool
+	http2    bool
 }
 
-func getToken(v url.Values, jwt, clientID, tokenURL string, insecure bool) (*oauth2.Token, error) {
+// transports are shared by every client of the process, so that connections to a server, such as the token endpoint
+// of a service logging in repeatedly, are kept alive and reused rather than paying for a TLS handshake each time
+var (
+	transportsMu sync.Mutex
+	transports   = map[transportKey]*http.Transport{}
+)
+
+// sharedTransport returns the pooled transport verifying TLS unless insecure, and negotiating HTTP/2 when http2 is set
+func sharedTransport(insecure, http2 bool) *http.Transport {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	key := transportKey{insecure: insecure, http2: http2}
+	tr, ok := transports[key]
+	if !ok {
+		tr = &http.Transport{
+			// #nosec: G402 this is users choice, typically in a dev/test setting
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: insecure},
+			ForceAttemptHTTP2:   http2,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+		}
+		transports[key] = tr
+	}
+	return tr
+}
+
+// newHTTPClient returns a client over the shared transport, whose Timeout and Transport the caller may change
+func newHTTPClient(insecure bool) *http.Client {
+	// this is the default client used by the Token api when Transport is nil
+	return &http.Client{Transport: sharedTransport(insecure, false)}
+}
+
+// loginTimeout bounds a request to the token endpoint, so that an endpoint which never answers fails the login rather
+// than holding it, and whatever waits upon it, forever
+const loginTimeout = 30 * time.Second
+
+func getToken(ctx context.Context, v url.Values, jwt, clientID, tokenURL string, insecure, http2 bool) (*oauth2.Token, error) {
 	config := clientcredentials.Config{
 		ClientID:       clientID,
 		TokenURL:       tokenURL,
@@ -116,15 +180,12 @@ func getToken(v url.Values, jwt, clientID, tokenURL string, insecure bool) (*oau
 		AuthStyle:      oauth2.AuthStyleInParams,
 	}
 
-	tr := &http.Transport{
-		// #nosec: G402 this is users choice, typically in a dev/test setting
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+	client := &http.Client{
+		Transport: &tracingTransport{base: sharedTransport(insecure, http2)},
+		Timeout:   loginTimeout,
 	}
 
-	// this is the default client used by the Token api when Transport is nil
-	httpClient := &http.Client{Transport: tr}
-
-	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
 	token, err := config.Token(ctx)
 	if err != nil {
 		return nil, err
@@ -141,22 +202,21 @@ func refresh(refToken, jwt, clientID, tokenURL string, insecure bool) (string, e
 		"client_assertion":      {jwt},
 		"refresh_token":         {refToken},
 	}
-	tok, err := getToken(v, jwt, clientID, tokenURL, insecure)
+	tok, err := getToken(context.Background(), v, jwt, clientID, tokenURL, insecure, false)
 	if err != nil {
 		return "", err
 	}
 
-	fmt.Printf("REFRESHED %+v\n", tok.RefreshToken)
-
 	return tok.AccessToken, nil
 }
 
-func login(jwt, clientID, tokenURL string, insecure bool) (string, error) {
+// login exchanges jwt for an access token at tokenURL, negotiating HTTP/2 when http2 is set
+func login(ctx context.Context, jwt, clientID, tokenURL string, insecure, http2 bool) (string, error) {
 	v := url.Values{
 		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
 		"client_assertion":      {jwt},
 	}
-	token, err := getToken(v, jwt, clientID, tokenURL, insecure)
+	token, err := getToken(ctx, v, jwt, clientID, tokenURL, insecure, http2)
 	if err != nil {
 		return "", err
 	}
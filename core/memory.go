@@ -0,0 +1,167 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/manetu/security-token/config"
+)
+
+func init() {
+	RegisterBackend("memory", func(*config.Configuration) (Backend, error) {
+		return NewMemoryBackend(), nil
+	})
+}
+
+type memoryToken struct {
+	key   *ecdsa.PrivateKey
+	cert  *x509.Certificate
+	label string
+}
+
+// memoryBackend holds software keys in process memory only, so that tests and CI pipelines can exercise the
+// generate and login flows without any keystore.  Everything is lost when the process exits.
+type memoryBackend struct {
+	sync.Mutex
+	tokens map[string]*memoryToken
+}
+
+// NewMemoryBackend returns an empty, ephemeral keystore
+func NewMemoryBackend() Backend {
+	return &memoryBackend{tokens: map[string]*memoryToken{}}
+}
+
+func (b *memoryBackend) Generate(id []byte) (crypto.Signer, error) {
+	return b.GenerateLabeled(id, "")
+}
+
+func (b *memoryBackend) GenerateLabeled(id []byte, label string) (crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.tokens[hex.EncodeToString(id)] = &memoryToken{key: key, label: label}
+
+	return key, nil
+}
+
+func (b *memoryBackend) ImportCertificate(id []byte, cert *x509.Certificate) error {
+	b.Lock()
+	defer b.Unlock()
+
+	t, ok := b.tokens[hex.EncodeToString(id)]
+	if !ok {
+		return errors.New("no key pair for certificate")
+	}
+	t.cert = cert
+
+	return nil
+}
+
+// ReplaceCertificate overwrites the certificate of the token id, as ImportCertificate does
+func (b *memoryBackend) ReplaceCertificate(id []byte, cert *x509.Certificate) error {
+	return b.ImportCertificate(id, cert)
+}
+
+func (b *memoryBackend) Certificates() ([]*x509.Certificate, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	ids := make([]string, 0, len(b.tokens))
+	for id := range b.tokens {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var certs []*x509.Certificate
+	for _, id := range ids {
+		if cert := b.tokens[id].cert; cert != nil {
+			certs = append(certs, cert)
+		}
+	}
+
+	return certs, nil
+}
+
+func (b *memoryBackend) Labels() (map[string]string, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	labels := map[string]string{}
+	for id, t := range b.tokens {
+		if t.label != "" {
+			labels[id] = t.label
+		}
+	}
+	return labels, nil
+}
+
+func (b *memoryBackend) FindToken(id []byte) (*Token, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	t, ok := b.tokens[hex.EncodeToString(id)]
+	if !ok || t.cert == nil {
+		return nil, nil
+	}
+
+	return &Token{Signer: t.key, Cert: t.cert}, nil
+}
+
+func (b *memoryBackend) Delete(id []byte) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if _, ok := b.tokens[hex.EncodeToString(id)]; !ok {
+		return errors.New("invalid serial number")
+	}
+	delete(b.tokens, hex.EncodeToString(id))
+
+	return nil
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
+
+func (b *memoryBackend) ExportKey(id []byte) (crypto.PrivateKey, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	t, ok := b.tokens[hex.EncodeToString(id)]
+	if !ok {
+		return nil, errors.New("invalid serial number")
+	}
+
+	return t.key, nil
+}
+
+func (b *memoryBackend) ImportKey(id []byte, key crypto.PrivateKey) error {
+	k, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.tokens[hex.EncodeToString(id)] = &memoryToken{key: k}
+
+	return nil
+}
@@ -0,0 +1,241 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/manetu/security-token/core"
+	"github.com/manetu/security-token/testutil"
+)
+
+// memoryCertificate issues a self-signed certificate for the key of signer, whose serial number is id
+func memoryCertificate(t *testing.T, signer crypto.Signer, id []byte) *x509.Certificate {
+	t.Helper()
+
+	template := &x509.Certificate{
+		SerialNumber: new(big.Int).SetBytes(id),
+		Subject:      pkix.Name{Organization: []string{"test"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestMemoryBackend(t *testing.T) {
+	b := core.NewMemoryBackend()
+	defer b.Close()
+
+	id := []byte{0x01, 0x02}
+	signer, err := b.Generate(id)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	// a key pair without its certificate is not yet a token
+	token, err := b.FindToken(id)
+	if err != nil || token != nil {
+		t.Fatalf("FindToken before ImportCertificate = %v, %v; want nil, nil", token, err)
+	}
+
+	cert := memoryCertificate(t, signer, id)
+	err = b.ImportCertificate([]byte{0x09}, cert)
+	if err == nil {
+		t.Error("ImportCertificate of an unknown id succeeded")
+	}
+	err = b.ImportCertificate(id, cert)
+	if err != nil {
+		t.Fatalf("ImportCertificate: %v", err)
+	}
+
+	certs, err := b.Certificates()
+	if err != nil || len(certs) != 1 || !certs[0].Equal(cert) {
+		t.Fatalf("Certificates = %d certificates, %v; want the one imported", len(certs), err)
+	}
+
+	token, err = b.FindToken(id)
+	if err != nil || token == nil {
+		t.Fatalf("FindToken = %v, %v; want the token", token, err)
+	}
+	digest := sha256.Sum256([]byte("payload"))
+	sig, err := token.Signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if !ecdsa.VerifyASN1(token.Cert.PublicKey.(*ecdsa.PublicKey), digest[:], sig) {
+		t.Error("the signature of the token does not verify against its certificate")
+	}
+
+	err = b.Delete(id)
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err = b.Delete(id); err == nil {
+		t.Error("deleting a token twice succeeded")
+	}
+	certs, err = b.Certificates()
+	if err != nil || len(certs) != 0 {
+		t.Errorf("Certificates after Delete = %d certificates, %v; want none", len(certs), err)
+	}
+}
+
+func TestMemoryBackendImportKey(t *testing.T) {
+	b := core.NewMemoryBackend()
+	defer b.Close()
+
+	importer, ok := b.(interface {
+		ImportKey(id []byte, key crypto.PrivateKey) error
+		ExportKey(id []byte) (crypto.PrivateKey, error)
+	})
+	if !ok {
+		t.Fatal("the memory backend imports and exports keys")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := []byte{0x0a}
+	err = importer.ImportKey(id, key)
+	if err != nil {
+		t.Fatalf("ImportKey: %v", err)
+	}
+	exported, err := importer.ExportKey(id)
+	if err != nil || !key.Equal(exported) {
+		t.Errorf("ExportKey = %v; want the key imported", err)
+	}
+
+	_, err = importer.ExportKey([]byte{0x0b})
+	if err == nil {
+		t.Error("ExportKey of an unknown id succeeded")
+	}
+	err = importer.ImportKey([]byte{0x0c}, []byte("not a key"))
+	if err == nil {
+		t.Error("ImportKey of an unsupported key succeeded")
+	}
+}
+
+// TestMemoryCore runs a token through its life, from Generate through Login to Delete, upon the memory backend
+func TestMemoryCore(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	server := testutil.NewTokenServer(t)
+
+	c := core.NewWithBackend(core.NewMemoryBackend())
+	c.SetQuiet(true)
+	defer c.Close()
+
+	cert, err := c.Generate("acme")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if got := cert.Subject.Organization; len(got) != 1 || got[0] != "acme" {
+		t.Errorf("realm = %v; want acme", got)
+	}
+	serial := core.HexEncode(cert.SerialNumber.Bytes())
+
+	serials, err := c.Serials()
+	if err != nil || len(serials) != 1 || serials[0] != serial {
+		t.Fatalf("Serials = %v, %v; want [%s]", serials, err, serial)
+	}
+
+	// the identity is refused until it is registered
+	_, err = c.LoginPKCS11(server.URL, false, serial)
+	if core.ExitCode(err) != core.ExitAuth {
+		t.Fatalf("Login of an unregistered identity = %v; want exit code %d", err, core.ExitAuth)
+	}
+
+	server.Register(cert)
+	jwt, err := c.LoginPKCS11(server.URL, false, serial)
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if jwt != testutil.AccessToken(cert) {
+		t.Errorf("Login = %q; want %q", jwt, testutil.AccessToken(cert))
+	}
+
+	err = c.Delete(core.DeleteOptions{Serial: serial, Force: true})
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	_, err = c.LoginPKCS11(server.URL, false, serial)
+	if core.ExitCode(err) != core.ExitNotFound {
+		t.Errorf("Login after Delete = %v; want exit code %d", err, core.ExitNotFound)
+	}
+}
+
+// TestMemoryCoreLabels selects a labelled token by its label wherever a serial is expected
+func TestMemoryCoreLabels(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	c := core.NewWithBackend(core.NewMemoryBackend())
+	c.SetQuiet(true)
+	defer c.Close()
+
+	cert, err := c.GenerateLabeled("acme", "billing-loader", 0)
+	if err != nil {
+		t.Fatalf("GenerateLabeled: %v", err)
+	}
+	_, err = c.Generate("acme")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	labels, err := c.Labels()
+	if err != nil || len(labels) != 1 || labels[0] != "billing-loader" {
+		t.Fatalf("Labels = %v, %v; want [billing-loader]", labels, err)
+	}
+
+	err = c.Use("billing-loader")
+	if err != nil {
+		t.Fatalf("Use: %v", err)
+	}
+	def, err := c.DefaultToken()
+	if err != nil || def != core.HexEncode(cert.SerialNumber.Bytes()) {
+		t.Errorf("DefaultToken = %s, %v; want the serial of the labelled token", def, err)
+	}
+
+	err = c.Use("no-such-label")
+	if core.ExitCode(err) != core.ExitNotFound {
+		t.Errorf("Use of an unknown label = %v; want exit code %d", err, core.ExitNotFound)
+	}
+}
+
+// TestMemoryCoreNoPicker refuses to choose among several tokens for a program, which never gets the picker
+func TestMemoryCoreNoPicker(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	c := core.NewWithBackend(core.NewMemoryBackend())
+	c.SetQuiet(true)
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err := c.Generate("acme")
+		if err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+	}
+
+	_, err := c.CheckToken("")
+	if core.ExitCode(err) != core.ExitNotFound {
+		t.Errorf("CheckToken of no serial among two tokens = %v; want exit code %d", err, core.ExitNotFound)
+	}
+}
@@ -0,0 +1,282 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsBuckets are the upper bounds, in seconds, of the latency histograms
+var metricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// metricsRegistry holds the metrics of the daemon modes, exported in the Prometheus text format.  A nil registry
+// records nothing, so operations need not check whether metrics are enabled.
+type metricsRegistry struct {
+	sync.Mutex
+	help       map[string]string
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+	// collectors write metrics computed afresh for each scrape
+	collectors []func(w io.Writer)
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		help: map[string]string{
+			"manetu_login_duration_seconds":           "Time taken to acquire an access token, by result",
+			"manetu_hsm_operation_duration_seconds":   "Time taken by keystore operations, by operation",
+			"manetu_hsm_operation_errors_total":       "Keystore operations that failed, by operation",
+			"manetu_cache_requests_total":             "Lookups of cached signers, by cache and result (hit or miss)",
+			"manetu_token_expiry_timestamp_seconds":   "Expiry of the certificate of each token, as a Unix timestamp",
+			"manetu_token_expiry_scrape_errors_total": "Failures to enumerate the tokens for their expiry",
+		},
+		counters:   map[string]map[string]float64{},
+		histograms: map[string]map[string]*histogram{},
+	}
+}
+
+// labels formats label pairs, given as name, value, name, value...
+func labels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(pairs[i] + "=" + strconv.Quote(pairs[i+1]))
+	}
+	return b.String()
+}
+
+func (r *metricsRegistry) inc(name, labels string) {
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.counters[name] == nil {
+		r.counters[name] = map[string]float64{}
+	}
+	r.counters[name][labels]++
+}
+
+func (r *metricsRegistry) observe(name, labels string, start time.Time) {
+	if r == nil {
+		return
+	}
+	v := time.Since(start).Seconds()
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.histograms[name] == nil {
+		r.histograms[name] = map[string]*histogram{}
+	}
+	h := r.histograms[name][labels]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(metricsBuckets))}
+		r.histograms[name][labels] = h
+	}
+	for i, le := range metricsBuckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// observeOp records the duration and any failure of a keystore operation
+func (r *metricsRegistry) observeOp(op string, start time.Time, err error) {
+	r.observe("manetu_hsm_operation_duration_seconds", labels("operation", op), start)
+	if err != nil {
+		r.inc("manetu_hsm_operation_errors_total", labels("operation", op))
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *metricsRegistry) header(w io.Writer, name, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, r.help[name], name, typ)
+}
+
+func (r *metricsRegistry) write(w io.Writer) {
+	r.Lock()
+	for _, name := range sortedKeys(r.counters) {
+		r.header(w, name, "counter")
+		for _, l := range sortedKeys(r.counters[name]) {
+			fmt.Fprintf(w, "%s{%s} %g\n", name, l, r.counters[name][l])
+		}
+	}
+
+	for _, name := range sortedKeys(r.histograms) {
+		r.header(w, name, "histogram")
+		for _, l := range sortedKeys(r.histograms[name]) {
+			h := r.histograms[name][l]
+			sep := ""
+			if l != "" {
+				sep = ","
+			}
+			for i, le := range metricsBuckets {
+				fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, l, sep, le, h.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, l, sep, h.count)
+			fmt.Fprintf(w, "%s_sum{%s} %g\n", name, l, h.sum)
+			fmt.Fprintf(w, "%s_count{%s} %d\n", name, l, h.count)
+		}
+	}
+	collectors := r.collectors
+	r.Unlock()
+
+	for _, collect := range collectors {
+		collect(w)
+	}
+}
+
+// collectExpiry exports the expiry of every token within backend at each scrape, so that operators may alert on
+// tokens nearing expiry, e.g. with manetu_token_expiry_timestamp_seconds - time() < 30 * 86400
+func (r *metricsRegistry) collectExpiry(backend Backend) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.collectors = append(r.collectors, func(w io.Writer) {
+		certs, err := backend.Certificates()
+		if err != nil {
+			r.inc("manetu_token_expiry_scrape_errors_total", "")
+			return
+		}
+
+		r.header(w, "manetu_token_expiry_timestamp_seconds", "gauge")
+		for _, cert := range certs {
+			fmt.Fprintf(w, "manetu_token_expiry_timestamp_seconds{%s} %d\n",
+				labels("serial", HexEncode(cert.SerialNumber.Bytes()), "realm", strings.Join(cert.Subject.Organization, ",")),
+				cert.NotAfter.Unix())
+		}
+	})
+}
+
+// SetMetrics exports metrics in the Prometheus format at http://addr/metrics while a daemon mode (agent, serve,
+// spiffe serve or ssh agent) runs
+func (c *Core) SetMetrics(addr string) {
+	c.metricsAddr = addr
+}
+
+// startMetrics begins serving metrics when enabled by SetMetrics, returning backend instrumented to record the
+// duration and failures of its operations, and a function stopping the server
+func (c *Core) startMetrics(backend Backend) (Backend, func(), error) {
+	if c.metricsAddr == "" {
+		return backend, func() {}, nil
+	}
+
+	c.metrics = newMetricsRegistry()
+	instrumented := &instrumentedBackend{Backend: backend, metrics: c.metrics}
+	c.metrics.collectExpiry(instrumented)
+
+	l, err := net.Listen("tcp", c.metricsAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listening for metrics: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		c.metrics.write(w)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		err := server.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logWarn("unable to serve metrics", "error", err)
+		}
+	}()
+
+	return instrumented, func() { _ = server.Close() }, nil
+}
+
+// instrumentedBackend records the duration and failures of the operations of a backend, including signatures made
+// with its keys
+type instrumentedBackend struct {
+	Backend
+	metrics *metricsRegistry
+}
+
+func (b *instrumentedBackend) Generate(id []byte) (crypto.Signer, error) {
+	start := time.Now()
+	signer, err := b.Backend.Generate(id)
+	b.metrics.observeOp("generate", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedSigner{Signer: signer, metrics: b.metrics}, nil
+}
+
+func (b *instrumentedBackend) ImportCertificate(id []byte, cert *x509.Certificate) error {
+	start := time.Now()
+	err := b.Backend.ImportCertificate(id, cert)
+	b.metrics.observeOp("import_certificate", start, err)
+	return err
+}
+
+func (b *instrumentedBackend) Certificates() ([]*x509.Certificate, error) {
+	start := time.Now()
+	certs, err := b.Backend.Certificates()
+	b.metrics.observeOp("certificates", start, err)
+	return certs, err
+}
+
+func (b *instrumentedBackend) FindToken(id []byte) (*Token, error) {
+	start := time.Now()
+	token, err := b.Backend.FindToken(id)
+	b.metrics.observeOp("find_token", start, err)
+	if err != nil || token == nil {
+		return token, err
+	}
+	return &Token{Signer: &instrumentedSigner{Signer: token.Signer, metrics: b.metrics}, Cert: token.Cert}, nil
+}
+
+func (b *instrumentedBackend) Delete(id []byte) error {
+	start := time.Now()
+	err := b.Backend.Delete(id)
+	b.metrics.observeOp("delete", start, err)
+	return err
+}
+
+type instrumentedSigner struct {
+	crypto.Signer
+	metrics *metricsRegistry
+}
+
+func (s *instrumentedSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	start := time.Now()
+	sig, err := s.Signer.Sign(rand, digest, opts)
+	s.metrics.observeOp("sign", start, err)
+	return sig, err
+}
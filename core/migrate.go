@@ -0,0 +1,157 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// openBackend instantiates the named backend from the configuration, independently of the default backend
+func (c *Core) openBackend(name string) (Backend, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	err := c.loadConfig()
+	if err != nil {
+		return nil, classify(ExitConfig, err)
+	}
+
+	backend, err := newBackend(name, &c.configuration)
+	if err != nil {
+		return nil, classify(ExitUnreachable, err)
+	}
+	return backend, nil
+}
+
+// migrateToken copies the token holding cert from src to dst.  The key pair and certificate are carried over intact,
+// preserving the MRN, when src can export the key and dst can import it.  Otherwise a new token is enrolled within
+// dst for the same realm, valid for validity from the time of clock.
+func migrateToken(src, dst Backend, cert *x509.Certificate, validity time.Duration, clock Clock) (*x509.Certificate, error) {
+	id := cert.SerialNumber.Bytes()
+
+	exporter, canExport := src.(keyExporter)
+	importer, canImport := dst.(keyImporter)
+	if canExport && canImport {
+		key, err := exporter.ExportKey(id)
+		if err == nil {
+			err = importer.ImportKey(id, key)
+			if err != nil {
+				return nil, err
+			}
+
+			err = dst.ImportCertificate(id, cert)
+			if err != nil {
+				return nil, err
+			}
+
+			return cert, nil
+		}
+		// most hardware keystores refuse to release keys; fall back to enrolling a new token
+	}
+
+	return generateToken(dst, strings.Join(cert.Subject.Organization, ","), tokenLabel(src, cert), validity, clock)
+}
+
+// Migrate moves every token from one backend to another, removing them from the source when move is set
+func (c *Core) Migrate(from, to string, move bool) error {
+	if from == to {
+		return fmt.Errorf("cannot migrate from %s to itself", from)
+	}
+
+	src, err := c.openBackend(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := c.openBackend(to)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	certs, err := src.Certificates()
+	if err != nil {
+		return err
+	}
+
+	// refuse before anything is moved, rather than part way through
+	for _, cert := range certs {
+		err = c.checkTokenPolicy(PolicyMigrate, cert)
+		if err != nil {
+			return fmt.Errorf("%s: %w", HexEncode(cert.SerialNumber.Bytes()), err)
+		}
+	}
+	validity, err := c.checkValidity(0)
+	if err != nil {
+		return err
+	}
+	clock, err := c.getClock()
+	if err != nil {
+		return err
+	}
+
+	if c.dryRun {
+		_, canExport := src.(keyExporter)
+		_, canImport := dst.(keyImporter)
+		for _, cert := range certs {
+			id := cert.SerialNumber.Bytes()
+			if canExport && canImport {
+				printPlan(fmt.Sprintf("copy token %s to %s, preserving its MRN", HexEncode(id), to), describeObjects(dst, id))
+			} else {
+				printPlan(fmt.Sprintf("enroll a new token in %s for realm %q, replacing token %s",
+					to, strings.Join(cert.Subject.Organization, ","), HexEncode(id)), describeObjects(dst, nil))
+			}
+			if move {
+				printPlan("remove from "+from, describeObjects(src, id))
+			}
+		}
+		return nil
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Serial", "Realm", "New Serial", "MRN Preserved"})
+
+	reenrolled := 0
+	for _, cert := range certs {
+		serial := HexEncode(cert.SerialNumber.Bytes())
+
+		migrated, err := migrateToken(src, dst, cert, validity, clock)
+		if err != nil {
+			table.Render()
+			return fmt.Errorf("%s: %w", serial, err)
+		}
+
+		preserved := "yes"
+		if migrated != cert {
+			preserved = "no"
+			reenrolled++
+		}
+		table.Append([]string{serial, strings.Join(cert.Subject.Organization, ","),
+			HexEncode(migrated.SerialNumber.Bytes()), preserved})
+
+		if move {
+			err = src.Delete(cert.SerialNumber.Bytes())
+			if err != nil {
+				table.Render()
+				return fmt.Errorf("%s: migrated, but could not be removed from %s: %w", serial, from, err)
+			}
+		}
+	}
+
+	table.Render()
+
+	if reenrolled > 0 {
+		fmt.Fprintf(os.Stderr, "%d token(s) were re-enrolled with new keys; their MRNs must be registered with Manetu\n", reenrolled)
+	}
+
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import "syscall"
+
+// lockMemory keeps the pages holding b from being written to swap
+func lockMemory(b []byte) error {
+	return syscall.Mlock(b)
+}
+
+func unlockMemory(b []byte) {
+	_ = syscall.Munlock(b)
+}
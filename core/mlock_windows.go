@@ -0,0 +1,29 @@
+//go:build windows
+
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"unsafe"
+)
+
+var (
+	virtualLock   = kernel32.NewProc("VirtualLock")
+	virtualUnlock = kernel32.NewProc("VirtualUnlock")
+)
+
+// lockMemory keeps the pages holding b within the working set, so that they are not written to the page file
+func lockMemory(b []byte) error {
+	r, _, err := virtualLock.Call(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func unlockMemory(b []byte) {
+	_, _, _ = virtualUnlock.Call(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
+}
@@ -0,0 +1,106 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+
+	"github.com/manetu/security-token/config"
+)
+
+// moduleMu serializes initializing and finalizing a PKCS#11 module, by crypto11 for the contexts of the pkcs11
+// backend and by withModule for its own use, so that neither finalizes a module in use by the other.  crypto11 counts
+// the users of a module only amongst its own contexts, and refuses a module that is already initialized.
+var moduleMu sync.Mutex
+
+// withModule runs op upon the PKCS#11 module of device, loaded directly for the operations that crypto11 does not
+// expose, and within the timeout of the device as are the operations of the pkcs11 backend.  The step what is named
+// in any error.  Should the device hang, op is abandoned and the module released once it completes, so that callers
+// must not use anything op sets once withModule has failed.
+func withModule(device config.Pkcs11Configuration, what string, op func(p *pkcs11.Ctx) error) error {
+	timeout, err := pkcs11Timeout(device)
+	if err != nil {
+		return classify(ExitConfig, err)
+	}
+
+	return withDeadline(timeout, what+" on "+device.TokenLabel, func() error {
+		p, release, err := loadModule(device.Path)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return op(p)
+	})
+}
+
+// loadModule loads and initializes the PKCS#11 module at path.  A module already initialized by crypto11 is left to it
+// to finalize; otherwise moduleMu is held until the returned function, which must always be called, finalizes it.
+func loadModule(path string) (*pkcs11.Ctx, func(), error) {
+	p := pkcs11.New(path)
+	if p == nil {
+		return nil, nil, classify(ExitUnreachable, fmt.Errorf("unable to load %s", path))
+	}
+
+	moduleMu.Lock()
+	err := p.Initialize()
+	if err == pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		moduleMu.Unlock()
+		return p, p.Destroy, nil
+	}
+	if err != nil {
+		moduleMu.Unlock()
+		p.Destroy()
+		return nil, nil, classify(ExitUnreachable, err)
+	}
+
+	return p, func() {
+		_ = p.Finalize()
+		moduleMu.Unlock()
+		p.Destroy()
+	}, nil
+}
+
+// findSlot returns the first slot holding a token with the given label
+func findSlot(p *pkcs11.Ctx, label string) (uint, error) {
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, slot := range slots {
+		info, err := p.GetTokenInfo(slot)
+		if err != nil {
+			return 0, err
+		}
+		if info.Label == label {
+			return slot, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no token with label %q found in %d slot(s)", label, len(slots))
+}
+
+// withSession runs op upon a read/write session on the token of device, as withModule runs it upon the module
+func withSession(device config.Pkcs11Configuration, what string, op func(p *pkcs11.Ctx, session pkcs11.SessionHandle) error) error {
+	return withModule(device, what, func(p *pkcs11.Ctx) error {
+		slot, err := findSlot(p, device.TokenLabel)
+		if err != nil {
+			return classify(ExitUnreachable, err)
+		}
+
+		session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = p.CloseSession(session)
+		}()
+
+		return op(p, session)
+	})
+}
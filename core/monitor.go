@@ -0,0 +1,239 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultMonitorThresholds raise alerts a month, a week and a day before expiry
+var defaultMonitorThresholds = []time.Duration{30 * 24 * time.Hour, 7 * 24 * time.Hour, 24 * time.Hour}
+
+// MonitorOptions configures the expiry monitor
+type MonitorOptions struct {
+	// Thresholds are the times before expiry at which an alert is raised, defaulting to 30d, 7d and 1d.  Each is
+	// reported once per certificate or JWT, as is its expiry.
+	Thresholds []time.Duration
+	// JWTs name files holding JWTs, such as those written by login --out, whose expiry is monitored too
+	JWTs []string
+	// Interval is the time between checks, defaulting to an hour
+	Interval time.Duration
+	// Syslog sends alerts to the system log as well as stderr
+	Syslog bool
+	// Once checks once and returns, failing with ExitExpired when an alert was raised, for cron and scripts
+	Once bool
+}
+
+// alertSink receives alerts besides stderr, as does *syslog.Writer
+type alertSink interface {
+	Warning(m string) error
+	Close() error
+}
+
+// monitor remembers the thresholds already reported, so that each is reported once
+type monitor struct {
+	core *Core
+	opts MonitorOptions
+	sink alertSink
+	// reported maps each certificate or JWT, by its expiry, to the number of thresholds reported
+	reported map[string]int
+}
+
+// Monitor watches the expiry of the certificates of the tokens and of the JWTs in opts.JWTs, raising an alert on
+// stderr, to the webhooks subscribed to token.expiring or jwt.expiring and, with opts.Syslog, to the system log as
+// each threshold is crossed.  It runs until interrupted unless opts.Once is set.  It fills the gap between the one-shot
+// webhook expiring and the rotation scheduler of the daemon modes, for keystores that are renewed by other means.
+func (c *Core) Monitor(opts MonitorOptions) error {
+	// a daemon holding its locks must never wait upon the terminal
+	c.interactive = false
+
+	if len(opts.Thresholds) == 0 {
+		opts.Thresholds = defaultMonitorThresholds
+	}
+	for _, t := range opts.Thresholds {
+		if t <= 0 {
+			return classify(ExitConfig, fmt.Errorf("thresholds must be positive, not %s", t))
+		}
+	}
+	// the longest threshold is crossed first
+	sort.Slice(opts.Thresholds, func(i, j int) bool { return opts.Thresholds[i] > opts.Thresholds[j] })
+	if opts.Interval <= 0 {
+		opts.Interval = defaultRotationInterval
+	}
+
+	m := &monitor{core: c, opts: opts, reported: map[string]int{}}
+	if opts.Syslog {
+		var err error
+		m.sink, err = openSyslog()
+		if err != nil {
+			return err
+		}
+		defer m.sink.Close()
+	}
+
+	backend := c.getBackend()
+
+	if opts.Once {
+		n, err := m.check(backend)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return classify(ExitExpired, fmt.Errorf("%d expiry alert(s) raised", n))
+		}
+		return nil
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	// a check that hangs on the keystore stops the watchdog, so that systemd restarts the monitor
+	var live keystoreLock
+	stopWatchdog := startWatchdog(&live)
+	defer stopWatchdog()
+	_ = sdNotify("READY=1\nSTATUS=Monitoring expiry")
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		live.Lock()
+		_, err := m.check(backend)
+		live.Unlock()
+		if err != nil {
+			logWarn("monitoring failed", "error", err)
+		}
+
+		select {
+		case <-sigs:
+			_ = sdNotify("STOPPING=1")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// check raises an alert for each certificate and JWT that has crossed a threshold not yet reported, returning the
+// number of alerts raised
+func (m *monitor) check(backend Backend) (int, error) {
+	now := time.Now()
+	n := 0
+
+	certs, err := backend.Certificates()
+	if err != nil {
+		return 0, err
+	}
+	for _, cert := range certs {
+		serial := HexEncode(cert.SerialNumber.Bytes())
+		if m.crossed(serial, cert.NotAfter, now) {
+			e := newWebhookEvent(WebhookTokenExpiring, cert)
+			m.alert(fmt.Sprintf("security token %s (%s)", serial, e.MRN), cert.NotAfter, now, e)
+			n++
+		}
+	}
+
+	var errs []string
+	for _, path := range m.opts.JWTs {
+		exp, err := jwtFileExpiry(path)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		if m.crossed(path, exp, now) {
+			e := newWebhookEvent(WebhookJWTExpiring, nil)
+			e.File = path
+			notAfter := exp.UTC()
+			e.NotAfter = &notAfter
+			m.alert("JWT in "+path, exp, now, e)
+			n++
+		}
+	}
+	if len(errs) > 0 {
+		return n, errors.New(strings.Join(errs, "; "))
+	}
+
+	return n, nil
+}
+
+// crossed reports whether the item expiring at notAfter has crossed a threshold, or expired, since last reported.  A
+// renewed certificate or JWT has a new expiry and so starts afresh.
+func (m *monitor) crossed(name string, notAfter, now time.Time) bool {
+	level := 0
+	remaining := notAfter.Sub(now)
+	for _, t := range m.opts.Thresholds {
+		if remaining <= t {
+			level++
+		}
+	}
+	if remaining <= 0 {
+		level++
+	}
+
+	key := name + "@" + notAfter.UTC().Format(time.RFC3339)
+	if level <= m.reported[key] {
+		return false
+	}
+	m.reported[key] = level
+	return true
+}
+
+func (m *monitor) alert(what string, notAfter, now time.Time, e WebhookEvent) {
+	msg := fmt.Sprintf("%s expires at %s, in %s", what, notAfter.UTC().Format(time.RFC3339), notAfter.Sub(now).Round(time.Minute))
+	if !notAfter.After(now) {
+		msg = fmt.Sprintf("%s expired at %s", what, notAfter.UTC().Format(time.RFC3339))
+	}
+
+	fmt.Fprintln(os.Stderr, msg)
+	if m.sink != nil {
+		err := m.sink.Warning(msg)
+		if err != nil {
+			logWarn("unable to log to syslog", "error", err)
+		}
+	}
+	m.core.notifyEvent(e)
+}
+
+// jwtFileExpiry returns the time at which the JWT held in path expires, by its exp claim.  The JWT is not verified:
+// only its holder's own copy is being watched.
+func jwtFileExpiry(path string) (time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	parts := strings.Split(strings.TrimSpace(string(data)), ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("malformed JWT")
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed JWT: %w", err)
+	}
+	var claims struct {
+		Exp *json.Number `json:"exp"`
+	}
+	err = json.Unmarshal(claimsJSON, &claims)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed JWT: %w", err)
+	}
+	if claims.Exp == nil {
+		return time.Time{}, errors.New("the JWT has no exp claim")
+	}
+	exp, err := claims.Exp.Float64()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed JWT: %w", err)
+	}
+
+	return time.Unix(int64(exp), 0), nil
+}
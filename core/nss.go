@@ -0,0 +1,134 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const nssDefaultModule = "Manetu Security Token"
+
+// NSSOptions selects the NSS database into which the certificate of a token is exported
+type NSSOptions struct {
+	// Dir is the directory of the database, such as a Firefox profile; a database is created there when missing
+	Dir string
+	// Certificate names a PEM file holding a certificate issued to the token, followed by its chain, exported in place
+	// of the token's self-signed certificate
+	Certificate string
+	// Nickname of the certificate in the database, defaulting to one naming the token
+	Nickname string
+	// Module is the name under which the PKCS#11 module of the pkcs11 backend is registered
+	Module string
+}
+
+// ExportNSS imports the certificate of the token identified by serial, and any intermediates, into an NSS database.
+// For tokens of the pkcs11 backend the PKCS#11 module of the device is registered too, so that Firefox, Thunderbird
+// and other NSS applications find the key of the token and its certificate on the device itself.  The certutil and
+// modutil NSS tools do the work, since the database may be in use by the applications.
+func (c *Core) ExportNSS(serial string, opts NSSOptions) (err error) {
+	if opts.Dir == "" {
+		return classify(ExitConfig, errors.New("the directory of the NSS database must be given"))
+	}
+
+	token, err := c.getToken(serial)
+	if err != nil {
+		return err
+	}
+	chain, err := exportChain(token, opts.Certificate)
+	if err != nil {
+		return err
+	}
+
+	backend := c.backendInUse()
+	module := orDefault(opts.Module, nssDefaultModule)
+	nickname := orDefault(opts.Nickname, "Manetu "+HexEncode(token.Cert.SerialNumber.Bytes()))
+
+	if c.dryRun {
+		objects := []string{fmt.Sprintf("certificate %q", nickname)}
+		if backend == "pkcs11" {
+			objects = append(objects, fmt.Sprintf("PKCS#11 module %q (%s)", module, c.configuration.Pkcs11.Path))
+		}
+		printPlan("add to the NSS database in "+opts.Dir, objects)
+		return nil
+	}
+
+	defer func() {
+		c.audit("export-nss", token.Cert, err)
+	}()
+
+	db := "sql:" + opts.Dir
+	_, err = os.Stat(filepath.Join(opts.Dir, "cert9.db"))
+	if errors.Is(err, os.ErrNotExist) {
+		err = os.MkdirAll(opts.Dir, 0700)
+		if err != nil {
+			return err
+		}
+		_, err = nssTool("certutil", nil, "-N", "-d", db, "--empty-password")
+	}
+	if err != nil {
+		return err
+	}
+
+	if backend == "pkcs11" {
+		// modutil -list fails for a module that is not registered
+		_, err = nssTool("modutil", nil, "-dbdir", db, "-list", module)
+		if err != nil {
+			_, err = nssTool("modutil", nil, "-dbdir", db, "-add", module, "-libfile", c.configuration.Pkcs11.Path, "-force")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, cert := range chain {
+		name := nickname
+		if i > 0 {
+			// trust anchors are left for the user to trust explicitly
+			if cert.CheckSignatureFrom(cert) == nil {
+				continue
+			}
+			name = nssNickname(cert)
+		}
+		_, err = nssTool("certutil", []byte(ExportCert(cert)), "-A", "-d", db, "-n", name, "-t", ",,", "-a")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func nssNickname(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	return cert.Subject.String()
+}
+
+// nssTool runs the named NSS tool with stdin, returning its output
+func nssTool(name string, stdin []byte, args ...string) ([]byte, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, classify(ExitConfig, fmt.Errorf("%s not found; install the NSS tools (libnss3-tools or nss-tools)", name))
+	}
+
+	// #nosec G204 the tool is found on $PATH and given the user's own arguments
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w: %s", name, args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,372 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1" // #nosec G505 fingerprints only, as shown by common tooling
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Fingerprints holds digests of the DER encoded certificate
+type Fingerprints struct {
+	SHA1   string `json:"sha1"`
+	SHA256 string `json:"sha256"`
+}
+
+// TokenInfo describes a security token in the JSON output of list and show.  Fields are only ever added to this
+// structure, so that scripts may rely on it.
+type TokenInfo struct {
+	Serial       string       `json:"serial"`
+	Realm        string       `json:"realm"`
+	MRN          string       `json:"mrn"`
+	NotBefore    time.Time    `json:"notBefore"`
+	NotAfter     time.Time    `json:"notAfter"`
+	KeyType      string       `json:"keyType"`
+	Fingerprints Fingerprints `json:"fingerprints"`
+	// SerialDecimal is the serial number as a decimal integer, as shown by some CA consoles and openssl
+	SerialDecimal string `json:"serialDecimal"`
+	// Certificate is the PEM encoded certificate, included by show only
+	Certificate string `json:"certificate,omitempty"`
+	// Warning flags a certificate that is not a Manetu identity, such as another application's on a shared token
+	Warning string `json:"warning,omitempty"`
+	// Label is the CKA_LABEL of the key pair, where the keystore labels tokens and the token has one
+	Label string `json:"label,omitempty"`
+}
+
+// NewTokenInfo describes the token holding cert
+func NewTokenInfo(cert *x509.Certificate) TokenInfo {
+	sha1sum := sha1.Sum(cert.Raw) // #nosec G401
+	sha256sum := sha256.Sum256(cert.Raw)
+
+	return TokenInfo{
+		Serial:    HexEncode(cert.SerialNumber.Bytes()),
+		Realm:     strings.Join(cert.Subject.Organization, ","),
+		MRN:       ComputeMRN(cert),
+		NotBefore: cert.NotBefore.UTC(),
+		NotAfter:  cert.NotAfter.UTC(),
+		KeyType:   keyType(cert),
+		Fingerprints: Fingerprints{
+			SHA1:   HexEncode(sha1sum[:]),
+			SHA256: HexEncode(sha256sum[:]),
+		},
+		SerialDecimal: cert.SerialNumber.String(),
+		Warning:       foreignCertificate(cert),
+	}
+}
+
+// foreignCertificate explains why cert is not a Manetu identity, or returns "" if it is
+func foreignCertificate(cert *x509.Certificate) string {
+	if len(cert.Subject.Organization) == 0 {
+		return "not a Manetu identity: the subject has no organization to identify the realm"
+	}
+	return ""
+}
+
+func keyType(cert *x509.Certificate) string {
+	switch pub := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		return "ECDSA " + pub.Curve.Params().Name
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", pub.N.BitLen())
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return cert.PublicKeyAlgorithm.String()
+	}
+}
+
+// tokenColumn is a column that may be selected for table or CSV output, named as in the JSON output
+type tokenColumn struct {
+	name string
+	// title heads the column within a table
+	title string
+	value func(info *TokenInfo) string
+}
+
+var tokenColumns = []tokenColumn{
+	{"serial", "Serial", func(info *TokenInfo) string { return info.Serial }},
+	{"label", "Label", func(info *TokenInfo) string { return info.Label }},
+	{"realm", "Realm", func(info *TokenInfo) string { return info.Realm }},
+	{"mrn", "MRN", func(info *TokenInfo) string { return info.MRN }},
+	{"notBefore", "Created", func(info *TokenInfo) string { return info.NotBefore.Format(time.RFC3339) }},
+	{"notAfter", "Expires", func(info *TokenInfo) string { return info.NotAfter.Format(time.RFC3339) }},
+	{"keyType", "Key Type", func(info *TokenInfo) string { return info.KeyType }},
+	{"sha1", "SHA1 Fingerprint", func(info *TokenInfo) string { return info.Fingerprints.SHA1 }},
+	{"sha256", "SHA256 Fingerprint", func(info *TokenInfo) string { return info.Fingerprints.SHA256 }},
+	{"serialDecimal", "Serial (Decimal)", func(info *TokenInfo) string { return info.SerialDecimal }},
+}
+
+// columnAliases are the alternative names accepted for columns, matching the terms used by list --sort
+var columnAliases = map[string]string{
+	"provider": "realm",
+	"created":  "notBefore",
+	"expiry":   "notAfter",
+	"decimal":  "serialDecimal",
+}
+
+// defaultTableColumns are shown by list when no columns are selected
+var defaultTableColumns = []string{"serial", "realm", "mrn", "notBefore"}
+
+// selectColumns resolves column names, case-insensitively, defaulting to all columns
+func selectColumns(names []string) ([]tokenColumn, error) {
+	if len(names) == 0 {
+		return tokenColumns, nil
+	}
+
+	var columns []tokenColumn
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if alias, ok := columnAliases[strings.ToLower(name)]; ok {
+			name = alias
+		}
+
+		found := false
+		for _, col := range tokenColumns {
+			if strings.EqualFold(name, col.name) {
+				columns = append(columns, col)
+				found = true
+				break
+			}
+		}
+		if !found {
+			available := make([]string, 0, len(tokenColumns))
+			for _, col := range tokenColumns {
+				available = append(available, col.name)
+			}
+			return nil, fmt.Errorf("unknown column %q (available: %s)", name, strings.Join(available, ", "))
+		}
+	}
+
+	return columns, nil
+}
+
+// hasColumn reports whether columns includes the column called name
+func hasColumn(columns []tokenColumn, name string) bool {
+	for _, col := range columns {
+		if col.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTable writes a row per token beneath a header of the column titles, highlighting expired and expiring
+// certificates when color is set
+func writeTable(infos []TokenInfo, columns []tokenColumn, color bool) {
+	header := make([]string, 0, len(columns))
+	for _, col := range columns {
+		header = append(header, col.title)
+	}
+
+	now := time.Now()
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader(header)
+	for i := range infos {
+		row := make([]string, 0, len(columns))
+		for _, col := range columns {
+			value := col.value(&infos[i])
+			// flag the row of a foreign certificate where its MRN would be
+			if col.name == "mrn" && value == "" && infos[i].Warning != "" {
+				value = "(not a Manetu identity)"
+			}
+			row = append(row, value)
+		}
+
+		if colors := expiryColors(&infos[i], len(columns), now); color && colors != nil {
+			table.Rich(row, colors)
+		} else {
+			table.Append(row)
+		}
+	}
+	table.Render()
+}
+
+// writeCSV writes a header row followed by a row per token
+func writeCSV(infos []TokenInfo, columns []tokenColumn) error {
+	w := csv.NewWriter(os.Stdout)
+
+	header := make([]string, 0, len(columns))
+	for _, col := range columns {
+		header = append(header, col.name)
+	}
+	err := w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	for i := range infos {
+		row := make([]string, 0, len(columns))
+		for _, col := range columns {
+			row = append(row, col.value(&infos[i]))
+		}
+		err = w.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+var keyUsageNames = []struct {
+	usage x509.KeyUsage
+	name  string
+}{
+	{x509.KeyUsageDigitalSignature, "Digital Signature"},
+	{x509.KeyUsageContentCommitment, "Non Repudiation"},
+	{x509.KeyUsageKeyEncipherment, "Key Encipherment"},
+	{x509.KeyUsageDataEncipherment, "Data Encipherment"},
+	{x509.KeyUsageKeyAgreement, "Key Agreement"},
+	{x509.KeyUsageCertSign, "Certificate Sign"},
+	{x509.KeyUsageCRLSign, "CRL Sign"},
+	{x509.KeyUsageEncipherOnly, "Encipher Only"},
+	{x509.KeyUsageDecipherOnly, "Decipher Only"},
+}
+
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "Any",
+	x509.ExtKeyUsageServerAuth:      "TLS Web Server Authentication",
+	x509.ExtKeyUsageClientAuth:      "TLS Web Client Authentication",
+	x509.ExtKeyUsageCodeSigning:     "Code Signing",
+	x509.ExtKeyUsageEmailProtection: "E-mail Protection",
+	x509.ExtKeyUsageTimeStamping:    "Time Stamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSP Signing",
+}
+
+var extensionNames = map[string]string{
+	"2.5.29.14": "Subject Key Identifier",
+	"2.5.29.15": "Key Usage",
+	"2.5.29.17": "Subject Alternative Name",
+	"2.5.29.19": "Basic Constraints",
+	"2.5.29.35": "Authority Key Identifier",
+	"2.5.29.37": "Extended Key Usage",
+}
+
+func extensionName(oid asn1.ObjectIdentifier) string {
+	if name, ok := extensionNames[oid.String()]; ok {
+		return name
+	}
+	return oid.String()
+}
+
+// writeText writes a human-readable breakdown of cert, in the manner of openssl x509 -text
+func writeText(w io.Writer, cert *x509.Certificate) {
+	info := NewTokenInfo(cert)
+
+	fmt.Fprintf(w, "Certificate:\n")
+	fmt.Fprintf(w, "    Version: %d\n", cert.Version)
+	fmt.Fprintf(w, "    Serial Number: %s\n", info.Serial)
+	fmt.Fprintf(w, "        (decimal): %s\n", info.SerialDecimal)
+	fmt.Fprintf(w, "    Signature Algorithm: %v\n", cert.SignatureAlgorithm)
+	fmt.Fprintf(w, "    Issuer: %s\n", cert.Issuer)
+	fmt.Fprintf(w, "    Validity:\n")
+	fmt.Fprintf(w, "        Not Before: %s\n", info.NotBefore.Format(time.RFC3339))
+	fmt.Fprintf(w, "        Not After : %s\n", info.NotAfter.Format(time.RFC3339))
+	fmt.Fprintf(w, "    Subject: %s\n", cert.Subject)
+	fmt.Fprintf(w, "    Subject Public Key Info:\n")
+	fmt.Fprintf(w, "        Key Type: %s\n", info.KeyType)
+	fmt.Fprintf(w, "    MRN: %s\n", info.MRN)
+
+	if len(cert.Extensions) > 0 {
+		fmt.Fprintf(w, "    Extensions:\n")
+	}
+	for _, ext := range cert.Extensions {
+		critical := ""
+		if ext.Critical {
+			critical = " (critical)"
+		}
+		fmt.Fprintf(w, "        %s%s:\n", extensionName(ext.Id), critical)
+
+		switch ext.Id.String() {
+		case "2.5.29.15":
+			var usages []string
+			for _, u := range keyUsageNames {
+				if cert.KeyUsage&u.usage != 0 {
+					usages = append(usages, u.name)
+				}
+			}
+			fmt.Fprintf(w, "            %s\n", strings.Join(usages, ", "))
+		case "2.5.29.19":
+			if cert.MaxPathLen > 0 || cert.MaxPathLenZero {
+				fmt.Fprintf(w, "            CA:%t, pathlen:%d\n", cert.IsCA, cert.MaxPathLen)
+			} else {
+				fmt.Fprintf(w, "            CA:%t\n", cert.IsCA)
+			}
+		case "2.5.29.37":
+			var usages []string
+			for _, u := range cert.ExtKeyUsage {
+				name, ok := extKeyUsageNames[u]
+				if !ok {
+					name = fmt.Sprintf("%d", u)
+				}
+				usages = append(usages, name)
+			}
+			for _, oid := range cert.UnknownExtKeyUsage {
+				usages = append(usages, oid.String())
+			}
+			fmt.Fprintf(w, "            %s\n", strings.Join(usages, ", "))
+		case "2.5.29.17":
+			var names []string
+			for _, n := range cert.DNSNames {
+				names = append(names, "DNS:"+n)
+			}
+			for _, n := range cert.EmailAddresses {
+				names = append(names, "email:"+n)
+			}
+			for _, n := range cert.IPAddresses {
+				names = append(names, "IP:"+n.String())
+			}
+			for _, n := range cert.URIs {
+				names = append(names, "URI:"+n.String())
+			}
+			fmt.Fprintf(w, "            %s\n", strings.Join(names, ", "))
+		case "2.5.29.14":
+			fmt.Fprintf(w, "            %s\n", HexEncode(cert.SubjectKeyId))
+		case "2.5.29.35":
+			fmt.Fprintf(w, "            %s\n", HexEncode(cert.AuthorityKeyId))
+		default:
+			fmt.Fprintf(w, "            %s\n", HexEncode(ext.Value))
+		}
+	}
+
+	fmt.Fprintf(w, "    Fingerprints:\n")
+	fmt.Fprintf(w, "        SHA256: %s\n", info.Fingerprints.SHA256)
+	fmt.Fprintf(w, "        SHA1  : %s\n", info.Fingerprints.SHA1)
+}
+
+// checkOutput validates the --output format requested of a command
+func checkOutput(output string, formats ...string) error {
+	for _, f := range formats {
+		if output == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported output format %q (available: %s)", output, strings.Join(formats, ", "))
+}
+
+func writeJSON(v interface{}) error {
+	return writeJSONTo(os.Stdout, v)
+}
+
+func writeJSONTo(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,72 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestSelectColumns(t *testing.T) {
+	for _, tc := range []struct {
+		names []string
+		want  []string
+		err   string
+	}{
+		{names: []string{"serial", "label", "mrn", "expiry"}, want: []string{"serial", "label", "mrn", "notAfter"}},
+		{names: []string{"Provider", " created ", "decimal"}, want: []string{"realm", "notBefore", "serialDecimal"}},
+		{names: []string{"serial", "owner"}, err: `unknown column "owner"`},
+	} {
+		t.Run(strings.Join(tc.names, ","), func(t *testing.T) {
+			columns, err := selectColumns(tc.names)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("selectColumns = %v; want %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, col := range columns {
+				got = append(got, col.name)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("selectColumns = %v; want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLabelColumn(t *testing.T) {
+	c := NewWithBackend(NewMemoryBackend())
+	c.SetQuiet(true)
+
+	cert, err := c.GenerateLabeled("acme", "billing-loader", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels, err := tokenLabels(c.getBackend())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := NewTokenInfo(cert)
+	info.Label = labels[hex.EncodeToString(cert.SerialNumber.Bytes())]
+
+	columns, err := selectColumns([]string{"serial", "label"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := columns[1].value(&info); got != "billing-loader" {
+		t.Errorf("label column = %q; want billing-loader", got)
+	}
+	if got := columns[0].value(&info); got == info.Realm {
+		t.Error("the serial column shows the realm")
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PassphraseFunc supplies the passphrase of an encrypted private key, and is only called when the key is encrypted
+type PassphraseFunc func() (string, error)
+
+var errIncorrectPassphrase = errors.New("incorrect passphrase for private key")
+
+// OIDs of the PKCS#5 v2.0 (RFC 8018) algorithms used by "openssl pkcs8 -topk8" and friends
+var (
+	oidPBES2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA224 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 8}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+
+	oidAES128CBC    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC   = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	pbes2KeyLengths = map[string]int{
+		oidAES128CBC.String():  16,
+		oidAES192CBC.String():  24,
+		oidAES256CBC.String():  32,
+		oidDESEDE3CBC.String(): 24,
+	}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// parsePrivateKey parses a DER encoded private key in any of the formats written by openssl: PKCS#8 ("PRIVATE KEY"),
+// SEC1 ("EC PRIVATE KEY") or PKCS#1 ("RSA PRIVATE KEY").  The format is detected from the data rather than trusting
+// the PEM type, which hand-assembled files do not always get right.
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		if ec, ecErr := x509.ParseECPrivateKey(der); ecErr == nil {
+			key = ec
+		} else if rsa, rsaErr := x509.ParsePKCS1PrivateKey(der); rsaErr == nil {
+			key = rsa
+		} else {
+			return nil, errors.New("unsupported private key: expected PKCS#8, SEC1 (EC) or PKCS#1 (RSA)")
+		}
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// checkKeyMatchesCert ensures that signer holds the private key of cert, so that a mismatched pair is reported as
+// such rather than as an opaque rejection of the login
+func checkKeyMatchesCert(signer crypto.Signer, cert *x509.Certificate) error {
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return errors.New("key does not match certificate")
+	}
+	return nil
+}
+
+// decryptPEMBlock returns the DER encoded key within block, decrypting it with the passphrase when the block is an
+// "ENCRYPTED PRIVATE KEY" (PKCS#8) or carries the legacy OpenSSL "Proc-Type: 4,ENCRYPTED" header.  In FIPS mode, the
+// legacy encryption is refused, as are the PKCS#8 algorithms that are not approved.
+func (c *Core) decryptPEMBlock(block *pem.Block, passphrase PassphraseFunc) ([]byte, error) {
+	//lint:ignore SA1019 legacy encrypted PEM remains common, despite its weak key derivation
+	legacy := x509.IsEncryptedPEMBlock(block)
+	if !legacy && block.Type != "ENCRYPTED PRIVATE KEY" {
+		return block.Bytes, nil
+	}
+	if legacy {
+		err := c.checkFIPS("legacy OpenSSL key encryption (MD5 key derivation)")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if passphrase == nil {
+		return nil, errors.New("private key is encrypted and no passphrase was given")
+	}
+	p, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+	pass := []byte(p)
+	defer LockSecret(pass)()
+
+	if legacy {
+		//lint:ignore SA1019 see above
+		der, err := x509.DecryptPEMBlock(block, pass)
+		if err == x509.IncorrectPasswordError {
+			return nil, classify(ExitAuth, errIncorrectPassphrase)
+		}
+		return der, err
+	}
+
+	return decryptPKCS8(block.Bytes, pass, c.fipsMode())
+}
+
+// decryptPKCS8 decrypts a PKCS#8 EncryptedPrivateKeyInfo protected by PBES2, returning the PrivateKeyInfo.  When fips
+// is set, only PBKDF2 with an HMAC of SHA-2 and AES are accepted, as SP 800-132 approves.
+func decryptPKCS8(der []byte, pass []byte, fips bool) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("error decoding encrypted private key: %w", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported private key encryption %v; convert the key with \"openssl pkcs8 -topk8 -v2 aes256\"", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("error decoding PBES2 parameters: %w", err)
+	}
+
+	scheme := params.EncryptionScheme.Algorithm
+	keyLen, ok := pbes2KeyLengths[scheme.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key cipher %v", scheme)
+	}
+	if fips && scheme.Equal(oidDESEDE3CBC) {
+		return nil, fipsRefusal("private key encryption with 3DES")
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("error decoding cipher parameters: %w", err)
+	}
+
+	key, err := deriveKey(params.KeyDerivationFunc, pass, keyLen, fips)
+	if err != nil {
+		return nil, err
+	}
+
+	var block cipher.Block
+	if scheme.Equal(oidDESEDE3CBC) {
+		block, err = des.NewTripleDESCipher(key)
+	} else {
+		block, err = aes.NewCipher(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data := info.EncryptedData
+	if len(iv) != block.BlockSize() || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("malformed encrypted private key")
+	}
+
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	// a wrong passphrase almost always leaves invalid padding behind
+	n := int(plain[len(plain)-1])
+	if n == 0 || n > block.BlockSize() || !bytes.Equal(plain[len(plain)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, classify(ExitAuth, errIncorrectPassphrase)
+	}
+
+	return plain[:len(plain)-n], nil
+}
+
+// deriveKey derives the cipher key from the passphrase with PBKDF2 or scrypt, or only with PBKDF2 over SHA-2 when fips
+// is set
+func deriveKey(kdf pkix.AlgorithmIdentifier, pass []byte, keyLen int, fips bool) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var params pbkdf2Params
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("error decoding PBKDF2 parameters: %w", err)
+		}
+
+		var h func() hash.Hash
+		switch prf := params.PRF.Algorithm; {
+		case len(prf) == 0, prf.Equal(oidHMACWithSHA1):
+			h = sha1.New
+		case prf.Equal(oidHMACWithSHA224):
+			h = sha256.New224
+		case prf.Equal(oidHMACWithSHA256):
+			h = sha256.New
+		case prf.Equal(oidHMACWithSHA384):
+			h = sha512.New384
+		case prf.Equal(oidHMACWithSHA512):
+			h = sha512.New
+		default:
+			return nil, fmt.Errorf("unsupported PBKDF2 hash %v", prf)
+		}
+		if fips && (len(params.PRF.Algorithm) == 0 || params.PRF.Algorithm.Equal(oidHMACWithSHA1)) {
+			return nil, fipsRefusal("private key encryption with PBKDF2 over SHA-1")
+		}
+
+		return pbkdf2.Key(pass, params.Salt, params.IterationCount, keyLen, h), nil
+
+	case kdf.Algorithm.Equal(oidScrypt):
+		if fips {
+			return nil, fipsRefusal("private key encryption with scrypt")
+		}
+		var params scryptParams
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("error decoding scrypt parameters: %w", err)
+		}
+
+		return scrypt.Key(pass, params.Salt, params.CostParameter, params.BlockSize, params.ParallelizationParameter, keyLen)
+
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function %v", kdf.Algorithm)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The keys of testdata/pkcs8 are the P-256 key of plain.pem encrypted by OpenSSL 3.0 with the passphrase
+// "correct-horse", as by:
+//
+//	openssl pkcs8 -topk8 -v2 aes256 -v2prf hmacWithSHA256 -iter 2048 -in plain.pem -out aes256-sha256.pem
+//	openssl pkcs8 -topk8 -v2 aes256 -scrypt -in plain.pem -out aes256-scrypt.pem
+const pkcs8Passphrase = "correct-horse"
+
+func readPEM(t *testing.T, name string) *pem.Block {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "pkcs8", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("%s holds no PEM block", name)
+	}
+	return block
+}
+
+func TestDecryptPKCS8(t *testing.T) {
+	plain := readPEM(t, "plain.pem").Bytes
+
+	for _, tc := range []struct {
+		file string
+		// fips is whether FIPS mode accepts the algorithms
+		fips bool
+	}{
+		{file: "aes256-sha256.pem", fips: true},
+		{file: "aes192-sha384.pem", fips: true},
+		{file: "aes128-sha512.pem", fips: true},
+		{file: "aes256-sha1.pem"},
+		{file: "des3-sha1.pem"},
+		{file: "aes256-scrypt.pem"},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			block := readPEM(t, tc.file)
+			if block.Type != "ENCRYPTED PRIVATE KEY" {
+				t.Fatalf("PEM type %q; want ENCRYPTED PRIVATE KEY", block.Type)
+			}
+
+			der, err := decryptPKCS8(block.Bytes, []byte(pkcs8Passphrase), false)
+			if err != nil {
+				t.Fatalf("decryptPKCS8: %v", err)
+			}
+			if !bytes.Equal(der, plain) {
+				t.Error("the decrypted key differs from plain.pem")
+			}
+			_, err = parsePrivateKey(der)
+			if err != nil {
+				t.Errorf("parsePrivateKey: %v", err)
+			}
+
+			_, err = decryptPKCS8(block.Bytes, []byte("wrong-horse"), false)
+			if ExitCode(err) != ExitAuth {
+				t.Errorf("decryptPKCS8 with the wrong passphrase = %v; want exit code %d", err, ExitAuth)
+			}
+
+			der, err = decryptPKCS8(block.Bytes, []byte(pkcs8Passphrase), true)
+			switch {
+			case tc.fips && (err != nil || !bytes.Equal(der, plain)):
+				t.Errorf("decryptPKCS8 in FIPS mode = %v; want the key", err)
+			case !tc.fips && ExitCode(err) != ExitDenied:
+				t.Errorf("decryptPKCS8 in FIPS mode = %v; want exit code %d", err, ExitDenied)
+			}
+		})
+	}
+}
+
+func TestDecryptPEMBlock(t *testing.T) {
+	c := NewWithBackend(NewMemoryBackend())
+	passphrase := func() (string, error) { return pkcs8Passphrase, nil }
+
+	plain := readPEM(t, "plain.pem")
+	der, err := c.decryptPEMBlock(plain, nil)
+	if err != nil || !bytes.Equal(der, plain.Bytes) {
+		t.Errorf("decryptPEMBlock of an unencrypted key = %v; want the key as is", err)
+	}
+
+	_, err = c.decryptPEMBlock(readPEM(t, "aes256-sha256.pem"), nil)
+	if err == nil {
+		t.Error("decryptPEMBlock of an encrypted key without a passphrase succeeded")
+	}
+	der, err = c.decryptPEMBlock(readPEM(t, "aes256-sha256.pem"), passphrase)
+	if err != nil || !bytes.Equal(der, plain.Bytes) {
+		t.Errorf("decryptPEMBlock = %v; want the key", err)
+	}
+
+	c.SetFIPS(true)
+	_, err = c.decryptPEMBlock(readPEM(t, "aes256-scrypt.pem"), passphrase)
+	if ExitCode(err) != ExitDenied {
+		t.Errorf("decryptPEMBlock of a key encrypted with scrypt in FIPS mode = %v; want exit code %d", err, ExitDenied)
+	}
+}
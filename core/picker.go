@@ -0,0 +1,180 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// pickerRows limits the number of tokens shown by the picker at once
+const pickerRows = 10
+
+// errPickerCancelled is returned when the user abandons the picker with Esc or Ctrl-C
+var errPickerCancelled = errors.New("cancelled")
+
+// pickerMatches reports whether cert matches the filter typed into the picker, by serial number (with or without
+// colons) or realm
+func pickerMatches(cert *x509.Certificate, filter string) bool {
+	if filter == "" {
+		return true
+	}
+
+	filter = strings.ToLower(filter)
+	serial := strings.ToLower(HexEncode(cert.SerialNumber.Bytes()))
+	return strings.Contains(serial, filter) ||
+		strings.Contains(strings.ReplaceAll(serial, ":", ""), strings.ReplaceAll(filter, ":", "")) ||
+		strings.Contains(strings.ToLower(strings.Join(cert.Subject.Organization, ",")), filter)
+}
+
+// pickToken presents an interactive selector on the terminal, which the user may filter by typing and navigate with
+// the arrow keys
+func pickToken(certs []*x509.Certificate) (*x509.Certificate, error) {
+	fd := int(os.Stdin.Fd())
+	saved, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = terminal.Restore(fd, saved)
+	}()
+
+	var (
+		filter  string
+		cursor  int
+		drawn   int
+		matches []*x509.Certificate
+		buf     = make([]byte, 16)
+	)
+
+	refilter := func() {
+		matches = matches[:0]
+		for _, cert := range certs {
+			if pickerMatches(cert, filter) {
+				matches = append(matches, cert)
+			}
+		}
+		cursor = 0
+	}
+	refilter()
+
+	for {
+		if cursor >= len(matches) {
+			cursor = len(matches) - 1
+		}
+		if cursor < 0 {
+			cursor = 0
+		}
+
+		// redraw in place, in raw mode where a newline does not return the carriage
+		if drawn > 0 {
+			fmt.Fprintf(os.Stderr, "\r\033[%dA", drawn)
+		}
+		fmt.Fprint(os.Stderr, "\r\033[J")
+		fmt.Fprintf(os.Stderr, "Select a security token (type to filter, arrows to move, enter to select, esc to cancel)\r\n")
+		fmt.Fprintf(os.Stderr, "> %s\r\n", filter)
+		drawn = 2
+
+		first := 0
+		if cursor >= pickerRows {
+			first = cursor - pickerRows + 1
+		}
+		for i := first; i < len(matches) && i < first+pickerRows; i++ {
+			marker := " "
+			if i == cursor {
+				marker = ">"
+			}
+			fmt.Fprintf(os.Stderr, "%s %s  %s\r\n", marker, HexEncode(matches[i].SerialNumber.Bytes()),
+				strings.Join(matches[i].Subject.Organization, ","))
+			drawn++
+		}
+		if len(matches) == 0 {
+			fmt.Fprint(os.Stderr, "  no matching security tokens\r\n")
+			drawn++
+		}
+
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range splitKeys(buf[:n]) {
+			switch {
+			case key == "\r" || key == "\n":
+				if len(matches) > 0 {
+					// erase the picker
+					fmt.Fprintf(os.Stderr, "\r\033[%dA\033[J", drawn)
+					return matches[cursor], nil
+				}
+			case key == "\x1b" || key == "\x03":
+				fmt.Fprintf(os.Stderr, "\r\033[%dA\033[J", drawn)
+				return nil, errPickerCancelled
+			case key == "\x1b[A" || key == "\x1bOA":
+				if cursor > 0 {
+					cursor--
+				}
+			case key == "\x1b[B" || key == "\x1bOB":
+				if cursor < len(matches)-1 {
+					cursor++
+				}
+			case key == "\x7f" || key == "\b":
+				if len(filter) > 0 {
+					filter = filter[:len(filter)-1]
+					refilter()
+				}
+			case strings.HasPrefix(key, "\x1b") || key < " ":
+				// ignore other control keys and escape sequences
+			default:
+				filter += key
+				refilter()
+			}
+		}
+	}
+}
+
+// splitKeys separates the keys read from the terminal in raw mode, which may arrive several at a time.  Escape
+// sequences are kept whole, while a lone escape is a key by itself.
+func splitKeys(b []byte) []string {
+	var keys []string
+	for len(b) > 0 {
+		n := 1
+		if b[0] == 0x1b && len(b) >= 3 && (b[1] == '[' || b[1] == 'O') {
+			n = 2
+			for n < len(b) && !(b[n] >= 0x40 && b[n] <= 0x7e) {
+				n++
+			}
+			if n < len(b) {
+				n++
+			}
+		} else if b[0] >= 0x80 {
+			// a multi-byte UTF-8 character
+			for n < len(b) && b[n]&0xc0 == 0x80 {
+				n++
+			}
+		}
+		keys = append(keys, string(b[:n]))
+		b = b[n:]
+	}
+	return keys
+}
+
+// selectToken chooses among several tokens, with the picker when c is interactive and running on a terminal
+func (c *Core) selectToken(certs []*x509.Certificate) (*x509.Certificate, error) {
+	if len(certs) == 1 {
+		return certs[0], nil
+	}
+
+	if !c.interactive || !terminal.IsTerminal(int(os.Stdin.Fd())) || !terminal.IsTerminal(int(os.Stderr.Fd())) {
+		return nil, classify(ExitNotFound, fmt.Errorf("%d security tokens found; select one with --serial or use", len(certs)))
+	}
+
+	sortCertificates(certs, "created", false)
+	return pickToken(certs)
+}
@@ -0,0 +1,42 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ChangePIN rotates the user PIN of the configured token via C_SetPIN.  The PINs are passed to the module without
+// being copied into Go strings, so that the caller may zeroize them once ChangePIN returns.
+func (c *Core) ChangePIN(oldPin, newPin []byte) error {
+	cfg, err := c.readConfig()
+	if err != nil {
+		return classify(ExitConfig, err)
+	}
+
+	err = c.checkPolicy(PolicyPINChange, "")
+	if err != nil {
+		return err
+	}
+
+	if c.dryRun {
+		fmt.Printf("Would change the user PIN of token %q\n", cfg.Pkcs11.TokenLabel)
+		return nil
+	}
+
+	return withSession(cfg.Pkcs11, "changing the user PIN", func(p *pkcs11.Ctx, session pkcs11.SessionHandle) error {
+		err := p.Login(session, pkcs11.CKU_USER, secretString(oldPin))
+		if err != nil {
+			return classify(ExitAuth, fmt.Errorf("login failed: %w", err))
+		}
+		defer func() {
+			_ = p.Logout(session)
+		}()
+
+		return p.SetPIN(session, secretString(oldPin), secretString(newPin))
+	})
+}
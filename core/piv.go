@@ -0,0 +1,374 @@
+//go:build piv
+
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-piv/piv-go/piv"
+
+	"github.com/manetu/security-token/config"
+)
+
+func init() {
+	RegisterBackend("piv", newPivBackend)
+}
+
+// the well known PIV slots that may hold tokens
+var pivSlots = []piv.Slot{piv.SlotAuthentication, piv.SlotSignature, piv.SlotKeyManagement, piv.SlotCardAuthentication}
+
+var (
+	pivPinPolicies = map[string]piv.PINPolicy{
+		"never":  piv.PINPolicyNever,
+		"once":   piv.PINPolicyOnce,
+		"always": piv.PINPolicyAlways,
+	}
+	pivTouchPolicies = map[string]piv.TouchPolicy{
+		"never":  piv.TouchPolicyNever,
+		"always": piv.TouchPolicyAlways,
+		"cached": piv.TouchPolicyCached,
+	}
+)
+
+// pivDeletedSubject is the common name of the certificate marking a slot whose token was deleted, since PIV offers
+// no means of removing a certificate object
+const pivDeletedSubject = "manetu-security-token deleted"
+
+// pivBackend talks directly to the PIV applet of a YubiKey over PC/SC by piv-go, without requiring the OpenSC
+// PKCS#11 module.  A PIV card holds a single key per slot, so each token occupies one of the slots 9a, 9c, 9d or 9e,
+// and new tokens are generated in the configured slot.
+type pivBackend struct {
+	sync.Mutex
+	yk   *piv.YubiKey
+	cfg  config.PivConfiguration
+	slot piv.Slot
+	// key holds the algorithm and policies of new keys
+	key           piv.Key
+	managementKey [24]byte
+	// pin is the PIN of the card, locked into memory until Close zeroizes it
+	pin    []byte
+	unlock func()
+}
+
+func newPivBackend(cfg *config.Configuration) (Backend, error) {
+	c := cfg.Piv
+
+	b := &pivBackend{cfg: c, key: piv.Key{
+		Algorithm:   piv.AlgorithmEC256,
+		PINPolicy:   piv.PINPolicyOnce,
+		TouchPolicy: piv.TouchPolicyNever,
+	}}
+
+	found := false
+	for _, s := range pivSlots {
+		if strings.EqualFold(orDefault(c.Slot, "9a"), s.String()) {
+			b.slot, found = s, true
+		}
+	}
+	if !found {
+		return nil, classify(ExitConfig, fmt.Errorf("unsupported PIV slot %q", c.Slot))
+	}
+
+	if c.PinPolicy != "" {
+		policy, ok := pivPinPolicies[strings.ToLower(c.PinPolicy)]
+		if !ok {
+			return nil, classify(ExitConfig, fmt.Errorf("unsupported PIN policy %q", c.PinPolicy))
+		}
+		b.key.PINPolicy = policy
+	}
+	if c.TouchPolicy != "" {
+		policy, ok := pivTouchPolicies[strings.ToLower(c.TouchPolicy)]
+		if !ok {
+			return nil, classify(ExitConfig, fmt.Errorf("unsupported touch policy %q", c.TouchPolicy))
+		}
+		b.key.TouchPolicy = policy
+	}
+
+	if t := strings.ToLower(orDefault(c.ManagementKeyType, "3des")); t != "3des" {
+		return nil, classify(ExitConfig, fmt.Errorf("unsupported management key type %q (available: 3des)", c.ManagementKeyType))
+	}
+	b.managementKey = piv.DefaultManagementKey
+	if c.ManagementKey != "" {
+		key, err := hex.DecodeString(c.ManagementKey)
+		if err != nil || len(key) != len(b.managementKey) {
+			return nil, classify(ExitConfig, errors.New("piv.managementkey must be 24 bytes of hex"))
+		}
+		copy(b.managementKey[:], key)
+	}
+
+	err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	// the configuration is shared with the core, so the backend zeroizes a copy of its own
+	b.pin = append([]byte(nil), c.Pin...)
+	b.unlock = LockSecret(b.pin)
+	return b, nil
+}
+
+// connect opens the first reader matching the configuration, or the first YubiKey found
+func (b *pivBackend) connect() error {
+	cards, err := piv.Cards()
+	if err != nil {
+		return classify(ExitUnreachable, fmt.Errorf("error listing smart card readers: %w", err))
+	}
+
+	var card string
+	for _, r := range cards {
+		if b.cfg.Reader != "" {
+			if strings.Contains(strings.ToLower(r), strings.ToLower(b.cfg.Reader)) {
+				card = r
+				break
+			}
+		} else if strings.Contains(strings.ToLower(r), "yubico") {
+			card = r
+			break
+		}
+	}
+	if card == "" && b.cfg.Reader == "" && len(cards) > 0 {
+		card = cards[0]
+	}
+	if card == "" {
+		return classify(ExitUnreachable, errors.New("no matching smart card reader found"))
+	}
+
+	b.yk, err = piv.Open(card)
+	if err != nil {
+		return classify(ExitUnreachable, fmt.Errorf("error connecting to %s: %w", card, err))
+	}
+	return nil
+}
+
+// auth presents the configured PIN to the card whenever the PIN policy of a key requires it
+func (b *pivBackend) auth() piv.KeyAuth {
+	return piv.KeyAuth{PINPrompt: func() (string, error) {
+		if len(b.pin) == 0 || len(b.pin) > 8 {
+			return "", classify(ExitConfig, errors.New("piv.pin must be configured (up to 8 characters)"))
+		}
+		return secretString(b.pin), nil
+	}}
+}
+
+// getCertificate returns the certificate of slot, or nil if the slot holds none
+func (b *pivBackend) getCertificate(slot piv.Slot) (*x509.Certificate, error) {
+	cert, err := b.yk.Certificate(slot)
+	if errors.Is(err, piv.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("slot %s: %w", slot, err)
+	}
+	if cert.Subject.CommonName == pivDeletedSubject {
+		return nil, nil
+	}
+	return cert, nil
+}
+
+// findSlot returns the slot holding the certificate with serial number id, along with the certificate, which is nil
+// if no slot holds it
+func (b *pivBackend) findSlot(id []byte) (piv.Slot, *x509.Certificate, error) {
+	for _, slot := range pivSlots {
+		cert, err := b.getCertificate(slot)
+		if err != nil {
+			return piv.Slot{}, nil, err
+		}
+		if cert != nil && bytes.Equal(cert.SerialNumber.Bytes(), id) {
+			return slot, cert, nil
+		}
+	}
+
+	return piv.Slot{}, nil, nil
+}
+
+// signer returns the signer of the key in slot, whose public key is pub
+func (b *pivBackend) signer(slot piv.Slot, pub crypto.PublicKey) (crypto.Signer, error) {
+	key, err := b.yk.PrivateKey(slot, pub, b.auth())
+	if err != nil {
+		return nil, fmt.Errorf("slot %s: %w", slot, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("slot %s: unsupported key type %T", slot, key)
+	}
+	return &pivSigner{Signer: signer, backend: b, slot: slot}, nil
+}
+
+func (b *pivBackend) Generate(id []byte) (crypto.Signer, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	cert, err := b.getCertificate(b.slot)
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil {
+		return nil, fmt.Errorf("slot %s is already in use by %s", b.slot, HexEncode(cert.SerialNumber.Bytes()))
+	}
+
+	pub, err := b.yk.GenerateKey(b.managementKey, b.slot, b.key)
+	if err != nil {
+		return nil, fmt.Errorf("error generating key in slot %s: %w", b.slot, err)
+	}
+
+	return b.signer(b.slot, pub)
+}
+
+func (b *pivBackend) ImportCertificate(id []byte, cert *x509.Certificate) error {
+	b.Lock()
+	defer b.Unlock()
+
+	// the certificate belongs with the key generated in the configured slot
+	return b.yk.SetCertificate(b.managementKey, b.slot, cert)
+}
+
+func (b *pivBackend) Certificates() ([]*x509.Certificate, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	var certs []*x509.Certificate
+	for _, slot := range pivSlots {
+		cert, err := b.getCertificate(slot)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil {
+			certs = append(certs, cert)
+		}
+	}
+
+	return certs, nil
+}
+
+func (b *pivBackend) FindToken(id []byte) (*Token, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	slot, cert, err := b.findSlot(id)
+	if err != nil || cert == nil {
+		return nil, err
+	}
+
+	signer, err := b.signer(slot, cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Token{Signer: signer, Cert: cert}, nil
+}
+
+// Delete destroys the key of the token by generating another in its slot, and marks the slot free with a certificate
+// of a throwaway key, since PIV offers no means of removing either a key or a certificate
+func (b *pivBackend) Delete(id []byte) error {
+	b.Lock()
+	defer b.Unlock()
+
+	slot, cert, err := b.findSlot(id)
+	if err != nil {
+		return err
+	}
+	if cert == nil {
+		return errors.New("invalid serial number")
+	}
+
+	_, err = b.yk.GenerateKey(b.managementKey, slot, b.key)
+	if err != nil {
+		return fmt.Errorf("error replacing the key in slot %s: %w", slot, err)
+	}
+
+	placeholder, err := pivDeletedCertificate()
+	if err != nil {
+		return err
+	}
+	return b.yk.SetCertificate(b.managementKey, slot, placeholder)
+}
+
+// pivDeletedCertificate returns a certificate marking a slot as free
+func pivDeletedCertificate() (*x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: pivDeletedSubject},
+		NotBefore:    now,
+		NotAfter:     now,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func (b *pivBackend) Close() error {
+	if b.unlock != nil {
+		b.unlock()
+	}
+	return b.yk.Close()
+}
+
+// touchRequired reports whether the key in slot requires a touch, according to its attestation where the card
+// attests its keys, and to the configured policy otherwise
+func (b *pivBackend) touchRequired(slot piv.Slot) bool {
+	fallback := b.key.TouchPolicy != piv.TouchPolicyNever
+
+	attestation, err := b.yk.AttestationCertificate()
+	if err != nil {
+		return fallback
+	}
+	cert, err := b.yk.Attest(slot)
+	if err != nil {
+		return fallback
+	}
+	a, err := piv.Verify(attestation, cert)
+	if err != nil {
+		return fallback
+	}
+	return a.TouchPolicy != piv.TouchPolicyNever
+}
+
+// pivSigner signs with the key of a PIV slot, serialized with every other use of the card and prompting for a touch
+// where the key requires one
+type pivSigner struct {
+	crypto.Signer
+	backend *pivBackend
+	slot    piv.Slot
+}
+
+func (s *pivSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	b := s.backend
+	b.Lock()
+	defer b.Unlock()
+
+	if b.touchRequired(s.slot) {
+		fmt.Fprintln(os.Stderr, "Touch your YubiKey...")
+	}
+
+	sig, err := s.Signer.Sign(rand, digest, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error signing with slot %s: %w", s.slot, err)
+	}
+	return sig, nil
+}
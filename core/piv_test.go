@@ -0,0 +1,43 @@
+//go:build piv
+
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/manetu/security-token/config"
+)
+
+// TestPivConfiguration refuses configurations the card cannot honour before looking for a reader
+func TestPivConfiguration(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cfg  config.PivConfiguration
+	}{
+		{"slot", config.PivConfiguration{Slot: "9b"}},
+		{"PIN policy", config.PivConfiguration{PinPolicy: "sometimes"}},
+		{"touch policy", config.PivConfiguration{TouchPolicy: "sometimes"}},
+		{"management key type", config.PivConfiguration{ManagementKeyType: "aes256"}},
+		{"management key", config.PivConfiguration{ManagementKey: "0102"}},
+	} {
+		_, err := newPivBackend(&config.Configuration{Piv: tt.cfg})
+		if ExitCode(err) != ExitConfig {
+			t.Errorf("%s: newPivBackend = %v; want exit code %d", tt.name, err, ExitConfig)
+		}
+	}
+}
+
+// TestPivDeletedCertificate marks a slot free with a certificate that no token carries
+func TestPivDeletedCertificate(t *testing.T) {
+	cert, err := pivDeletedCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != pivDeletedSubject || len(cert.Subject.Organization) != 0 {
+		t.Errorf("the certificate of a deleted token has subject %s", cert.Subject)
+	}
+}
@@ -0,0 +1,848 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/miekg/pkcs11"
+
+	"github.com/manetu/security-token/config"
+)
+
+func init() {
+	RegisterBackend("pkcs11", newPkcs11Backend)
+}
+
+// pkcs11Context is the part of crypto11.Context that the backend uses, so that the PKCS#11 simulator may stand in for
+// a module
+type pkcs11Context interface {
+	GenerateECDSAKeyPairWithAttributes(public, private crypto11.AttributeSet, curve elliptic.Curve) (crypto11.Signer, error)
+	ImportCertificate(id []byte, cert *x509.Certificate) error
+	FindCertificate(id []byte, label []byte, serial *big.Int) (*x509.Certificate, error)
+	DeleteCertificate(id []byte, label []byte, serial *big.Int) error
+	FindAllPairedCertificates() ([]tls.Certificate, error)
+	FindKeyPair(id []byte, label []byte) (crypto11.Signer, error)
+	FindAllKeyPairs() ([]crypto11.Signer, error)
+	GetAttribute(key interface{}, attribute crypto11.AttributeType) (*crypto11.Attribute, error)
+	Close() error
+}
+
+type pkcs11Backend struct {
+	sync.Mutex
+	// reconnecting serializes reconnect, so that a device lost by several operations at once is reopened only once
+	reconnecting sync.Mutex
+	ctx          pkcs11Context
+	// devices holds the primary device followed by any replicas, and contexts the devices opened so far
+	devices  []config.Pkcs11Configuration
+	contexts []pkcs11Context
+	certs    certCache
+	// timeout bounds each operation on the device, unless zero
+	timeout time.Duration
+	// open configures a device, by crypto11 unless simulated
+	open func(device config.Pkcs11Configuration) (pkcs11Context, error)
+}
+
+// defaultPkcs11Timeout bounds each operation on a device, since a network HSM may otherwise hang indefinitely
+const defaultPkcs11Timeout = time.Minute
+
+func newPkcs11Backend(cfg *config.Configuration) (Backend, error) {
+	return newPkcs11BackendWith(cfg, openCrypto11)
+}
+
+// newPkcs11BackendWith returns a pkcs11 backend configuring its devices with open
+func newPkcs11BackendWith(cfg *config.Configuration, open func(config.Pkcs11Configuration) (pkcs11Context, error)) (Backend, error) {
+	b := &pkcs11Backend{
+		devices: append([]config.Pkcs11Configuration{cfg.Pkcs11}, cfg.Pkcs11.Replicas...),
+		certs:   certCache{ttl: defaultCertCacheTTL},
+		timeout: defaultPkcs11Timeout,
+		open:    open,
+	}
+	b.contexts = make([]pkcs11Context, len(b.devices))
+
+	if cfg.Pkcs11.CacheTTL != "" {
+		ttl, err := ParseDuration(cfg.Pkcs11.CacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("pkcs11.cachettl: %w", err)
+		}
+		b.certs.ttl = ttl
+	}
+	timeout, err := pkcs11Timeout(cfg.Pkcs11)
+	if err != nil {
+		return nil, err
+	}
+	b.timeout = timeout
+
+	// operate on the first device that is available
+	for i := range b.devices {
+		b.ctx, err = b.context(i)
+		if err == nil {
+			return b, nil
+		}
+		if len(b.devices) > 1 {
+			logWarn("unable to open the device", "token", b.devices[i].TokenLabel, "error", err)
+		}
+	}
+
+	return nil, err
+}
+
+// pkcs11Timeout returns the time allowed for each operation on device
+func pkcs11Timeout(device config.Pkcs11Configuration) (time.Duration, error) {
+	if device.Timeout == "" {
+		return defaultPkcs11Timeout, nil
+	}
+	timeout, err := ParseDuration(device.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("pkcs11.timeout: %w", err)
+	}
+	return timeout, nil
+}
+
+// openCrypto11 configures the PKCS#11 library of device through crypto11
+func openCrypto11(device config.Pkcs11Configuration) (pkcs11Context, error) {
+	moduleMu.Lock()
+	defer moduleMu.Unlock()
+
+	// crypto11 keeps its own copy of the PIN, to log in again, for the life of the context
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       device.Path,
+		TokenLabel: device.TokenLabel,
+		Pin:        string(device.Pin),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+// context returns the context for the i'th device, opening it on first use
+func (b *pkcs11Backend) context(i int) (pkcs11Context, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.contexts[i] != nil {
+		return b.contexts[i], nil
+	}
+
+	ctx, err := b.open(b.devices[i])
+	if err != nil {
+		return nil, err
+	}
+
+	b.contexts[i] = ctx
+	return ctx, nil
+}
+
+func (b *pkcs11Backend) Generate(id []byte) (crypto.Signer, error) {
+	return b.GenerateLabeled(id, "")
+}
+
+// GenerateLabeled is Generate setting the CKA_LABEL of both keys to label, unless it is empty
+func (b *pkcs11Backend) GenerateLabeled(id []byte, label string) (crypto.Signer, error) {
+	defer b.certs.invalidate()
+
+	var public crypto11.AttributeSet
+	var err error
+	if label == "" {
+		public, err = crypto11.NewAttributeSetWithID(id)
+	} else {
+		public, err = crypto11.NewAttributeSetWithIDAndLabel(id, []byte(label))
+	}
+	if err != nil {
+		return nil, err
+	}
+	private := public.Copy()
+	// permit ECDH as well as signing
+	err = private.Set(crypto11.CkaDerive, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mu        sync.Mutex
+		signer    crypto11.Signer
+		abandoned bool
+	)
+	err = b.withContext("generating a key pair for serial "+HexEncode(id), func(ctx pkcs11Context) error {
+		generated, err := ctx.GenerateECDSAKeyPairWithAttributes(public, private, elliptic.P256())
+
+		mu.Lock()
+		defer mu.Unlock()
+		if abandoned && generated != nil {
+			// a key pair generated once the device has timed out would be left without a certificate
+			_ = generated.Delete()
+			return err
+		}
+		signer = generated
+		return err
+	})
+	if err != nil {
+		mu.Lock()
+		abandoned = true
+		late := signer
+		mu.Unlock()
+		if late != nil {
+			go func() {
+				_ = late.Delete()
+			}()
+		}
+		return nil, err
+	}
+	return signer, nil
+}
+
+func (b *pkcs11Backend) ImportCertificate(id []byte, cert *x509.Certificate) error {
+	defer b.certs.invalidate()
+
+	return b.withContext("importing the certificate for serial "+HexEncode(id), func(ctx pkcs11Context) error {
+		return ctx.ImportCertificate(id, cert)
+	})
+}
+
+// ReplaceCertificate swaps the certificate object of the token id for cert, restoring the old one should the import
+// fail, so that the key is never left without a certificate
+func (b *pkcs11Backend) ReplaceCertificate(id []byte, cert *x509.Certificate) error {
+	defer b.certs.invalidate()
+
+	var old *x509.Certificate
+	err := b.withContext("finding the certificate for serial "+HexEncode(id), func(ctx pkcs11Context) error {
+		var err error
+		old, err = ctx.FindCertificate(id, nil, nil)
+		if err != nil {
+			return err
+		}
+		return ctx.DeleteCertificate(id, nil, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx := b.current()
+	err = b.withDeadline("importing the certificate for serial "+HexEncode(id)+" on "+b.label(ctx), func() error {
+		return ctx.ImportCertificate(id, cert)
+	})
+	if err != nil && old != nil {
+		rerr := b.withDeadline("restoring the certificate for serial "+HexEncode(id)+" on "+b.label(ctx), func() error {
+			return ctx.ImportCertificate(id, old)
+		})
+		if rerr != nil {
+			return fmt.Errorf("%w; the old certificate could not be restored: %v", err, rerr)
+		}
+	}
+	return err
+}
+
+func (b *pkcs11Backend) Certificates() ([]*x509.Certificate, error) {
+	return b.certs.get(func() ([]*x509.Certificate, error) {
+		return b.enumerateWithRetry(nil)
+	})
+}
+
+// StreamCertificates passes each certificate to fn as it is enumerated, or from the cache when it is fresh
+func (b *pkcs11Backend) StreamCertificates(fn func(*x509.Certificate)) error {
+	enumerated := false
+	certs, err := b.certs.get(func() ([]*x509.Certificate, error) {
+		enumerated = true
+		return b.enumerateWithRetry(fn)
+	})
+	if err != nil || enumerated {
+		return err
+	}
+
+	for _, cert := range certs {
+		fn(cert)
+	}
+	return nil
+}
+
+// enumerateWithRetry enumerates the certificates, reconnecting should the device have been lost.  Certificates passed
+// to fn before the device was lost are not passed again, nor are any after the enumeration has failed.
+func (b *pkcs11Backend) enumerateWithRetry(fn func(*x509.Certificate)) ([]*x509.Certificate, error) {
+	var (
+		certs  []*x509.Certificate
+		mu     sync.Mutex
+		seen   = map[string]bool{}
+		failed bool
+	)
+	err := b.withContext("enumerating the certificates", func(ctx pkcs11Context) error {
+		var err error
+		certs, err = b.enumerate(ctx, func(cert *x509.Certificate) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			serial := string(cert.SerialNumber.Bytes())
+			if fn != nil && !failed && !seen[serial] {
+				seen[serial] = true
+				fn(cert)
+			}
+		})
+		return err
+	})
+	if err != nil {
+		// an enumeration that timed out may yet find more in the background
+		mu.Lock()
+		failed = true
+		mu.Unlock()
+		return nil, err
+	}
+	return certs, nil
+}
+
+// enumerate returns the certificates paired with a key pair, passing each to fn as it is found.  The objects are
+// fetched and parsed in parallel, which crypto11 does not do, falling back to its sequential pass should a session of
+// our own be refused.
+func (b *pkcs11Backend) enumerate(ctx pkcs11Context, fn func(*x509.Certificate)) ([]*x509.Certificate, error) {
+	p, slot, session, release, err := b.rawSession()
+	if err == nil {
+		defer release()
+		return enumerateObjects(p, slot, session, fn)
+	}
+
+	pairs, err := ctx.FindAllPairedCertificates()
+	if err != nil {
+		return nil, err
+	}
+
+	certs := make([]*x509.Certificate, 0, len(pairs))
+	for _, x := range pairs {
+		if x.Leaf == nil {
+			continue
+		}
+		certs = append(certs, x.Leaf)
+		fn(x.Leaf)
+	}
+
+	return certs, nil
+}
+
+func (b *pkcs11Backend) FindToken(id []byte) (*Token, error) {
+	var (
+		signer crypto11.Signer
+		cert   *x509.Certificate
+		used   pkcs11Context
+	)
+	err := b.withContext("finding the key pair for serial "+HexEncode(id), func(ctx pkcs11Context) error {
+		var err error
+		used = ctx
+		signer, err = ctx.FindKeyPair(id, nil)
+		if err != nil || signer == nil {
+			return err
+		}
+		cert, err = ctx.FindCertificate(id, nil, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if signer == nil {
+		return nil, nil
+	}
+	if cert == nil {
+		return nil, fmt.Errorf("certificate not found for serial %s", HexEncode(id))
+	}
+
+	return &Token{
+		Signer: &pkcs11Signer{backend: b, id: id, ctx: used, signer: signer},
+		Cert:   cert,
+	}, nil
+}
+
+func (b *pkcs11Backend) Delete(id []byte) error {
+	defer b.certs.invalidate()
+
+	var signer crypto11.Signer
+	err := b.withContext("deleting the certificate for serial "+HexEncode(id), func(ctx pkcs11Context) error {
+		err := ctx.DeleteCertificate(id, nil, nil)
+		if err != nil {
+			return err
+		}
+		signer, err = ctx.FindKeyPair(id, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if signer == nil {
+		_, _ = fmt.Fprint(os.Stderr, "ERROR: Invalid serial number")
+		return nil
+	}
+
+	return b.withDeadline("deleting the key pair for serial "+HexEncode(id)+" on "+b.label(b.current()), signer.Delete)
+}
+
+// Labels returns the CKA_LABEL of each key pair that has one, keyed by the hex encoding of its CKA_ID
+func (b *pkcs11Backend) Labels() (map[string]string, error) {
+	labels := map[string]string{}
+	err := b.withContext("reading the labels of the key pairs", func(ctx pkcs11Context) error {
+		signers, err := ctx.FindAllKeyPairs()
+		if err != nil {
+			return err
+		}
+		for _, signer := range signers {
+			id, err := ctx.GetAttribute(signer, crypto11.CkaId)
+			if err != nil {
+				return err
+			}
+			label, err := ctx.GetAttribute(signer, crypto11.CkaLabel)
+			if err != nil {
+				return err
+			}
+			if id != nil && label != nil && len(label.Value) > 0 {
+				labels[hex.EncodeToString(id.Value)] = string(label.Value)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+func (b *pkcs11Backend) DescribeObjects(id []byte) []string {
+	token := b.devices[0].TokenLabel
+	return []string{
+		fmt.Sprintf("CKO_PRIVATE_KEY (CKK_EC P-256, CKA_ID %s) on token %q", describeID(id), token),
+		fmt.Sprintf("CKO_PUBLIC_KEY (CKK_EC P-256, CKA_ID %s) on token %q", describeID(id), token),
+		fmt.Sprintf("CKO_CERTIFICATE (CKC_X_509, CKA_ID %s) on token %q", describeID(id), token),
+	}
+}
+
+// Orphans finds the private keys without certificates.  Since crypto11 only enumerates certificates alongside their
+// keys, certificates without keys are not found; these are not left behind by generate or delete, which create the
+// key before the certificate and remove the certificate before the key.
+func (b *pkcs11Backend) Orphans() ([]Orphan, error) {
+	var orphans []Orphan
+	ctx := b.current()
+	err := b.withDeadline("finding orphaned keys on "+b.label(ctx), func() error {
+		var err error
+		orphans, err = b.orphans(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
+
+func (b *pkcs11Backend) orphans(ctx pkcs11Context) ([]Orphan, error) {
+	signers, err := ctx.FindAllKeyPairs()
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []Orphan
+	for _, signer := range signers {
+		attr, err := ctx.GetAttribute(signer, crypto11.CkaId)
+		if err != nil {
+			return nil, err
+		}
+		if attr == nil {
+			continue
+		}
+		id := attr.Value
+
+		cert, err := ctx.FindCertificate(id, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if cert == nil {
+			orphans = append(orphans, Orphan{ID: id, Kind: "private key", Object: b.DescribeObjects(id)[0]})
+		}
+	}
+
+	return orphans, nil
+}
+
+func (b *pkcs11Backend) RemoveOrphan(orphan Orphan) error {
+	ctx := b.current()
+	return b.withDeadline("removing an orphaned object on "+b.label(ctx), func() error {
+		if orphan.Kind != "private key" {
+			return ctx.DeleteCertificate(orphan.ID, nil, nil)
+		}
+
+		signer, err := ctx.FindKeyPair(orphan.ID, nil)
+		if err != nil {
+			return err
+		}
+		if signer == nil {
+			return nil
+		}
+		return signer.Delete()
+	})
+}
+
+// rawSession opens a session of its own on the device in use, for the operations that crypto11 does not expose.  The
+// module is already initialized and logged in by crypto11, which keeps ownership of both, as loadModule leaves it.
+// The returned function closes the session and must always be called.
+func (b *pkcs11Backend) rawSession() (*pkcs11.Ctx, uint, pkcs11.SessionHandle, func(), error) {
+	device := b.devices[b.index(b.current())]
+	if device.Path == "" {
+		return nil, 0, 0, nil, errors.New("no PKCS#11 module is configured")
+	}
+
+	p, unload, err := loadModule(device.Path)
+	if err != nil {
+		return nil, 0, 0, nil, err
+	}
+
+	slot, err := findSlot(p, device.TokenLabel)
+	if err != nil {
+		unload()
+		return nil, 0, 0, nil, err
+	}
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		unload()
+		return nil, 0, 0, nil, err
+	}
+	release := func() {
+		_ = p.CloseSession(session)
+		unload()
+	}
+	err = p.Login(session, pkcs11.CKU_USER, secretString(device.Pin))
+	if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		release()
+		return nil, 0, 0, nil, err
+	}
+
+	return p, slot, session, release, nil
+}
+
+// ECDH derives the secret shared with peer by CKM_ECDH1_DERIVE, which crypto11 does not expose, through a session of
+// its own on the device in use.  Keys generated before ECDH was supported lack CKA_DERIVE, and are refused by the
+// device.
+func (b *pkcs11Backend) ECDH(id []byte, peer *ecdsa.PublicKey) ([]byte, error) {
+	var secret []byte
+	err := b.withContext("deriving a shared secret for serial "+HexEncode(id), func(pkcs11Context) error {
+		var err error
+		secret, err = b.ecdh(id, peer)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func (b *pkcs11Backend) ecdh(id []byte, peer *ecdsa.PublicKey) ([]byte, error) {
+	p, _, session, release, err := b.rawSession()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	err = p.FindObjectsInit(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys, _, err := p.FindObjects(session, 1)
+	_ = p.FindObjectsFinal(session)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, classify(ExitNotFound, errors.New("private key not found"))
+	}
+
+	size := (peer.Curve.Params().BitSize + 7) / 8
+	// the shared secret is a session object, readable so that it may be passed to HKDF
+	secret, err := p.DeriveKey(session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDH1_DERIVE,
+			pkcs11.NewECDH1DeriveParams(pkcs11.CKD_NULL, nil, elliptic.Marshal(peer.Curve, peer.X, peer.Y)))},
+		keys[0],
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, size),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+		})
+	if err != nil {
+		return nil, fmt.Errorf("key agreement failed (keys generated by earlier releases cannot derive): %w", err)
+	}
+	defer func() {
+		_ = p.DestroyObject(session, secret)
+	}()
+
+	attrs, err := p.GetAttributeValue(session, secret, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil)})
+	if err != nil {
+		return nil, err
+	}
+	return attrs[0].Value, nil
+}
+
+func (b *pkcs11Backend) Close() error {
+	moduleMu.Lock()
+	defer moduleMu.Unlock()
+
+	var err error
+	for _, ctx := range b.contexts {
+		if ctx == nil {
+			continue
+		}
+		if e := ctx.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// current returns the context of the device in use
+func (b *pkcs11Backend) current() pkcs11Context {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.ctx
+}
+
+// index returns the position of ctx amongst the devices
+func (b *pkcs11Backend) index(ctx pkcs11Context) int {
+	b.Lock()
+	defer b.Unlock()
+
+	for i, c := range b.contexts {
+		if c == ctx {
+			return i
+		}
+	}
+	return 0
+}
+
+// label returns the token label of the device of ctx
+func (b *pkcs11Backend) label(ctx pkcs11Context) string {
+	return b.devices[b.index(ctx)].TokenLabel
+}
+
+// deviceLost reports whether err shows the device to have gone away, as on a USB re-plug or a blip of the network to
+// an HSM, after which its sessions are useless until the module is configured afresh
+func deviceLost(err error) bool {
+	var perr pkcs11.Error
+	if !errors.As(err, &perr) {
+		return false
+	}
+	switch perr {
+	case pkcs11.CKR_DEVICE_ERROR, pkcs11.CKR_DEVICE_REMOVED, pkcs11.CKR_TOKEN_NOT_PRESENT,
+		pkcs11.CKR_SESSION_HANDLE_INVALID, pkcs11.CKR_SESSION_CLOSED:
+		return true
+	}
+	return false
+}
+
+// withContext runs op against the device in use, reconnecting and running it once more should the device have been
+// lost, rather than requiring the process to be restarted
+func (b *pkcs11Backend) withContext(what string, op func(ctx pkcs11Context) error) error {
+	ctx := b.current()
+	err := b.withDeadline(what+" on "+b.label(ctx), func() error { return op(ctx) })
+	if !deviceLost(err) {
+		return err
+	}
+
+	ctx, rerr := b.reconnect(ctx, err)
+	if rerr != nil {
+		return fmt.Errorf("%w; reconnecting failed: %v", err, rerr)
+	}
+	return b.withDeadline(what+" on "+b.label(ctx), func() error { return op(ctx) })
+}
+
+// withDeadline runs op within the timeout of the backend, as does the withDeadline function
+func (b *pkcs11Backend) withDeadline(what string, op func() error) error {
+	return withDeadline(b.timeout, what, op)
+}
+
+// withDeadline runs op, naming the step what in any error it returns, and failing with an error wrapping
+// context.DeadlineExceeded should it not complete within timeout, unless zero, so that a hung device does not block
+// the CLI or a daemon forever.  A PKCS#11 call cannot be cancelled, so op is left to complete in the background;
+// callers must not use anything op sets once withDeadline has failed.
+func withDeadline(timeout time.Duration, what string, op func() error) (err error) {
+	start := time.Now()
+	defer func() {
+		logDebug(what, "duration", time.Since(start), "error", err)
+	}()
+
+	if timeout <= 0 {
+		return wrapStep(what, op())
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- op()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return wrapStep(what, err)
+	case <-timer.C:
+		return classify(ExitUnreachable, fmt.Errorf("%s did not complete within %s: %w", what, timeout, context.DeadlineExceeded))
+	}
+}
+
+// wrapStep names the step that failed with err, so that the failure points at it while errors.Is and errors.As still
+// see the error of the device
+func wrapStep(what string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", what, err)
+}
+
+// reconnect closes stale, the context of a device that was lost, and configures the device afresh.  When another
+// operation has already done so, the context it opened is returned.
+func (b *pkcs11Backend) reconnect(stale pkcs11Context, cause error) (pkcs11Context, error) {
+	b.reconnecting.Lock()
+	defer b.reconnecting.Unlock()
+
+	if ctx := b.current(); ctx != stale {
+		return ctx, nil
+	}
+
+	i := b.index(stale)
+	logWarn("lost the device, reconnecting", "token", b.devices[i].TokenLabel, "error", cause)
+
+	b.Lock()
+	b.contexts[i] = nil
+	b.Unlock()
+	// closing the last context of the module finalizes it, so that the module is initialized afresh
+	moduleMu.Lock()
+	_ = stale.Close()
+	moduleMu.Unlock()
+
+	ctx, err := b.context(i)
+	if err != nil {
+		return nil, err
+	}
+
+	b.Lock()
+	b.ctx = ctx
+	b.Unlock()
+	b.certs.invalidate()
+
+	return ctx, nil
+}
+
+// pkcs11Signer signs with the key found on the device in use.  Should the device have been lost, it reconnects and
+// signs once more with the key found anew; should signing still fail, it fails over to the same key on each replica in
+// turn, so that login survives the loss of an HSM.
+type pkcs11Signer struct {
+	sync.Mutex
+	backend *pkcs11Backend
+	id      []byte
+	ctx     pkcs11Context
+	signer  crypto.Signer
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.signer.Public()
+}
+
+func (s *pkcs11Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.Lock()
+	ctx, signer := s.ctx, s.signer
+	s.Unlock()
+
+	sig, err := s.sign(ctx, signer, rand, digest, opts)
+	if err == nil {
+		return sig, nil
+	}
+
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return nil, err
+	}
+
+	if deviceLost(err) {
+		ctx, rerr := s.backend.reconnect(ctx, err)
+		if rerr == nil {
+			found, ferr := s.findKeyPair(ctx)
+			if ferr == nil && found != nil && pub.Equal(found.Public()) {
+				s.Lock()
+				s.ctx, s.signer = ctx, found
+				s.Unlock()
+
+				sig, err = s.sign(ctx, found, rand, digest, opts)
+				if err == nil {
+					return sig, nil
+				}
+			}
+		}
+	}
+
+	current := s.backend.current()
+	for i, device := range s.backend.devices {
+		ctx, cerr := s.backend.context(i)
+		if cerr != nil || ctx == current {
+			continue
+		}
+
+		logWarn("signing failed, failing over", "serial", HexEncode(s.id), "token", device.TokenLabel, "error", err)
+
+		replica, ferr := s.findKeyPair(ctx)
+		if ferr != nil || replica == nil {
+			err = fmt.Errorf("key not found on %s", device.TokenLabel)
+			continue
+		}
+		if !pub.Equal(replica.Public()) {
+			err = fmt.Errorf("key on %s does not match", device.TokenLabel)
+			continue
+		}
+
+		sig, err = s.sign(ctx, replica, rand, digest, opts)
+		if err == nil {
+			return sig, nil
+		}
+	}
+
+	return nil, err
+}
+
+// sign signs digest with signer, found on the device of ctx, within the timeout of the backend
+func (s *pkcs11Signer) sign(ctx pkcs11Context, signer crypto.Signer, rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var sig []byte
+	err := s.backend.withDeadline("signing with serial "+HexEncode(s.id)+" on "+s.backend.label(ctx), func() error {
+		var err error
+		sig, err = signer.Sign(rand, digest, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// findKeyPair finds the key pair of s on the device of ctx within the timeout of the backend
+func (s *pkcs11Signer) findKeyPair(ctx pkcs11Context) (crypto11.Signer, error) {
+	var signer crypto11.Signer
+	err := s.backend.withDeadline("finding the key pair for serial "+HexEncode(s.id)+" on "+s.backend.label(ctx), func() error {
+		var err error
+		signer, err = ctx.FindKeyPair(s.id, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
@@ -0,0 +1,69 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+
+	"github.com/manetu/security-token/config"
+)
+
+// hungContext is a simulated context whose key generation hangs until released
+type hungContext struct {
+	*pkcs11SimContext
+	release chan struct{}
+}
+
+func (c *hungContext) GenerateECDSAKeyPairWithAttributes(public, private crypto11.AttributeSet, curve elliptic.Curve) (crypto11.Signer, error) {
+	<-c.release
+	return c.pkcs11SimContext.GenerateECDSAKeyPairWithAttributes(public, private, curve)
+}
+
+// TestGenerateTimeout fails a generate that hangs, and removes the key pair it leaves once the device completes it
+func TestGenerateTimeout(t *testing.T) {
+	sim := &pkcs11SimContext{sim: &pkcs11Simulator{
+		keys:   map[string]*ecdsa.PrivateKey{},
+		certs:  map[string]*x509.Certificate{},
+		labels: map[string]string{},
+	}}
+	ctx := &hungContext{pkcs11SimContext: sim, release: make(chan struct{})}
+	cfg := &config.Configuration{Pkcs11: config.Pkcs11Configuration{TokenLabel: "test", Timeout: "50ms"}}
+	backend, err := newPkcs11BackendWith(cfg, func(config.Pkcs11Configuration) (pkcs11Context, error) {
+		return ctx, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	_, err = backend.Generate([]byte{1, 2, 3})
+	if !errors.Is(err, context.DeadlineExceeded) || ExitCode(err) != ExitUnreachable {
+		t.Fatalf("Generate = %v; want a deadline exceeded with exit code %d", err, ExitUnreachable)
+	}
+
+	close(ctx.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		keys, err := sim.FindAllKeyPairs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the key pair generated after the timeout was left behind")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/x509"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+const (
+	// enumerationWorkers bounds the sessions opened to fetch the objects of a token in parallel
+	enumerationWorkers = 8
+	// findObjectsBatch is the number of handles requested of each C_FindObjects
+	findObjectsBatch = 256
+)
+
+// enumerateObjects returns the certificates whose CKA_ID is shared by both halves of a key pair, as does crypto11's
+// FindAllPairedCertificates, but fetches the attributes of the objects with several sessions at once, since each is a
+// round trip to a network HSM.  Each certificate is passed to fn, when set, as soon as it is parsed; the certificates
+// are in no particular order.
+func enumerateObjects(p *pkcs11.Ctx, slot uint, session pkcs11.SessionHandle, fn func(*x509.Certificate)) ([]*x509.Certificate, error) {
+	sessions := []pkcs11.SessionHandle{session}
+	defer func() {
+		for _, s := range sessions[1:] {
+			_ = p.CloseSession(s)
+		}
+	}()
+	// further sessions share the login of the first; a device refusing more simply enumerates with fewer
+	for len(sessions) < enumerationWorkers {
+		s, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+		if err != nil {
+			break
+		}
+		sessions = append(sessions, s)
+	}
+
+	ids := func(class uint) (map[string]bool, error) {
+		handles, err := findObjects(p, session, class)
+		if err != nil {
+			return nil, err
+		}
+		set := make(map[string]bool, len(handles))
+		var mu sync.Mutex
+		err = fetchAttributes(p, sessions, handles, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, nil)},
+			func(attrs []*pkcs11.Attribute) error {
+				mu.Lock()
+				defer mu.Unlock()
+				set[string(attrs[0].Value)] = true
+				return nil
+			})
+		return set, err
+	}
+	private, err := ids(pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		return nil, err
+	}
+	public, err := ids(pkcs11.CKO_PUBLIC_KEY)
+	if err != nil {
+		return nil, err
+	}
+
+	handles, err := findObjects(p, session, pkcs11.CKO_CERTIFICATE)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mu    sync.Mutex
+		certs []*x509.Certificate
+		seen  = map[string]bool{}
+	)
+	err = fetchAttributes(p, sessions, handles, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	}, func(attrs []*pkcs11.Attribute) error {
+		id := string(attrs[0].Value)
+		if id == "" || !private[id] || !public[id] {
+			return nil
+		}
+		cert, err := x509.ParseCertificate(attrs[1].Value)
+		if err != nil {
+			// a foreign certificate on a shared token is no reason to hide the rest
+			logWarn("skipping a certificate that cannot be parsed", "id", describeID([]byte(id)), "error", err)
+			return nil
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		// crypto11 pairs a key with the first certificate found for its CKA_ID
+		if seen[id] {
+			return nil
+		}
+		seen[id] = true
+		certs = append(certs, cert)
+		if fn != nil {
+			fn(cert)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return certs, nil
+}
+
+// findObjects returns the handles of every object of class
+func findObjects(p *pkcs11.Ctx, session pkcs11.SessionHandle, class uint) ([]pkcs11.ObjectHandle, error) {
+	err := p.FindObjectsInit(session, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = p.FindObjectsFinal(session)
+	}()
+
+	var handles []pkcs11.ObjectHandle
+	for {
+		batch, _, err := p.FindObjects(session, findObjectsBatch)
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			return handles, nil
+		}
+		handles = append(handles, batch...)
+	}
+}
+
+// fetchAttributes reads the attributes of template from each object of handles, spreading the objects across sessions,
+// and passes them to fn, which may be called concurrently.  Objects lacking an attribute are skipped, and the first
+// error stops the remaining work.
+func fetchAttributes(p *pkcs11.Ctx, sessions []pkcs11.SessionHandle, handles []pkcs11.ObjectHandle,
+	template []*pkcs11.Attribute, fn func([]*pkcs11.Attribute) error) error {
+	work := make(chan pkcs11.ObjectHandle)
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		failed   = make(chan struct{})
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(failed)
+		})
+	}
+
+	for _, session := range sessions {
+		wg.Add(1)
+		go func(session pkcs11.SessionHandle) {
+			defer wg.Done()
+			for handle := range work {
+				attrs, err := p.GetAttributeValue(session, handle, template)
+				if err == pkcs11.Error(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID) {
+					// as crypto11 does, objects without a CKA_ID are no part of a token
+					continue
+				}
+				if err == nil {
+					err = fn(attrs)
+				}
+				if err != nil {
+					fail(err)
+				}
+			}
+		}(session)
+	}
+
+feed:
+	for _, handle := range handles {
+		select {
+		case work <- handle:
+		case <-failed:
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	return firstErr
+}
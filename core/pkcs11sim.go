@@ -0,0 +1,275 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/miekg/pkcs11"
+
+	"github.com/manetu/security-token/config"
+)
+
+func init() {
+	RegisterBackend("pkcs11sim", newPkcs11SimBackend)
+}
+
+// pkcs11Simulator is a token held in process memory that stands in for a PKCS#11 module behind crypto11, so that the
+// pkcs11 backend, and the logic of core above it, may be exercised quickly on machines without any module.  Keys are
+// P-256 keys generated in software, each object is found by its CKA_ID alone, and everything is lost when the process
+// exits.  Any replicas configured share the one simulated token.  Operations that need a raw session of their own,
+// such as ECDH, are not simulated.
+type pkcs11Simulator struct {
+	sync.Mutex
+	keys  map[string]*ecdsa.PrivateKey
+	certs map[string]*x509.Certificate
+	// labels holds the CKA_LABEL of the keys generated with one
+	labels map[string]string
+	// ids lists the CKA_IDs of the keys in the order generated, in which a token returns its objects
+	ids []string
+}
+
+func newPkcs11SimBackend(cfg *config.Configuration) (Backend, error) {
+	sim := &pkcs11Simulator{
+		keys:   map[string]*ecdsa.PrivateKey{},
+		certs:  map[string]*x509.Certificate{},
+		labels: map[string]string{},
+	}
+	return newPkcs11BackendWith(cfg, func(config.Pkcs11Configuration) (pkcs11Context, error) {
+		return &pkcs11SimContext{sim: sim}, nil
+	})
+}
+
+// pkcs11SimContext is a context on the simulated token, which fails as crypto11 does once closed
+type pkcs11SimContext struct {
+	sync.Mutex
+	sim    *pkcs11Simulator
+	closed bool
+}
+
+// errSimClosed matches the error of crypto11 on a closed context
+var errSimClosed = errors.New("context is closed")
+
+func (c *pkcs11SimContext) check() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return errSimClosed
+	}
+	return nil
+}
+
+func (c *pkcs11SimContext) GenerateECDSAKeyPairWithAttributes(public, private crypto11.AttributeSet, curve elliptic.Curve) (crypto11.Signer, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	attr, ok := public[crypto11.CkaId]
+	if !ok || len(attr.Value) == 0 {
+		return nil, pkcs11.Error(pkcs11.CKR_TEMPLATE_INCOMPLETE)
+	}
+	id := string(attr.Value)
+
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	c.sim.Lock()
+	defer c.sim.Unlock()
+
+	if _, ok := c.sim.keys[id]; ok {
+		return nil, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_VALUE_INVALID)
+	}
+	c.sim.keys[id] = key
+	c.sim.ids = append(c.sim.ids, id)
+	if label, ok := public[crypto11.CkaLabel]; ok {
+		c.sim.labels[id] = string(label.Value)
+	}
+
+	return &pkcs11SimSigner{ctx: c, id: id, key: key}, nil
+}
+
+func (c *pkcs11SimContext) ImportCertificate(id []byte, cert *x509.Certificate) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	if id == nil {
+		return errors.New("id cannot be nil")
+	}
+	if cert == nil {
+		return errors.New("certificate cannot be nil")
+	}
+
+	c.sim.Lock()
+	defer c.sim.Unlock()
+
+	if _, ok := c.sim.certs[string(id)]; ok {
+		return pkcs11.Error(pkcs11.CKR_ATTRIBUTE_VALUE_INVALID)
+	}
+	c.sim.certs[string(id)] = cert
+	return nil
+}
+
+// FindCertificate returns the certificate with CKA_ID id, or nil as crypto11 does when there is none.  The label and
+// serial are not simulated.
+func (c *pkcs11SimContext) FindCertificate(id []byte, _ []byte, _ *big.Int) (*x509.Certificate, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+
+	c.sim.Lock()
+	defer c.sim.Unlock()
+
+	return c.sim.certs[string(id)], nil
+}
+
+func (c *pkcs11SimContext) DeleteCertificate(id []byte, _ []byte, _ *big.Int) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+
+	c.sim.Lock()
+	defer c.sim.Unlock()
+
+	delete(c.sim.certs, string(id))
+	return nil
+}
+
+func (c *pkcs11SimContext) FindAllPairedCertificates() ([]tls.Certificate, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+
+	c.sim.Lock()
+	defer c.sim.Unlock()
+
+	var pairs []tls.Certificate
+	for _, id := range c.sim.ids {
+		cert, ok := c.sim.certs[id]
+		if !ok {
+			continue
+		}
+		pairs = append(pairs, tls.Certificate{
+			Certificate: [][]byte{cert.Raw},
+			PrivateKey:  &pkcs11SimSigner{ctx: c, id: id, key: c.sim.keys[id]},
+			Leaf:        cert,
+		})
+	}
+	return pairs, nil
+}
+
+// FindKeyPair returns the key pair with CKA_ID id, or nil as crypto11 does when there is none
+func (c *pkcs11SimContext) FindKeyPair(id []byte, _ []byte) (crypto11.Signer, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+
+	c.sim.Lock()
+	defer c.sim.Unlock()
+
+	key, ok := c.sim.keys[string(id)]
+	if !ok {
+		return nil, nil
+	}
+	return &pkcs11SimSigner{ctx: c, id: string(id), key: key}, nil
+}
+
+func (c *pkcs11SimContext) FindAllKeyPairs() ([]crypto11.Signer, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+
+	c.sim.Lock()
+	defer c.sim.Unlock()
+
+	signers := make([]crypto11.Signer, 0, len(c.sim.ids))
+	for _, id := range c.sim.ids {
+		signers = append(signers, &pkcs11SimSigner{ctx: c, id: id, key: c.sim.keys[id]})
+	}
+	return signers, nil
+}
+
+// GetAttribute returns the CKA_ID or CKA_LABEL of a simulated key, the only attributes simulated
+func (c *pkcs11SimContext) GetAttribute(key interface{}, attribute crypto11.AttributeType) (*crypto11.Attribute, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(*pkcs11SimSigner)
+	if !ok {
+		return nil, errors.New("not a key of the simulated token")
+	}
+	switch attribute {
+	case crypto11.CkaId:
+		return pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(signer.id)), nil
+	case crypto11.CkaLabel:
+		c.sim.Lock()
+		defer c.sim.Unlock()
+
+		return pkcs11.NewAttribute(pkcs11.CKA_LABEL, []byte(c.sim.labels[signer.id])), nil
+	}
+	return nil, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)
+}
+
+func (c *pkcs11SimContext) Close() error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.closed = true
+	return nil
+}
+
+// pkcs11SimSigner is a key pair on the simulated token, usable only while the context that found it is open
+type pkcs11SimSigner struct {
+	ctx *pkcs11SimContext
+	id  string
+	key *ecdsa.PrivateKey
+}
+
+func (s *pkcs11SimSigner) Public() crypto.PublicKey {
+	return &s.key.PublicKey
+}
+
+func (s *pkcs11SimSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if err := s.ctx.check(); err != nil {
+		return nil, err
+	}
+	return s.key.Sign(rand, digest, opts)
+}
+
+// Delete removes the key pair, leaving any certificate with the same CKA_ID, as crypto11 does
+func (s *pkcs11SimSigner) Delete() error {
+	if err := s.ctx.check(); err != nil {
+		return err
+	}
+
+	sim := s.ctx.sim
+	sim.Lock()
+	defer sim.Unlock()
+
+	if _, ok := sim.keys[s.id]; !ok {
+		return nil
+	}
+	delete(sim.keys, s.id)
+	delete(sim.labels, s.id)
+	for i, id := range sim.ids {
+		if id == s.id {
+			sim.ids = append(sim.ids[:i], sim.ids[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
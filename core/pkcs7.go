@@ -0,0 +1,648 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+
+	oidAttributeContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttributeMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+// digestOIDs maps the digest algorithms of signed messages to their identifiers
+var digestOIDs = map[crypto.Hash]asn1.ObjectIdentifier{
+	crypto.SHA1:   oidSHA1,
+	crypto.SHA256: oidSHA256,
+	crypto.SHA384: oidSHA384,
+	crypto.SHA512: oidSHA512,
+}
+
+// contentInfo is the outer structure of PKCS#7 and CMS messages (RFC 5652, section 3).  encoding/asn1 ignores the
+// explicit tag of a RawValue when marshalling, so Content must be built with explicitContent.
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// signedData is the SignedData of RFC 5652, section 5.1, keeping the parts not needed by the parser raw
+type signedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      asn1.RawValue
+}
+
+type issuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+// signerInfo is the SignerInfo of RFC 5652, section 5.3, identifying its signer by issuer and serial number
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsAttribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []keyTransRecipientInfo `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type keyTransRecipientInfo struct {
+	Version                int
+	IssuerAndSerialNumber  issuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// explicitContent wraps der in the [0] EXPLICIT tag of the content of a contentInfo
+func explicitContent(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// octets returns the contents of an OCTET STRING, joining the segments of a constructed one
+func octets(v asn1.RawValue) ([]byte, error) {
+	if !v.IsCompound {
+		return v.Bytes, nil
+	}
+
+	var out []byte
+	rest := v.Bytes
+	for len(rest) > 0 {
+		var segment asn1.RawValue
+		var err error
+		rest, err = asn1.Unmarshal(rest, &segment)
+		if err != nil {
+			return nil, err
+		}
+		data, err := octets(segment)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, data...)
+	}
+	return out, nil
+}
+
+func newAttribute(oid asn1.ObjectIdentifier, value interface{}) (cmsAttribute, error) {
+	der, err := asn1.Marshal(value)
+	if err != nil {
+		return cmsAttribute{}, err
+	}
+	return cmsAttribute{Type: oid, Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: der}}, nil
+}
+
+// marshalAttributes encodes attrs as a SET OF in DER order, sorted by their encodings, over which verifiers compute
+// the signature whatever the order they were given in
+func marshalAttributes(attrs []cmsAttribute) ([]byte, error) {
+	encoded := make([][]byte, len(attrs))
+	for i, a := range attrs {
+		der, err := asn1.Marshal(a)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = der
+	}
+	sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 })
+
+	return asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(encoded, nil)})
+}
+
+// parseAttributes decodes the [0] IMPLICIT attributes of a signerInfo
+func parseAttributes(v asn1.RawValue) ([]cmsAttribute, error) {
+	var attrs []cmsAttribute
+	rest := v.Bytes
+	for len(rest) > 0 {
+		var a cmsAttribute
+		var err error
+		rest, err = asn1.Unmarshal(rest, &a)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, a)
+	}
+	return attrs, nil
+}
+
+// attributeValue returns the DER of the single value of the attribute oid, or nil when it is absent
+func attributeValue(attrs []cmsAttribute, oid asn1.ObjectIdentifier) []byte {
+	for _, a := range attrs {
+		if a.Type.Equal(oid) {
+			return a.Value.Bytes
+		}
+	}
+	return nil
+}
+
+// parseCertsOnly returns the certificates carried by a DER encoded PKCS#7 SignedData, such as the "certs-only"
+// responses of EST and SCEP servers
+func parseCertsOnly(der []byte) ([]*x509.Certificate, error) {
+	sd, err := parseSignedData(der)
+	if err != nil {
+		return nil, err
+	}
+	if len(sd.Certificates.Bytes) == 0 {
+		return nil, errors.New("pkcs7: no certificates found")
+	}
+
+	return x509.ParseCertificates(sd.Certificates.Bytes)
+}
+
+func parseSignedData(der []byte) (*signedData, error) {
+	var ci contentInfo
+	rest, err := asn1.Unmarshal(der, &ci)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs7: %w", err)
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("pkcs7: trailing data")
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("pkcs7: unexpected content type %s", ci.ContentType)
+	}
+
+	var sd signedData
+	_, err = asn1.Unmarshal(ci.Content.Bytes, &sd)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs7: %w", err)
+	}
+
+	return &sd, nil
+}
+
+// signedContent returns the encapsulated content of sd, or nil when it is detached
+func (sd *signedData) signedContent() ([]byte, error) {
+	var ci contentInfo
+	_, err := asn1.Unmarshal(sd.ContentInfo.FullBytes, &ci)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs7: %w", err)
+	}
+	if len(ci.Content.FullBytes) == 0 {
+		return nil, nil
+	}
+
+	return octets(ci.Content)
+}
+
+func (sd *signedData) signerInfos() ([]signerInfo, error) {
+	var infos []signerInfo
+	_, err := asn1.UnmarshalWithParams(sd.SignerInfos.FullBytes, &infos, "set")
+	if err != nil {
+		return nil, fmt.Errorf("pkcs7: %w", err)
+	}
+	return infos, nil
+}
+
+// signerCertificate finds the certificate of si among certs
+func signerCertificate(si signerInfo, certs []*x509.Certificate) *x509.Certificate {
+	for _, cert := range certs {
+		if bytes.Equal(cert.RawIssuer, si.IssuerAndSerialNumber.Issuer.FullBytes) &&
+			cert.SerialNumber.Cmp(si.IssuerAndSerialNumber.SerialNumber) == 0 {
+			return cert
+		}
+	}
+	return nil
+}
+
+// verifySignerInfo checks the signature of si by cert over content, returning its authenticated attributes
+func verifySignerInfo(si signerInfo, cert *x509.Certificate, content []byte) ([]cmsAttribute, error) {
+	var hash crypto.Hash
+	for h, oid := range digestOIDs {
+		if si.DigestAlgorithm.Algorithm.Equal(oid) {
+			hash = h
+		}
+	}
+	if hash == 0 {
+		return nil, fmt.Errorf("pkcs7: unsupported digest algorithm %s", si.DigestAlgorithm.Algorithm)
+	}
+	h := hash.New()
+	h.Write(content)
+	digest := h.Sum(nil)
+
+	signed := content
+	var attrs []cmsAttribute
+	if len(si.AuthenticatedAttributes.FullBytes) > 0 {
+		var err error
+		attrs, err = parseAttributes(si.AuthenticatedAttributes)
+		if err != nil {
+			return nil, fmt.Errorf("pkcs7: %w", err)
+		}
+		var messageDigest []byte
+		_, err = asn1.Unmarshal(attributeValue(attrs, oidAttributeMessageDigest), &messageDigest)
+		if err != nil || !bytes.Equal(messageDigest, digest) {
+			return nil, errors.New("pkcs7: the message digest does not match the content")
+		}
+		// the signature covers the attributes with their universal SET tag in place of [0] IMPLICIT
+		signed = append([]byte{0x31}, si.AuthenticatedAttributes.FullBytes[1:]...)
+	}
+
+	alg, err := signatureAlgorithm(cert.PublicKey, hash)
+	if err != nil {
+		return nil, err
+	}
+	err = cert.CheckSignature(alg, signed, si.EncryptedDigest)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs7: %w", err)
+	}
+
+	return attrs, nil
+}
+
+func signatureAlgorithm(pub crypto.PublicKey, hash crypto.Hash) (x509.SignatureAlgorithm, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		switch hash {
+		case crypto.SHA1:
+			return x509.SHA1WithRSA, nil
+		case crypto.SHA256:
+			return x509.SHA256WithRSA, nil
+		case crypto.SHA384:
+			return x509.SHA384WithRSA, nil
+		case crypto.SHA512:
+			return x509.SHA512WithRSA, nil
+		}
+	case *ecdsa.PublicKey:
+		switch hash {
+		case crypto.SHA1:
+			return x509.ECDSAWithSHA1, nil
+		case crypto.SHA256:
+			return x509.ECDSAWithSHA256, nil
+		case crypto.SHA384:
+			return x509.ECDSAWithSHA384, nil
+		case crypto.SHA512:
+			return x509.ECDSAWithSHA512, nil
+		}
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("pkcs7: unsupported signature key %T with %s", pub, hash)
+}
+
+// signatureAlgorithmIdentifier names the algorithm of signatures by signer over digests of hash within a signerInfo
+func signatureAlgorithmIdentifier(signer crypto.Signer, hash crypto.Hash) (pkix.AlgorithmIdentifier, error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}, nil
+	case *ecdsa.PublicKey:
+		oid, ok := map[crypto.Hash]asn1.ObjectIdentifier{
+			crypto.SHA1:   oidECDSAWithSHA1,
+			crypto.SHA256: oidECDSAWithSHA256,
+			crypto.SHA384: oidECDSAWithSHA384,
+			crypto.SHA512: oidECDSAWithSHA512,
+		}[hash]
+		if ok {
+			return pkix.AlgorithmIdentifier{Algorithm: oid}, nil
+		}
+	}
+	return pkix.AlgorithmIdentifier{}, fmt.Errorf("pkcs7: unsupported signature key %T with %s", signer.Public(), hash)
+}
+
+// signData returns a DER encoded SignedData of content, signed by signer, identified by cert, over its digest by hash
+// and attrs along with the mandatory content type and message digest attributes.  content is encapsulated unless
+// detached; certs are included in the message.
+func signData(content []byte, detached bool, signer crypto.Signer, cert *x509.Certificate, hash crypto.Hash, attrs []cmsAttribute, certs []*x509.Certificate) ([]byte, error) {
+	digestAlg, ok := digestOIDs[hash]
+	if !ok {
+		return nil, fmt.Errorf("pkcs7: unsupported digest algorithm %s", hash)
+	}
+	sigAlg, err := signatureAlgorithmIdentifier(signer, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	h.Write(content)
+	digest := h.Sum(nil)
+
+	contentType, err := newAttribute(oidAttributeContentType, oidData)
+	if err != nil {
+		return nil, err
+	}
+	messageDigest, err := newAttribute(oidAttributeMessageDigest, digest)
+	if err != nil {
+		return nil, err
+	}
+	attrs = append([]cmsAttribute{contentType, messageDigest}, attrs...)
+
+	signed, err := marshalAttributes(attrs)
+	if err != nil {
+		return nil, err
+	}
+	h = hash.New()
+	h.Write(signed)
+	signature, err := signer.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return nil, err
+	}
+	// within the signerInfo, the attributes are [0] IMPLICIT
+	signed[0] = 0xa0
+
+	si := signerInfo{
+		Version:                   1,
+		IssuerAndSerialNumber:     issuerAndSerial{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, SerialNumber: cert.SerialNumber},
+		DigestAlgorithm:           pkix.AlgorithmIdentifier{Algorithm: digestAlg, Parameters: asn1.NullRawValue},
+		AuthenticatedAttributes:   asn1.RawValue{FullBytes: signed},
+		DigestEncryptionAlgorithm: sigAlg,
+		EncryptedDigest:           signature,
+	}
+	infos, err := asn1.MarshalWithParams([]signerInfo{si}, "set")
+	if err != nil {
+		return nil, err
+	}
+	algs, err := asn1.MarshalWithParams([]pkix.AlgorithmIdentifier{si.DigestAlgorithm}, "set")
+	if err != nil {
+		return nil, err
+	}
+
+	encap := contentInfo{ContentType: oidData}
+	if !detached {
+		data, err := asn1.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+		encap.Content = explicitContent(data)
+	}
+	encapDER, err := asn1.Marshal(encap)
+	if err != nil {
+		return nil, err
+	}
+
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: asn1.RawValue{FullBytes: algs},
+		ContentInfo:      asn1.RawValue{FullBytes: encapDER},
+		SignerInfos:      asn1.RawValue{FullBytes: infos},
+	}
+	if len(certs) > 0 {
+		var raw []byte
+		for _, c := range certs {
+			raw = append(raw, c.Raw...)
+		}
+		sd.Certificates = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw}
+	}
+	sdDER, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(contentInfo{ContentType: oidSignedData, Content: explicitContent(sdDER)})
+}
+
+// setUnsignedAttributes replaces the unauthenticated attributes of the single signer of the SignedData msg, returning
+// the message re-encoded.  update is given the signerInfo, so that an attribute may be computed over its signature.
+func setUnsignedAttributes(msg []byte, update func(si signerInfo) ([]cmsAttribute, error)) ([]byte, error) {
+	sd, err := parseSignedData(msg)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := sd.signerInfos()
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) != 1 {
+		return nil, fmt.Errorf("pkcs7: expected one signer, found %d", len(infos))
+	}
+
+	attrs, err := update(infos[0])
+	if err != nil {
+		return nil, err
+	}
+	unsigned, err := marshalAttributes(attrs)
+	if err != nil {
+		return nil, err
+	}
+	// within the signerInfo, the unauthenticated attributes are [1] IMPLICIT
+	unsigned[0] = 0xa1
+	infos[0].UnauthenticatedAttributes = asn1.RawValue{FullBytes: unsigned}
+
+	sd.SignerInfos.FullBytes, err = asn1.MarshalWithParams(infos, "set")
+	if err != nil {
+		return nil, err
+	}
+	sdDER, err := asn1.Marshal(*sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{ContentType: oidSignedData, Content: explicitContent(sdDER)})
+}
+
+// envelope encrypts content for recipient, whose key must be RSA, with AES-128-CBC or, for legacy servers, 3DES
+func envelope(content []byte, recipient *x509.Certificate, useAES bool) ([]byte, error) {
+	pub, ok := recipient.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("pkcs7: unsupported recipient key %T", recipient.PublicKey)
+	}
+
+	alg := oidDESEDE3CBC
+	if useAES {
+		alg = oidAES128CBC
+	}
+	key := make([]byte, pbes2KeyLengths[alg.String()])
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var block cipher.Block
+	if useAES {
+		block, err = aes.NewCipher(key)
+	} else {
+		block, err = des.NewTripleDESCipher(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, block.BlockSize())
+	_, err = rand.Read(iv)
+	if err != nil {
+		return nil, err
+	}
+
+	n := block.BlockSize() - len(content)%block.BlockSize()
+	padded := append(append([]byte{}, content...), bytes.Repeat([]byte{byte(n)}, n)...)
+	encrypted := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, padded)
+
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+
+	ed := envelopedData{
+		RecipientInfos: []keyTransRecipientInfo{{
+			IssuerAndSerialNumber:  issuerAndSerial{Issuer: asn1.RawValue{FullBytes: recipient.RawIssuer}, SerialNumber: recipient.SerialNumber},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encryptedKey,
+		}},
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: alg, Parameters: asn1.RawValue{FullBytes: params}},
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: encrypted},
+		},
+	}
+	edDER, err := asn1.Marshal(ed)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(contentInfo{ContentType: oidEnvelopedData, Content: explicitContent(edDER)})
+}
+
+// openEnvelope decrypts the DER encoded EnvelopedData der with key
+func openEnvelope(der []byte, key *rsa.PrivateKey) ([]byte, error) {
+	var ci contentInfo
+	_, err := asn1.Unmarshal(der, &ci)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs7: %w", err)
+	}
+	if !ci.ContentType.Equal(oidEnvelopedData) {
+		return nil, fmt.Errorf("pkcs7: unexpected content type %s", ci.ContentType)
+	}
+	var ed envelopedData
+	_, err = asn1.Unmarshal(ci.Content.Bytes, &ed)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs7: %w", err)
+	}
+	if len(ed.RecipientInfos) == 0 {
+		return nil, errors.New("pkcs7: no recipients")
+	}
+
+	var contentKey []byte
+	for _, ri := range ed.RecipientInfos {
+		contentKey, err = rsa.DecryptPKCS1v15(rand.Reader, key, ri.EncryptedKey)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, errors.New("pkcs7: the message is not encrypted for this key")
+	}
+
+	eci := ed.EncryptedContentInfo
+	var block cipher.Block
+	switch {
+	case eci.ContentEncryptionAlgorithm.Algorithm.Equal(oidDESEDE3CBC):
+		block, err = des.NewTripleDESCipher(contentKey)
+	case eci.ContentEncryptionAlgorithm.Algorithm.Equal(oidAES128CBC),
+		eci.ContentEncryptionAlgorithm.Algorithm.Equal(oidAES192CBC),
+		eci.ContentEncryptionAlgorithm.Algorithm.Equal(oidAES256CBC):
+		block, err = aes.NewCipher(contentKey)
+	default:
+		return nil, fmt.Errorf("pkcs7: unsupported content encryption %s", eci.ContentEncryptionAlgorithm.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var iv []byte
+	_, err = asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv)
+	if err != nil || len(iv) != block.BlockSize() {
+		return nil, errors.New("pkcs7: invalid initialization vector")
+	}
+	encrypted, err := octets(eci.EncryptedContent)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs7: %w", err)
+	}
+	if len(encrypted) == 0 || len(encrypted)%block.BlockSize() != 0 {
+		return nil, errors.New("pkcs7: invalid encrypted content")
+	}
+
+	plain := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, encrypted)
+	n := int(plain[len(plain)-1])
+	if n == 0 || n > block.BlockSize() || !bytes.Equal(plain[len(plain)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, errors.New("pkcs7: invalid padding")
+	}
+
+	return plain[:len(plain)-n], nil
+}
+
+// leafFirst orders certs, as found unordered in a PKCS#7 bag, from the certificate of the key of signer up through
+// its issuers
+func leafFirst(certs []*x509.Certificate, signer crypto.Signer) ([]*x509.Certificate, error) {
+	var leaf *x509.Certificate
+	rest := make([]*x509.Certificate, 0, len(certs))
+	for _, cert := range certs {
+		if leaf == nil && checkKeyMatchesCert(signer, cert) == nil {
+			leaf = cert
+			continue
+		}
+		rest = append(rest, cert)
+	}
+	if leaf == nil {
+		return nil, errors.New("no certificate carries the token's key")
+	}
+
+	chain := []*x509.Certificate{leaf}
+	for len(rest) > 0 {
+		last := chain[len(chain)-1]
+		found := -1
+		for i, cert := range rest {
+			if last.CheckSignatureFrom(cert) == nil {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			break
+		}
+		chain = append(chain, rest[found])
+		rest = append(rest[:found], rest[found+1:]...)
+	}
+
+	return chain, nil
+}
@@ -0,0 +1,339 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// The files of testdata/pkcs7 were made by OpenSSL 3.0 from content.txt, with the self-signed certificates and keys
+// rsa.pem, rsa.key, ec.pem (P-384) and ec.key:
+//
+//	signed-rsa.der          openssl cms -sign -binary -nodetach -md sha256 -signer rsa.pem -inkey rsa.key
+//	signed-ec-detached.der  openssl cms -sign -binary -md sha384 -signer ec.pem -inkey ec.key
+//	enveloped-<cipher>.der  openssl cms -encrypt -binary -<cipher> -recip rsa.pem
+//	certs.p7b               openssl crl2pkcs7 -nocrl -certfile rsa.pem -certfile ec.pem
+func readPKCS7(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "pkcs7", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func readPKCS7Cert(t *testing.T, name string) *x509.Certificate {
+	t.Helper()
+
+	block, _ := pem.Decode(readPKCS7(t, name))
+	if block == nil {
+		t.Fatalf("no PEM found in %s", name)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func readPKCS7Key(t *testing.T, name string) crypto.Signer {
+	t.Helper()
+
+	block, _ := pem.Decode(readPKCS7(t, name))
+	if block == nil {
+		t.Fatalf("no PEM found in %s", name)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.(crypto.Signer)
+}
+
+// verifySignedData checks the one signature of the SignedData der, by one of the certificates it carries, over content
+// or over the content it encapsulates when content is nil, returning the content signed
+func verifySignedData(t *testing.T, der, content []byte) []byte {
+	t.Helper()
+
+	sd, err := parseSignedData(der)
+	if err != nil {
+		t.Fatalf("parseSignedData: %v", err)
+	}
+	if content == nil {
+		content, err = sd.signedContent()
+		if err != nil || content == nil {
+			t.Fatalf("signedContent = %v; want the content encapsulated", err)
+		}
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := sd.signerInfos()
+	if err != nil || len(infos) != 1 {
+		t.Fatalf("signerInfos = %d, %v; want one", len(infos), err)
+	}
+	cert := signerCertificate(infos[0], certs)
+	if cert == nil {
+		t.Fatal("the certificate of the signer is missing")
+	}
+	attrs, err := verifySignerInfo(infos[0], cert, content)
+	if err != nil {
+		t.Fatalf("verifySignerInfo: %v", err)
+	}
+	var contentType asn1.ObjectIdentifier
+	_, err = asn1.Unmarshal(attributeValue(attrs, oidAttributeContentType), &contentType)
+	if err != nil || !contentType.Equal(oidData) {
+		t.Errorf("the content type attribute is %v; want id-data", contentType)
+	}
+	return content
+}
+
+func TestVerifyOpenSSLSignedData(t *testing.T) {
+	content := readPKCS7(t, "content.txt")
+
+	got := verifySignedData(t, readPKCS7(t, "signed-rsa.der"), nil)
+	if !bytes.Equal(got, content) {
+		t.Errorf("the content signed = %q; want %q", got, content)
+	}
+
+	der := readPKCS7(t, "signed-ec-detached.der")
+	sd, err := parseSignedData(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encapsulated, err := sd.signedContent(); err != nil || encapsulated != nil {
+		t.Errorf("signedContent of a detached signature = %q, %v; want nil", encapsulated, err)
+	}
+	verifySignedData(t, der, content)
+
+	// the signature of other content
+	infos, err := sd.signerInfos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = verifySignerInfo(infos[0], readPKCS7Cert(t, "ec.pem"), []byte("other content"))
+	if err == nil {
+		t.Error("the signature over other content verified")
+	}
+	// by another key
+	_, err = verifySignerInfo(infos[0], readPKCS7Cert(t, "rsa.pem"), content)
+	if err == nil {
+		t.Error("the signature verified with the key of another certificate")
+	}
+}
+
+func TestOpenOpenSSLEnvelope(t *testing.T) {
+	content := readPKCS7(t, "content.txt")
+	key := readPKCS7Key(t, "rsa.key").(*rsa.PrivateKey)
+
+	for _, name := range []string{"enveloped-aes128.der", "enveloped-aes256.der", "enveloped-des3.der"} {
+		got, err := openEnvelope(readPKCS7(t, name), key)
+		if err != nil {
+			t.Errorf("openEnvelope %s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("openEnvelope %s = %q; want %q", name, got, content)
+		}
+	}
+
+	other, _ := testCA(t, "Other")
+	_, err := openEnvelope(readPKCS7(t, "enveloped-aes128.der"), other)
+	if err == nil {
+		t.Error("an envelope for another key opened")
+	}
+	_, err = openEnvelope(readPKCS7(t, "signed-rsa.der"), key)
+	if err == nil {
+		t.Error("a SignedData opened as an envelope")
+	}
+}
+
+func TestParseOpenSSLCertsOnly(t *testing.T) {
+	certs, err := parseCertsOnly(readPKCS7(t, "certs.p7b"))
+	if err != nil {
+		t.Fatalf("parseCertsOnly: %v", err)
+	}
+	if len(certs) != 2 || !certs[0].Equal(readPKCS7Cert(t, "rsa.pem")) || !certs[1].Equal(readPKCS7Cert(t, "ec.pem")) {
+		t.Errorf("parseCertsOnly = %d certificates; want those of rsa.pem and ec.pem", len(certs))
+	}
+
+	_, err = parseCertsOnly(readPKCS7(t, "enveloped-aes128.der"))
+	if err == nil {
+		t.Error("parseCertsOnly of an EnvelopedData succeeded")
+	}
+	_, err = parseCertsOnly(append(readPKCS7(t, "certs.p7b"), 0x00))
+	if err == nil {
+		t.Error("parseCertsOnly with trailing data succeeded")
+	}
+}
+
+// TestSignData round trips signData through verifySignedData, and through OpenSSL when it is installed
+func TestSignData(t *testing.T) {
+	content := readPKCS7(t, "content.txt")
+
+	for _, tt := range []struct {
+		name     string
+		key      string
+		cert     string
+		hash     crypto.Hash
+		detached bool
+	}{
+		{"RSA SHA-256", "rsa.key", "rsa.pem", crypto.SHA256, false},
+		{"RSA SHA-512 detached", "rsa.key", "rsa.pem", crypto.SHA512, true},
+		{"ECDSA SHA-384", "ec.key", "ec.pem", crypto.SHA384, false},
+		{"ECDSA SHA-256 detached", "ec.key", "ec.pem", crypto.SHA256, true},
+	} {
+		signer := readPKCS7Key(t, tt.key)
+		cert := readPKCS7Cert(t, tt.cert)
+		der, err := signData(content, tt.detached, signer, cert, tt.hash, nil, []*x509.Certificate{cert})
+		if err != nil {
+			t.Fatalf("%s: signData: %v", tt.name, err)
+		}
+
+		if tt.detached {
+			verifySignedData(t, der, content)
+		} else if got := verifySignedData(t, der, nil); !bytes.Equal(got, content) {
+			t.Errorf("%s: the content signed = %q; want %q", tt.name, got, content)
+		}
+
+		verifyWithOpenSSL(t, der, content, tt.detached)
+	}
+
+	_, err := signData(content, false, readPKCS7Key(t, "ec.key"), readPKCS7Cert(t, "ec.pem"), crypto.MD5, nil, nil)
+	if err == nil {
+		t.Error("signData with MD5 succeeded")
+	}
+}
+
+// verifyWithOpenSSL verifies the signature of the SignedData der over content with "openssl cms -verify", when it is
+// installed
+func verifyWithOpenSSL(t *testing.T, der, content []byte, detached bool) {
+	t.Helper()
+
+	path, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Log("openssl is not installed; skipping its verification")
+		return
+	}
+	dir := t.TempDir()
+	in := filepath.Join(dir, "signed.der")
+	err = os.WriteFile(in, der, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// -noverify checks the signature but not the chain of the self-signed certificate
+	args := []string{"cms", "-verify", "-binary", "-noverify", "-inform", "DER", "-in", in}
+	if detached {
+		data := filepath.Join(dir, "content")
+		err = os.WriteFile(data, content, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args = append(args, "-content", data)
+	}
+	// #nosec G204 the arguments are those of the test
+	out, err := exec.Command(path, args...).Output()
+	if err != nil {
+		t.Errorf("openssl cms -verify: %v", err)
+		return
+	}
+	if !bytes.Equal(out, content) {
+		t.Errorf("openssl cms -verify = %q; want %q", out, content)
+	}
+}
+
+// TestEnvelope round trips envelope through openEnvelope, and through "openssl cms -decrypt" when it is installed
+func TestEnvelope(t *testing.T) {
+	content := readPKCS7(t, "content.txt")
+	key := readPKCS7Key(t, "rsa.key").(*rsa.PrivateKey)
+	cert := readPKCS7Cert(t, "rsa.pem")
+
+	for _, useAES := range []bool{true, false} {
+		der, err := envelope(content, cert, useAES)
+		if err != nil {
+			t.Fatalf("envelope: %v", err)
+		}
+		got, err := openEnvelope(der, key)
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("openEnvelope of an envelope with AES %v = %q, %v; want %q", useAES, got, err, content)
+		}
+
+		path, err := exec.LookPath("openssl")
+		if err != nil {
+			continue
+		}
+		in := filepath.Join(t.TempDir(), "enveloped.der")
+		err = os.WriteFile(in, der, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// #nosec G204 the arguments are those of the test
+		out, err := exec.Command(path, "cms", "-decrypt", "-binary", "-inform", "DER", "-in", in,
+			"-inkey", filepath.Join("testdata", "pkcs7", "rsa.key")).Output()
+		if err != nil || !bytes.Equal(out, content) {
+			t.Errorf("openssl cms -decrypt of an envelope with AES %v = %q, %v; want %q", useAES, out, err, content)
+		}
+	}
+
+	ecCert := readPKCS7Cert(t, "ec.pem")
+	if _, ok := ecCert.PublicKey.(*ecdsa.PublicKey); !ok {
+		t.Fatal("ec.pem does not hold an EC key")
+	}
+	_, err := envelope(content, ecCert, true)
+	if err == nil {
+		t.Error("an envelope for an EC recipient was made")
+	}
+}
+
+func TestMarshalAttributes(t *testing.T) {
+	contentType, err := newAttribute(oidAttributeContentType, oidData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messageDigest, err := newAttribute(oidAttributeMessageDigest, []byte{0x01, 0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// whatever the order given, the SET OF is sorted by the encodings of its members
+	const want = "312d" +
+		"301106092a864886f70d010904310404020102" +
+		"301806092a864886f70d010903310b06092a864886f70d010701"
+	for _, attrs := range [][]cmsAttribute{{contentType, messageDigest}, {messageDigest, contentType}} {
+		der, err := marshalAttributes(attrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(der); got != want {
+			t.Errorf("marshalAttributes = %s; want %s", got, want)
+		}
+	}
+}
+
+func TestOctets(t *testing.T) {
+	// a constructed OCTET STRING of two segments, as BER encoders may write
+	var v asn1.RawValue
+	_, err := asn1.Unmarshal([]byte{0x24, 0x08, 0x04, 0x02, 'a', 'b', 0x04, 0x02, 'c', 'd'}, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := octets(v)
+	if err != nil || string(got) != "abcd" {
+		t.Errorf("octets = %q, %v; want abcd", got, err)
+	}
+}
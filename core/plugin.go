@@ -0,0 +1,227 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+
+	"github.com/manetu/security-token/config"
+)
+
+// pluginPrefix is prepended to the backend name when searching $PATH for a plugin that is not configured explicitly
+const pluginPrefix = "manetu-security-token-backend-"
+
+// The requests and responses of the plugin protocol, exported for plugins written in Go.  Binary values are base64
+// encoded by encoding/json.
+
+type PluginTokenRequest struct {
+	ID []byte `json:"id"`
+}
+
+type PluginGenerateResponse struct {
+	// PKIX, ASN.1 DER encoded public key
+	PublicKey []byte `json:"publickey"`
+}
+
+type PluginImportCertificateRequest struct {
+	ID          []byte `json:"id"`
+	Certificate []byte `json:"certificate"`
+}
+
+type PluginCertificateResponse struct {
+	// DER encoded certificate, or empty if the token does not exist
+	Certificate []byte `json:"certificate"`
+}
+
+type PluginCertificatesResponse struct {
+	Certificates [][]byte `json:"certificates"`
+}
+
+type PluginSignRequest struct {
+	ID     []byte `json:"id"`
+	Digest []byte `json:"digest"`
+}
+
+type PluginSignResponse struct {
+	// DER encoded ECDSA signature
+	Signature []byte `json:"signature"`
+}
+
+type PluginEmpty struct{}
+
+// pluginConn joins the standard input and output of the plugin process into a single connection
+type pluginConn struct {
+	io.ReadCloser
+	io.WriteCloser
+}
+
+func (c *pluginConn) Close() error {
+	werr := c.WriteCloser.Close()
+	rerr := c.ReadCloser.Close()
+	if werr != nil {
+		return werr
+	}
+	return rerr
+}
+
+// pluginBackend delegates to an external executable, so vendors may integrate proprietary keystores without
+// forking.  The plugin is started once per invocation and serves JSON-RPC 1.0 requests for the methods
+// Backend.Generate, Backend.ImportCertificate, Backend.Certificates, Backend.FindToken, Backend.Delete and
+// Backend.Sign on its standard input and output.  Anything it writes to standard error is passed through to the user.
+// Note that Backend.Sign is called for a newly generated key before its certificate is imported, since the
+// certificate is self-signed.
+type pluginBackend struct {
+	cmd    *exec.Cmd
+	client *rpc.Client
+}
+
+// newPluginBackend starts the plugin configured under plugins.<name>, or else the executable
+// manetu-security-token-backend-<name> found on $PATH
+func newPluginBackend(name string, cfg *config.Configuration) (Backend, error) {
+	p, ok := cfg.Plugins[name]
+	if !ok {
+		path, err := exec.LookPath(pluginPrefix + name)
+		if err != nil {
+			return nil, classify(ExitConfig, fmt.Errorf("unknown backend %q (available: %v)", name, Backends()))
+		}
+		p.Path = path
+	}
+	if p.Path == "" {
+		return nil, classify(ExitConfig, fmt.Errorf("plugins.%s.path must be configured", name))
+	}
+
+	// #nosec G204 the plugin path is taken from the configuration file or $PATH, both under the user's control
+	cmd := exec.Command(p.Path, p.Args...)
+	cmd.Env = append(os.Environ(), p.Env...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("error starting plugin %s: %w", p.Path, err)
+	}
+
+	return &pluginBackend{
+		cmd:    cmd,
+		client: jsonrpc.NewClient(&pluginConn{ReadCloser: stdout, WriteCloser: stdin}),
+	}, nil
+}
+
+func (b *pluginBackend) call(method string, in, out interface{}) error {
+	err := b.client.Call("Backend."+method, in, out)
+	if err != nil {
+		return fmt.Errorf("plugin: %w", err)
+	}
+	return nil
+}
+
+func (b *pluginBackend) Generate(id []byte) (crypto.Signer, error) {
+	var out PluginGenerateResponse
+	err := b.call("Generate", &PluginTokenRequest{ID: id}, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(out.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("plugin: error parsing the public key: %w", err)
+	}
+
+	return &pluginSigner{backend: b, id: id, pub: pub}, nil
+}
+
+func (b *pluginBackend) ImportCertificate(id []byte, cert *x509.Certificate) error {
+	return b.call("ImportCertificate", &PluginImportCertificateRequest{ID: id, Certificate: cert.Raw}, &PluginEmpty{})
+}
+
+func (b *pluginBackend) Certificates() ([]*x509.Certificate, error) {
+	var out PluginCertificatesResponse
+	err := b.call("Certificates", &PluginEmpty{}, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for _, der := range out.Certificates {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("plugin: error parsing a certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+func (b *pluginBackend) FindToken(id []byte) (*Token, error) {
+	var out PluginCertificateResponse
+	err := b.call("FindToken", &PluginTokenRequest{ID: id}, &out)
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Certificate) == 0 {
+		return nil, nil
+	}
+
+	cert, err := x509.ParseCertificate(out.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("plugin: error parsing the certificate: %w", err)
+	}
+
+	return &Token{
+		Signer: &pluginSigner{backend: b, id: id, pub: cert.PublicKey},
+		Cert:   cert,
+	}, nil
+}
+
+func (b *pluginBackend) Delete(id []byte) error {
+	return b.call("Delete", &PluginTokenRequest{ID: id}, &PluginEmpty{})
+}
+
+// Close shuts down the plugin by closing its standard input
+func (b *pluginBackend) Close() error {
+	_ = b.client.Close()
+	return b.cmd.Wait()
+}
+
+// pluginSigner implements crypto.Signer by delegating to the Backend.Sign method of the plugin
+type pluginSigner struct {
+	backend *pluginBackend
+	id      []byte
+	pub     crypto.PublicKey
+}
+
+func (s *pluginSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *pluginSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+	}
+
+	var out PluginSignResponse
+	err := s.backend.call("Sign", &PluginSignRequest{ID: s.id, Digest: digest}, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Signature, nil
+}
@@ -0,0 +1,278 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// DefaultPolicyPath is the policy applied when the configuration file names none, if the file exists
+const DefaultPolicyPath = "/etc/manetu/policy.yml"
+
+// defaultValidity is the lifetime of the certificate of a new token, unless limited by the policy
+const defaultValidity = 3650 * 24 * time.Hour
+
+// The operations that policy rules may deny
+const (
+	PolicyGenerate   = "generate"
+	PolicyDelete     = "delete"
+	PolicyMigrate    = "migrate"
+	PolicyGC         = "gc"
+	PolicyPINChange  = "pin-change"
+	PolicySSHCertify = "ssh-certify"
+	PolicySVID       = "spiffe-svid"
+	PolicyRotate     = "rotate"
+)
+
+var policyOperations = []string{PolicyGenerate, PolicyDelete, PolicyMigrate, PolicyGC, PolicyPINChange, PolicySSHCertify,
+	PolicySVID, PolicyRotate}
+
+// PolicyRule denies an operation, or every operation when Operation is "*", on tokens whose realm matches the Realm
+// pattern, or on all tokens when Realm is empty
+type PolicyRule struct {
+	Operation string
+	Realm     string
+}
+
+// Policy restricts the operations of a shared host, checked before any change is made to the keystore
+type Policy struct {
+	Deny []PolicyRule
+	// Realms, when set, lists the patterns of the realms for which tokens may be generated
+	Realms []string
+	// MaxValidity limits the lifetime of the certificates of new tokens, of SSH certificates and of SVIDs, such as
+	// 90d.  New tokens are issued for this long rather than the default of ten years.
+	MaxValidity string
+	// RequireLabel refuses to generate tokens without a label
+	RequireLabel bool
+
+	maxValidity time.Duration
+}
+
+// SetPolicy selects the policy file restricting the operations of c, or disables the policy when path is empty.
+// Cores made with New apply policy.path of the configuration file, defaulting to /etc/manetu/policy.yml when present;
+// those made with NewWithBackend apply none unless given one here.
+func (c *Core) SetPolicy(path string) {
+	c.policyPath = path
+	c.policySet = true
+	c.policy = nil
+}
+
+// LoadPolicy reads and validates the policy file at path
+func LoadPolicy(path string) (*Policy, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("yaml")
+	err := v.ReadInConfig()
+	if err != nil {
+		return nil, classify(ExitConfig, fmt.Errorf("error reading policy: %w", err))
+	}
+
+	var p Policy
+	err = v.Unmarshal(&p)
+	if err != nil {
+		return nil, classify(ExitConfig, fmt.Errorf("%s: %w", path, err))
+	}
+
+	err = p.validate()
+	if err != nil {
+		return nil, classify(ExitConfig, fmt.Errorf("%s: %w", path, err))
+	}
+	return &p, nil
+}
+
+func (p *Policy) validate() error {
+	for _, rule := range p.Deny {
+		if rule.Operation != "*" && !contains(policyOperations, rule.Operation) {
+			return fmt.Errorf("unknown operation %q (available: *, %s)", rule.Operation, strings.Join(policyOperations, ", "))
+		}
+		if _, err := path.Match(rule.Realm, ""); err != nil {
+			return fmt.Errorf("invalid realm pattern %q", rule.Realm)
+		}
+	}
+	for _, realm := range p.Realms {
+		if _, err := path.Match(realm, ""); err != nil {
+			return fmt.Errorf("invalid realm pattern %q", realm)
+		}
+	}
+
+	if p.MaxValidity != "" {
+		d, err := ParseDuration(p.MaxValidity)
+		if err != nil {
+			return fmt.Errorf("maxvalidity: %w", err)
+		}
+		if d <= 0 {
+			return errors.New("maxvalidity must be positive")
+		}
+		p.maxValidity = d
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// getPolicy returns the policy in force, or nil when there is none
+func (c *Core) getPolicy() (*Policy, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.policy != nil {
+		return c.policy, nil
+	}
+
+	file := c.policyPath
+	if !c.policySet {
+		file = c.configuration.Policy.Path
+		if file == "" {
+			if _, err := os.Stat(DefaultPolicyPath); err != nil {
+				return nil, nil
+			}
+			file = DefaultPolicyPath
+		}
+	}
+	if file == "" {
+		return nil, nil
+	}
+
+	p, err := LoadPolicy(file)
+	if err != nil {
+		return nil, err
+	}
+	c.policy = p
+	return p, nil
+}
+
+// checkPolicy refuses op on a token of realm when a rule of the policy denies it
+func (c *Core) checkPolicy(op, realm string) error {
+	p, err := c.getPolicy()
+	if err != nil || p == nil {
+		return err
+	}
+
+	for _, rule := range p.Deny {
+		if rule.Operation != "*" && rule.Operation != op {
+			continue
+		}
+		if matched, _ := path.Match(rule.Realm, realm); rule.Realm != "" && !matched {
+			continue
+		}
+		if rule.Realm == "" {
+			return classify(ExitDenied, fmt.Errorf("%s is denied by policy", op))
+		}
+		return classify(ExitDenied, fmt.Errorf("%s is denied by policy for realm %q", op, realm))
+	}
+
+	if op == PolicyGenerate && len(p.Realms) > 0 {
+		for _, pattern := range p.Realms {
+			if matched, _ := path.Match(pattern, realm); matched {
+				return nil
+			}
+		}
+		return classify(ExitDenied, fmt.Errorf("realm %q is not permitted by policy (permitted: %s)", realm, strings.Join(p.Realms, ", ")))
+	}
+
+	return nil
+}
+
+// checkTokenPolicy refuses op on the token holding cert when a rule of the policy denies it for any of the realms of
+// the certificate
+func (c *Core) checkTokenPolicy(op string, cert *x509.Certificate) error {
+	if len(cert.Subject.Organization) == 0 {
+		return c.checkPolicy(op, "")
+	}
+	for _, realm := range cert.Subject.Organization {
+		err := c.checkPolicy(op, realm)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLabel refuses to generate a token without a label when the policy requires one
+func (c *Core) checkLabel(label string) error {
+	p, err := c.getPolicy()
+	if err != nil || p == nil {
+		return err
+	}
+
+	if p.RequireLabel && label == "" {
+		return classify(ExitDenied, errors.New("a label is required by policy for new tokens"))
+	}
+	return nil
+}
+
+// checkValidity refuses a certificate lifetime beyond the maximum of the policy.  A validity of zero requests the
+// default lifetime of a new token, which is returned, shortened to the maximum of the policy if need be.
+func (c *Core) checkValidity(validity time.Duration) (time.Duration, error) {
+	p, err := c.getPolicy()
+	if err != nil {
+		return 0, err
+	}
+
+	if validity == 0 {
+		validity = defaultValidity
+		if p != nil && p.maxValidity > 0 && validity > p.maxValidity {
+			validity = p.maxValidity
+		}
+		return validity, nil
+	}
+
+	if p != nil && p.maxValidity > 0 && validity > p.maxValidity {
+		return 0, classify(ExitDenied, fmt.Errorf("a validity of %s exceeds the maximum of %s permitted by policy", validity, p.MaxValidity))
+	}
+	return validity, nil
+}
+
+// PolicyShow prints the policy in force, or reports that there is none
+func (c *Core) PolicyShow() error {
+	if !c.policySet {
+		_, err := c.readConfig()
+		if err != nil {
+			return classify(ExitConfig, err)
+		}
+	}
+
+	p, err := c.getPolicy()
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		fmt.Println("No policy is in force")
+		return nil
+	}
+
+	for _, rule := range p.Deny {
+		realm := "any realm"
+		if rule.Realm != "" {
+			realm = fmt.Sprintf("realm %q", rule.Realm)
+		}
+		fmt.Printf("deny %s of %s\n", rule.Operation, realm)
+	}
+	if len(p.Realms) > 0 {
+		fmt.Printf("generate only for realms %s\n", strings.Join(p.Realms, ", "))
+	}
+	if p.MaxValidity != "" {
+		fmt.Printf("max validity %s\n", p.MaxValidity)
+	}
+	if p.RequireLabel {
+		fmt.Println("require a label for new tokens")
+	}
+	return nil
+}
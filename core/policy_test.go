@@ -0,0 +1,94 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// policyCore returns a core of the memory backend subject to the policy given as YAML
+func policyCore(t *testing.T, policy string) *Core {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	path := filepath.Join(dir, "policy.yml")
+	err := os.WriteFile(path, []byte(policy), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewWithBackend(NewMemoryBackend())
+	c.SetQuiet(true)
+	c.SetPolicy(path)
+	return c
+}
+
+// TestRequireLabel refuses tokens generated without a label, locally, by enroll and through the agent
+func TestRequireLabel(t *testing.T) {
+	c := policyCore(t, "requirelabel: true\n")
+	server := newRemoteServer(c, c.getBackend(), false)
+
+	_, err := c.GenerateLabeled("acme", "", 0)
+	if ExitCode(err) != ExitDenied {
+		t.Errorf("GenerateLabeled without a label = %v; want exit code %d", err, ExitDenied)
+	}
+	_, err = c.GenerateLabeled("acme", "web", 0)
+	if err != nil {
+		t.Errorf("GenerateLabeled with a label: %v", err)
+	}
+
+	_, err = c.Enroll(EnrollOptions{Realm: "acme", URL: "http://127.0.0.1:1"})
+	if ExitCode(err) != ExitDenied {
+		t.Errorf("Enroll without a label = %v; want exit code %d", err, ExitDenied)
+	}
+
+	_, err = server.generateToken(&agentGenerateTokenRequest{Realm: "acme"})
+	if ExitCode(err) != ExitDenied {
+		t.Errorf("GenerateToken without a label = %v; want exit code %d", err, ExitDenied)
+	}
+	var in agentGenerateTokenRequest
+	err = in.unmarshal((&agentGenerateTokenRequest{Realm: "acme", Label: "api"}).marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.generateToken(&in)
+	if err != nil {
+		t.Errorf("GenerateToken with a label: %v", err)
+	}
+
+	certs, err := c.getBackend().Certificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 {
+		t.Errorf("%d tokens were generated; want 2", len(certs))
+	}
+}
+
+// TestTokenPolicyRealms matches each realm of a token against the rules, rather than the realms joined together
+func TestTokenPolicyRealms(t *testing.T) {
+	c := policyCore(t, "deny:\n  - operation: delete\n    realm: prod\n")
+
+	for _, tt := range []struct {
+		realms   []string
+		wantExit int
+	}{
+		{[]string{"prod"}, ExitDenied},
+		{[]string{"dev", "prod"}, ExitDenied},
+		{[]string{"dev"}, ExitOK},
+		{nil, ExitOK},
+	} {
+		cert := &x509.Certificate{Subject: pkix.Name{Organization: tt.realms}}
+		err := c.checkTokenPolicy(PolicyDelete, cert)
+		if ExitCode(err) != tt.wantExit {
+			t.Errorf("checkTokenPolicy(%q) = %v; want exit code %d", tt.realms, err, tt.wantExit)
+		}
+	}
+}
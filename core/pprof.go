@@ -0,0 +1,55 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// SetProfiling serves the runtime profiles of Go's net/http/pprof at http://addr/debug/pprof/ while a daemon mode
+// (agent, serve, spiffe serve or ssh agent) runs, so that the CPU, heap and goroutines of a long-running process may be
+// inspected with "go tool pprof".  The profiles reveal the internals of the process, so addr should be a loopback
+// address.
+func (c *Core) SetProfiling(addr string) {
+	c.pprofAddr = addr
+}
+
+// startProfiling begins serving profiles when enabled by SetProfiling, returning a function stopping the server
+func (c *Core) startProfiling() (func(), error) {
+	if c.pprofAddr == "" {
+		return func() {}, nil
+	}
+
+	l, err := net.Listen("tcp", c.pprofAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for profiling: %w", err)
+	}
+	if addr, ok := l.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+		logWarn("serving profiles beyond this host; prefer a loopback address", "address", l.Addr())
+	}
+
+	// importing pprof also registers its handlers upon http.DefaultServeMux, which is never served
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		err := server.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logWarn("unable to serve profiles", "error", err)
+		}
+	}()
+
+	return func() { _ = server.Close() }, nil
+}
@@ -0,0 +1,450 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/manetu/security-token/config"
+)
+
+func init() {
+	RegisterBackend("remote", newRemoteBackend)
+}
+
+// remoteService is the fully qualified name of the RemoteSigner service defined in api/remotesigner.proto
+const remoteService = "/manetu.securitytoken.v1.RemoteSigner/"
+
+// remoteMessage is implemented by the messages of the RemoteSigner service.  They consist only of bytes, string and
+// bool fields, so we encode them directly rather than depending on generated code.
+type remoteMessage interface {
+	marshal() []byte
+	unmarshal(data []byte) error
+}
+
+func appendBytesField(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendBoolField(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+// parseBytesFields calls f for each bytes field within data, skipping any fields of other types
+func parseBytesFields(data []byte, f func(num protowire.Number, v []byte)) error {
+	return parseFields(data, f, nil)
+}
+
+// parseFields calls f for each bytes field within data, and varint for each varint field when given, skipping any
+// fields of other types
+func parseFields(data []byte, f func(num protowire.Number, v []byte), varint func(num protowire.Number, v uint64)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch {
+		case typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			f(num, append([]byte{}, v...))
+			data = data[n:]
+		case typ == protowire.VarintType && varint != nil:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			varint(num, v)
+			data = data[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+
+	return nil
+}
+
+type remoteEmpty struct{}
+
+func (m *remoteEmpty) marshal() []byte {
+	return nil
+}
+
+func (m *remoteEmpty) unmarshal(data []byte) error {
+	return parseBytesFields(data, func(protowire.Number, []byte) {})
+}
+
+type remoteTokenRequest struct {
+	ID []byte
+}
+
+func (m *remoteTokenRequest) marshal() []byte {
+	return appendBytesField(nil, 1, m.ID)
+}
+
+func (m *remoteTokenRequest) unmarshal(data []byte) error {
+	return parseBytesFields(data, func(num protowire.Number, v []byte) {
+		if num == 1 {
+			m.ID = v
+		}
+	})
+}
+
+type remoteGenerateResponse struct {
+	PublicKey []byte
+}
+
+func (m *remoteGenerateResponse) marshal() []byte {
+	return appendBytesField(nil, 1, m.PublicKey)
+}
+
+func (m *remoteGenerateResponse) unmarshal(data []byte) error {
+	return parseBytesFields(data, func(num protowire.Number, v []byte) {
+		if num == 1 {
+			m.PublicKey = v
+		}
+	})
+}
+
+type remoteImportCertificateRequest struct {
+	ID          []byte
+	Certificate []byte
+}
+
+func (m *remoteImportCertificateRequest) marshal() []byte {
+	return appendBytesField(appendBytesField(nil, 1, m.ID), 2, m.Certificate)
+}
+
+func (m *remoteImportCertificateRequest) unmarshal(data []byte) error {
+	return parseBytesFields(data, func(num protowire.Number, v []byte) {
+		switch num {
+		case 1:
+			m.ID = v
+		case 2:
+			m.Certificate = v
+		}
+	})
+}
+
+type remoteCertificateResponse struct {
+	Certificate []byte
+}
+
+func (m *remoteCertificateResponse) marshal() []byte {
+	return appendBytesField(nil, 1, m.Certificate)
+}
+
+func (m *remoteCertificateResponse) unmarshal(data []byte) error {
+	return parseBytesFields(data, func(num protowire.Number, v []byte) {
+		if num == 1 {
+			m.Certificate = v
+		}
+	})
+}
+
+type remoteListCertificatesResponse struct {
+	Certificates [][]byte
+}
+
+func (m *remoteListCertificatesResponse) marshal() []byte {
+	var b []byte
+	for _, cert := range m.Certificates {
+		b = appendBytesField(b, 1, cert)
+	}
+	return b
+}
+
+func (m *remoteListCertificatesResponse) unmarshal(data []byte) error {
+	return parseBytesFields(data, func(num protowire.Number, v []byte) {
+		if num == 1 {
+			m.Certificates = append(m.Certificates, v)
+		}
+	})
+}
+
+// remoteSignRequest asks for a signature over Digest, made with the hash named by Hash, as crypto.Hash names it, or
+// SHA-256 when empty as clients predating it expect.  PSS selects RSASSA-PSS, with a salt as long as the digest, over
+// PKCS #1 v1.5 for an RSA key.
+type remoteSignRequest struct {
+	ID     []byte
+	Digest []byte
+	Hash   string
+	PSS    bool
+}
+
+func (m *remoteSignRequest) marshal() []byte {
+	b := appendBytesField(appendBytesField(nil, 1, m.ID), 2, m.Digest)
+	return appendBoolField(appendBytesField(b, 3, []byte(m.Hash)), 4, m.PSS)
+}
+
+func (m *remoteSignRequest) unmarshal(data []byte) error {
+	return parseFields(data, func(num protowire.Number, v []byte) {
+		switch num {
+		case 1:
+			m.ID = v
+		case 2:
+			m.Digest = v
+		case 3:
+			m.Hash = string(v)
+		}
+	}, func(num protowire.Number, v uint64) {
+		if num == 4 {
+			m.PSS = v != 0
+		}
+	})
+}
+
+// remoteHashes are the hashes of the digests the RemoteSigner Sign method accepts
+var remoteHashes = map[string]crypto.Hash{
+	crypto.SHA256.String(): crypto.SHA256,
+	crypto.SHA384.String(): crypto.SHA384,
+	crypto.SHA512.String(): crypto.SHA512,
+}
+
+// signerOpts returns the options with which the request asks to sign
+func (m *remoteSignRequest) signerOpts() (crypto.SignerOpts, error) {
+	hash := crypto.SHA256
+	if m.Hash != "" {
+		var ok bool
+		hash, ok = remoteHashes[m.Hash]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash %s", m.Hash)
+		}
+	}
+	if len(m.Digest) != hash.Size() {
+		return nil, fmt.Errorf("the digest is %d bytes, not the %d of %s", len(m.Digest), hash.Size(), hash)
+	}
+	if m.PSS {
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash}, nil
+	}
+	return hash, nil
+}
+
+type remoteSignResponse struct {
+	Signature []byte
+}
+
+func (m *remoteSignResponse) marshal() []byte {
+	return appendBytesField(nil, 1, m.Signature)
+}
+
+func (m *remoteSignResponse) unmarshal(data []byte) error {
+	return parseBytesFields(data, func(num protowire.Number, v []byte) {
+		if num == 1 {
+			m.Signature = v
+		}
+	})
+}
+
+// remoteCodec encodes remoteMessages in the protobuf wire format.  It is registered under the name "proto" so that
+// it interoperates with RemoteSigner implementations built from the .proto definition.
+type remoteCodec struct{}
+
+func (remoteCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(remoteMessage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (remoteCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(remoteMessage)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+func (remoteCodec) Name() string {
+	return "proto"
+}
+
+// remoteBackend forwards every keystore operation to a RemoteSigner service over mutually authenticated TLS, so a
+// central HSM appliance can serve many hosts
+type remoteBackend struct {
+	conn *grpc.ClientConn
+}
+
+func newRemoteBackend(cfg *config.Configuration) (Backend, error) {
+	c := cfg.Remote
+
+	if c.Address == "" {
+		return nil, errors.New("remote.address must be configured")
+	}
+	if c.ClientCert == "" || c.ClientKey == "" {
+		return nil, errors.New("remote.clientcert and remote.clientkey must be configured")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("error loading client certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ServerName:   c.ServerName,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.CACert != "" {
+		pem, err := os.ReadFile(c.CACert)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CACert)
+		}
+	}
+
+	conn, err := grpc.Dial(c.Address,
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(remoteCodec{})))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", c.Address, err)
+	}
+
+	return &remoteBackend{conn: conn}, nil
+}
+
+func (b *remoteBackend) invoke(method string, in, out remoteMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	return b.conn.Invoke(ctx, remoteService+method, in, out)
+}
+
+func (b *remoteBackend) Generate(id []byte) (crypto.Signer, error) {
+	out := &remoteGenerateResponse{}
+	err := b.invoke("Generate", &remoteTokenRequest{ID: id}, out)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(out.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("remote: error parsing the public key: %w", err)
+	}
+
+	return &remoteSigner{backend: b, id: id, pub: pub}, nil
+}
+
+func (b *remoteBackend) ImportCertificate(id []byte, cert *x509.Certificate) error {
+	return b.invoke("ImportCertificate", &remoteImportCertificateRequest{ID: id, Certificate: cert.Raw}, &remoteEmpty{})
+}
+
+func (b *remoteBackend) Certificates() ([]*x509.Certificate, error) {
+	out := &remoteListCertificatesResponse{}
+	err := b.invoke("ListCertificates", &remoteEmpty{}, out)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for _, der := range out.Certificates {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("remote: error parsing a certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+func (b *remoteBackend) FindToken(id []byte) (*Token, error) {
+	out := &remoteCertificateResponse{}
+	err := b.invoke("GetCertificate", &remoteTokenRequest{ID: id}, out)
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Certificate) == 0 {
+		return nil, nil
+	}
+
+	cert, err := x509.ParseCertificate(out.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("remote: error parsing the certificate: %w", err)
+	}
+
+	return &Token{
+		Signer: &remoteSigner{backend: b, id: id, pub: cert.PublicKey},
+		Cert:   cert,
+	}, nil
+}
+
+func (b *remoteBackend) Delete(id []byte) error {
+	return b.invoke("Delete", &remoteTokenRequest{ID: id}, &remoteEmpty{})
+}
+
+func (b *remoteBackend) Close() error {
+	return b.conn.Close()
+}
+
+// remoteSigner implements crypto.Signer by delegating to the RemoteSigner Sign method
+type remoteSigner struct {
+	backend *remoteBackend
+	id      []byte
+	pub     crypto.PublicKey
+}
+
+func (s *remoteSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *remoteSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash := opts.HashFunc()
+	if _, ok := remoteHashes[hash.String()]; !ok {
+		return nil, fmt.Errorf("unsupported hash %v", hash)
+	}
+	req := &remoteSignRequest{ID: s.id, Digest: digest, Hash: hash.String()}
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		// the remote signer salts with as many bytes as the digest, which verifiers expecting any length accept
+		if pss.SaltLength != rsa.PSSSaltLengthEqualsHash && pss.SaltLength != rsa.PSSSaltLengthAuto && pss.SaltLength != hash.Size() {
+			return nil, fmt.Errorf("unsupported PSS salt length %d", pss.SaltLength)
+		}
+		req.PSS = true
+	}
+
+	out := &remoteSignResponse{}
+	err := s.backend.invoke("Sign", req, out)
+	if err != nil {
+		return nil, err
+	}
+
+	// the remote signer returns the signature as crypto.Signer does: DER encoded for ECDSA, raw for RSA
+	return out.Signature, nil
+}
@@ -0,0 +1,267 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// remoteSignerPair serves backend as a RemoteSigner over a Unix socket, returning a remote backend connected to it
+func remoteSignerPair(t *testing.T, backend Backend) *remoteBackend {
+	t.Helper()
+
+	c := NewWithBackend(backend)
+	c.SetQuiet(true)
+	server := grpc.NewServer(grpc.ForceServerCodec(remoteCodec{}))
+	newRemoteServer(c, backend, false).register(server)
+	sock := filepath.Join(t.TempDir(), "signer.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = server.Serve(l)
+	}()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("unix:"+sock,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(remoteCodec{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &remoteBackend{conn: conn}
+}
+
+// keyBackend serves tokens of software keys of any type, which the memory backend, holding only P-256 keys, cannot
+type keyBackend struct {
+	Backend
+	tokens map[string]*Token
+}
+
+// add makes key, with a self-signed certificate, the token of id
+func (b *keyBackend) add(t *testing.T, id []byte, key crypto.Signer) {
+	t.Helper()
+
+	template := &x509.Certificate{
+		SerialNumber: new(big.Int).SetBytes(id),
+		Subject:      pkix.Name{Organization: []string{"acme"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.tokens[string(id)] = &Token{Signer: key, Cert: cert}
+}
+
+func (b *keyBackend) FindToken(id []byte) (*Token, error) {
+	return b.tokens[string(id)], nil
+}
+
+// TestRemoteSign signs through a RemoteSigner with each hash and padding that crypto.Signer callers ask for
+func TestRemoteSign(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &keyBackend{Backend: NewMemoryBackend(), tokens: map[string]*Token{}}
+	backend.add(t, []byte{0x01}, rsaKey)
+	backend.add(t, []byte{0x02}, ecKey)
+	remote := remoteSignerPair(t, backend)
+
+	for _, tt := range []struct {
+		name string
+		id   byte
+		opts crypto.SignerOpts
+	}{
+		{"RSA SHA-256", 0x01, crypto.SHA256},
+		{"RSA SHA-384", 0x01, crypto.SHA384},
+		{"RSA SHA-512", 0x01, crypto.SHA512},
+		{"RSA PSS SHA-256", 0x01, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}},
+		{"RSA PSS SHA-512", 0x01, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA512}},
+		{"ECDSA SHA-256", 0x02, crypto.SHA256},
+		{"ECDSA SHA-384", 0x02, crypto.SHA384},
+	} {
+		token, err := remote.FindToken([]byte{tt.id})
+		if err != nil || token == nil {
+			t.Fatalf("FindToken = %v, %v", token, err)
+		}
+		h := tt.opts.HashFunc().New()
+		h.Write([]byte("payload"))
+		digest := h.Sum(nil)
+		sig, err := token.Signer.Sign(rand.Reader, digest, tt.opts)
+		if err != nil {
+			t.Errorf("%s: Sign: %v", tt.name, err)
+			continue
+		}
+
+		switch pub := token.Cert.PublicKey.(type) {
+		case *rsa.PublicKey:
+			if pss, ok := tt.opts.(*rsa.PSSOptions); ok {
+				err = rsa.VerifyPSS(pub, pss.Hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+			} else {
+				err = rsa.VerifyPKCS1v15(pub, tt.opts.HashFunc(), digest, sig)
+			}
+			if err != nil {
+				t.Errorf("%s: the signature does not verify: %v", tt.name, err)
+			}
+		case *ecdsa.PublicKey:
+			if !ecdsa.VerifyASN1(pub, digest, sig) {
+				t.Errorf("%s: the signature does not verify", tt.name)
+			}
+		}
+	}
+
+	token, err := remote.FindToken([]byte{0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = token.Signer.Sign(rand.Reader, make([]byte, 20), crypto.SHA1)
+	if err == nil {
+		t.Error("a SHA-1 digest was signed")
+	}
+	_, err = token.Signer.Sign(rand.Reader, make([]byte, 32), &rsa.PSSOptions{SaltLength: 8, Hash: crypto.SHA256})
+	if err == nil {
+		t.Error("a PSS signature with a salt of 8 bytes was made with one of 32")
+	}
+}
+
+func TestRemoteSignRequest(t *testing.T) {
+	digest := make([]byte, 48)
+	in := &remoteSignRequest{ID: []byte{0x01}, Digest: digest, Hash: "SHA-384", PSS: true}
+	var out remoteSignRequest
+	err := out.unmarshal(in.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := out.signerOpts()
+	if err != nil {
+		t.Fatalf("signerOpts: %v", err)
+	}
+	pss, ok := opts.(*rsa.PSSOptions)
+	if !ok || pss.Hash != crypto.SHA384 || pss.SaltLength != rsa.PSSSaltLengthEqualsHash {
+		t.Errorf("signerOpts = %#v; want PSS over SHA-384", opts)
+	}
+
+	// clients predating the hash field sign SHA-256 digests
+	legacy := &remoteSignRequest{ID: []byte{0x01}, Digest: make([]byte, 32)}
+	opts, err = legacy.signerOpts()
+	if err != nil || opts != crypto.SHA256 {
+		t.Errorf("signerOpts of a request without a hash = %v, %v; want SHA-256", opts, err)
+	}
+
+	for _, bad := range []*remoteSignRequest{
+		{Digest: make([]byte, 32), Hash: "MD5"},
+		{Digest: make([]byte, 32), Hash: "SHA-384"},
+		{Digest: make([]byte, 20)},
+	} {
+		_, err = bad.signerOpts()
+		if err == nil {
+			t.Errorf("signerOpts of %s over %d bytes succeeded", bad.Hash, len(bad.Digest))
+		}
+	}
+}
+
+// TestRemotePolicy subjects the changes made through a RemoteSigner to the policy of the server, recording them in
+// its audit log
+func TestRemotePolicy(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	policy := filepath.Join(dir, "policy.yml")
+	err := os.WriteFile(policy, []byte("deny:\n  - operation: delete\nrealms:\n  - acme\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := NewMemoryBackend()
+	c := NewWithBackend(backend)
+	c.SetQuiet(true)
+	c.SetPolicy(policy)
+	c.SetAuditLog(filepath.Join(dir, "audit.log"))
+	server := newRemoteServer(c, backend, false)
+
+	generate := func(id []byte, realm string) error {
+		out, err := server.generate(&remoteTokenRequest{ID: id})
+		if err != nil {
+			return err
+		}
+		pub, err := x509.ParsePKIXPublicKey(out.(*remoteGenerateResponse).PublicKey)
+		if err != nil || pub == nil {
+			t.Fatalf("ParsePKIXPublicKey = %v, %v", pub, err)
+		}
+		signer, err := server.signer(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := selfSignToken(signer, id, realm, time.Hour, SystemClock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = server.importCertificate(&remoteImportCertificateRequest{ID: id, Certificate: cert.Raw})
+		return err
+	}
+
+	err = generate([]byte{0x01}, "acme")
+	if err != nil {
+		t.Fatalf("generate for a permitted realm: %v", err)
+	}
+	err = generate([]byte{0x02}, "other")
+	if ExitCode(err) != ExitDenied {
+		t.Errorf("generate for a realm not permitted = %v; want exit code %d", err, ExitDenied)
+	}
+	if token, _ := backend.FindToken([]byte{0x02}); token != nil {
+		t.Error("the token refused by policy was left in the keystore")
+	}
+
+	_, err = server.delete(&remoteTokenRequest{ID: []byte{0x01}})
+	if ExitCode(err) != ExitDenied {
+		t.Errorf("delete = %v; want exit code %d", err, ExitDenied)
+	}
+	if token, _ := backend.FindToken([]byte{0x01}); token == nil {
+		t.Error("the token was deleted despite the policy")
+	}
+
+	_, entries, err := c.readAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Operation+" "+e.Serial+" "+e.Result)
+	}
+	want := []string{"generate 01 ok", "generate 02 failed", "delete 01 failed"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("audit log = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,435 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteServer serves the RemoteSigner service defined in api/remotesigner.proto from a local backend, along with the
+// Agent service defined in api/agent.proto.  Signers are kept once found, so that a session held
+// open by the backend serves every later request without another lookup.  Changes to the keystore are subject to the
+// policy of the core and recorded in its audit log, as they are when made locally.
+type remoteServer struct {
+	keystoreLock
+	core     *Core
+	backend  Backend
+	insecure bool
+	signers  map[string]crypto.Signer
+	// pending holds the ids generated whose certificates are yet to be imported
+	pending map[string]bool
+}
+
+func newRemoteServer(c *Core, backend Backend, insecure bool) *remoteServer {
+	return &remoteServer{core: c, backend: backend, insecure: insecure, signers: map[string]crypto.Signer{},
+		pending: map[string]bool{}}
+}
+
+// register adds the services of s to server
+func (s *remoteServer) register(server *grpc.Server) {
+	server.RegisterService(&remoteSignerServiceDesc, s)
+	server.RegisterService(&agentServiceDesc, s)
+}
+
+// remoteMethod adapts a handler of remoteMessages to a gRPC method
+func remoteMethod(name string, in func() remoteMessage, call func(s *remoteServer, ctx context.Context, in remoteMessage) (remoteMessage, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			m := in()
+			if err := dec(m); err != nil {
+				return nil, err
+			}
+			return call(srv.(*remoteServer), ctx, m)
+		},
+	}
+}
+
+var remoteSignerServiceDesc = grpc.ServiceDesc{
+	ServiceName: "manetu.securitytoken.v1.RemoteSigner",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		remoteMethod("Generate", func() remoteMessage { return &remoteTokenRequest{} },
+			func(s *remoteServer, _ context.Context, in remoteMessage) (remoteMessage, error) {
+				return s.generate(in.(*remoteTokenRequest))
+			}),
+		remoteMethod("ImportCertificate", func() remoteMessage { return &remoteImportCertificateRequest{} },
+			func(s *remoteServer, _ context.Context, in remoteMessage) (remoteMessage, error) {
+				return s.importCertificate(in.(*remoteImportCertificateRequest))
+			}),
+		remoteMethod("ListCertificates", func() remoteMessage { return &remoteEmpty{} },
+			func(s *remoteServer, _ context.Context, _ remoteMessage) (remoteMessage, error) {
+				return s.listCertificates()
+			}),
+		remoteMethod("GetCertificate", func() remoteMessage { return &remoteTokenRequest{} },
+			func(s *remoteServer, _ context.Context, in remoteMessage) (remoteMessage, error) {
+				return s.getCertificate(in.(*remoteTokenRequest))
+			}),
+		remoteMethod("Delete", func() remoteMessage { return &remoteTokenRequest{} },
+			func(s *remoteServer, _ context.Context, in remoteMessage) (remoteMessage, error) {
+				return s.delete(in.(*remoteTokenRequest))
+			}),
+		remoteMethod("Sign", func() remoteMessage { return &remoteSignRequest{} },
+			func(s *remoteServer, _ context.Context, in remoteMessage) (remoteMessage, error) {
+				return s.sign(in.(*remoteSignRequest))
+			}),
+	},
+	Metadata: "api/remotesigner.proto",
+}
+
+var agentServiceDesc = grpc.ServiceDesc{
+	ServiceName: "manetu.securitytoken.v1.Agent",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		remoteMethod("Login", func() remoteMessage { return &agentLoginRequest{} },
+			func(s *remoteServer, ctx context.Context, in remoteMessage) (remoteMessage, error) {
+				return s.login(ctx, in.(*agentLoginRequest))
+			}),
+		remoteMethod("GenerateToken", func() remoteMessage { return &agentGenerateTokenRequest{} },
+			func(s *remoteServer, _ context.Context, in remoteMessage) (remoteMessage, error) {
+				return s.generateToken(in.(*agentGenerateTokenRequest))
+			}),
+	},
+	Metadata: "api/agent.proto",
+}
+
+func (s *remoteServer) generate(in *remoteTokenRequest) (remoteMessage, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	signer, err := s.backend.Generate(in.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the new certificate is self-signed before it is imported, so the signer must be usable straight away
+	s.signers[string(in.ID)] = signer
+	s.pending[string(in.ID)] = true
+
+	pub, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &remoteGenerateResponse{PublicKey: pub}, nil
+}
+
+func (s *remoteServer) importCertificate(in *remoteImportCertificateRequest) (remoteMessage, error) {
+	cert, err := x509.ParseCertificate(in.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the certificate: %w", err)
+	}
+
+	// the realm of a new token is known only from its certificate, so generate is checked against the policy here,
+	// and the key pair of a token the policy refuses is removed.  RemoteSigner carries no label.
+	err = s.core.checkTokenPolicy(PolicyGenerate, cert)
+	if err == nil {
+		err = s.core.checkLabel("")
+	}
+	if err == nil {
+		_, err = s.core.checkValidity(cert.NotAfter.Sub(cert.NotBefore))
+	}
+
+	s.Lock()
+	if err != nil {
+		if s.pending[string(in.ID)] {
+			delete(s.signers, string(in.ID))
+			if derr := s.backend.Delete(in.ID); derr != nil {
+				logWarn("unable to remove the key pair of a token refused by policy", "serial", HexEncode(in.ID), "error", derr)
+			}
+		}
+	} else {
+		err = s.backend.ImportCertificate(in.ID, cert)
+	}
+	delete(s.pending, string(in.ID))
+	s.Unlock()
+
+	s.core.audit("generate", cert, err)
+	if err != nil {
+		return nil, err
+	}
+	s.core.notify(WebhookTokenCreated, cert)
+	return &remoteEmpty{}, nil
+}
+
+func (s *remoteServer) listCertificates() (remoteMessage, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	certs, err := s.backend.Certificates()
+	if err != nil {
+		return nil, err
+	}
+
+	out := &remoteListCertificatesResponse{}
+	for _, cert := range certs {
+		out.Certificates = append(out.Certificates, cert.Raw)
+	}
+	return out, nil
+}
+
+func (s *remoteServer) getCertificate(in *remoteTokenRequest) (remoteMessage, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	token, err := s.backend.FindToken(in.ID)
+	if err == nil {
+		token, err = s.core.fipsToken(token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return &remoteCertificateResponse{}, nil
+	}
+
+	s.signers[string(in.ID)] = token.Signer
+	return &remoteCertificateResponse{Certificate: token.Cert.Raw}, nil
+}
+
+func (s *remoteServer) delete(in *remoteTokenRequest) (remoteMessage, error) {
+	s.Lock()
+	token, err := s.backend.FindToken(in.ID)
+	if err == nil && token == nil {
+		err = errors.New("invalid serial number")
+	}
+	if err == nil {
+		err = s.core.checkTokenPolicy(PolicyDelete, token.Cert)
+	}
+	if err != nil {
+		s.Unlock()
+		if token != nil {
+			s.core.audit("delete", token.Cert, err)
+		} else {
+			s.core.auditEntry(AuditEntry{Operation: "delete", Serial: HexEncode(in.ID)}, time.Time{}, err)
+		}
+		return nil, err
+	}
+
+	delete(s.signers, string(in.ID))
+	delete(s.pending, string(in.ID))
+	err = s.backend.Delete(in.ID)
+	s.Unlock()
+
+	s.core.audit("delete", token.Cert, err)
+	if err != nil {
+		return nil, err
+	}
+	s.core.notify(WebhookTokenDeleted, token.Cert)
+	return &remoteEmpty{}, nil
+}
+
+// signer returns the signer for id, which the caller must hold the lock to call
+func (s *remoteServer) signer(id []byte) (crypto.Signer, error) {
+	if signer, ok := s.signers[string(id)]; ok {
+		s.core.metrics.inc("manetu_cache_requests_total", labels("cache", "signer", "result", "hit"))
+		return signer, nil
+	}
+	s.core.metrics.inc("manetu_cache_requests_total", labels("cache", "signer", "result", "miss"))
+
+	token, err := s.backend.FindToken(id)
+	if err == nil {
+		token, err = s.core.fipsToken(token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, errors.New("invalid serial number")
+	}
+
+	s.signers[string(id)] = token.Signer
+	return token.Signer, nil
+}
+
+func (s *remoteServer) sign(in *remoteSignRequest) (remoteMessage, error) {
+	opts, err := in.signerOpts()
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	signer, err := s.signer(in.ID)
+	if err != nil {
+		s.Unlock()
+		return nil, err
+	}
+	start := time.Now()
+	sig, err := signer.Sign(rand.Reader, in.Digest, opts)
+	s.Unlock()
+
+	s.core.auditEntry(AuditEntry{Operation: "sign", Serial: HexEncode(in.ID)}, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteSignResponse{Signature: sig}, nil
+}
+
+// serializedSigner signs while holding the lock of the server, so that the signature of a login assertion, made
+// outside of the lock, is still serialized with every other call to the backend
+type serializedSigner struct {
+	crypto.Signer
+	sync.Locker
+}
+
+func (s serializedSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.Signer.Sign(rand, digest, opts)
+}
+
+func (s *remoteServer) login(ctx context.Context, in *agentLoginRequest) (remoteMessage, error) {
+	serial := ""
+	if len(in.ID) > 0 {
+		serial = HexEncode(in.ID)
+	}
+
+	// getToken falls back to the default or only token when no id is given
+	s.Lock()
+	token, err := s.core.getToken(serial)
+	s.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// the lock is held only to sign the assertion, never across the round trip to the token endpoint, which would
+	// otherwise stall every other request behind a slow endpoint
+	ctx, cancel := context.WithTimeout(ctx, loginTimeout)
+	defer cancel()
+	jwt, err := s.core.LoginContext(ctx, in.URL, s.insecure, serializedSigner{token.Signer, s}, token.Cert)
+	if err != nil {
+		return nil, err
+	}
+	return &agentLoginResponse{Token: jwt}, nil
+}
+
+func (s *remoteServer) generateToken(in *agentGenerateTokenRequest) (remoteMessage, error) {
+	if in.Realm == "" {
+		return nil, errors.New("realm must be provided")
+	}
+
+	if _, ok := s.backend.(labeler); in.Label != "" && !ok {
+		return nil, classify(ExitConfig, errors.New("the keystore cannot label tokens"))
+	}
+	err := s.core.checkPolicy(PolicyGenerate, in.Realm)
+	if err != nil {
+		return nil, err
+	}
+	err = s.core.checkLabel(in.Label)
+	if err != nil {
+		return nil, err
+	}
+	validity, err := s.core.checkValidity(0)
+	if err != nil {
+		return nil, err
+	}
+	clock, err := s.core.getClock()
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	cert, err := generateToken(s.backend, in.Realm, in.Label, validity, clock)
+	s.Unlock()
+
+	s.core.audit("generate", cert, err)
+	if err != nil {
+		return nil, err
+	}
+	s.core.notify(WebhookTokenCreated, cert)
+	return &remoteCertificateResponse{Certificate: cert.Raw}, nil
+}
+
+// serveUntilInterrupted serves l until SIGINT or SIGTERM, letting requests in progress complete.  Under systemd, it
+// reports readiness and, unless a call to the keystore has held live past the watchdog timeout, pings the watchdog.
+func serveUntilInterrupted(server *grpc.Server, l net.Listener, live *keystoreLock) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	go func() {
+		<-sigs
+		_ = sdNotify("STOPPING=1")
+		server.GracefulStop()
+	}()
+
+	stopWatchdog := startWatchdog(live)
+	defer stopWatchdog()
+
+	_ = sdNotify("READY=1\nSTATUS=Serving on " + l.Addr().String())
+	return server.Serve(l)
+}
+
+type agentGenerateTokenRequest struct {
+	Realm string
+	Label string
+}
+
+func (m *agentGenerateTokenRequest) marshal() []byte {
+	return appendBytesField(appendBytesField(nil, 1, []byte(m.Realm)), 2, []byte(m.Label))
+}
+
+func (m *agentGenerateTokenRequest) unmarshal(data []byte) error {
+	return parseBytesFields(data, func(num protowire.Number, v []byte) {
+		switch num {
+		case 1:
+			m.Realm = string(v)
+		case 2:
+			m.Label = string(v)
+		}
+	})
+}
+
+type agentLoginRequest struct {
+	// ID selects the token, defaulting to the token selected with use, or the only token
+	ID  []byte
+	URL string
+}
+
+func (m *agentLoginRequest) marshal() []byte {
+	return appendBytesField(appendBytesField(nil, 1, m.ID), 2, []byte(m.URL))
+}
+
+func (m *agentLoginRequest) unmarshal(data []byte) error {
+	return parseBytesFields(data, func(num protowire.Number, v []byte) {
+		switch num {
+		case 1:
+			m.ID = v
+		case 2:
+			m.URL = string(v)
+		}
+	})
+}
+
+type agentLoginResponse struct {
+	Token string
+}
+
+func (m *agentLoginResponse) marshal() []byte {
+	return appendBytesField(nil, 1, []byte(m.Token))
+}
+
+func (m *agentLoginResponse) unmarshal(data []byte) error {
+	return parseBytesFields(data, func(num protowire.Number, v []byte) {
+		if num == 1 {
+			m.Token = string(v)
+		}
+	})
+}
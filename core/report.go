@@ -0,0 +1,245 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/x509"
+	"html/template"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/manetu/security-token/config"
+)
+
+// ReportSource is a configured keystore covered by a report: the top-level configuration, or one of its profiles
+type ReportSource struct {
+	Profile string `json:"profile"`
+	Backend string `json:"backend"`
+	Tokens  int    `json:"tokens"`
+	// Error reports why the tokens of the keystore could not be enumerated
+	Error string `json:"error,omitempty"`
+}
+
+// ReportToken is a token within a report, along with the profiles through which it was found
+type ReportToken struct {
+	TokenInfo
+	Profiles []string `json:"profiles"`
+}
+
+// ExpiryBucket counts the tokens expiring within a period, those expiring earlier excepted
+type ExpiryBucket struct {
+	Label string `json:"label"`
+	Count int    `json:"count"`
+}
+
+// Report is an inventory of the tokens across all configured keystores.  Like TokenInfo, fields are only ever added.
+type Report struct {
+	Generated time.Time      `json:"generated"`
+	Sources   []ReportSource `json:"sources"`
+	// Total counts distinct tokens, since profiles may share a keystore
+	Total    int            `json:"total"`
+	Realms   map[string]int `json:"realms"`
+	KeyTypes map[string]int `json:"keyTypes"`
+	Expiry   []ExpiryBucket `json:"expiry"`
+	Expired  []ReportToken  `json:"expired"`
+}
+
+// expiryBuckets are the periods of the expiry histogram, after the tokens already expired
+var expiryBuckets = []struct {
+	label  string
+	within time.Duration
+}{
+	{"within 7 days", 7 * 24 * time.Hour},
+	{"within 30 days", 30 * 24 * time.Hour},
+	{"within 90 days", 90 * 24 * time.Hour},
+	{"within a year", 365 * 24 * time.Hour},
+}
+
+// Report writes an inventory of the tokens of the top-level configuration and every profile, as JSON or HTML: counts
+// by realm (the provider of the identity) and key type, a histogram of expiry dates, and the tokens already expired.  A
+// keystore that cannot be reached is reported as such rather than failing the report.
+func (c *Core) Report(output string, w io.Writer) error {
+	err := checkOutput(output, "json", "html")
+	if err != nil {
+		return err
+	}
+
+	_, err = c.readConfig()
+	if err != nil {
+		return classify(ExitConfig, err)
+	}
+
+	profiles := []string{""}
+	configMu.Lock()
+	for name := range viper.GetStringMap("profiles") {
+		profiles = append(profiles, name)
+	}
+	configMu.Unlock()
+	sort.Strings(profiles[1:])
+
+	now := time.Now()
+	report := Report{
+		Generated: now.UTC(),
+		Realms:    map[string]int{},
+		KeyTypes:  map[string]int{},
+		Expiry:    []ExpiryBucket{{Label: "expired"}},
+		Expired:   []ReportToken{},
+	}
+	for _, b := range expiryBuckets {
+		report.Expiry = append(report.Expiry, ExpiryBucket{Label: b.label})
+	}
+	report.Expiry = append(report.Expiry, ExpiryBucket{Label: "later"})
+
+	tokens := map[string]*ReportToken{}
+	var order []string
+
+	// the keystores are enumerated at once, since each may be a network HSM or cloud KMS taking seconds
+	sources := make([]ReportSource, len(profiles))
+	certs := make([][]*x509.Certificate, len(profiles))
+	tick, stop := c.startCounter("Enumerating security tokens...")
+	var wg sync.WaitGroup
+	for i, profile := range profiles {
+		// the configuration is decoded here rather than by the goroutines, which would only wait on configMu
+		cfg, err := profileConfiguration(profile)
+		wg.Add(1)
+		go func(i int, profile string) {
+			defer wg.Done()
+			sources[i], certs[i] = reportSource(profile, cfg, err, tick)
+		}(i, profile)
+	}
+	wg.Wait()
+	stop()
+
+	for i, profile := range profiles {
+		report.Sources = append(report.Sources, sources[i])
+
+		for _, cert := range certs[i] {
+			info := NewTokenInfo(cert)
+			name := orDefault(profile, "default")
+			if t, ok := tokens[info.Serial]; ok {
+				t.Profiles = append(t.Profiles, name)
+				continue
+			}
+			tokens[info.Serial] = &ReportToken{TokenInfo: info, Profiles: []string{name}}
+			order = append(order, info.Serial)
+		}
+	}
+
+	for _, serial := range order {
+		t := tokens[serial]
+		report.Total++
+		report.Realms[t.Realm]++
+		report.KeyTypes[t.KeyType]++
+
+		bucket := len(report.Expiry) - 1
+		if t.NotAfter.Before(now) {
+			bucket = 0
+			report.Expired = append(report.Expired, *t)
+		} else {
+			for i, b := range expiryBuckets {
+				if t.NotAfter.Before(now.Add(b.within)) {
+					bucket = i + 1
+					break
+				}
+			}
+		}
+		report.Expiry[bucket].Count++
+	}
+	sort.Slice(report.Expired, func(i, j int) bool {
+		return report.Expired[i].NotAfter.Before(report.Expired[j].NotAfter)
+	})
+
+	if output == "json" {
+		return writeJSONTo(w, report)
+	}
+	return reportTemplate.Execute(w, report)
+}
+
+// reportSource enumerates the certificates of the keystore configured by profile as cfg, or that could not be
+// configured for cfgErr, calling tick for each as it is found
+func reportSource(profile string, cfg config.Configuration, cfgErr error, tick func()) (ReportSource, []*x509.Certificate) {
+	source := ReportSource{Profile: orDefault(profile, "default")}
+
+	if cfgErr != nil {
+		source.Error = cfgErr.Error()
+		return source, nil
+	}
+	source.Backend = orDefault(cfg.Backend, "pkcs11")
+
+	backend, err := newBackend(source.Backend, &cfg)
+	if err != nil {
+		source.Error = err.Error()
+		return source, nil
+	}
+	defer func() {
+		_ = backend.Close()
+	}()
+
+	certs, err := streamCertificates(backend, func(*x509.Certificate) { tick() })
+	if err != nil {
+		source.Error = err.Error()
+		return source, nil
+	}
+	source.Tokens = len(certs)
+
+	return source, certs
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"date": func(t time.Time) string { return t.Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Security token report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+th { background: #f0f0f0; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Security token report</h1>
+<p>Generated {{date .Generated}}: {{.Total}} tokens.</p>
+
+<h2>Keystores</h2>
+<table>
+<tr><th>Profile</th><th>Backend</th><th>Tokens</th></tr>
+{{range .Sources}}<tr><td>{{.Profile}}</td><td>{{.Backend}}</td><td>{{if .Error}}<span class="error">{{.Error}}</span>{{else}}{{.Tokens}}{{end}}</td></tr>
+{{end}}</table>
+
+<h2>Realms</h2>
+<table>
+<tr><th>Realm</th><th>Tokens</th></tr>
+{{range $realm, $count := .Realms}}<tr><td>{{$realm}}</td><td>{{$count}}</td></tr>
+{{end}}</table>
+
+<h2>Key types</h2>
+<table>
+<tr><th>Key type</th><th>Tokens</th></tr>
+{{range $type, $count := .KeyTypes}}<tr><td>{{$type}}</td><td>{{$count}}</td></tr>
+{{end}}</table>
+
+<h2>Expiry</h2>
+<table>
+<tr><th>Expiring</th><th>Tokens</th></tr>
+{{range .Expiry}}<tr><td>{{.Label}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+
+<h2>Expired</h2>
+{{if .Expired}}<table>
+<tr><th>Serial</th><th>Realm</th><th>MRN</th><th>Expired</th><th>Profiles</th></tr>
+{{range .Expired}}<tr><td>{{.Serial}}</td><td>{{.Realm}}</td><td>{{.MRN}}</td><td>{{date .NotAfter}}</td><td>{{range $i, $p := .Profiles}}{{if $i}}, {{end}}{{$p}}{{end}}</td></tr>
+{{end}}</table>
+{{else}}<p>None.</p>
+{{end}}</body>
+</html>
+`))
@@ -0,0 +1,301 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// The modes of the rotation scheduler
+const (
+	// RotationRenew reissues the certificate of the existing key
+	RotationRenew = "renew"
+	// RotationRotate generates a new token for the realm, leaving the old one in place until it is deleted
+	RotationRotate = "rotate"
+)
+
+// defaultRotationInterval is the time between checks of the rotation scheduler
+const defaultRotationInterval = time.Hour
+
+// certificateReplacer is implemented by backends able to replace the certificate of a token while keeping its key,
+// which allows certificates to be renewed
+type certificateReplacer interface {
+	ReplaceCertificate(id []byte, cert *x509.Certificate) error
+}
+
+// RotationOptions configures the scheduler of the agent and server modes renewing or rotating tokens as they near
+// expiry
+type RotationOptions struct {
+	// Before renews or rotates tokens expiring within the duration, or disables the scheduler when zero
+	Before time.Duration
+	// Mode is RotationRenew or RotationRotate, defaulting to RotationRotate
+	Mode string
+	// Interval is the time between checks, defaulting to an hour
+	Interval time.Duration
+}
+
+// SetRotation enables the rotation scheduler of the agent and server modes
+func (c *Core) SetRotation(opts RotationOptions) {
+	c.rotation = opts
+}
+
+// startRotation checks for expiring tokens now and then at every interval, until the returned function is called
+func (s *remoteServer) startRotation() (func(), error) {
+	opts := s.core.rotation
+	if opts.Before <= 0 {
+		return func() {}, nil
+	}
+	if opts.Mode == "" {
+		opts.Mode = RotationRotate
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultRotationInterval
+	}
+
+	switch opts.Mode {
+	case RotationRotate:
+	case RotationRenew:
+		// the backend of the daemon may be instrumented, hiding the optional interfaces of the keystore
+		if _, ok := s.core.getBackend().(certificateReplacer); !ok {
+			return nil, classify(ExitConfig, errors.New("the keystore backend cannot renew certificates (available with memory, pkcs11 and softkeys); use rotate"))
+		}
+	default:
+		return nil, classify(ExitConfig, fmt.Errorf("unknown rotation mode %q (available: renew, rotate)", opts.Mode))
+	}
+
+	validity, err := s.core.checkValidity(0)
+	if err != nil {
+		return nil, err
+	}
+	if validity <= opts.Before {
+		return nil, classify(ExitConfig, fmt.Errorf("new certificates are valid for %s, which would expire within the rotation window of %s", validity, opts.Before))
+	}
+
+	reg, err := s.core.rotationRegistration(opts.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			err := s.rotateExpiring(opts, reg)
+			if err != nil {
+				logWarn("rotation failed", "error", err)
+			}
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() { close(done) }, nil
+}
+
+// registration registers the new certificates of the rotation scheduler with the registrar of the enroll section
+type registration struct {
+	registrar EnrollRegistrar
+	opts      EnrollOptions
+}
+
+// rotationRegistration returns the registration of new certificates configured by the enroll section, or nil when it
+// names no URL.  The MRN of a token is the digest of its certificate, so renewing a certificate in place changes the
+// MRN under which the token logs in: renew is refused without a registration, which must accept the new certificate
+// before it replaces the old one.  A rotated token leaves its predecessor in place, so its registration may be left to
+// the operator.
+func (c *Core) rotationRegistration(mode string) (*registration, error) {
+	registrar, opts, err := c.enrollment(EnrollOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if opts.URL == "" {
+		if mode == RotationRenew {
+			return nil, classify(ExitConfig, errors.New("renewing a certificate changes the MRN of its token, so renew requires the enroll section to register the new certificate; use rotate"))
+		}
+		return nil, nil
+	}
+	return &registration{registrar: registrar, opts: opts}, nil
+}
+
+// rotateExpiring renews each token expiring within opts.Before or, when rotating, generates a new token for each realm
+// whose tokens all expire within opts.Before.  New certificates are registered with reg unless it is nil.
+func (s *remoteServer) rotateExpiring(opts RotationOptions, reg *registration) error {
+	s.Lock()
+	certs, err := s.backend.Certificates()
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(opts.Before)
+	var errs []string
+	if opts.Mode == RotationRenew {
+		replacer := s.core.getBackend().(certificateReplacer)
+		for _, cert := range certs {
+			if cert.NotAfter.After(deadline) {
+				continue
+			}
+			err = s.renewToken(replacer, reg, cert)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", HexEncode(cert.SerialNumber.Bytes()), err))
+			}
+		}
+	} else {
+		// a realm needs a new token only when none of its tokens outlasts the deadline, so each realm is rotated once
+		latest := map[string]*x509.Certificate{}
+		for _, cert := range certs {
+			realm := strings.Join(cert.Subject.Organization, ",")
+			if prev, ok := latest[realm]; !ok || cert.NotAfter.After(prev.NotAfter) {
+				latest[realm] = cert
+			}
+		}
+		for _, realm := range sortedKeys(latest) {
+			cert := latest[realm]
+			if cert.NotAfter.After(deadline) {
+				continue
+			}
+			err = s.rotateToken(reg, cert)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", HexEncode(cert.SerialNumber.Bytes()), err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// renewToken reissues the certificate of the token holding cert for its existing key, registering the new certificate
+// with reg before it replaces cert, so that the token is never left with an MRN unknown to Manetu.  The lock of s is
+// held across the calls to the backend, but not across the registration.
+func (s *remoteServer) renewToken(replacer certificateReplacer, reg *registration, cert *x509.Certificate) (err error) {
+	c := s.core
+	renewed := cert
+	defer func() {
+		c.audit("renew", renewed, err)
+	}()
+
+	err = c.checkTokenPolicy(PolicyRotate, cert)
+	if err != nil {
+		return err
+	}
+	validity, err := c.checkValidity(0)
+	if err != nil {
+		return err
+	}
+	clock, err := c.getClock()
+	if err != nil {
+		return err
+	}
+
+	id := cert.SerialNumber.Bytes()
+	s.Lock()
+	token, err := s.backend.FindToken(id)
+	var next *x509.Certificate
+	if err == nil && token != nil {
+		next, err = selfSignToken(token.Signer, id, strings.Join(cert.Subject.Organization, ","), validity, clock)
+	}
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return classify(ExitNotFound, errors.New("the key of the token was not found"))
+	}
+
+	err = c.register(reg.registrar, reg.opts, next)
+	if err != nil {
+		return fmt.Errorf("the renewed certificate was not registered, and the token was left unchanged: %w", err)
+	}
+
+	s.Lock()
+	err = replacer.ReplaceCertificate(id, next)
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	renewed = next
+
+	c.notifyRotated(renewed, cert, true)
+	return nil
+}
+
+// rotateToken generates a new token for the realm of cert, leaving the token holding cert in place, and registers it
+// with reg unless reg is nil
+func (s *remoteServer) rotateToken(reg *registration, cert *x509.Certificate) (err error) {
+	c := s.core
+	rotated := cert
+	defer func() {
+		c.audit("rotate", rotated, err)
+	}()
+
+	err = c.checkTokenPolicy(PolicyRotate, cert)
+	if err != nil {
+		return err
+	}
+	validity, err := c.checkValidity(0)
+	if err != nil {
+		return err
+	}
+	clock, err := c.getClock()
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	next, err := generateToken(s.backend, strings.Join(cert.Subject.Organization, ","), tokenLabel(s.backend, cert), validity, clock)
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	rotated = next
+
+	registered := false
+	if reg != nil {
+		err = c.register(reg.registrar, reg.opts, next)
+		if err != nil {
+			// the previous token remains in place, so the new one may be registered with enroll --serial
+			logWarn("the rotated token was not registered", "serial", HexEncode(next.SerialNumber.Bytes()), "error", err)
+		}
+		registered = err == nil
+	}
+
+	c.notifyRotated(rotated, cert, registered)
+	return nil
+}
+
+// notifyRotated reports that cert has replaced previous.  Unless registered, the MRN of cert must be registered with
+// Manetu in place of that of previous.
+func (c *Core) notifyRotated(cert, previous *x509.Certificate, registered bool) {
+	serial := HexEncode(cert.SerialNumber.Bytes())
+	what := "renewed"
+	if prev := HexEncode(previous.SerialNumber.Bytes()); prev != serial {
+		what = "replaced by " + serial
+		serial = prev
+	}
+	action := "registered as " + ComputeMRN(cert)
+	if !registered {
+		action = "register " + ComputeMRN(cert) + " with Manetu"
+	}
+	fmt.Fprintf(os.Stderr, "%s %s, expiring %s; %s\n", serial, what, cert.NotAfter.UTC().Format(time.RFC3339), action)
+
+	e := newWebhookEvent(WebhookTokenRotated, cert)
+	e.Previous = HexEncode(previous.SerialNumber.Bytes())
+	e.PreviousMRN = ComputeMRN(previous)
+	c.notifyEvent(e)
+}
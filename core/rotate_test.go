@@ -0,0 +1,111 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/manetu/security-token/config"
+)
+
+// registry is a registration service of the http enroll registrar, recording the MRNs posted to it
+type registry struct {
+	sync.Mutex
+	mrns   []string
+	refuse bool
+}
+
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		MRN string
+	}
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if r.refuse {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	r.mrns = append(r.mrns, body.MRN)
+}
+
+func TestRotationRegistration(t *testing.T) {
+	t.Setenv("MANETU_URL", "")
+	c := NewWithBackend(NewMemoryBackend())
+	defer c.Close()
+
+	_, err := c.rotationRegistration(RotationRenew)
+	if ExitCode(err) != ExitConfig {
+		t.Errorf("renew without an enroll URL = %v; want exit code %d", err, ExitConfig)
+	}
+	reg, err := c.rotationRegistration(RotationRotate)
+	if err != nil || reg != nil {
+		t.Errorf("rotate without an enroll URL = %v, %v; want no registration", reg, err)
+	}
+}
+
+// TestRenewRegisters renews an expiring certificate only once its new MRN is registered
+func TestRenewRegisters(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	r := &registry{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	backend := NewMemoryBackend()
+	c := NewWithBackend(backend)
+	c.SetQuiet(true)
+	c.configuration.Enroll = config.EnrollConfiguration{Registrar: "http", URL: server.URL}
+	c.configured = true
+	defer c.Close()
+
+	cert, err := c.GenerateValidFor("acme", time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateValidFor: %v", err)
+	}
+	reg, err := c.rotationRegistration(RotationRenew)
+	if err != nil || reg == nil {
+		t.Fatalf("rotationRegistration = %v, %v; want the http registrar", reg, err)
+	}
+	s := newRemoteServer(c, backend, false)
+	opts := RotationOptions{Before: 24 * time.Hour, Mode: RotationRenew}
+
+	// a refused registration leaves the token as it was
+	r.refuse = true
+	err = s.rotateExpiring(opts, reg)
+	if err == nil {
+		t.Error("rotateExpiring succeeded although the registration was refused")
+	}
+	certs, err := backend.Certificates()
+	if err != nil || len(certs) != 1 || !certs[0].Equal(cert) {
+		t.Fatalf("Certificates after a refused registration = %d certificates, %v; want the original", len(certs), err)
+	}
+
+	r.refuse = false
+	err = s.rotateExpiring(opts, reg)
+	if err != nil {
+		t.Fatalf("rotateExpiring: %v", err)
+	}
+	certs, err = backend.Certificates()
+	if err != nil || len(certs) != 1 {
+		t.Fatalf("Certificates = %d certificates, %v; want one", len(certs), err)
+	}
+	renewed := certs[0]
+	if renewed.SerialNumber.Cmp(cert.SerialNumber) != 0 || !renewed.NotAfter.After(cert.NotAfter) {
+		t.Errorf("the certificate of %s was not renewed", HexEncode(cert.SerialNumber.Bytes()))
+	}
+	if len(r.mrns) != 1 || r.mrns[0] != ComputeMRN(renewed) {
+		t.Errorf("registered %v; want [%s]", r.mrns, ComputeMRN(renewed))
+	}
+}
@@ -0,0 +1,529 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OIDs of the SCEP (RFC 8894) message attributes
+var (
+	oidSCEPMessageType    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidSCEPPKIStatus      = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 3}
+	oidSCEPFailInfo       = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 4}
+	oidSCEPSenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidSCEPRecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
+	oidSCEPTransactionID  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+
+	oidChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+)
+
+const (
+	scepMessagePKCSReq = "19"
+	scepMessageCertRep = "3"
+
+	scepSuccess = "0"
+	scepFailure = "2"
+	scepPending = "3"
+)
+
+var scepFailInfo = map[string]string{
+	"0": "unrecognized or unsupported algorithm",
+	"1": "integrity check failed",
+	"2": "transaction not permitted or supported",
+	"3": "message time too far from system time",
+	"4": "no certificate could be identified",
+}
+
+// SCEPOptions configures enrollment with a SCEP (RFC 8894) server, such as Microsoft NDES
+type SCEPOptions struct {
+	// URL of the server, such as http://ndes.example.com/certsrv/mscep/mscep.dll
+	URL string
+	// Identifier selects one of several CAs served by the server, if any
+	Identifier string
+	// Challenge is the password authorizing the request, as issued by the CA administrator
+	Challenge string
+	// CAFingerprint, the hex encoded SHA-256 fingerprint of a certificate of the CA, authenticates a server reached
+	// over plain HTTP
+	CAFingerprint string
+	// CommonName and DNSNames form the subject of an initial enrollment, the common name defaulting to the MRN
+	CommonName string
+	DNSNames   []string
+	// Renew requests a new certificate for the subject of that previously issued to the token
+	Renew    bool
+	Insecure bool
+}
+
+// SCEP obtains a certificate for the key of the token identified by serial from a SCEP server.  The request is
+// signed by the token's key; as SCEP encrypts its response to the requester, which the P-256 keys of tokens cannot
+// decrypt, the message carrying it is signed by a transient RSA key of the client.  The token remains identified by
+// its self-signed certificate; the issued chain is returned, leaf first, and kept in $HOME/.manetu/certs/scep.
+func (c *Core) SCEP(serial string, opts SCEPOptions) (chain []*x509.Certificate, err error) {
+	if opts.URL == "" {
+		return nil, classify(ExitConfig, errors.New("the URL of the SCEP server must be given"))
+	}
+
+	token, err := c.getToken(serial)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		c.audit("scep", token.Cert, err)
+	}()
+	id := token.Cert.SerialNumber.Bytes()
+
+	store, err := newFileCertStore("", "scep")
+	if err != nil {
+		return nil, err
+	}
+
+	client := newHTTPClient(opts.Insecure)
+	client.Timeout = 60 * time.Second
+
+	caps := scepCaps(client, opts)
+	if !caps["AES"] && !caps["SCEPSTANDARD"] {
+		err = c.checkFIPS("3DES, the only cipher offered by the SCEP server,")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !caps["SHA-256"] && !caps["SCEPSTANDARD"] {
+		err = c.checkFIPSDigest(crypto.SHA1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	caCerts, err := c.SCEPCACerts(opts)
+	if err != nil {
+		return nil, err
+	}
+	recipient := scepRecipient(caCerts)
+
+	template := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: firstNonEmpty(opts.CommonName, ComputeMRN(token.Cert))},
+		DNSNames: opts.DNSNames,
+	}
+	if opts.Renew {
+		previous, err := store.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if previous == nil {
+			return nil, classify(ExitNotFound, errors.New("no certificate has been issued to the token by SCEP; enroll it first"))
+		}
+		template = &x509.CertificateRequest{
+			Subject:        previous.Subject,
+			DNSNames:       previous.DNSNames,
+			EmailAddresses: previous.EmailAddresses,
+			IPAddresses:    previous.IPAddresses,
+			URIs:           previous.URIs,
+		}
+	}
+
+	csr, err := createCSRWithChallenge(template, token.Signer, opts.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the certificate request: %w", err)
+	}
+	txid := sha256.Sum256(parsed.RawSubjectPublicKeyInfo)
+	transactionID := hex.EncodeToString(txid[:])
+
+	stop := c.startSpinner("Requesting certificate...")
+	defer stop()
+
+	transientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	transientCert, err := selfSignTransient(transientKey, template.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	enveloped, err := envelope(csr, recipient, caps["AES"] || caps["SCEPSTANDARD"])
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	var attrs []cmsAttribute
+	for _, a := range []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidSCEPMessageType, scepMessagePKCSReq},
+		{oidSCEPTransactionID, transactionID},
+		{oidSCEPSenderNonce, nonce},
+	} {
+		attr, err := newAttribute(a.oid, a.value)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+
+	hash := crypto.SHA1
+	if caps["SHA-256"] || caps["SCEPSTANDARD"] {
+		hash = crypto.SHA256
+	}
+	msg, err := signData(enveloped, false, transientKey, transientCert, hash, attrs, []*x509.Certificate{transientCert})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := scepPKIOperation(client, opts, msg, caps["POSTPKIOPERATION"] || caps["SCEPSTANDARD"])
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := scepCertRep(resp, caCerts, transactionID, nonce)
+	if err != nil {
+		return nil, err
+	}
+	der, err := openEnvelope(content, transientKey)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertsOnly(der)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err = leafFirst(certs, token.Signer)
+	if err != nil {
+		return nil, fmt.Errorf("the issued certificate does not carry the token's key: %w", err)
+	}
+
+	err = store.PutChain(id, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	return chain, nil
+}
+
+// SCEPCACerts returns the CA, and any RA, certificates of the SCEP server, checking them against opts.CAFingerprint
+// when set
+func (c *Core) SCEPCACerts(opts SCEPOptions) ([]*x509.Certificate, error) {
+	if opts.URL == "" {
+		return nil, classify(ExitConfig, errors.New("the URL of the SCEP server must be given"))
+	}
+	client := newHTTPClient(opts.Insecure)
+	client.Timeout = 60 * time.Second
+
+	resp, err := scepGet(client, opts, "GetCACert", opts.Identifier)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	if cert, err := x509.ParseCertificate(data); err == nil {
+		certs = []*x509.Certificate{cert}
+	} else {
+		certs, err = parseCertsOnly(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the CA certificates of the SCEP server: %w", err)
+		}
+	}
+
+	if opts.CAFingerprint != "" {
+		want := strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(opts.CAFingerprint))
+		trusted := false
+		for _, cert := range certs {
+			sum := sha256.Sum256(cert.Raw)
+			if hex.EncodeToString(sum[:]) == want {
+				trusted = true
+			}
+		}
+		if !trusted {
+			return nil, classify(ExitAuth, errors.New("no CA certificate of the SCEP server matches the fingerprint"))
+		}
+	}
+
+	return certs, nil
+}
+
+// scepRecipient chooses the certificate to which requests are encrypted: that of the RA when there is one, preferring
+// one for key encipherment, or otherwise that of the CA
+func scepRecipient(certs []*x509.Certificate) *x509.Certificate {
+	var ra *x509.Certificate
+	for _, cert := range certs {
+		if cert.IsCA {
+			continue
+		}
+		if cert.KeyUsage&x509.KeyUsageKeyEncipherment != 0 {
+			return cert
+		}
+		if ra == nil {
+			ra = cert
+		}
+	}
+	if ra != nil {
+		return ra
+	}
+	return certs[0]
+}
+
+// scepCaps returns the capabilities of the server, in upper case, assuming none when they cannot be determined
+func scepCaps(client *http.Client, opts SCEPOptions) map[string]bool {
+	caps := map[string]bool{}
+	resp, err := scepGet(client, opts, "GetCACaps", opts.Identifier)
+	if err != nil {
+		return caps
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 64*1024))
+	for scanner.Scan() {
+		if cap := strings.ToUpper(strings.TrimSpace(scanner.Text())); cap != "" {
+			caps[cap] = true
+		}
+	}
+	return caps
+}
+
+func scepURL(opts SCEPOptions, operation, message string) (string, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("operation", operation)
+	if message != "" {
+		q.Set("message", message)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func scepGet(client *http.Client, opts SCEPOptions, operation, message string) (*http.Response, error) {
+	u, err := scepURL(opts, operation, message)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, classify(ExitUnreachable, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("SCEP %s: %s", operation, resp.Status)
+	}
+	return resp, nil
+}
+
+// scepPKIOperation sends msg to the server, by POST when it is supported, and returns the response message
+func scepPKIOperation(client *http.Client, opts SCEPOptions, msg []byte, post bool) ([]byte, error) {
+	var resp *http.Response
+	if post {
+		u, err := scepURL(opts, "PKIOperation", "")
+		if err != nil {
+			return nil, err
+		}
+		resp, err = client.Post(u, "application/x-pki-message", bytes.NewReader(msg))
+		if err != nil {
+			return nil, classify(ExitUnreachable, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("SCEP PKIOperation: %s", resp.Status)
+		}
+	} else {
+		var err error
+		resp, err = scepGet(client, opts, "PKIOperation", base64.StdEncoding.EncodeToString(msg))
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// scepCertRep verifies the CertRep message resp, signed by one of caCerts in answer to the request of transactionID
+// and nonce, and returns its enveloped content
+func scepCertRep(resp []byte, caCerts []*x509.Certificate, transactionID string, nonce []byte) ([]byte, error) {
+	sd, err := parseSignedData(resp)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := sd.signerInfos()
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) != 1 {
+		return nil, fmt.Errorf("the SCEP response has %d signers", len(infos))
+	}
+	signer := signerCertificate(infos[0], caCerts)
+	if signer == nil {
+		return nil, errors.New("the SCEP response is not signed by the CA or its RA")
+	}
+	content, err := sd.signedContent()
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := verifySignerInfo(infos[0], signer, content)
+	if err != nil {
+		return nil, err
+	}
+
+	printable := func(oid asn1.ObjectIdentifier) string {
+		var s string
+		_, _ = asn1.Unmarshal(attributeValue(attrs, oid), &s)
+		return s
+	}
+	var recipientNonce []byte
+	_, _ = asn1.Unmarshal(attributeValue(attrs, oidSCEPRecipientNonce), &recipientNonce)
+
+	switch {
+	case printable(oidSCEPMessageType) != scepMessageCertRep:
+		return nil, fmt.Errorf("unexpected SCEP message type %q", printable(oidSCEPMessageType))
+	case printable(oidSCEPTransactionID) != transactionID:
+		return nil, errors.New("the SCEP response answers another transaction")
+	case !bytes.Equal(recipientNonce, nonce):
+		return nil, errors.New("the SCEP response does not answer this request")
+	}
+
+	switch status := printable(oidSCEPPKIStatus); status {
+	case scepSuccess:
+		return content, nil
+	case scepPending:
+		return nil, errors.New("the SCEP server is holding the request for approval; run the command again once approved")
+	case scepFailure:
+		info := printable(oidSCEPFailInfo)
+		return nil, classify(ExitAuth, fmt.Errorf("the SCEP server rejected the request: %s", orDefault(scepFailInfo[info], "failInfo "+info)))
+	default:
+		return nil, fmt.Errorf("unexpected SCEP status %q", status)
+	}
+}
+
+// csrSignatureHashes maps the signature algorithms chosen by x509.CreateCertificateRequest to their digests
+var csrSignatureHashes = map[string]crypto.Hash{
+	oidECDSAWithSHA256.String():                                 crypto.SHA256,
+	oidECDSAWithSHA384.String():                                 crypto.SHA384,
+	oidECDSAWithSHA512.String():                                 crypto.SHA512,
+	asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}.String(): crypto.SHA256,
+	asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}.String(): crypto.SHA384,
+	asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}.String(): crypto.SHA512,
+}
+
+// createCSRWithChallenge creates a certificate request for template signed by signer, including the challenge
+// password attribute when challenge is set.  x509.CreateCertificateRequest cannot encode the attribute itself, so
+// the request it creates is extended and signed again.
+func createCSRWithChallenge(template *x509.CertificateRequest, signer crypto.Signer, challenge string) ([]byte, error) {
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, signer)
+	if err != nil || challenge == "" {
+		return der, err
+	}
+
+	var csr struct {
+		TBS                asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		Signature          asn1.BitString
+	}
+	_, err = asn1.Unmarshal(der, &csr)
+	if err != nil {
+		return nil, err
+	}
+	var tbs struct {
+		Version    int
+		Subject    asn1.RawValue
+		PublicKey  asn1.RawValue
+		Attributes []asn1.RawValue `asn1:"tag:0"`
+	}
+	_, err = asn1.Unmarshal(csr.TBS.FullBytes, &tbs)
+	if err != nil {
+		return nil, err
+	}
+
+	attr, err := newAttribute(oidChallengePassword, challenge)
+	if err != nil {
+		return nil, err
+	}
+	attrDER, err := asn1.Marshal(attr)
+	if err != nil {
+		return nil, err
+	}
+	tbs.Attributes = append(tbs.Attributes, asn1.RawValue{FullBytes: attrDER})
+	tbsDER, err := asn1.Marshal(tbs)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, ok := csrSignatureHashes[csr.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported certificate request signature %s", csr.SignatureAlgorithm.Algorithm)
+	}
+	h := hash.New()
+	h.Write(tbsDER)
+	signature, err := signer.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return nil, err
+	}
+
+	csr.TBS = asn1.RawValue{FullBytes: tbsDER}
+	csr.Signature = asn1.BitString{Bytes: signature, BitLength: len(signature) * 8}
+	der, err = asn1.Marshal(csr)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the certificate request: %w", err)
+	}
+	return der, parsed.CheckSignature()
+}
+
+// selfSignTransient issues the short-lived self-signed certificate identifying the transient key of a SCEP request
+func selfSignTransient(key *rsa.PrivateKey, subject pkix.Name) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
@@ -0,0 +1,434 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCA returns a self-signed RSA CA of the given name
+func testCA(t *testing.T, name string) (*rsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+// certsOnly returns the degenerate SignedData carrying certs without a signer, as CAs return issued certificates
+func certsOnly(certs ...*x509.Certificate) ([]byte, error) {
+	empty, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true})
+	if err != nil {
+		return nil, err
+	}
+	encap, err := asn1.Marshal(contentInfo{ContentType: oidData})
+	if err != nil {
+		return nil, err
+	}
+	var raw []byte
+	for _, cert := range certs {
+		raw = append(raw, cert.Raw...)
+	}
+
+	sd, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: asn1.RawValue{FullBytes: empty},
+		ContentInfo:      asn1.RawValue{FullBytes: encap},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw},
+		SignerInfos:      asn1.RawValue{FullBytes: empty},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{ContentType: oidSignedData, Content: explicitContent(sd)})
+}
+
+// scepServer is a fake SCEP server in the manner of NDES, whose CA issues a certificate to each request carrying its
+// challenge password
+type scepServer struct {
+	*httptest.Server
+
+	caKey     *rsa.PrivateKey
+	ca        *x509.Certificate
+	caps      string
+	challenge string
+
+	sync.Mutex
+	// methods records the HTTP method of each PKIOperation
+	methods []string
+	serial  int64
+}
+
+func newSCEPServer(t *testing.T, caps string) *scepServer {
+	t.Helper()
+
+	s := &scepServer{caps: caps, challenge: "8B1C0F", serial: 100}
+	s.caKey, s.ca = testCA(t, "NDES Test CA")
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// fingerprint returns the SHA-256 fingerprint of the CA, as given to --ca-fingerprint
+func (s *scepServer) fingerprint() string {
+	sum := sha256.Sum256(s.ca.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *scepServer) serve(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Query().Get("operation") {
+	case "GetCACaps":
+		_, _ = w.Write([]byte(s.caps))
+	case "GetCACert":
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		_, _ = w.Write(s.ca.Raw)
+	case "PKIOperation":
+		var msg []byte
+		var err error
+		if r.Method == http.MethodPost {
+			msg, err = io.ReadAll(r.Body)
+		} else {
+			msg, err = base64.StdEncoding.DecodeString(r.URL.Query().Get("message"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Lock()
+		s.methods = append(s.methods, r.Method)
+		s.Unlock()
+
+		resp, err := s.certRep(msg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pki-message")
+		_, _ = w.Write(resp)
+	default:
+		http.Error(w, "unknown operation", http.StatusBadRequest)
+	}
+}
+
+// certRep answers the PKCSReq msg with a CertRep, granting the request only when its challenge password is correct
+func (s *scepServer) certRep(msg []byte) ([]byte, error) {
+	sd, err := parseSignedData(msg)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := sd.signerInfos()
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertsOnly(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) != 1 {
+		return nil, errors.New("expected one signer")
+	}
+	requester := signerCertificate(infos[0], certs)
+	if requester == nil {
+		return nil, errors.New("the certificate of the requester is missing")
+	}
+	content, err := sd.signedContent()
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := verifySignerInfo(infos[0], requester, content)
+	if err != nil {
+		return nil, err
+	}
+
+	var messageType, transactionID string
+	var nonce []byte
+	_, _ = asn1.Unmarshal(attributeValue(attrs, oidSCEPMessageType), &messageType)
+	_, _ = asn1.Unmarshal(attributeValue(attrs, oidSCEPTransactionID), &transactionID)
+	_, _ = asn1.Unmarshal(attributeValue(attrs, oidSCEPSenderNonce), &nonce)
+	if messageType != scepMessagePKCSReq {
+		return nil, errors.New("expected a PKCSReq")
+	}
+
+	der, err := openEnvelope(content, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+	err = csr.CheckSignature()
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := csrChallenge(csr)
+	if err != nil {
+		return nil, err
+	}
+
+	type attribute struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}
+	reply := []attribute{
+		{oidSCEPMessageType, scepMessageCertRep},
+		{oidSCEPTransactionID, transactionID},
+		{oidSCEPRecipientNonce, nonce},
+		{oidSCEPSenderNonce, []byte("0123456789abcdef")},
+	}
+	var enveloped []byte
+	if challenge != s.challenge {
+		reply = append(reply, attribute{oidSCEPPKIStatus, scepFailure}, attribute{oidSCEPFailInfo, "2"})
+	} else {
+		s.Lock()
+		s.serial++
+		serial := s.serial
+		s.Unlock()
+
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+		}
+		leaf, err := x509.CreateCertificate(rand.Reader, template, s.ca, csr.PublicKey, s.caKey)
+		if err != nil {
+			return nil, err
+		}
+		issued, err := x509.ParseCertificate(leaf)
+		if err != nil {
+			return nil, err
+		}
+		degenerate, err := certsOnly(s.ca, issued)
+		if err != nil {
+			return nil, err
+		}
+		// the response is encrypted to the transient certificate signing the request
+		enveloped, err = envelope(degenerate, requester, true)
+		if err != nil {
+			return nil, err
+		}
+		reply = append(reply, attribute{oidSCEPPKIStatus, scepSuccess})
+	}
+
+	var replyAttrs []cmsAttribute
+	for _, a := range reply {
+		attr, err := newAttribute(a.oid, a.value)
+		if err != nil {
+			return nil, err
+		}
+		replyAttrs = append(replyAttrs, attr)
+	}
+	return signData(enveloped, false, s.caKey, s.ca, crypto.SHA256, replyAttrs, []*x509.Certificate{s.ca})
+}
+
+// csrChallenge returns the challenge password of csr, which x509.ParseCertificateRequest does not decode
+func csrChallenge(csr *x509.CertificateRequest) (string, error) {
+	var tbs struct {
+		Version    int
+		Subject    asn1.RawValue
+		PublicKey  asn1.RawValue
+		Attributes []cmsAttribute `asn1:"tag:0"`
+	}
+	_, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &tbs)
+	if err != nil {
+		return "", err
+	}
+
+	// a request without the attribute has no challenge
+	var challenge string
+	_, _ = asn1.Unmarshal(attributeValue(tbs.Attributes, oidChallengePassword), &challenge)
+	return challenge, nil
+}
+
+func TestCreateCSRWithChallenge(t *testing.T) {
+	signer, err := NewMemoryBackend().Generate([]byte{0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.CertificateRequest{Subject: pkix.Name{CommonName: "svc"}, DNSNames: []string{"svc.example.com"}}
+
+	for _, challenge := range []string{"", "8B1C0F"} {
+		der, err := createCSRWithChallenge(template, signer, challenge)
+		if err != nil {
+			t.Fatalf("createCSRWithChallenge(%q): %v", challenge, err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = csr.CheckSignature(); err != nil {
+			t.Errorf("the request with challenge %q does not verify: %v", challenge, err)
+		}
+		got, err := csrChallenge(csr)
+		if err != nil || got != challenge {
+			t.Errorf("challenge = %q, %v; want %q", got, err, challenge)
+		}
+		if csr.Subject.CommonName != "svc" || len(csr.DNSNames) != 1 {
+			t.Errorf("the request lost its subject: %v %v", csr.Subject, csr.DNSNames)
+		}
+	}
+}
+
+// TestSCEP enrolls a token with a fake NDES server offering the capabilities of each generation of server
+func TestSCEP(t *testing.T) {
+	tests := []struct {
+		name   string
+		caps   string
+		method string
+		fips   bool
+		code   int
+	}{
+		{"modern", "POSTPKIOperation\nSHA-256\nAES\nRenewal\n", http.MethodPost, false, 0},
+		{"standard", "SCEPStandard\n", http.MethodPost, false, 0},
+		{"without POST", "SHA-256\nAES\n", http.MethodGet, false, 0},
+		{"legacy", "", http.MethodGet, false, 0},
+		{"legacy in FIPS mode", "", "", true, ExitDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HOME", t.TempDir())
+			server := newSCEPServer(t, tt.caps)
+
+			c := NewWithBackend(NewMemoryBackend())
+			c.SetQuiet(true)
+			c.SetFIPS(tt.fips)
+			defer c.Close()
+			cert, err := c.Generate("acme")
+			if err != nil {
+				t.Fatal(err)
+			}
+			serial := HexEncode(cert.SerialNumber.Bytes())
+
+			opts := SCEPOptions{
+				URL:           server.URL + "/certsrv/mscep/mscep.dll",
+				Challenge:     server.challenge,
+				CAFingerprint: server.fingerprint(),
+				DNSNames:      []string{"svc.example.com"},
+			}
+			chain, err := c.SCEP(serial, opts)
+			if ExitCode(err) != tt.code {
+				t.Fatalf("SCEP = %v; want exit code %d", err, tt.code)
+			}
+			if err != nil {
+				return
+			}
+
+			if len(chain) != 2 || !chain[1].Equal(server.ca) {
+				t.Fatalf("SCEP returned %d certificates; want the leaf and the CA", len(chain))
+			}
+			if chain[0].Subject.CommonName != ComputeMRN(cert) || len(chain[0].DNSNames) != 1 {
+				t.Errorf("issued %v %v; want the MRN and svc.example.com", chain[0].Subject, chain[0].DNSNames)
+			}
+			if !cert.PublicKey.(*ecdsa.PublicKey).Equal(chain[0].PublicKey) {
+				t.Error("the issued certificate does not carry the key of the token")
+			}
+			if len(server.methods) != 1 || server.methods[0] != tt.method {
+				t.Errorf("PKIOperation by %v; want %s", server.methods, tt.method)
+			}
+
+			// a renewal keeps the subject issued before
+			opts.CommonName = "ignored on renewal"
+			opts.Renew = true
+			renewed, err := c.SCEP(serial, opts)
+			if err != nil {
+				t.Fatalf("SCEP renewal: %v", err)
+			}
+			if renewed[0].Subject.CommonName != chain[0].Subject.CommonName || renewed[0].SerialNumber.Cmp(chain[0].SerialNumber) == 0 {
+				t.Errorf("renewal issued %v, serial %s; want a new certificate for %v", renewed[0].Subject, renewed[0].SerialNumber, chain[0].Subject)
+			}
+		})
+	}
+}
+
+func TestSCEPRefused(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	server := newSCEPServer(t, "POSTPKIOperation\nSHA-256\nAES\n")
+
+	c := NewWithBackend(NewMemoryBackend())
+	c.SetQuiet(true)
+	defer c.Close()
+	cert, err := c.Generate("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := HexEncode(cert.SerialNumber.Bytes())
+	opts := SCEPOptions{URL: server.URL, Challenge: server.challenge, CAFingerprint: server.fingerprint()}
+
+	tests := []struct {
+		name   string
+		modify func(opts *SCEPOptions)
+		code   int
+	}{
+		{"a wrong challenge", func(opts *SCEPOptions) { opts.Challenge = "wrong" }, ExitAuth},
+		{"another CA", func(opts *SCEPOptions) { opts.CAFingerprint = hex.EncodeToString(make([]byte, 32)) }, ExitAuth},
+		{"renewal before enrollment", func(opts *SCEPOptions) { opts.Renew = true }, ExitNotFound},
+		{"no URL", func(opts *SCEPOptions) { opts.URL = "" }, ExitConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := opts
+			tt.modify(&o)
+			_, err := c.SCEP(serial, o)
+			if ExitCode(err) != tt.code {
+				t.Errorf("SCEP = %v; want exit code %d", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestSCEPRecipient(t *testing.T) {
+	_, ca := testCA(t, "CA")
+	ra := &x509.Certificate{KeyUsage: x509.KeyUsageDigitalSignature}
+	raEncipher := &x509.Certificate{KeyUsage: x509.KeyUsageKeyEncipherment}
+
+	if got := scepRecipient([]*x509.Certificate{ca}); got != ca {
+		t.Error("a lone CA is not the recipient")
+	}
+	if got := scepRecipient([]*x509.Certificate{ca, ra}); got != ra {
+		t.Error("the RA is not preferred to the CA")
+	}
+	if got := scepRecipient([]*x509.Certificate{ca, ra, raEncipher}); got != raEncipher {
+		t.Error("the RA for key encipherment is not preferred")
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// WriteSecretFile atomically replaces the file at path with data, readable only by its owner.  The data is written to
+// a temporary file within the same directory, which is renamed into place once complete, so that readers never see a
+// partial file and the permissions do not depend upon the umask.  When owner is set, as "user[:group]" by name or
+// id, the file is handed to that user before it becomes visible.
+func WriteSecretFile(path string, data []byte, owner string) error {
+	path = filepath.Clean(path)
+
+	uid, gid := -1, -1
+	if owner != "" {
+		var err error
+		uid, gid, err = lookupOwner(owner)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer func() {
+		_ = os.Remove(tmp)
+	}()
+
+	err = f.Chmod(0600)
+	if err == nil && owner != "" {
+		err = f.Chown(uid, gid)
+	}
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// lookupOwner resolves "user[:group]" to numeric ids, defaulting the group to the primary group of the user
+func lookupOwner(owner string) (int, int, error) {
+	name, group, hasGroup := strings.Cut(owner, ":")
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		u, err = user.LookupId(name)
+		if err != nil {
+			return 0, 0, fmt.Errorf("unknown user %q", name)
+		}
+	}
+
+	gid := u.Gid
+	if hasGroup {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			g, err = user.LookupGroupId(group)
+			if err != nil {
+				return 0, 0, fmt.Errorf("unknown group %q", group)
+			}
+		}
+		gid = g.Gid
+	}
+
+	uidN, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user %q has no numeric id", name)
+	}
+	gidN, err := strconv.Atoi(gid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("group %q has no numeric id", gid)
+	}
+
+	return uidN, gidN, nil
+}
@@ -0,0 +1,480 @@
+//go:build darwin && cgo
+
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+/*
+#cgo LDFLAGS: -framework Security -framework CoreFoundation
+#include <stdlib.h>
+#include <string.h>
+#include <CoreFoundation/CoreFoundation.h>
+#include <Security/Security.h>
+
+static CFMutableDictionaryRef mstDictionary(void) {
+	return CFDictionaryCreateMutable(kCFAllocatorDefault, 0, &kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+}
+
+static CFDataRef mstData(const void *p, long n) {
+	return CFDataCreate(kCFAllocatorDefault, p, n);
+}
+
+static CFStringRef mstString(const char *s) {
+	return CFStringCreateWithCString(kCFAllocatorDefault, s, kCFStringEncodingUTF8);
+}
+
+static const UInt8 *mstBytes(CFDataRef d) {
+	return CFDataGetBytePtr(d);
+}
+
+static long mstLength(CFDataRef d) {
+	return CFDataGetLength(d);
+}
+
+static long mstCount(CFArrayRef a) {
+	return CFArrayGetCount(a);
+}
+
+static CFDataRef mstArrayData(CFArrayRef a, long i) {
+	return (CFDataRef)CFArrayGetValueAtIndex(a, i);
+}
+
+static void mstReleaseData(CFDataRef d) { CFRelease(d); }
+static void mstReleaseString(CFStringRef s) { CFRelease(s); }
+static void mstReleaseArray(CFArrayRef a) { CFRelease(a); }
+static void mstReleaseKey(SecKeyRef k) { CFRelease(k); }
+
+// mstStatus converts a CFError into the OSStatus it carries, releasing it
+static OSStatus mstStatus(CFErrorRef error) {
+	OSStatus status;
+
+	if (error == NULL)
+		return errSecSuccess;
+
+	status = (OSStatus)CFErrorGetCode(error);
+	CFRelease(error);
+	return status == errSecSuccess ? errSecParam : status;
+}
+
+// mstErrorMessage returns a malloc'd description of status
+static char *mstErrorMessage(OSStatus status) {
+	char buf[256] = "unknown error";
+	CFStringRef message = SecCopyErrorMessageString(status, NULL);
+
+	if (message != NULL) {
+		CFStringGetCString(message, buf, sizeof(buf), kCFStringEncodingUTF8);
+		CFRelease(message);
+	}
+	return strdup(buf);
+}
+
+static OSStatus mstGenerate(CFDataRef tag, CFStringRef label, int presence, SecKeyRef *key) {
+	SecAccessControlCreateFlags flags = kSecAccessControlPrivateKeyUsage;
+	SecAccessControlRef access;
+	CFMutableDictionaryRef priv, attrs;
+	CFNumberRef size;
+	CFErrorRef error = NULL;
+	int bits = 256;
+
+	if (presence)
+		flags |= kSecAccessControlUserPresence;
+
+	access = SecAccessControlCreateWithFlags(kCFAllocatorDefault, kSecAttrAccessibleWhenUnlockedThisDeviceOnly, flags, &error);
+	if (access == NULL)
+		return mstStatus(error);
+
+	priv = mstDictionary();
+	CFDictionarySetValue(priv, kSecAttrIsPermanent, kCFBooleanTrue);
+	CFDictionarySetValue(priv, kSecAttrApplicationTag, tag);
+	CFDictionarySetValue(priv, kSecAttrLabel, label);
+	CFDictionarySetValue(priv, kSecAttrAccessControl, access);
+
+	size = CFNumberCreate(kCFAllocatorDefault, kCFNumberIntType, &bits);
+
+	attrs = mstDictionary();
+	CFDictionarySetValue(attrs, kSecAttrKeyType, kSecAttrKeyTypeECSECPrimeRandom);
+	CFDictionarySetValue(attrs, kSecAttrKeySizeInBits, size);
+	CFDictionarySetValue(attrs, kSecAttrTokenID, kSecAttrTokenIDSecureEnclave);
+	CFDictionarySetValue(attrs, kSecPrivateKeyAttrs, priv);
+
+	*key = SecKeyCreateRandomKey(attrs, &error);
+
+	CFRelease(attrs);
+	CFRelease(size);
+	CFRelease(priv);
+	CFRelease(access);
+
+	return mstStatus(error);
+}
+
+static CFMutableDictionaryRef mstKeyQuery(CFDataRef tag) {
+	CFMutableDictionaryRef query = mstDictionary();
+
+	CFDictionarySetValue(query, kSecClass, kSecClassKey);
+	CFDictionarySetValue(query, kSecAttrKeyClass, kSecAttrKeyClassPrivate);
+	CFDictionarySetValue(query, kSecAttrTokenID, kSecAttrTokenIDSecureEnclave);
+	CFDictionarySetValue(query, kSecAttrApplicationTag, tag);
+	return query;
+}
+
+static OSStatus mstFindKey(CFDataRef tag, SecKeyRef *key) {
+	CFMutableDictionaryRef query = mstKeyQuery(tag);
+	OSStatus status;
+
+	CFDictionarySetValue(query, kSecReturnRef, kCFBooleanTrue);
+	status = SecItemCopyMatching(query, (CFTypeRef *)key);
+	CFRelease(query);
+	return status;
+}
+
+static OSStatus mstDeleteKey(CFDataRef tag) {
+	CFMutableDictionaryRef query = mstKeyQuery(tag);
+	OSStatus status = SecItemDelete(query);
+
+	CFRelease(query);
+	return status;
+}
+
+// mstPublicKey returns the X9.63 (uncompressed point) encoding of the public half of key
+static OSStatus mstPublicKey(SecKeyRef key, CFDataRef *out) {
+	SecKeyRef pub = SecKeyCopyPublicKey(key);
+	CFErrorRef error = NULL;
+
+	if (pub == NULL)
+		return errSecParam;
+
+	*out = SecKeyCopyExternalRepresentation(pub, &error);
+	CFRelease(pub);
+	return mstStatus(error);
+}
+
+// mstSign produces a DER encoded ECDSA signature over a SHA-256 digest
+static OSStatus mstSign(SecKeyRef key, CFDataRef digest, CFDataRef *out) {
+	CFErrorRef error = NULL;
+
+	*out = SecKeyCreateSignature(key, kSecKeyAlgorithmECDSASignatureDigestX962SHA256, digest, &error);
+	return mstStatus(error);
+}
+
+static OSStatus mstAddCertificate(CFDataRef der, CFStringRef label) {
+	SecCertificateRef cert = SecCertificateCreateWithData(kCFAllocatorDefault, der);
+	CFMutableDictionaryRef attrs;
+	OSStatus status;
+
+	if (cert == NULL)
+		return errSecDecode;
+
+	attrs = mstDictionary();
+	CFDictionarySetValue(attrs, kSecClass, kSecClassCertificate);
+	CFDictionarySetValue(attrs, kSecValueRef, cert);
+	CFDictionarySetValue(attrs, kSecAttrLabel, label);
+
+	status = SecItemAdd(attrs, NULL);
+	CFRelease(attrs);
+	CFRelease(cert);
+	return status;
+}
+
+static CFMutableDictionaryRef mstCertificateQuery(CFStringRef label) {
+	CFMutableDictionaryRef query = mstDictionary();
+
+	CFDictionarySetValue(query, kSecClass, kSecClassCertificate);
+	CFDictionarySetValue(query, kSecAttrLabel, label);
+	CFDictionarySetValue(query, kSecMatchLimit, kSecMatchLimitAll);
+	return query;
+}
+
+// mstCertificates returns the DER encoding of each certificate carrying label
+static OSStatus mstCertificates(CFStringRef label, CFArrayRef *out) {
+	CFMutableDictionaryRef query = mstCertificateQuery(label);
+	OSStatus status;
+
+	CFDictionarySetValue(query, kSecReturnData, kCFBooleanTrue);
+	status = SecItemCopyMatching(query, (CFTypeRef *)out);
+	CFRelease(query);
+	return status;
+}
+
+// mstDeleteCertificate removes the certificate carrying label whose encoding matches der
+static OSStatus mstDeleteCertificate(CFStringRef label, CFDataRef der) {
+	CFMutableDictionaryRef query = mstCertificateQuery(label);
+	CFArrayRef certs = NULL;
+	OSStatus status;
+	CFIndex i;
+
+	CFDictionarySetValue(query, kSecReturnRef, kCFBooleanTrue);
+	status = SecItemCopyMatching(query, (CFTypeRef *)&certs);
+	CFRelease(query);
+	if (status != errSecSuccess)
+		return status;
+
+	status = errSecItemNotFound;
+	for (i = 0; i < CFArrayGetCount(certs); i++) {
+		SecCertificateRef cert = (SecCertificateRef)CFArrayGetValueAtIndex(certs, i);
+		CFDataRef data = SecCertificateCopyData(cert);
+		Boolean match = CFEqual(data, der);
+
+		CFRelease(data);
+		if (match) {
+			CFMutableDictionaryRef item = mstDictionary();
+
+			CFDictionarySetValue(item, kSecClass, kSecClassCertificate);
+			CFDictionarySetValue(item, kSecValueRef, cert);
+			status = SecItemDelete(item);
+			CFRelease(item);
+			break;
+		}
+	}
+
+	CFRelease(certs);
+	return status;
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"unsafe"
+
+	"github.com/manetu/security-token/config"
+)
+
+func init() {
+	RegisterBackend("secureenclave", newSecureEnclaveBackend)
+}
+
+// secureEnclaveBackend generates non-exportable P-256 keys within the Secure Enclave of the Mac, tagged with the
+// token id, and keeps the certificates in the login Keychain.  Keychain items created by this backend all carry the
+// configured label.
+type secureEnclaveBackend struct {
+	label    string
+	presence bool
+}
+
+func newSecureEnclaveBackend(cfg *config.Configuration) (Backend, error) {
+	return &secureEnclaveBackend{
+		label:    orDefault(cfg.SecureEnclave.Label, "manetu-security-token"),
+		presence: cfg.SecureEnclave.UserPresence,
+	}, nil
+}
+
+type osStatusError struct {
+	status C.OSStatus
+}
+
+func (e *osStatusError) Error() string {
+	msg := C.mstErrorMessage(e.status)
+	defer C.free(unsafe.Pointer(msg))
+
+	return fmt.Sprintf("%s (%d)", C.GoString(msg), int(e.status))
+}
+
+func osStatus(status C.OSStatus) error {
+	if status == C.errSecSuccess {
+		return nil
+	}
+	return &osStatusError{status: status}
+}
+
+func isItemNotFound(err error) bool {
+	var e *osStatusError
+	return errors.As(err, &e) && e.status == C.errSecItemNotFound
+}
+
+func cfData(b []byte) C.CFDataRef {
+	if len(b) == 0 {
+		return C.mstData(nil, 0)
+	}
+	return C.mstData(unsafe.Pointer(&b[0]), C.long(len(b)))
+}
+
+func goBytes(d C.CFDataRef) []byte {
+	return C.GoBytes(unsafe.Pointer(C.mstBytes(d)), C.int(C.mstLength(d)))
+}
+
+func (b *secureEnclaveBackend) cfLabel() C.CFStringRef {
+	label := C.CString(b.label)
+	defer C.free(unsafe.Pointer(label))
+
+	return C.mstString(label)
+}
+
+func (b *secureEnclaveBackend) Generate(id []byte) (crypto.Signer, error) {
+	tag := cfData(id)
+	defer C.mstReleaseData(tag)
+	label := b.cfLabel()
+	defer C.mstReleaseString(label)
+
+	presence := C.int(0)
+	if b.presence {
+		presence = 1
+	}
+
+	var key C.SecKeyRef
+	err := osStatus(C.mstGenerate(tag, label, presence, &key))
+	if err != nil {
+		return nil, fmt.Errorf("error generating key in the Secure Enclave: %w", err)
+	}
+	defer C.mstReleaseKey(key)
+
+	var point C.CFDataRef
+	err = osStatus(C.mstPublicKey(key, &point))
+	if err != nil {
+		return nil, err
+	}
+	defer C.mstReleaseData(point)
+
+	x, y := elliptic.Unmarshal(elliptic.P256(), goBytes(point))
+	if x == nil {
+		return nil, errors.New("error decoding public key")
+	}
+
+	return &secureEnclaveSigner{id: id, pub: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}}, nil
+}
+
+func (b *secureEnclaveBackend) ImportCertificate(id []byte, cert *x509.Certificate) error {
+	der := cfData(cert.Raw)
+	defer C.mstReleaseData(der)
+	label := b.cfLabel()
+	defer C.mstReleaseString(label)
+
+	return osStatus(C.mstAddCertificate(der, label))
+}
+
+func (b *secureEnclaveBackend) Certificates() ([]*x509.Certificate, error) {
+	label := b.cfLabel()
+	defer C.mstReleaseString(label)
+
+	var list C.CFArrayRef
+	err := osStatus(C.mstCertificates(label, &list))
+	if isItemNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer C.mstReleaseArray(list)
+
+	var certs []*x509.Certificate
+	for i := C.long(0); i < C.mstCount(list); i++ {
+		cert, err := x509.ParseCertificate(goBytes(C.mstArrayData(list, i)))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing a certificate of the keychain: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+func (b *secureEnclaveBackend) findCertificate(id []byte) (*x509.Certificate, error) {
+	certs, err := b.Certificates()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cert := range certs {
+		if bytes.Equal(cert.SerialNumber.Bytes(), id) {
+			return cert, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (b *secureEnclaveBackend) FindToken(id []byte) (*Token, error) {
+	cert, err := b.findCertificate(id)
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return nil, nil
+	}
+
+	return &Token{
+		Signer: &secureEnclaveSigner{id: id, pub: cert.PublicKey},
+		Cert:   cert,
+	}, nil
+}
+
+func (b *secureEnclaveBackend) Delete(id []byte) error {
+	cert, err := b.findCertificate(id)
+	if err != nil {
+		return err
+	}
+	if cert == nil {
+		return errors.New("invalid serial number")
+	}
+
+	der := cfData(cert.Raw)
+	defer C.mstReleaseData(der)
+	label := b.cfLabel()
+	defer C.mstReleaseString(label)
+
+	err = osStatus(C.mstDeleteCertificate(label, der))
+	if err != nil {
+		return err
+	}
+
+	tag := cfData(id)
+	defer C.mstReleaseData(tag)
+
+	err = osStatus(C.mstDeleteKey(tag))
+	if isItemNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (b *secureEnclaveBackend) Close() error {
+	return nil
+}
+
+// secureEnclaveSigner implements crypto.Signer by looking up the Secure Enclave key tagged with id for each
+// signature.  macOS prompts for Touch ID or the login password when the key requires user presence.
+type secureEnclaveSigner struct {
+	id  []byte
+	pub crypto.PublicKey
+}
+
+func (s *secureEnclaveSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *secureEnclaveSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+	}
+
+	tag := cfData(s.id)
+	defer C.mstReleaseData(tag)
+
+	var key C.SecKeyRef
+	err := osStatus(C.mstFindKey(tag, &key))
+	if err != nil {
+		return nil, fmt.Errorf("error finding Secure Enclave key: %w", err)
+	}
+	defer C.mstReleaseKey(key)
+
+	data := cfData(digest)
+	defer C.mstReleaseData(data)
+
+	var sig C.CFDataRef
+	err = osStatus(C.mstSign(key, data, &sig))
+	if err != nil {
+		return nil, fmt.Errorf("error signing with the Secure Enclave: %w", err)
+	}
+	defer C.mstReleaseData(sig)
+
+	// Security.framework returns a DER encoded ECDSA signature, as crypto.Signer requires
+	return goBytes(sig), nil
+}
@@ -0,0 +1,183 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TokenStatus is the health of a security token, as reported by CheckToken to the readiness probes of services
+// embedding the package.  Like TokenInfo, fields are only ever added.
+type TokenStatus struct {
+	Serial string `json:"serial,omitempty"`
+	MRN    string `json:"mrn,omitempty"`
+	// Found reports that both the key pair and the certificate of the token exist
+	Found bool `json:"found"`
+	// Signs reports that the key signed a random payload, and that the signature verified against the certificate
+	Signs bool `json:"signs"`
+	// Valid reports that the certificate is within its validity period
+	Valid    bool      `json:"valid"`
+	NotAfter time.Time `json:"notAfter"`
+	// Healthy reports that every check passed
+	Healthy bool `json:"healthy"`
+	// Error is the reason the first failed check failed
+	Error string `json:"error,omitempty"`
+
+	// signErr, verifyErr and validErr are the failures of the checks, and hash the digest signed, for SelfTest
+	signErr, verifyErr, validErr error
+	hash                         crypto.Hash
+}
+
+// CheckToken checks that the key pair and certificate of the token identified by serial exist, that the key signs, and
+// that the certificate has not expired, much as does the selftest command but without printing.  The status is
+// returned whatever the outcome, with an error when the token is not healthy, classified as for the other operations.
+func (c *Core) CheckToken(serial string) (TokenStatus, error) {
+	token, err := c.getToken(serial)
+	if err != nil {
+		return TokenStatus{Error: err.Error()}, err
+	}
+
+	status := c.checkToken(token, time.Now())
+	for _, err := range []error{status.signErr, status.verifyErr} {
+		if err != nil {
+			return status, err
+		}
+	}
+	if status.validErr != nil {
+		return status, classify(ExitExpired, status.validErr)
+	}
+	return status, nil
+}
+
+// checkToken signs a random payload with token, verifies the signature against its certificate and checks the
+// validity period of the certificate at now
+func (c *Core) checkToken(token *Token, now time.Time) TokenStatus {
+	cert := token.Cert
+	status := TokenStatus{
+		Serial:   HexEncode(cert.SerialNumber.Bytes()),
+		MRN:      ComputeMRN(cert),
+		Found:    true,
+		NotAfter: cert.NotAfter.UTC(),
+	}
+
+	payload := make([]byte, 32)
+	_, status.signErr = rand.Read(payload)
+	if status.signErr == nil {
+		status.hash = matchedDigest(token.Signer.Public())
+		digest := payload
+		if _, ok := token.Signer.Public().(ed25519.PublicKey); ok {
+			status.hash = 0
+		} else {
+			h := status.hash.New()
+			h.Write(payload)
+			digest = h.Sum(nil)
+		}
+
+		var sig []byte
+		sig, status.signErr = token.Signer.Sign(rand.Reader, digest, status.hash)
+		c.audit("selftest", cert, status.signErr)
+		if status.signErr == nil {
+			status.verifyErr = verifyDigest(cert, status.hash, digest, sig)
+			status.Signs = status.verifyErr == nil
+		}
+	}
+
+	switch {
+	case now.Before(cert.NotBefore):
+		status.validErr = fmt.Errorf("not valid before %s", cert.NotBefore.UTC().Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		status.validErr = fmt.Errorf("expired at %s", status.NotAfter.Format(time.RFC3339))
+	default:
+		status.Valid = true
+	}
+
+	status.Healthy = status.Signs && status.Valid
+	for _, err := range []error{status.signErr, status.verifyErr, status.validErr} {
+		if err != nil {
+			status.Error = err.Error()
+			break
+		}
+	}
+	return status
+}
+
+// SelfTest checks that the token identified by serial, or every token when serial is empty, still works as an
+// identity: its key signs a random payload, the signature verifies against its stored certificate, and the certificate
+// is within its validity period.  It prints a pass/fail checklist for each token, as does Doctor for the configuration.
+func (c *Core) SelfTest(serial string) error {
+	var tokens []*Token
+	if serial != "" {
+		token, err := c.getToken(serial)
+		if err != nil {
+			return err
+		}
+		tokens = append(tokens, token)
+	} else {
+		backend := c.getBackend()
+		certs, err := backend.Certificates()
+		if err != nil {
+			return err
+		}
+		if len(certs) == 0 {
+			return classify(ExitNotFound, errors.New("no security-tokens found"))
+		}
+		for _, cert := range certs {
+			token, err := backend.FindToken(cert.SerialNumber.Bytes())
+			if err != nil {
+				return err
+			}
+			if token != nil {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+
+	l := &checklist{}
+	for i, token := range tokens {
+		if i > 0 {
+			fmt.Println()
+		}
+		now := time.Now()
+		status := c.checkToken(token, now)
+		fmt.Printf("Security token %s (%s)\n", status.Serial, status.MRN)
+
+		if l.report(selfTestSteps[0], status.signErr, fmt.Sprintf("%s signature over %s", keyType(token.Cert), hashName(status.hash))) {
+			l.report(selfTestSteps[1], status.verifyErr, "ok")
+		} else {
+			l.skip(selfTestSteps[1])
+		}
+
+		remaining := token.Cert.NotAfter.Sub(now)
+		in := remaining.Round(time.Minute).String()
+		if days := int(remaining / (24 * time.Hour)); days > 0 {
+			in = fmt.Sprintf("%d days", days)
+		}
+		l.report(selfTestSteps[2], status.validErr, fmt.Sprintf("valid until %s, in %s", status.NotAfter.Format(time.RFC3339), in))
+	}
+
+	if l.failed {
+		return errors.New("one or more checks failed")
+	}
+	return nil
+}
+
+var selfTestSteps = []string{
+	"Sign a random payload",
+	"Verify the signature against the certificate",
+	"Check the validity period",
+}
+
+// hashName names the digest signed, or the message itself for Ed25519
+func hashName(hash crypto.Hash) string {
+	if hash == 0 {
+		return "the payload"
+	}
+	return hash.String()
+}
@@ -0,0 +1,106 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// ServeOptions configures the gRPC server started by Serve
+type ServeOptions struct {
+	// Address to listen on, such as ":8443"
+	Address string
+	// Cert and Key name the PEM encoded certificate and private key of the server
+	Cert string
+	Key  string
+	// ClientCA names the PEM encoded CA certificates that client certificates must chain to
+	ClientCA string
+	// Insecure allows insecure TLS for logins requested through the server
+	Insecure bool
+}
+
+// Serve exposes the keystore over TCP through the RemoteSigner and Agent gRPC services, until interrupted.  Every
+// client must present a certificate issued by one of the client CAs, so that sidecars and programs in other languages
+// may use the tokens without any other credential.
+func (c *Core) Serve(opts ServeOptions) error {
+	// a daemon holding its locks must never wait upon the terminal
+	c.interactive = false
+
+	// a socket passed by systemd socket activation takes the place of --grpc
+	l, err := systemdListener()
+	if err != nil {
+		return err
+	}
+	if l == nil && opts.Address == "" {
+		return classify(ExitConfig, errors.New("--grpc must be given the address to listen on"))
+	}
+	if opts.Cert == "" || opts.Key == "" || opts.ClientCA == "" {
+		return classify(ExitConfig, errors.New("--cert, --key and --client-ca must all be given"))
+	}
+
+	cert, err := tls.LoadX509KeyPair(opts.Cert, opts.Key)
+	if err != nil {
+		return fmt.Errorf("error loading server certificate: %w", err)
+	}
+
+	pem, err := os.ReadFile(opts.ClientCA)
+	if err != nil {
+		return err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", opts.ClientCA)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	backend, stopMetrics, err := c.startMetrics(c.getBackend())
+	if err != nil {
+		return err
+	}
+	defer stopMetrics()
+
+	stopProfiling, err := c.startProfiling()
+	if err != nil {
+		return err
+	}
+	defer stopProfiling()
+
+	if l == nil {
+		l, err = net.Listen("tcp", opts.Address)
+		if err != nil {
+			return err
+		}
+	}
+
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)), grpc.ForceServerCodec(remoteCodec{}))
+	rs := newRemoteServer(c, backend, opts.Insecure)
+	rs.register(server)
+
+	stopRotation, err := rs.startRotation()
+	if err != nil {
+		return err
+	}
+	defer stopRotation()
+
+	if !c.quiet {
+		fmt.Fprintf(os.Stderr, "Serving gRPC on %s\n", l.Addr())
+	}
+
+	return serveUntilInterrupted(server, l, &rs.keystoreLock)
+}
@@ -0,0 +1,185 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"time"
+)
+
+// signDigests maps the names accepted by --digest to the digests signed
+var signDigests = map[string]crypto.Hash{
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+// SignOptions configures Sign
+type SignOptions struct {
+	// Digest names the digest of the data that is signed: "sha256", "sha384" or "sha512", defaulting to that matched to
+	// the key: SHA-384 for P-384, SHA-512 for P-521 and SHA-256 otherwise.  Ed25519 keys sign the data itself.
+	Digest string
+	// Encoding is that of ECDSA signatures: "der" (the default), the ASN.1 SEQUENCE of X.509 and CMS tooling, or "raw",
+	// the fixed-size concatenation r||s of JOSE, COSE and WebAuthn.  RSA and Ed25519 signatures have but one encoding.
+	Encoding string
+}
+
+// Sign signs the file at path with the key of the token identified by serial, so that the token may sign documents
+// and artifacts as well as login assertions.  The signature is that of "openssl dgst -sign": DER encoded for ECDSA,
+// PKCS#1 v1.5 for RSA, unless opts.Encoding selects raw ECDSA signatures.
+func (c *Core) Sign(serial string, path string, opts SignOptions) ([]byte, error) {
+	switch opts.Encoding {
+	case "", "der", "raw":
+	default:
+		return nil, classify(ExitConfig, fmt.Errorf("unsupported signature encoding %q (available: der, raw)", opts.Encoding))
+	}
+
+	token, err := c.getToken(serial)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := signDigest(opts.Digest, token.Signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := digestFile(path, token.Signer.Public(), hash)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := token.Signer.Public().(ed25519.PublicKey); ok {
+		hash = 0
+	}
+
+	start := time.Now()
+	sig, err := token.Signer.Sign(rand.Reader, digest, hash)
+	c.auditSince("sign", token.Cert, start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if pub, ok := token.Signer.Public().(*ecdsa.PublicKey); ok && opts.Encoding == "raw" {
+		return rawSignature(sig, (pub.Curve.Params().BitSize+7)/8)
+	}
+	return sig, nil
+}
+
+// Verify checks sig, produced by Sign with the options given, over the file at path against the certificate of the
+// token identified by serial or, when certPath is set, the PEM encoded certificate within the file.  It returns the
+// certificate of the signer.
+func (c *Core) Verify(serial string, certPath string, path string, sig []byte, opts SignOptions) (*x509.Certificate, error) {
+	cert, err := c.tokenOrCert(serial, certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = VerifySignature(cert, path, sig, opts)
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// VerifySignature checks sig, produced by Sign with the options given, over the file at path against the public key of
+// cert.  ECDSA signatures may be DER or raw encoded, whatever opts.Encoding, and any signature may also be base64
+// encoded, as written by sign --sigstore.  Whether cert is itself to be trusted,
+// such as by its MRN, is for the caller to decide.
+func VerifySignature(cert *x509.Certificate, path string, sig []byte, opts SignOptions) error {
+	hash, err := signDigest(opts.Digest, cert.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	digest, err := digestFile(path, cert.PublicKey, hash)
+	if err != nil {
+		return err
+	}
+
+	if decoded, err := base64.StdEncoding.DecodeString(string(sig)); err == nil {
+		sig = decoded
+	}
+
+	return verifyDigest(cert, hash, digest, sig)
+}
+
+// verifyDigest checks sig over digest, the message itself for Ed25519, against the public key of cert
+func verifyDigest(cert *x509.Certificate, hash crypto.Hash, digest []byte, sig []byte) error {
+	var ok bool
+	switch pub := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(pub, digest, sig)
+		if size := (pub.Curve.Params().BitSize + 7) / 8; !ok && len(sig) == 2*size {
+			r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+			ok = ecdsa.Verify(pub, digest, r, s)
+		}
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, digest, sig)
+	default:
+		return fmt.Errorf("unsupported public key type %s", keyType(cert))
+	}
+	if !ok {
+		return errors.New("the signature does not match the data and certificate")
+	}
+	return nil
+}
+
+// signDigest returns the digest named by --digest, defaulting to that matched to pub
+func signDigest(name string, pub crypto.PublicKey) (crypto.Hash, error) {
+	if name == "" {
+		return matchedDigest(pub), nil
+	}
+	hash, ok := signDigests[name]
+	if !ok {
+		return 0, classify(ExitConfig, fmt.Errorf("unsupported digest %q (available: sha256, sha384, sha512)", name))
+	}
+	return hash, nil
+}
+
+// matchedDigest returns the digest of a strength matching that of an EC key, as JOSE and COSE require, or SHA-256
+func matchedDigest(pub crypto.PublicKey) crypto.Hash {
+	if pub, ok := pub.(*ecdsa.PublicKey); ok {
+		switch pub.Curve.Params().BitSize {
+		case 384:
+			return crypto.SHA384
+		case 521:
+			return crypto.SHA512
+		}
+	}
+	return crypto.SHA256
+}
+
+// digestFile returns the digest of the file at path, or its whole content for an Ed25519 key, which signs the message
+// itself
+func digestFile(path string, pub crypto.PublicKey, hash crypto.Hash) ([]byte, error) {
+	if _, ok := pub.(ed25519.PublicKey); ok {
+		return os.ReadFile(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := hash.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,343 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The public-good instances of Fulcio and Rekor operated by the Sigstore project
+const (
+	SigstoreFulcioURL = "https://fulcio.sigstore.dev"
+	SigstoreRekorURL  = "https://rekor.sigstore.dev"
+)
+
+// SigstoreOptions configures SignSigstore
+type SigstoreOptions struct {
+	// Serial selects the token, defaulting to the token selected with use
+	Serial string
+	// Artifact names the file to sign
+	Artifact string
+	// IdentityToken is an OIDC identity token which, when set, is exchanged with Fulcio for a short-lived certificate
+	// binding the token's key to the identity
+	IdentityToken string
+	FulcioURL     string
+	// Upload records the signature in the Rekor transparency log
+	Upload   bool
+	RekorURL string
+	Insecure bool
+}
+
+// SigstoreSignature is the result of SignSigstore, in the forms consumed by "cosign verify-blob"
+type SigstoreSignature struct {
+	// Signature is the DER encoded signature over the SHA-256 digest of the artifact
+	Signature []byte
+	// Certificates holds the chain issued by Fulcio, leaf first, if an identity token was given
+	Certificates []*x509.Certificate
+	// Bundle is the cosign bundle holding the signature, certificate and Rekor entry, if uploaded
+	Bundle []byte
+	// LogIndex is the index of the Rekor entry, if uploaded
+	LogIndex int64
+}
+
+// SignSigstore signs an artifact with the key of a token, optionally with a Fulcio certificate and a Rekor entry, so
+// that the token may serve as a supply-chain signing identity verifiable with the Sigstore tooling
+func (c *Core) SignSigstore(opts SigstoreOptions) (*SigstoreSignature, error) {
+	if opts.FulcioURL == "" {
+		opts.FulcioURL = SigstoreFulcioURL
+	}
+	if opts.RekorURL == "" {
+		opts.RekorURL = SigstoreRekorURL
+	}
+
+	f, err := os.Open(opts.Artifact)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	_ = f.Close()
+	if err != nil {
+		return nil, err
+	}
+	digest := h.Sum(nil)
+
+	token, err := c.getToken(opts.Serial)
+	if err != nil {
+		return nil, err
+	}
+
+	client := newHTTPClient(opts.Insecure)
+	out := &SigstoreSignature{}
+
+	if opts.IdentityToken != "" {
+		stop := c.startSpinner("Requesting signing certificate from Fulcio...")
+		out.Certificates, err = fulcioCertificate(client, opts.FulcioURL, opts.IdentityToken, token.Signer)
+		stop()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out.Signature, err = token.Signer.Sign(rand.Reader, digest, crypto.SHA256)
+	c.audit("sign", token.Cert, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.Upload {
+		return out, nil
+	}
+
+	// Rekor records either the Fulcio certificate or, without one, the bare public key
+	var verifier []byte
+	if len(out.Certificates) > 0 {
+		verifier = []byte(ExportCert(out.Certificates[0]))
+	} else {
+		pub, err := x509.MarshalPKIXPublicKey(token.Signer.Public())
+		if err != nil {
+			return nil, err
+		}
+		verifier = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+	}
+
+	stop := c.startSpinner("Uploading to Rekor...")
+	entry, err := rekorUpload(client, opts.RekorURL, digest, out.Signature, verifier)
+	stop()
+	if err != nil {
+		return nil, err
+	}
+	out.LogIndex = entry.LogIndex
+
+	bundle := cosignBundle{
+		Base64Signature: base64.StdEncoding.EncodeToString(out.Signature),
+		RekorBundle: &cosignRekorBundle{
+			SignedEntryTimestamp: entry.Verification.SignedEntryTimestamp,
+			Payload: cosignRekorPayload{
+				Body:           entry.Body,
+				IntegratedTime: entry.IntegratedTime,
+				LogIndex:       entry.LogIndex,
+				LogID:          entry.LogID,
+			},
+		},
+	}
+	if len(out.Certificates) > 0 {
+		bundle.Cert = base64.StdEncoding.EncodeToString(verifier)
+	}
+	out.Bundle, err = json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// cosignBundle is the bundle written by "cosign sign-blob --bundle"
+type cosignBundle struct {
+	Base64Signature string             `json:"base64Signature"`
+	Cert            string             `json:"cert,omitempty"`
+	RekorBundle     *cosignRekorBundle `json:"rekorBundle,omitempty"`
+}
+
+type cosignRekorBundle struct {
+	SignedEntryTimestamp string             `json:"SignedEntryTimestamp"`
+	Payload              cosignRekorPayload `json:"Payload"`
+}
+
+type cosignRekorPayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogIndex       int64  `json:"logIndex"`
+	LogID          string `json:"logID"`
+}
+
+// postJSON posts in to url, decoding the response into out when the server answers with one of the accepted statuses
+func postJSON(client *http.Client, url string, in interface{}, out interface{}, accepted ...int) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	for _, status := range accepted {
+		if resp.StatusCode == status {
+			return json.Unmarshal(data, out)
+		}
+	}
+	return fmt.Errorf("%s: %s: %s", url, resp.Status, strings.TrimSpace(string(data)))
+}
+
+// fulcioCertificate exchanges an OIDC identity token for a certificate of the key of signer, proving possession of
+// the key by signing the identity within the token
+func fulcioCertificate(client *http.Client, fulcioURL, idToken string, signer crypto.Signer) ([]*x509.Certificate, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed identity token")
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("malformed identity token: %w", err)
+	}
+	var claims struct {
+		Subject string `json:"sub"`
+		Email   string `json:"email"`
+	}
+	err = json.Unmarshal(claimsJSON, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("malformed identity token: %w", err)
+	}
+
+	// Fulcio identifies email-based tokens by the email claim, and all others by the subject
+	subject := claims.Subject
+	if claims.Email != "" {
+		subject = claims.Email
+	}
+	if subject == "" {
+		return nil, errors.New("identity token has neither a subject nor an email")
+	}
+
+	sum := sha256.Sum256([]byte(subject))
+	proof, err := signer.Sign(rand.Reader, sum[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	algorithm := "ECDSA"
+	if _, ok := signer.Public().(*rsa.PublicKey); ok {
+		algorithm = "RSA_PSS"
+	}
+
+	type publicKey struct {
+		Algorithm string `json:"algorithm"`
+		Content   string `json:"content"`
+	}
+	in := map[string]interface{}{
+		"credentials": map[string]string{"oidcIdentityToken": idToken},
+		"publicKeyRequest": map[string]interface{}{
+			"publicKey": publicKey{
+				Algorithm: algorithm,
+				Content:   string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})),
+			},
+			"proofOfPossession": base64.StdEncoding.EncodeToString(proof),
+		},
+	}
+
+	type chain struct {
+		Chain struct {
+			Certificates []string `json:"certificates"`
+		} `json:"chain"`
+	}
+	var resp struct {
+		Embedded *chain `json:"signedCertificateEmbeddedSct"`
+		Detached *chain `json:"signedCertificateDetachedSct"`
+	}
+	err = postJSON(client, strings.TrimSuffix(fulcioURL, "/")+"/api/v2/signingCert", in, &resp, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting certificate from Fulcio: %w", err)
+	}
+
+	issued := resp.Embedded
+	if issued == nil {
+		issued = resp.Detached
+	}
+	if issued == nil {
+		return nil, errors.New("no certificate returned by Fulcio")
+	}
+
+	var certs []*x509.Certificate
+	for _, p := range issued.Chain.Certificates {
+		for _, block := range decodePEMBlocks([]byte(p), "CERTIFICATE") {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing the certificate issued by Fulcio: %w", err)
+			}
+			certs = append(certs, cert)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate returned by Fulcio")
+	}
+
+	err = checkKeyMatchesCert(signer, certs[0])
+	if err != nil {
+		return nil, fmt.Errorf("certificate issued by Fulcio: %w", err)
+	}
+
+	return certs, nil
+}
+
+type rekorEntry struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+	Verification   struct {
+		SignedEntryTimestamp string `json:"signedEntryTimestamp"`
+	} `json:"verification"`
+}
+
+// rekorUpload records a hashedrekord entry of the signature over digest, verified by the PEM encoded certificate or
+// public key
+func rekorUpload(client *http.Client, rekorURL string, digest, sig, verifier []byte) (*rekorEntry, error) {
+	in := map[string]interface{}{
+		"apiVersion": "0.0.1",
+		"kind":       "hashedrekord",
+		"spec": map[string]interface{}{
+			"signature": map[string]interface{}{
+				"content":   base64.StdEncoding.EncodeToString(sig),
+				"publicKey": map[string]string{"content": base64.StdEncoding.EncodeToString(verifier)},
+			},
+			"data": map[string]interface{}{
+				"hash": map[string]string{"algorithm": "sha256", "value": hex.EncodeToString(digest)},
+			},
+		},
+	}
+
+	var resp map[string]rekorEntry
+	err := postJSON(client, strings.TrimSuffix(rekorURL, "/")+"/api/v1/log/entries", in, &resp, http.StatusCreated)
+	if err != nil {
+		return nil, fmt.Errorf("error uploading to Rekor: %w", err)
+	}
+	for _, entry := range resp {
+		return &entry, nil
+	}
+	return nil, errors.New("no entry returned by Rekor")
+}
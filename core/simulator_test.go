@@ -0,0 +1,177 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core_test
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/manetu/security-token/core"
+	"github.com/manetu/security-token/testutil"
+)
+
+// listTokens returns the tokens that List prints as JSON for opts
+func listTokens(t *testing.T, c *core.Core, opts core.ListOptions) []core.TokenInfo {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	opts.Output = "json"
+	err = c.List(opts)
+	os.Stdout = stdout
+	_ = w.Close()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var infos []core.TokenInfo
+	err = json.Unmarshal(out, &infos)
+	if err != nil {
+		t.Fatalf("List printed %q: %v", out, err)
+	}
+	return infos
+}
+
+func serialOf(cert *x509.Certificate) string {
+	return core.HexEncode(cert.SerialNumber.Bytes())
+}
+
+// TestSimulatedCore runs Generate, List, Delete and Login through the pkcs11 backend upon a simulated token
+func TestSimulatedCore(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// realms for which a token is generated, in order
+		realms []string
+		// label of a token generated for the realm acme, after those of realms
+		label string
+		// register registers the first token with the token endpoint
+		register bool
+		// deleteRealm deletes every token for the realm before logging in
+		deleteRealm string
+		// login selects the token of the login: its serial when "serial", else the label given
+		login string
+		// listRealm filters the tokens listed
+		listRealm string
+		// wantListed is the number of tokens listed
+		wantListed int
+		// wantExit is the exit code of the login
+		wantExit int
+	}{
+		{name: "login", realms: []string{"acme"}, register: true, login: "serial", wantListed: 1},
+		{name: "unregistered", realms: []string{"acme"}, login: "serial", wantListed: 1, wantExit: core.ExitAuth},
+		{name: "unknown", realms: []string{"acme"}, login: "0a:0b", wantListed: 1, wantExit: core.ExitNotFound},
+		{name: "by label", label: "billing-loader", register: true, login: "billing-loader", wantListed: 1},
+		{name: "unknown label", label: "billing-loader", login: "other-loader", wantListed: 1, wantExit: core.ExitNotFound},
+		{name: "listed by realm", realms: []string{"acme", "other", "acme"}, register: true, login: "serial", listRealm: "acme", wantListed: 2},
+		{name: "deleted", realms: []string{"acme", "other"}, register: true, deleteRealm: "acme", login: "serial", wantListed: 1, wantExit: core.ExitNotFound},
+		{name: "others deleted", realms: []string{"acme", "other"}, register: true, deleteRealm: "other", login: "serial", wantListed: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HOME", t.TempDir())
+			server := testutil.NewTokenServer(t)
+
+			c, err := testutil.SimulatedCore()
+			if err != nil {
+				t.Fatalf("SimulatedCore: %v", err)
+			}
+			c.SetQuiet(true)
+			defer c.Close()
+
+			var certs []*x509.Certificate
+			for _, realm := range tt.realms {
+				cert, err := c.Generate(realm)
+				if err != nil {
+					t.Fatalf("Generate: %v", err)
+				}
+				certs = append(certs, cert)
+			}
+			if tt.label != "" {
+				cert, err := c.GenerateLabeled("acme", tt.label, 0)
+				if err != nil {
+					t.Fatalf("GenerateLabeled: %v", err)
+				}
+				certs = append(certs, cert)
+			}
+			if tt.register {
+				server.Register(certs[0])
+			}
+
+			if tt.deleteRealm != "" {
+				err = c.Delete(core.DeleteOptions{Realm: tt.deleteRealm, Force: true})
+				if err != nil {
+					t.Fatalf("Delete: %v", err)
+				}
+			}
+
+			listed := listTokens(t, c, core.ListOptions{Realm: tt.listRealm})
+			if len(listed) != tt.wantListed {
+				t.Errorf("List = %d tokens; want %d", len(listed), tt.wantListed)
+			}
+			for _, info := range listed {
+				if tt.listRealm != "" && info.Realm != tt.listRealm {
+					t.Errorf("List of the realm %s includes %s of %s", tt.listRealm, info.Serial, info.Realm)
+				}
+			}
+
+			login := tt.login
+			if login == "serial" {
+				login = serialOf(certs[0])
+			}
+			jwt, err := c.LoginPKCS11(server.URL, false, login)
+			if core.ExitCode(err) != tt.wantExit {
+				t.Fatalf("Login = %v; want exit code %d", err, tt.wantExit)
+			}
+			if err == nil && jwt != testutil.AccessToken(certs[0]) {
+				t.Errorf("Login = %q; want %q", jwt, testutil.AccessToken(certs[0]))
+			}
+		})
+	}
+}
+
+// TestSimulatedCoreDelete deletes a single token by its serial, and refuses to delete it again
+func TestSimulatedCoreDelete(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	c, err := testutil.SimulatedCore()
+	if err != nil {
+		t.Fatalf("SimulatedCore: %v", err)
+	}
+	c.SetQuiet(true)
+	defer c.Close()
+
+	kept, err := c.Generate("acme")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	deleted, err := c.Generate("acme")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	err = c.Delete(core.DeleteOptions{Serial: serialOf(deleted), Force: true})
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	serials, err := c.Serials()
+	if err != nil || len(serials) != 1 || serials[0] != serialOf(kept) {
+		t.Errorf("Serials after Delete = %v, %v; want [%s]", serials, err, serialOf(kept))
+	}
+
+	err = c.Delete(core.DeleteOptions{Serial: serialOf(deleted), Force: true})
+	if core.ExitCode(err) != core.ExitNotFound {
+		t.Errorf("Delete of a deleted token = %v; want exit code %d", err, core.ExitNotFound)
+	}
+}
@@ -0,0 +1,55 @@
+//go:build !windows
+
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// privateDir creates dir for a socket of the current user, tightening a directory of the user that others may read
+// and refusing one that others may change, through which they could replace the socket
+func privateDir(dir string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("cannot determine the owner of %s", dir)
+	}
+
+	if int(st.Uid) == os.Getuid() {
+		if fi.Mode().Perm()&0077 != 0 {
+			return os.Chmod(dir, 0700)
+		}
+		return nil
+	}
+
+	// a shared directory such as /tmp is safe only when sticky, so that others cannot remove the socket
+	if fi.Mode().Perm()&0022 != 0 && fi.Mode()&os.ModeSticky == 0 {
+		return fmt.Errorf("%s may be changed by other users", dir)
+	}
+	return nil
+}
+
+// listenUnix listens on the Unix socket at path, which is created with mode 0600 rather than changed to it once bound,
+// so that no other user can connect in between
+func listenUnix(path string) (net.Listener, error) {
+	// the umask is that of the process, but the daemons listen before serving anything that creates files
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,50 @@
+//go:build !windows
+
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestListenPrivateSocket binds within a directory that others could read, which it tightens, with a socket that is
+// private from the moment it exists
+func TestListenPrivateSocket(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "run")
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "agent.sock")
+
+	l, err := listenPrivateSocket(path, "an agent")
+	if err != nil {
+		t.Fatalf("listenPrivateSocket: %v", err)
+	}
+	defer l.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket mode = %o; want 600", perm)
+	}
+	fi, err = os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0700 {
+		t.Errorf("directory mode = %o; want 700", perm)
+	}
+
+	_, err = listenPrivateSocket(path, "an agent")
+	if err == nil {
+		t.Error("a second listener replaced the live socket")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build windows
+
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"net"
+	"os"
+)
+
+// privateDir creates dir for a socket of the current user, which the ACL of the profile beneath it keeps private
+func privateDir(dir string) error {
+	return os.MkdirAll(dir, 0700)
+}
+
+// listenUnix listens on the Unix socket at path, whose access Windows governs by the ACL of its directory
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
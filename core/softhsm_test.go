@@ -0,0 +1,108 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/manetu/security-token/core"
+	"github.com/manetu/security-token/testutil"
+)
+
+// softHSMCore returns a quiet Core upon the SoftHSM2 token h
+func softHSMCore(t *testing.T, h *testutil.SoftHSM) *core.Core {
+	t.Helper()
+
+	c, err := h.Core()
+	if err != nil {
+		t.Fatalf("unable to open the SoftHSM2 token: %v", err)
+	}
+	c.SetQuiet(true)
+	return c
+}
+
+// TestSoftHSM runs a token through its life, from Generate through Login and Sign to Delete, upon a SoftHSM2 token
+func TestSoftHSM(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	h := testutil.StartSoftHSM(t)
+	server := testutil.NewTokenServer(t)
+
+	c := softHSMCore(t, h)
+	defer c.Close()
+
+	cert, err := c.Generate("acme")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	serial := core.HexEncode(cert.SerialNumber.Bytes())
+
+	serials, err := c.Serials()
+	if err != nil || len(serials) != 1 || serials[0] != serial {
+		t.Fatalf("Serials = %v, %v; want [%s]", serials, err, serial)
+	}
+
+	server.Register(cert)
+	jwt, err := c.LoginPKCS11(server.URL, false, serial)
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if jwt != testutil.AccessToken(cert) {
+		t.Errorf("Login = %q; want %q", jwt, testutil.AccessToken(cert))
+	}
+
+	artifact := filepath.Join(t.TempDir(), "artifact")
+	err = os.WriteFile(artifact, []byte("signed by the HSM"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := c.Sign(serial, artifact, core.SignOptions{})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	digest := sha256.Sum256([]byte("signed by the HSM"))
+	if !ecdsa.VerifyASN1(cert.PublicKey.(*ecdsa.PublicKey), digest[:], sig) {
+		t.Error("the signature of the HSM does not verify against the certificate of the token")
+	}
+
+	err = c.Delete(core.DeleteOptions{Serial: serial, Force: true})
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	_, err = c.LoginPKCS11(server.URL, false, serial)
+	if core.ExitCode(err) != core.ExitNotFound {
+		t.Errorf("Login after Delete = %v; want exit code %d", err, core.ExitNotFound)
+	}
+}
+
+// TestSoftHSMPersistence finds a token generated by one Core from another, as it is kept by the HSM rather than by
+// the process
+func TestSoftHSMPersistence(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	h := testutil.StartSoftHSM(t)
+
+	c := softHSMCore(t, h)
+	cert, err := c.GenerateLabeled("acme", "billing-loader", 0)
+	if err != nil {
+		t.Fatalf("GenerateLabeled: %v", err)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = softHSMCore(t, h)
+	defer c.Close()
+	status, err := c.CheckToken("billing-loader")
+	if err != nil {
+		t.Fatalf("CheckToken of the label: %v", err)
+	}
+	if status.Serial != core.HexEncode(cert.SerialNumber.Bytes()) || !status.Healthy {
+		t.Errorf("CheckToken = %+v; want the healthy token generated", status)
+	}
+}
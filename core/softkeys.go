@@ -0,0 +1,240 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/manetu/security-token/config"
+)
+
+func init() {
+	RegisterBackend("softkeys", newSoftKeysBackend)
+}
+
+// softKeysBackend keeps software keys as unencrypted PKCS#8 files alongside their certificates, by default in
+// $HOME/.manetu/softkeys.  It offers no protection beyond file permissions and is intended for development, or as
+// an intermediate step when migrating between keystores.
+type softKeysBackend struct {
+	dir   string
+	certs *fileCertStore
+}
+
+func newSoftKeysBackend(cfg *config.Configuration) (Backend, error) {
+	dir := cfg.SoftKeys.Path
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(home, ".manetu", "softkeys")
+	}
+
+	certs, err := newFileCertStore(dir, "softkeys")
+	if err != nil {
+		return nil, err
+	}
+
+	return &softKeysBackend{dir: certs.dir, certs: certs}, nil
+}
+
+func (b *softKeysBackend) keyPath(id []byte) string {
+	return filepath.Join(b.dir, hex.EncodeToString(id)+".key")
+}
+
+func (b *softKeysBackend) DescribeObjects(id []byte) []string {
+	return []string{
+		"private key " + filepath.Join(b.dir, describeID(id)+".key"),
+		"certificate " + filepath.Join(b.dir, describeID(id)+".pem"),
+	}
+}
+
+// loadKey returns the private key for id, or nil if it does not exist
+func (b *softKeysBackend) loadKey(id []byte) (crypto.Signer, error) {
+	data, err := os.ReadFile(b.keyPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer LockSecret(data)()
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("no PEM encoded private key found")
+	}
+	defer LockSecret(block.Bytes)()
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	return signer, nil
+}
+
+func (b *softKeysBackend) storeKey(id []byte, key crypto.PrivateKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	defer LockSecret(der)()
+
+	err = os.MkdirAll(b.dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	defer LockSecret(data)()
+	return os.WriteFile(b.keyPath(id), data, 0600)
+}
+
+func (b *softKeysBackend) Generate(id []byte) (crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.storeKey(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (b *softKeysBackend) ImportCertificate(id []byte, cert *x509.Certificate) error {
+	return b.certs.Put(id, cert)
+}
+
+// ReplaceCertificate overwrites the certificate of the token id, as ImportCertificate does
+func (b *softKeysBackend) ReplaceCertificate(id []byte, cert *x509.Certificate) error {
+	return b.certs.Put(id, cert)
+}
+
+func (b *softKeysBackend) Certificates() ([]*x509.Certificate, error) {
+	return b.certs.List()
+}
+
+func (b *softKeysBackend) FindToken(id []byte) (*Token, error) {
+	cert, err := b.certs.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return nil, nil
+	}
+
+	key, err := b.loadKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, nil
+	}
+
+	return &Token{Signer: key, Cert: cert}, nil
+}
+
+func (b *softKeysBackend) Delete(id []byte) error {
+	cert, err := b.certs.Get(id)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(b.keyPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		if cert == nil {
+			return errors.New("invalid serial number")
+		}
+	} else if err != nil {
+		return err
+	}
+
+	return b.certs.Delete(id)
+}
+
+func (b *softKeysBackend) Close() error {
+	return nil
+}
+
+func (b *softKeysBackend) ExportKey(id []byte) (crypto.PrivateKey, error) {
+	key, err := b.loadKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, errors.New("invalid serial number")
+	}
+
+	return key, nil
+}
+
+func (b *softKeysBackend) ImportKey(id []byte, key crypto.PrivateKey) error {
+	return b.storeKey(id, key)
+}
+
+func (b *softKeysBackend) Orphans() ([]Orphan, error) {
+	entries, err := os.ReadDir(b.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	present := map[string]bool{}
+	for _, e := range entries {
+		present[e.Name()] = !e.IsDir()
+	}
+
+	var orphans []Orphan
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		if !present[name] || (ext != ".key" && ext != ".pem") {
+			continue
+		}
+
+		id, err := hex.DecodeString(strings.TrimSuffix(name, ext))
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case ext == ".key" && !present[hex.EncodeToString(id)+".pem"]:
+			orphans = append(orphans, Orphan{ID: id, Kind: "private key", Object: "private key " + filepath.Join(b.dir, name)})
+		case ext == ".pem" && !present[hex.EncodeToString(id)+".key"]:
+			orphans = append(orphans, Orphan{ID: id, Kind: "certificate", Object: "certificate " + filepath.Join(b.dir, name)})
+		}
+	}
+
+	return orphans, nil
+}
+
+func (b *softKeysBackend) RemoveOrphan(orphan Orphan) error {
+	if orphan.Kind == "private key" {
+		return os.Remove(b.keyPath(orphan.ID))
+	}
+	return b.certs.Delete(orphan.ID)
+}
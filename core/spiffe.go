@@ -0,0 +1,481 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// SpiffeEndpointEnv names the environment variable through which SPIFFE workloads find the Workload API
+const SpiffeEndpointEnv = "SPIFFE_ENDPOINT_SOCKET"
+
+var (
+	spiffeTrustDomainRe = regexp.MustCompile(`^[a-z0-9._-]+$`)
+	spiffeSegmentRe     = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+)
+
+// SpiffeOptions configures the X.509-SVIDs issued by SVID and WorkloadAPI
+type SpiffeOptions struct {
+	// TrustDomain names the SPIFFE trust domain, such as "example.org"
+	TrustDomain string
+	// CACert names the PEM encoded certificate of the CA issuing SVIDs for the trust domain, followed by any
+	// intermediates and the root
+	CACert string
+	// CAKey names the PEM encoded private key of the CA
+	CAKey string
+	// Passphrase supplies the passphrase of an encrypted CA key
+	Passphrase PassphraseFunc
+	// TTL is the lifetime of each SVID, limited to that of the CA certificate
+	TTL time.Duration
+}
+
+// SpiffeID returns the SPIFFE ID of the token holding cert within trustDomain, mapping its MRN
+// mrn:iam:<realm>:identity:<hash> to spiffe://<trustDomain>/iam/<realm>/identity/<hash>
+func SpiffeID(cert *x509.Certificate, trustDomain string) (string, error) {
+	if !spiffeTrustDomainRe.MatchString(trustDomain) {
+		return "", fmt.Errorf("invalid trust domain %q: only lower case letters, digits, '.', '-' and '_' are allowed", trustDomain)
+	}
+	if len(cert.Subject.Organization) == 0 {
+		return "", errors.New("certificate subject has no organization to identify the realm")
+	}
+
+	segments := strings.Split(strings.TrimPrefix(ComputeMRN(cert), "mrn:"), ":")
+	for _, s := range segments {
+		if !spiffeSegmentRe.MatchString(s) {
+			return "", fmt.Errorf("MRN segment %q cannot be used within a SPIFFE ID", s)
+		}
+	}
+
+	return "spiffe://" + trustDomain + "/" + strings.Join(segments, "/"), nil
+}
+
+// spiffeCA issues SVIDs for a trust domain
+type spiffeCA struct {
+	cert   *x509.Certificate
+	signer crypto.Signer
+	// chain holds the intermediates between cert and the roots, including cert unless it is itself a root
+	chain []*x509.Certificate
+	// roots holds the self-signed certificates of the CA file, forming the trust bundle of the domain
+	roots []*x509.Certificate
+}
+
+func (c *Core) loadSpiffeCA(opts SpiffeOptions) (*spiffeCA, error) {
+	if opts.CACert == "" || opts.CAKey == "" {
+		return nil, classify(ExitConfig, errors.New("--ca-cert and --ca-key must both be given"))
+	}
+	if opts.TTL <= 0 {
+		return nil, classify(ExitConfig, errors.New("the SVID lifetime must be positive"))
+	}
+
+	kBytes, err := c.pathToBytes(opts.CAKey)
+	if err != nil {
+		return nil, err
+	}
+	block := decodePEMBlock(kBytes, "PRIVATE KEY")
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM encoded private key found", opts.CAKey)
+	}
+	der, err := c.decryptPEMBlock(block, opts.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := parsePrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	cBytes, err := c.pathToBytes(opts.CACert)
+	if err != nil {
+		return nil, err
+	}
+
+	ca := &spiffeCA{signer: signer}
+	for _, block := range decodePEMBlocks(cBytes, "CERTIFICATE") {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", opts.CACert, err)
+		}
+		if checkKeyMatchesCert(signer, cert) == nil {
+			ca.cert = cert
+		}
+		if cert.CheckSignatureFrom(cert) == nil {
+			ca.roots = append(ca.roots, cert)
+		} else {
+			ca.chain = append(ca.chain, cert)
+		}
+	}
+	if ca.cert == nil {
+		return nil, fmt.Errorf("%s: no certificate matches the CA key", opts.CACert)
+	}
+	if !ca.cert.IsCA {
+		return nil, fmt.Errorf("%s: the certificate of the CA key is not a CA certificate", opts.CACert)
+	}
+
+	return ca, nil
+}
+
+// issue signs an X.509-SVID for pub identified by id, valid for ttl or until the CA certificate expires
+func (ca *spiffeCA) issue(pub crypto.PublicKey, id string, subject pkix.Name, ttl time.Duration) (*x509.Certificate, error) {
+	u, err := url.Parse(id)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(ttl)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		URIs:                  []*url.URL{u},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca.cert, pub, ca.signer)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// SVID issues an X.509-SVID for the key of the token identified by serial, returning it PEM encoded along with the
+// chain of the CA, so that the HSM-held key may serve as a SPIFFE identity
+func (c *Core) SVID(serial string, opts SpiffeOptions) (string, error) {
+	token, err := c.getToken(serial)
+	if err != nil {
+		return "", err
+	}
+	err = c.checkTokenPolicy(PolicySVID, token.Cert)
+	if err != nil {
+		return "", err
+	}
+	_, err = c.checkValidity(opts.TTL)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := SpiffeID(token.Cert, opts.TrustDomain)
+	if err != nil {
+		return "", err
+	}
+
+	ca, err := c.loadSpiffeCA(opts)
+	if err != nil {
+		return "", err
+	}
+
+	svid, err := ca.issue(token.Signer.Public(), id, token.Cert.Subject, opts.TTL)
+	if err != nil {
+		return "", err
+	}
+
+	out := ExportCert(svid)
+	for _, cert := range ca.chain {
+		out += ExportCert(cert)
+	}
+	return out, nil
+}
+
+// WorkloadAPI serves the X.509-SVIDs of every token within the keystore over the SPIFFE Workload API on a Unix
+// socket, readable only by the current user, until interrupted.  The Workload API hands each workload its private
+// key, which an HSM never releases, so each SVID carries a short-lived software key, identified by the MRN of its
+// token and reissued at half its lifetime.
+func (c *Core) WorkloadAPI(socket string, opts SpiffeOptions) error {
+	// a daemon holding its locks must never wait upon the terminal
+	c.interactive = false
+
+	if !spiffeTrustDomainRe.MatchString(opts.TrustDomain) {
+		return classify(ExitConfig, fmt.Errorf("invalid trust domain %q", opts.TrustDomain))
+	}
+
+	ca, err := c.loadSpiffeCA(opts)
+	if err != nil {
+		return err
+	}
+	if len(ca.roots) == 0 {
+		return fmt.Errorf("%s must include the root certificate of the trust domain, served as its bundle", opts.CACert)
+	}
+
+	if socket == "" {
+		socket, err = runtimeSocket("spiffe.sock")
+		if err != nil {
+			return err
+		}
+	}
+
+	backend, stopMetrics, err := c.startMetrics(c.getBackend())
+	if err != nil {
+		return err
+	}
+	defer stopMetrics()
+
+	stopProfiling, err := c.startProfiling()
+	if err != nil {
+		return err
+	}
+	defer stopProfiling()
+
+	_, err = c.checkValidity(opts.TTL)
+	if err != nil {
+		return err
+	}
+
+	s := &workloadServer{core: c, backend: backend, ca: ca, opts: opts}
+
+	// fail early, rather than on the first request, when the keystore holds nothing to serve
+	_, _, err = s.current()
+	if err != nil {
+		return err
+	}
+
+	l, err := listenPrivateSocket(socket, "a Workload API server")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(socket)
+	}()
+
+	server := grpc.NewServer(grpc.ForceServerCodec(remoteCodec{}))
+	server.RegisterService(&workloadServiceDesc, s)
+
+	fmt.Printf("%s=unix://%s; export %s;\n", SpiffeEndpointEnv, socket, SpiffeEndpointEnv)
+
+	return serveUntilInterrupted(server, l, &s.keystoreLock)
+}
+
+// workloadServer serves the SVIDs of the tokens within backend, shared between all workloads until due for renewal
+type workloadServer struct {
+	keystoreLock
+	core    *Core
+	backend Backend
+	ca      *spiffeCA
+	opts    SpiffeOptions
+	resp    *workloadX509SVIDResponse
+	renew   time.Time
+}
+
+// current returns the SVIDs to serve and when they are to be renewed, issuing new SVIDs when they are due
+func (s *workloadServer) current() (*workloadX509SVIDResponse, time.Time, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.resp != nil && time.Now().Before(s.renew) {
+		return s.resp, s.renew, nil
+	}
+
+	certs, err := s.backend.Certificates()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(certs) == 0 {
+		return nil, time.Time{}, classify(ExitNotFound, errors.New("no security-tokens found"))
+	}
+
+	// the first SVID is the default of the workload, so the token selected with use comes first
+	def, err := s.core.DefaultToken()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var bundle []byte
+	for _, root := range s.ca.roots {
+		bundle = append(bundle, root.Raw...)
+	}
+
+	resp := &workloadX509SVIDResponse{}
+	for _, cert := range certs {
+		if s.core.checkTokenPolicy(PolicySVID, cert) != nil {
+			continue
+		}
+
+		id, err := SpiffeID(cert, s.opts.TrustDomain)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("%s: %w", HexEncode(cert.SerialNumber.Bytes()), err)
+		}
+
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		svid, err := s.ca.issue(key.Public(), id, cert.Subject, s.opts.TTL)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		chain := svid.Raw
+		for _, c := range s.ca.chain {
+			chain = append(chain, c.Raw...)
+		}
+
+		serial := HexEncode(cert.SerialNumber.Bytes())
+		entry := &workloadX509SVID{SpiffeID: id, Certificates: chain, Key: pkcs8, Bundle: bundle, Hint: serial}
+		if serial == def {
+			resp.SVIDs = append([]*workloadX509SVID{entry}, resp.SVIDs...)
+		} else {
+			resp.SVIDs = append(resp.SVIDs, entry)
+		}
+	}
+	if len(resp.SVIDs) == 0 {
+		return nil, time.Time{}, classify(ExitDenied, errors.New("policy denies an SVID for every security token"))
+	}
+
+	s.resp = resp
+	s.renew = time.Now().Add(s.opts.TTL / 2)
+	return s.resp, s.renew, nil
+}
+
+// fetchX509SVID streams the SVIDs to a workload, sending them again whenever they are renewed
+func (s *workloadServer) fetchX509SVID(stream grpc.ServerStream) error {
+	// the Workload API requires this header, so that a browser or proxy cannot be tricked into calling it
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if v := md.Get("workload.spiffe.io"); len(v) != 1 || v[0] != "true" {
+		return status.Error(codes.InvalidArgument, "security header missing from request")
+	}
+
+	err := stream.RecvMsg(&remoteEmpty{})
+	if err != nil {
+		return err
+	}
+
+	for {
+		resp, renew, err := s.current()
+		if err != nil {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+
+		err = stream.SendMsg(resp)
+		if err != nil {
+			return err
+		}
+
+		timer := time.NewTimer(time.Until(renew))
+		select {
+		case <-stream.Context().Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// workloadServiceDesc serves the FetchX509SVID method of the SPIFFE Workload API, defined in workload.proto of the
+// SPIFFE project.  Its other methods are reported as unimplemented.
+var workloadServiceDesc = grpc.ServiceDesc{
+	ServiceName: "SpiffeWorkloadAPI",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "FetchX509SVID",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(*workloadServer).fetchX509SVID(stream)
+			},
+			ServerStreams: true,
+		},
+	},
+	Metadata: "workload.proto",
+}
+
+type workloadX509SVID struct {
+	SpiffeID string
+	// Certificates holds the DER encoded SVID followed by its intermediates
+	Certificates []byte
+	// Key holds the DER encoded PKCS#8 private key
+	Key []byte
+	// Bundle holds the DER encoded roots of the trust domain
+	Bundle []byte
+	Hint   string
+}
+
+func (m *workloadX509SVID) marshal() []byte {
+	b := appendBytesField(nil, 1, []byte(m.SpiffeID))
+	b = appendBytesField(b, 2, m.Certificates)
+	b = appendBytesField(b, 3, m.Key)
+	b = appendBytesField(b, 4, m.Bundle)
+	return appendBytesField(b, 5, []byte(m.Hint))
+}
+
+func (m *workloadX509SVID) unmarshal(data []byte) error {
+	return parseBytesFields(data, func(num protowire.Number, v []byte) {
+		switch num {
+		case 1:
+			m.SpiffeID = string(v)
+		case 2:
+			m.Certificates = v
+		case 3:
+			m.Key = v
+		case 4:
+			m.Bundle = v
+		case 5:
+			m.Hint = string(v)
+		}
+	})
+}
+
+type workloadX509SVIDResponse struct {
+	SVIDs []*workloadX509SVID
+}
+
+func (m *workloadX509SVIDResponse) marshal() []byte {
+	var b []byte
+	for _, svid := range m.SVIDs {
+		b = appendBytesField(b, 1, svid.marshal())
+	}
+	return b
+}
+
+func (m *workloadX509SVIDResponse) unmarshal(data []byte) error {
+	var err error
+	perr := parseBytesFields(data, func(num protowire.Number, v []byte) {
+		if num == 1 {
+			svid := &workloadX509SVID{}
+			if e := svid.unmarshal(v); e != nil && err == nil {
+				err = e
+			}
+			m.SVIDs = append(m.SVIDs, svid)
+		}
+	})
+	if perr != nil {
+		return perr
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// spinnerDelay avoids flicker for operations that complete promptly
+	spinnerDelay    = 500 * time.Millisecond
+	spinnerInterval = 100 * time.Millisecond
+)
+
+var spinnerFrames = []rune{'|', '/', '-', '\\'}
+
+// startSpinner shows msg with an animated spinner on stderr while a slow keystore operation, such as key generation
+// on a network HSM, is in progress.  Nothing is shown under --quiet or when stderr is not a terminal.  The returned
+// function stops the spinner and erases it, and must be called before anything else is written to the terminal.
+func (c *Core) startSpinner(msg string) func() {
+	return c.spin(func() string { return msg })
+}
+
+// startCounter shows msg with a spinner, as does startSpinner, followed by the number of items found so far, such as
+// the tokens of a large inventory as they are enumerated.  The first function returned counts an item, and may be
+// called concurrently; the second stops the spinner.
+func (c *Core) startCounter(msg string) (func(), func()) {
+	var n int64
+	stop := c.spin(func() string {
+		return fmt.Sprintf("%s %d found", msg, atomic.LoadInt64(&n))
+	})
+	return func() { atomic.AddInt64(&n, 1) }, stop
+}
+
+// spin animates a spinner before the message returned by text, which is called afresh for each frame
+func (c *Core) spin(text func() string) func() {
+	if c.quiet || !terminal.IsTerminal(int(os.Stderr.Fd())) {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(spinnerDelay):
+		}
+
+		ticker := time.NewTicker(spinnerInterval)
+		defer ticker.Stop()
+
+		for i := 0; ; i++ {
+			fmt.Fprintf(os.Stderr, "\r%c %s\033[K", spinnerFrames[i%len(spinnerFrames)], text())
+			select {
+			case <-stop:
+				fmt.Fprint(os.Stderr, "\r\033[K")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,402 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SSHPublicKey returns the public key of the token identified by serial in the authorized_keys format, commented
+// with its MRN
+func (c *Core) SSHPublicKey(serial string) (string, error) {
+	token, err := c.getToken(serial)
+	if err != nil {
+		return "", err
+	}
+
+	pub, err := ssh.NewPublicKey(token.Signer.Public())
+	if err != nil {
+		return "", err
+	}
+
+	return sshAuthorizedKey(pub, ComputeMRN(token.Cert)), nil
+}
+
+// sshAuthorizedKey formats pub as a line of authorized_keys, with comment
+func sshAuthorizedKey(pub ssh.PublicKey, comment string) string {
+	line := strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(pub)), "\n")
+	if comment != "" {
+		line += " " + comment
+	}
+	return line + "\n"
+}
+
+// SSHCertOptions configures SSHCertify
+type SSHCertOptions struct {
+	// CASerial selects the token whose key signs the certificate
+	CASerial string
+	// Serial selects the token whose key is certified, unless PublicKey is given
+	Serial string
+	// PublicKey is the key to certify, in the authorized_keys format
+	PublicKey []byte
+	// Host issues a host certificate rather than a user certificate
+	Host bool
+	// KeyID identifies the certificate in the logs of the server, defaulting to the MRN of the certified token
+	KeyID string
+	// Principals lists the users or host names for which the certificate is valid
+	Principals []string
+	// Validity is the lifetime of the certificate
+	Validity time.Duration
+}
+
+// SSHCertify mints an OpenSSH certificate for a token or public key, signed by the key of the CA token, so that the
+// same hardware identity serves as an SSH certificate authority.  The certificate is returned in the format of a
+// -cert.pub file.
+func (c *Core) SSHCertify(opts SSHCertOptions) (string, error) {
+	if len(opts.Principals) == 0 {
+		return "", errors.New("at least one principal must be provided")
+	}
+	if opts.Validity <= 0 {
+		return "", errors.New("the validity must be positive")
+	}
+
+	var (
+		pub     ssh.PublicKey
+		comment string
+		err     error
+	)
+	if opts.PublicKey != nil {
+		pub, comment, _, _, err = ssh.ParseAuthorizedKey(opts.PublicKey)
+		if err != nil {
+			return "", fmt.Errorf("error parsing public key: %w", err)
+		}
+		if opts.KeyID == "" {
+			opts.KeyID = comment
+		}
+	} else {
+		token, err := c.getToken(opts.Serial)
+		if err != nil {
+			return "", err
+		}
+		pub, err = ssh.NewPublicKey(token.Signer.Public())
+		if err != nil {
+			return "", err
+		}
+		comment = ComputeMRN(token.Cert)
+		if opts.KeyID == "" {
+			opts.KeyID = comment
+		}
+	}
+
+	ca, err := c.getToken(opts.CASerial)
+	if err != nil {
+		return "", fmt.Errorf("CA token: %w", err)
+	}
+	err = c.checkTokenPolicy(PolicySSHCertify, ca.Cert)
+	if err != nil {
+		return "", err
+	}
+	_, err = c.checkValidity(opts.Validity)
+	if err != nil {
+		return "", err
+	}
+	caSigner, err := ssh.NewSignerFromSigner(ca.Signer)
+	if err != nil {
+		return "", err
+	}
+
+	serial := make([]byte, 8)
+	_, err = rand.Read(serial)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             pub,
+		Serial:          binary.BigEndian.Uint64(serial),
+		CertType:        ssh.UserCert,
+		KeyId:           opts.KeyID,
+		ValidPrincipals: opts.Principals,
+		// allow for clocks running a little behind ours
+		ValidAfter:  uint64(now.Add(-5 * time.Minute).Unix()),
+		ValidBefore: uint64(now.Add(opts.Validity).Unix()),
+	}
+	if opts.Host {
+		cert.CertType = ssh.HostCert
+	} else {
+		// the extensions granted by ssh-keygen by default
+		cert.Permissions.Extensions = map[string]string{
+			"permit-X11-forwarding":   "",
+			"permit-agent-forwarding": "",
+			"permit-port-forwarding":  "",
+			"permit-pty":              "",
+			"permit-user-rc":          "",
+		}
+	}
+
+	err = cert.SignCert(rand.Reader, caSigner)
+	c.audit("sign", ca.Cert, err)
+	if err != nil {
+		return "", err
+	}
+
+	return sshAuthorizedKey(cert, comment), nil
+}
+
+// SSHAgent serves the keys of every token within the keystore over the ssh-agent protocol on a Unix socket, readable
+// only by the current user, until interrupted.  Certificates read from certPaths are offered alongside the keys they
+// certify.
+func (c *Core) SSHAgent(socket string, certPaths []string) error {
+	// a daemon holding its locks must never wait upon the terminal
+	c.interactive = false
+
+	backend, stopMetrics, err := c.startMetrics(c.getBackend())
+	if err != nil {
+		return err
+	}
+	defer stopMetrics()
+
+	stopProfiling, err := c.startProfiling()
+	if err != nil {
+		return err
+	}
+	defer stopProfiling()
+
+	a := &sshAgent{core: c, backend: backend, signers: map[string]ssh.Signer{}, owners: map[string]*x509.Certificate{}}
+
+	for _, path := range certPaths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		cert, ok := pub.(*ssh.Certificate)
+		if !ok {
+			return fmt.Errorf("%s is not an SSH certificate", path)
+		}
+		a.certs = append(a.certs, cert)
+	}
+
+	// fail early, and report any certificate matching none of the tokens
+	keys, err := a.List()
+	if err != nil {
+		return err
+	}
+	for _, cert := range a.certs {
+		found := false
+		for _, key := range keys {
+			found = found || bytes.Equal(key.Blob, cert.Marshal())
+		}
+		if !found {
+			return fmt.Errorf("certificate %q does not certify the key of any security token", cert.KeyId)
+		}
+	}
+
+	if socket == "" {
+		socket, err = runtimeSocket("ssh-agent.sock")
+		if err != nil {
+			return err
+		}
+	}
+
+	l, err := listenPrivateSocket(socket, "an ssh agent")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(socket)
+	}()
+
+	fmt.Printf("SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;\n", socket)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-sigs:
+		case <-done:
+		}
+		_ = l.Close()
+	}()
+	defer close(done)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			_ = agent.ServeAgent(a, conn)
+		}()
+	}
+}
+
+var errSSHAgentReadOnly = errors.New("the keys of security tokens are managed with generate and delete")
+
+// sshAgent implements the ssh-agent protocol over the tokens of a backend.  Keys are enumerated afresh for each
+// listing, so tokens generated while the agent runs are offered straight away.
+type sshAgent struct {
+	mu      sync.Mutex
+	core    *Core
+	backend Backend
+	certs   []*ssh.Certificate
+	// signers maps the wire format of each public key to its signer, and owners to the certificate of its token
+	signers map[string]ssh.Signer
+	owners  map[string]*x509.Certificate
+}
+
+func (a *sshAgent) List() ([]*agent.Key, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	certs, err := a.backend.Certificates()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*agent.Key
+	for _, cert := range certs {
+		signer, err := a.signer(cert)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", HexEncode(cert.SerialNumber.Bytes()), err)
+		}
+		pub := signer.PublicKey()
+		comment := ComputeMRN(cert)
+
+		keys = append(keys, &agent.Key{Format: pub.Type(), Blob: pub.Marshal(), Comment: comment})
+		for _, sshCert := range a.certs {
+			if bytes.Equal(sshCert.Key.Marshal(), pub.Marshal()) {
+				keys = append(keys, &agent.Key{Format: sshCert.Type(), Blob: sshCert.Marshal(), Comment: comment})
+				a.signers[string(sshCert.Marshal())] = signer
+				a.owners[string(sshCert.Marshal())] = cert
+			}
+		}
+	}
+	return keys, nil
+}
+
+// signer returns the signer of the token holding cert, which the caller must hold the lock to call
+func (a *sshAgent) signer(cert *x509.Certificate) (ssh.Signer, error) {
+	pub, err := ssh.NewPublicKey(cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if signer, ok := a.signers[string(pub.Marshal())]; ok {
+		a.core.metrics.inc("manetu_cache_requests_total", labels("cache", "ssh", "result", "hit"))
+		return signer, nil
+	}
+	a.core.metrics.inc("manetu_cache_requests_total", labels("cache", "ssh", "result", "miss"))
+
+	token, err := a.backend.FindToken(cert.SerialNumber.Bytes())
+	if err == nil {
+		token, err = a.core.fipsToken(token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, errors.New("invalid serial number")
+	}
+
+	signer, err := ssh.NewSignerFromSigner(token.Signer)
+	if err != nil {
+		return nil, err
+	}
+	a.signers[string(pub.Marshal())] = signer
+	a.owners[string(pub.Marshal())] = cert
+	return signer, nil
+}
+
+func (a *sshAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *sshAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	signer, ok := a.signers[string(key.Marshal())]
+	if !ok {
+		return nil, errors.New("no security token holds the requested key")
+	}
+
+	// RSA keys default to SHA-1 signatures, which servers increasingly refuse, unless the client asks otherwise
+	algorithm := ""
+	switch {
+	case flags&agent.SignatureFlagRsaSha256 != 0:
+		algorithm = ssh.KeyAlgoRSASHA256
+	case flags&agent.SignatureFlagRsaSha512 != 0:
+		algorithm = ssh.KeyAlgoRSASHA512
+	}
+
+	var (
+		sig *ssh.Signature
+		err error
+	)
+	if as, ok := signer.(ssh.AlgorithmSigner); ok && algorithm != "" {
+		sig, err = as.SignWithAlgorithm(rand.Reader, data, algorithm)
+	} else {
+		sig, err = signer.Sign(rand.Reader, data)
+	}
+	a.core.audit("sign", a.owners[string(key.Marshal())], err)
+	return sig, err
+}
+
+func (a *sshAgent) Signers() ([]ssh.Signer, error) {
+	if _, err := a.List(); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var signers []ssh.Signer
+	for _, signer := range a.signers {
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+func (a *sshAgent) Extension(string, []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+func (a *sshAgent) Add(agent.AddedKey) error       { return errSSHAgentReadOnly }
+func (a *sshAgent) Remove(ssh.PublicKey) error     { return errSSHAgentReadOnly }
+func (a *sshAgent) RemoveAll() error               { return errSSHAgentReadOnly }
+func (a *sshAgent) Lock(passphrase []byte) error   { return errSSHAgentReadOnly }
+func (a *sshAgent) Unlock(passphrase []byte) error { return errSSHAgentReadOnly }
@@ -0,0 +1,111 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// state holds settings recorded by commands such as use, persisted between invocations in $HOME/.manetu/state.json
+type state struct {
+	// Defaults maps each profile to the serial number of its default token.  The top-level configuration is recorded
+	// under the empty name.
+	Defaults map[string]string `json:"defaults,omitempty"`
+}
+
+func statePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".manetu", "state.json"), nil
+}
+
+// loadState reads the persisted state, which is empty if nothing has been recorded
+func loadState() (*state, error) {
+	s := &state{Defaults: make(map[string]string)}
+
+	path, err := statePath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Clean(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		return nil, err
+	}
+	if s.Defaults == nil {
+		s.Defaults = make(map[string]string)
+	}
+
+	return s, nil
+}
+
+func (s *state) save() error {
+	path, err := statePath()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0600)
+}
+
+// Use records serial as the default token of the selected profile, used when a command is given no serial
+func (c *Core) Use(serial string) error {
+	token, err := c.getToken(serial)
+	if err != nil {
+		return err
+	}
+
+	s, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	s.Defaults[c.profile] = HexEncode(token.Cert.SerialNumber.Bytes())
+	return s.save()
+}
+
+// ClearDefault forgets the default token of the selected profile
+func (c *Core) ClearDefault() error {
+	s, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	delete(s.Defaults, c.profile)
+	return s.save()
+}
+
+// DefaultToken returns the serial number of the default token of the selected profile, or "" if none is recorded
+func (c *Core) DefaultToken() (string, error) {
+	s, err := loadState()
+	if err != nil {
+		return "", err
+	}
+
+	return s.Defaults[c.profile], nil
+}
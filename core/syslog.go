@@ -0,0 +1,21 @@
+//go:build !windows
+
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+// openSyslog connects to the local system log, tagging messages with the name of the program
+func openSyslog() (alertSink, error) {
+	w, err := syslog.New(syslog.LOG_WARNING|syslog.LOG_DAEMON, "manetu-security-token")
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to syslog: %w", err)
+	}
+	return w, nil
+}
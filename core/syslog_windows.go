@@ -0,0 +1,13 @@
+//go:build windows
+
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import "errors"
+
+func openSyslog() (alertSink, error) {
+	return nil, classify(ExitConfig, errors.New("syslog is not available on Windows"))
+}
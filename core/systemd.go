@@ -0,0 +1,139 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// systemdListenFD is the first file descriptor passed by socket activation
+const systemdListenFD = 3
+
+// systemdListener returns the socket passed to the process by systemd socket activation, or nil when the process was
+// started otherwise.  The environment describing the socket is cleared, so that it is not inherited by children.
+func systemdListener() (net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	n, err := strconv.Atoi(fds)
+	if err != nil {
+		return nil, errors.New("invalid LISTEN_FDS from systemd")
+	}
+	if n != 1 {
+		return nil, errors.New("socket activation must pass exactly one socket")
+	}
+
+	f := os.NewFile(uintptr(systemdListenFD), "LISTEN_FD_3")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// sdNotify sends state, such as "READY=1", to the service manager, doing nothing unless run by systemd with
+// Type=notify
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		// an abstract socket
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns half the watchdog timeout configured by WatchdogSec=, or zero when the watchdog is off
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// keystoreLock serializes the calls of a daemon to its keystore, recording when it was taken, so that the watchdog can
+// tell a call that hangs from one that is merely in progress without ever waiting for the lock itself
+type keystoreLock struct {
+	mu sync.Mutex
+	// since is the time in Unix nanoseconds at which the lock was taken, or zero while it is free
+	since int64
+}
+
+func (l *keystoreLock) Lock() {
+	l.mu.Lock()
+	atomic.StoreInt64(&l.since, time.Now().UnixNano())
+}
+
+func (l *keystoreLock) Unlock() {
+	atomic.StoreInt64(&l.since, 0)
+	l.mu.Unlock()
+}
+
+// heldFor returns how long the lock has been held, or zero while it is free
+func (l *keystoreLock) heldFor() time.Duration {
+	since := atomic.LoadInt64(&l.since)
+	if since == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, since))
+}
+
+// startWatchdog pings the systemd watchdog until the returned function is called.  The pings stop while live has been
+// held for longer than the watchdog timeout, so that a call hung in the HSM has systemd restart the service, while
+// the pings themselves never wait upon live and go on however busy the service is.
+func startWatchdog(live *keystoreLock) func() {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			// the interval is half the timeout
+			if live.heldFor() > 2*interval {
+				continue
+			}
+			_ = sdNotify("WATCHDOG=1")
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,68 @@
+//go:build !windows
+
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestWatchdog pings while requests contend for the keystore, and stops only while a call holds it past the timeout
+func TestWatchdog(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", addr)
+	t.Setenv("WATCHDOG_USEC", "100000")
+	t.Setenv("WATCHDOG_PID", "")
+
+	pinged := func(within time.Duration) bool {
+		_ = conn.SetReadDeadline(time.Now().Add(within))
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return false
+			}
+			if string(buf[:n]) == "WATCHDOG=1" {
+				return true
+			}
+		}
+	}
+
+	var live keystoreLock
+	stop := startWatchdog(&live)
+	defer stop()
+
+	if !pinged(500 * time.Millisecond) {
+		t.Fatal("no ping while the keystore was idle")
+	}
+
+	// a call in progress within the timeout does not stop the pings
+	live.Lock()
+	if !pinged(80 * time.Millisecond) {
+		t.Error("no ping while a call was in progress")
+	}
+
+	// once held past the timeout, the call is taken to be hung
+	time.Sleep(150 * time.Millisecond)
+	for pinged(5 * time.Millisecond) {
+	}
+	if pinged(150 * time.Millisecond) {
+		t.Error("pinged while a call was hung")
+	}
+
+	live.Unlock()
+	if !pinged(500 * time.Millisecond) {
+		t.Error("no ping once the call completed")
+	}
+}
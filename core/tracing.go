@@ -0,0 +1,94 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"context"
+	"crypto"
+	"io"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans of this package to the TracerProvider
+const tracerName = "github.com/manetu/security-token/core"
+
+// SetTracerProvider records the spans of logins and the HSM operations they perform with tp, rather than with the
+// global provider of otel.GetTracerProvider, which records nothing unless the program has set one
+func (c *Core) SetTracerProvider(tp trace.TracerProvider) {
+	c.tracerProvider = tp
+}
+
+func (c *Core) tracer() trace.Tracer {
+	tp := c.tracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// endSpan marks span as failed when err is set, then ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedSigner records a span for each signature made with an HSM held key, within the trace of ctx
+type tracedSigner struct {
+	crypto.Signer
+	ctx    context.Context
+	tracer trace.Tracer
+}
+
+func (s *tracedSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	_, span := s.tracer.Start(s.ctx, "hsm.sign")
+	sig, err := s.Signer.Sign(rand, digest, opts)
+	endSpan(span, err)
+	return sig, err
+}
+
+// tracingTransport records a client span for each request made during a login, and propagates its trace context to
+// the server in the request headers
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	ctx, span := tracer.Start(ctx, "HTTP "+req.Method, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", req.URL.Redacted()),
+		))
+
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		logDebug("HTTP "+req.Method, "url", req.URL.Redacted(), "duration", time.Since(start), "error", err)
+		endSpan(span, err)
+		return nil, err
+	}
+	logDebug("HTTP "+req.Method, "url", req.URL.Redacted(), "status", resp.StatusCode, "duration", time.Since(start))
+
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	span.End()
+	return resp, nil
+}
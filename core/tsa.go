@@ -0,0 +1,268 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/manetu/security-token/config"
+)
+
+var (
+	oidTSTInfo                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidAttributeTimeStampToken = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 14}
+)
+
+// TimestampOptions selects the RFC 3161 time-stamping authority (TSA) from which timestamps are obtained
+type TimestampOptions struct {
+	// URL of the TSA, defaulting to tsa.url of the configuration file
+	URL string
+	// CACert names the PEM encoded certificates trusted to issue the certificate of the TSA, defaulting to tsa.caCert
+	// of the configuration file.  Without any, the signature of the timestamp is checked but not the identity of the TSA.
+	CACert   string
+	Insecure bool
+}
+
+type tsaMessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+// tsaRequest is the TimeStampReq of RFC 3161, section 2.4.1
+type tsaRequest struct {
+	Version        int
+	MessageImprint tsaMessageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional"`
+}
+
+// tsaResponse is the TimeStampResp of RFC 3161, section 2.4.2
+type tsaResponse struct {
+	Status struct {
+		Status       int
+		StatusString []string       `asn1:"optional,utf8"`
+		FailInfo     asn1.BitString `asn1:"optional"`
+	}
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+// tstInfo is the TSTInfo of RFC 3161, section 2.4.2, keeping the parts not checked raw
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint tsaMessageImprint
+	SerialNumber   *big.Int
+	GenTime        asn1.RawValue
+	Accuracy       asn1.RawValue `asn1:"optional"`
+	Ordering       bool          `asn1:"optional"`
+	Nonce          *big.Int      `asn1:"optional"`
+	TSA            asn1.RawValue `asn1:"optional,tag:0"`
+	Extensions     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// Timestamp obtains a timestamp over data, typically a signature, from the TSA, so that the signature remains
+// verifiable after the certificate of the token has expired.  It returns the DER encoded TimeStampResp, as verified by
+// "openssl ts -verify", and the time at which the TSA saw data.
+func (c *Core) Timestamp(data []byte, opts TimestampOptions) ([]byte, time.Time, error) {
+	resp, _, genTime, err := c.timestamp(data, opts)
+	return resp, genTime, err
+}
+
+// timestamp obtains and checks a timestamp over the SHA-256 digest of data, returning the TimeStampResp, the
+// TimeStampToken within it and the time of the timestamp
+func (c *Core) timestamp(data []byte, opts TimestampOptions) ([]byte, []byte, time.Time, error) {
+	var none time.Time
+	var tsa config.TSAConfiguration
+	if opts.URL == "" || opts.CACert == "" {
+		// only a timestamp needs the configuration file, when the TSA is not given
+		if cfg, err := c.readConfig(); err == nil {
+			tsa = cfg.Tsa
+		} else if opts.URL == "" {
+			return nil, nil, none, classify(ExitConfig, err)
+		}
+	}
+	url := orDefault(opts.URL, tsa.URL)
+	if url == "" {
+		return nil, nil, none, classify(ExitConfig, errors.New("no TSA configured: set tsa.url or give --tsa"))
+	}
+
+	digest := crypto.SHA256.New()
+	digest.Write(data)
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, nil, none, err
+	}
+	req := tsaRequest{
+		Version: 1,
+		MessageImprint: tsaMessageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			HashedMessage: digest.Sum(nil),
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	}
+	if tsa.Policy != "" {
+		req.ReqPolicy, err = parseOID(tsa.Policy)
+		if err != nil {
+			return nil, nil, none, classify(ExitConfig, fmt.Errorf("tsa.policy: %w", err))
+		}
+	}
+	body, err := asn1.Marshal(req)
+	if err != nil {
+		return nil, nil, none, err
+	}
+
+	stop := c.startSpinner("Requesting timestamp...")
+	resp, err := postTimestampQuery(newHTTPClient(opts.Insecure), url, body)
+	stop()
+	if err != nil {
+		return nil, nil, none, classify(ExitUnreachable, err)
+	}
+
+	var tr tsaResponse
+	_, err = asn1.Unmarshal(resp, &tr)
+	if err != nil {
+		return nil, nil, none, fmt.Errorf("tsa: %w", err)
+	}
+	// granted, or granted with modifications
+	if tr.Status.Status > 1 || len(tr.TimeStampToken.FullBytes) == 0 {
+		return nil, nil, none, fmt.Errorf("tsa: timestamp refused with status %d: %s", tr.Status.Status, strings.Join(tr.Status.StatusString, "; "))
+	}
+
+	genTime, err := checkTimestampToken(tr.TimeStampToken.FullBytes, req, orDefault(opts.CACert, tsa.CACert))
+	if err != nil {
+		return nil, nil, none, fmt.Errorf("tsa: %w", err)
+	}
+
+	return resp, tr.TimeStampToken.FullBytes, genTime, nil
+}
+
+func postTimestampQuery(client *http.Client, url string, body []byte) ([]byte, error) {
+	resp, err := client.Post(url, "application/timestamp-query", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return data, nil
+}
+
+// checkTimestampToken checks that token is signed by a TSA, over the imprint and nonce of req, returning the time of
+// the timestamp.  The certificate of the TSA is verified against the certificates in caCert, when given.
+func checkTimestampToken(token []byte, req tsaRequest, caCert string) (time.Time, error) {
+	var none time.Time
+	sd, err := parseSignedData(token)
+	if err != nil {
+		return none, err
+	}
+	var encap contentInfo
+	_, err = asn1.Unmarshal(sd.ContentInfo.FullBytes, &encap)
+	if err != nil || !encap.ContentType.Equal(oidTSTInfo) {
+		return none, errors.New("the timestamp token does not hold a TSTInfo")
+	}
+	content, err := sd.signedContent()
+	if err != nil {
+		return none, err
+	}
+	var info tstInfo
+	_, err = asn1.Unmarshal(content, &info)
+	if err != nil {
+		return none, err
+	}
+	if !bytes.Equal(info.MessageImprint.HashedMessage, req.MessageImprint.HashedMessage) ||
+		info.Nonce == nil || info.Nonce.Cmp(req.Nonce) != 0 {
+		return none, errors.New("the timestamp does not answer the request")
+	}
+	genTime, err := time.Parse("20060102150405Z0700", string(info.GenTime.Bytes))
+	if err != nil {
+		return none, fmt.Errorf("malformed time %q", info.GenTime.Bytes)
+	}
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return none, fmt.Errorf("tsa: error parsing the certificates of the response: %w", err)
+	}
+	infos, err := sd.signerInfos()
+	if err != nil {
+		return none, err
+	}
+	if len(infos) != 1 {
+		return none, fmt.Errorf("expected one signer, found %d", len(infos))
+	}
+	cert := signerCertificate(infos[0], certs)
+	if cert == nil {
+		return none, errors.New("the certificate of the TSA is missing")
+	}
+	_, err = verifySignerInfo(infos[0], cert, content)
+	if err != nil {
+		return none, err
+	}
+
+	if caCert == "" {
+		logWarn("the TSA is not authenticated; set tsa.caCert to do so", "tsa", cert.Subject.CommonName)
+		return genTime, nil
+	}
+	data, err := os.ReadFile(caCert)
+	if err != nil {
+		return none, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return none, fmt.Errorf("no certificates found in %s", caCert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs {
+		intermediates.AddCert(cert)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   genTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	})
+	if err != nil {
+		return none, classify(ExitAuth, fmt.Errorf("the TSA is not trusted: %w", err))
+	}
+
+	return genTime, nil
+}
+
+// parseOID parses the dotted form of an object identifier
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	var oid asn1.ObjectIdentifier
+	for _, part := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("malformed OID %q", s)
+		}
+		oid = append(oid, n)
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("malformed OID %q", s)
+	}
+	return oid, nil
+}
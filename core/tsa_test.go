@@ -0,0 +1,125 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The files of testdata/tsa were made by OpenSSL 3.0: req.tsq by "openssl ts -query -data data.bin -sha256 -cert",
+// and token.der by "openssl ts -reply -token_out" from a TSA whose certificate, with a critical timeStamping extended
+// key usage, is issued by the root of ca.pem.
+func readTSA(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "tsa", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCheckTimestampToken(t *testing.T) {
+	token := readTSA(t, "token.der")
+	var req tsaRequest
+	_, err := asn1.Unmarshal(readTSA(t, "req.tsq"), &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest := sha256.Sum256(readTSA(t, "data.bin")); string(req.MessageImprint.HashedMessage) != string(digest[:]) {
+		t.Fatal("req.tsq does not ask for a timestamp over data.bin")
+	}
+	caCert := filepath.Join("testdata", "tsa", "ca.pem")
+
+	genTime, err := checkTimestampToken(token, req, caCert)
+	if err != nil {
+		t.Fatalf("checkTimestampToken: %v", err)
+	}
+	if genTime.Year() < 2020 || genTime.After(time.Now()) {
+		t.Errorf("genTime = %v", genTime)
+	}
+
+	// without a CA, the signature alone is checked
+	_, err = checkTimestampToken(token, req, "")
+	if err != nil {
+		t.Errorf("checkTimestampToken without a CA: %v", err)
+	}
+
+	other := req
+	other.Nonce = new(big.Int).Add(req.Nonce, big.NewInt(1))
+	_, err = checkTimestampToken(token, other, caCert)
+	if err == nil {
+		t.Error("a timestamp answering another nonce was accepted")
+	}
+
+	other = req
+	other.MessageImprint.HashedMessage = make([]byte, sha256.Size)
+	_, err = checkTimestampToken(token, other, caCert)
+	if err == nil {
+		t.Error("a timestamp over another digest was accepted")
+	}
+
+	// a TSA not issued by the CA given
+	_, ca := testCA(t, "Another Root")
+	another := filepath.Join(t.TempDir(), "another.pem")
+	err = os.WriteFile(another, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkTimestampToken(token, req, another)
+	if ExitCode(err) != ExitAuth {
+		t.Errorf("checkTimestampToken against another CA = %v; want exit code %d", err, ExitAuth)
+	}
+
+	// a SignedData holding no TSTInfo
+	sd, err := certsOnly(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkTimestampToken(sd, req, caCert)
+	if err == nil {
+		t.Error("a SignedData holding no TSTInfo was accepted")
+	}
+
+	corrupt := append([]byte(nil), token...)
+	corrupt[len(corrupt)-1] ^= 0x01
+	_, err = checkTimestampToken(corrupt, req, caCert)
+	if err == nil {
+		t.Error("a timestamp with a corrupt signature was accepted")
+	}
+}
+
+func TestParseOID(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want asn1.ObjectIdentifier
+	}{
+		{"1.3.6.1.4.1.4146.2.3", asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 4146, 2, 3}},
+		{"2.5", asn1.ObjectIdentifier{2, 5}},
+		{"1", nil},
+		{"", nil},
+		{"1..2", nil},
+		{"1.-2", nil},
+		{"1.two", nil},
+	} {
+		got, err := parseOID(tt.in)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseOID(%q) = %v; want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseOID(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
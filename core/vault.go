@@ -0,0 +1,349 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/manetu/security-token/config"
+)
+
+func init() {
+	RegisterBackend("vault", newVaultBackend)
+}
+
+// vaultBackend delegates signing to the transit secrets engine of HashiCorp Vault, with certificates kept in a KV
+// version 2 secrets engine, so organizations standardized on Vault can use it as the key custodian.
+type vaultBackend struct {
+	address   string
+	token     string
+	namespace string
+	mount     string
+	client    *http.Client
+	certs     certStore
+}
+
+func newVaultBackend(cfg *config.Configuration) (Backend, error) {
+	c := cfg.Vault
+
+	address := c.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if address == "" {
+		return nil, errors.New("vault.address or VAULT_ADDR must be configured")
+	}
+
+	token := c.Token
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if token == "" {
+		// the token helper used by the vault CLI after "vault login"
+		home, err := os.UserHomeDir()
+		if err == nil {
+			b, err := os.ReadFile(filepath.Join(home, ".vault-token"))
+			if err == nil {
+				token = strings.TrimSpace(string(b))
+			}
+		}
+	}
+	if token == "" {
+		return nil, errors.New("no Vault token found")
+	}
+
+	namespace := c.Namespace
+	if namespace == "" {
+		namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+
+	b := &vaultBackend{
+		address:   strings.TrimSuffix(address, "/"),
+		token:     token,
+		namespace: namespace,
+		mount:     orDefault(c.Mount, "transit"),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+	b.certs = &vaultCertStore{
+		backend: b,
+		mount:   orDefault(c.KvMount, "secret"),
+		path:    orDefault(c.KvPath, "manetu-security-tokens"),
+	}
+
+	return b, nil
+}
+
+func orDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// do issues a request against the Vault HTTP API.  It returns errNotFound for 404 responses.
+func (b *vaultBackend) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, b.address+"/v1/"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", b.token)
+	if b.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", b.namespace)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Errors []string
+		}
+		if json.Unmarshal(data, &e) != nil || len(e.Errors) == 0 {
+			return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return fmt.Errorf("vault: %s", strings.Join(e.Errors, "; "))
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func vaultKeyName(id []byte) string {
+	return "mst-" + hex.EncodeToString(id)
+}
+
+func (b *vaultBackend) Generate(id []byte) (crypto.Signer, error) {
+	name := vaultKeyName(id)
+
+	err := b.do(http.MethodPost, b.mount+"/keys/"+name, map[string]interface{}{
+		"type":       "ecdsa-p256",
+		"exportable": false,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var key struct {
+		Data struct {
+			Keys map[string]struct {
+				PublicKey string `json:"public_key"`
+			}
+		}
+	}
+	err = b.do(http.MethodGet, b.mount+"/keys/"+name, nil, &key)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(key.Data.Keys["1"].PublicKey))
+	if block == nil {
+		return nil, errors.New("error decoding public key")
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the public key: %w", err)
+	}
+
+	return &vaultSigner{backend: b, name: name, pub: pub}, nil
+}
+
+func (b *vaultBackend) ImportCertificate(id []byte, cert *x509.Certificate) error {
+	return b.certs.Put(id, cert)
+}
+
+func (b *vaultBackend) Certificates() ([]*x509.Certificate, error) {
+	return b.certs.List()
+}
+
+func (b *vaultBackend) FindToken(id []byte) (*Token, error) {
+	cert, err := b.certs.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return nil, nil
+	}
+
+	return &Token{
+		Signer: &vaultSigner{backend: b, name: vaultKeyName(id), pub: cert.PublicKey},
+		Cert:   cert,
+	}, nil
+}
+
+func (b *vaultBackend) Delete(id []byte) error {
+	err := b.certs.Delete(id)
+	if err != nil {
+		return err
+	}
+
+	name := vaultKeyName(id)
+
+	// transit keys are protected from deletion until explicitly allowed
+	err = b.do(http.MethodPost, b.mount+"/keys/"+name+"/config", map[string]bool{
+		"deletion_allowed": true,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	return b.do(http.MethodDelete, b.mount+"/keys/"+name, nil, nil)
+}
+
+func (b *vaultBackend) Close() error {
+	return nil
+}
+
+// vaultSigner implements crypto.Signer by delegating to the transit sign endpoint
+type vaultSigner struct {
+	backend *vaultBackend
+	name    string
+	pub     crypto.PublicKey
+}
+
+func (s *vaultSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *vaultSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+	}
+
+	var signed struct {
+		Data struct {
+			Signature string
+		}
+	}
+	err := s.backend.do(http.MethodPost, s.backend.mount+"/sign/"+s.name+"/sha2-256", map[string]interface{}{
+		"input":                base64.StdEncoding.EncodeToString(digest),
+		"prehashed":            true,
+		"marshaling_algorithm": "asn1",
+	}, &signed)
+	if err != nil {
+		return nil, err
+	}
+
+	// signatures are returned as vault:v<version>:<base64 DER>
+	parts := strings.SplitN(signed.Data.Signature, ":", 3)
+	if len(parts) != 3 {
+		return nil, errors.New("malformed signature returned by vault")
+	}
+
+	return base64.StdEncoding.DecodeString(parts[2])
+}
+
+// vaultCertStore keeps certificates in a KV version 2 secrets engine under <mount>/<path>/<hex id>
+type vaultCertStore struct {
+	backend *vaultBackend
+	mount   string
+	path    string
+}
+
+func (s *vaultCertStore) secret(kind string, id string) string {
+	return s.mount + "/" + kind + "/" + s.path + "/" + id
+}
+
+func (s *vaultCertStore) Put(id []byte, cert *x509.Certificate) error {
+	return s.backend.do(http.MethodPost, s.secret("data", hex.EncodeToString(id)), map[string]interface{}{
+		"data": map[string]string{
+			"certificate": ExportCert(cert),
+		},
+	}, nil)
+}
+
+func (s *vaultCertStore) get(id string) (*x509.Certificate, error) {
+	var secret struct {
+		Data struct {
+			Data struct {
+				Certificate string
+			}
+		}
+	}
+	err := s.backend.do(http.MethodGet, s.secret("data", id), nil, &secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCertPEM([]byte(secret.Data.Data.Certificate))
+}
+
+func (s *vaultCertStore) Get(id []byte) (*x509.Certificate, error) {
+	cert, err := s.get(hex.EncodeToString(id))
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+	return cert, err
+}
+
+func (s *vaultCertStore) List() ([]*x509.Certificate, error) {
+	var list struct {
+		Data struct {
+			Keys []string
+		}
+	}
+	err := s.backend.do("LIST", s.mount+"/metadata/"+s.path, nil, &list)
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for _, key := range list.Data.Keys {
+		cert, err := s.get(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+func (s *vaultCertStore) Delete(id []byte) error {
+	err := s.backend.do(http.MethodDelete, s.secret("metadata", hex.EncodeToString(id)), nil, nil)
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,166 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// VaultLoginOptions selects the Vault server and auth method used by VaultLogin
+type VaultLoginOptions struct {
+	// Address of the Vault server, defaulting to vault.address of the configuration file, then VAULT_ADDR
+	Address string
+	// Namespace of Vault Enterprise, defaulting to vault.namespace of the configuration file, then VAULT_NAMESPACE
+	Namespace string
+	// CACert names the PEM encoded CA certificates of the server, defaulting to VAULT_CACERT or the system roots
+	CACert   string
+	Insecure bool
+	// Method is "cert", presenting the certificate of the token for TLS client authentication, or "jwt"
+	Method string
+	// Mount is the path of the auth method, defaulting to the name of the method
+	Mount string
+	// Role names the role to log in as; the cert method tries every role when it is empty
+	Role string
+	// ManetuURL, when set with the jwt method, presents an access token acquired from Manetu.  Otherwise the JWT is an
+	// assertion signed by the token itself for Audience, to be verified with jwt_validation_pubkeys.
+	ManetuURL string
+	Audience  string
+}
+
+// VaultLogin authenticates to Vault with the token identified by serial, so that access to secrets is rooted in the
+// same hardware identity, and returns the Vault token
+func (c *Core) VaultLogin(serial string, opts VaultLoginOptions) (token string, err error) {
+	t, err := c.getToken(serial)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		c.audit("vault-login", t.Cert, err)
+	}()
+
+	address := firstNonEmpty(opts.Address, c.configuration.Vault.Address, os.Getenv("VAULT_ADDR"))
+	if address == "" {
+		return "", classify(ExitConfig, errors.New("--address, vault.address or VAULT_ADDR must be given"))
+	}
+	namespace := firstNonEmpty(opts.Namespace, c.configuration.Vault.Namespace, os.Getenv("VAULT_NAMESPACE"))
+
+	tlsConfig := &tls.Config{
+		// #nosec: G402 this is users choice, typically in a dev/test setting
+		InsecureSkipVerify: opts.Insecure,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if caCert := firstNonEmpty(opts.CACert, os.Getenv("VAULT_CACERT")); caCert != "" {
+		data, err := os.ReadFile(caCert)
+		if err != nil {
+			return "", err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return "", fmt.Errorf("no certificates found in %s", caCert)
+		}
+	}
+
+	body := map[string]string{}
+	switch opts.Method {
+	case "cert":
+		tlsConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{t.Cert.Raw}, PrivateKey: t.Signer, Leaf: t.Cert}}
+		if opts.Role != "" {
+			body["name"] = opts.Role
+		}
+	case "jwt":
+		if opts.Role == "" {
+			return "", classify(ExitConfig, errors.New("the jwt method requires --role"))
+		}
+		var jwt string
+		if opts.ManetuURL != "" {
+			jwt, err = c.Login(opts.ManetuURL, opts.Insecure, t.Signer, t.Cert)
+		} else {
+			var clock Clock
+			clock, err = c.getClock()
+			if err != nil {
+				return "", err
+			}
+			jwt, err = createJWT(clock, t.Signer, c.assertionDigest, ComputeMRN(t.Cert), opts.Audience)
+		}
+		if err != nil {
+			return "", err
+		}
+		body["role"] = opts.Role
+		body["jwt"] = jwt
+	default:
+		return "", classify(ExitConfig, fmt.Errorf("unknown auth method %q (available: cert, jwt)", opts.Method))
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+
+	mount := strings.Trim(orDefault(opts.Mount, opts.Method), "/")
+	url := strings.TrimSuffix(address, "/") + "/v1/auth/" + mount + "/login"
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}, Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", classify(ExitUnreachable, err)
+	}
+	defer resp.Body.Close()
+
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		Errors []string
+		Auth   struct {
+			ClientToken string `json:"client_token"`
+		}
+	}
+	_ = json.Unmarshal(data, &result)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := resp.Status
+		if len(result.Errors) > 0 {
+			msg = strings.Join(result.Errors, "; ")
+		}
+		err = fmt.Errorf("vault: %s", msg)
+		if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusForbidden {
+			return "", classify(ExitAuth, err)
+		}
+		return "", err
+	}
+	if result.Auth.ClientToken == "" {
+		return "", errors.New("vault: no client token in the response")
+	}
+
+	return result.Auth.ClientToken, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
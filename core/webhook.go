@@ -0,0 +1,228 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/manetu/security-token/config"
+)
+
+// The lifecycle events posted to webhooks
+const (
+	WebhookTokenCreated  = "token.created"
+	WebhookTokenDeleted  = "token.deleted"
+	WebhookTokenRotated  = "token.rotated"
+	WebhookTokenExpiring = "token.expiring"
+	WebhookJWTExpiring   = "jwt.expiring"
+	WebhookTest          = "test"
+)
+
+// webhookTimeout bounds each request, so that an unreachable webhook cannot hold up the operation it reports
+const webhookTimeout = 10 * time.Second
+
+// WebhookSignatureHeader carries the hex encoded HMAC-SHA256 of the body, keyed by the secret of the webhook
+const WebhookSignatureHeader = "X-Manetu-Signature"
+
+// WebhookEvent is the body posted to webhooks of the json format
+type WebhookEvent struct {
+	Event    string     `json:"event"`
+	Time     time.Time  `json:"time"`
+	Host     string     `json:"host"`
+	Serial   string     `json:"serial,omitempty"`
+	MRN      string     `json:"mrn,omitempty"`
+	Realm    string     `json:"realm,omitempty"`
+	NotAfter *time.Time `json:"not_after,omitempty"`
+	// Previous and PreviousMRN identify the token, or certificate, replaced by a rotation
+	Previous    string `json:"previous,omitempty"`
+	PreviousMRN string `json:"previous_mrn,omitempty"`
+	// File names the file holding the JWT of a jwt.expiring event
+	File string `json:"file,omitempty"`
+}
+
+func newWebhookEvent(event string, cert *x509.Certificate) WebhookEvent {
+	e := WebhookEvent{Event: event, Time: time.Now().UTC()}
+	e.Host, _ = os.Hostname()
+	if cert != nil {
+		e.Serial = HexEncode(cert.SerialNumber.Bytes())
+		notAfter := cert.NotAfter.UTC()
+		e.NotAfter = &notAfter
+		if len(cert.Subject.Organization) > 0 {
+			e.MRN = ComputeMRN(cert)
+			e.Realm = cert.Subject.Organization[0]
+		}
+	}
+	return e
+}
+
+// notify posts event for cert to the webhooks subscribed to it.  The operation has already happened by now, so a
+// failure to deliver is reported as a warning rather than failing the operation.
+func (c *Core) notify(event string, cert *x509.Certificate) {
+	c.notifyEvent(newWebhookEvent(event, cert))
+}
+
+func (c *Core) notifyEvent(e WebhookEvent) {
+	c.Lock()
+	hooks := c.configuration.Webhooks
+	c.Unlock()
+
+	for _, hook := range hooks {
+		if !subscribed(hook, e.Event) {
+			continue
+		}
+		err := postWebhook(hook, e)
+		if err != nil {
+			logWarn("unable to notify the webhook", "url", hook.URL, "event", e.Event, "error", err)
+		}
+	}
+}
+
+func subscribed(hook config.WebhookConfiguration, event string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, e := range hook.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookText describes e in a sentence, for chat webhooks
+func webhookText(e WebhookEvent) string {
+	var what string
+	switch e.Event {
+	case WebhookTokenCreated:
+		what = "created"
+	case WebhookTokenDeleted:
+		what = "deleted"
+	case WebhookTokenRotated:
+		what = fmt.Sprintf("rotated, replacing %s (%s)", e.Previous, e.PreviousMRN)
+	case WebhookTokenExpiring:
+		if e.NotAfter == nil {
+			what = "is expiring"
+		} else if e.NotAfter.Before(e.Time) {
+			what = fmt.Sprintf("expired at %s", e.NotAfter.Format(time.RFC3339))
+		} else {
+			what = fmt.Sprintf("expires at %s", e.NotAfter.Format(time.RFC3339))
+		}
+	case WebhookJWTExpiring:
+		if e.NotAfter != nil && e.NotAfter.Before(e.Time) {
+			return fmt.Sprintf("JWT in %s on %s expired at %s", e.File, e.Host, e.NotAfter.Format(time.RFC3339))
+		}
+		return fmt.Sprintf("JWT in %s on %s expires at %s", e.File, e.Host, e.NotAfter.Format(time.RFC3339))
+	case WebhookTest:
+		return fmt.Sprintf("Test notification from manetu-security-token on %s", e.Host)
+	default:
+		what = e.Event
+	}
+
+	return fmt.Sprintf("Security token %s (%s) on %s %s", e.Serial, e.MRN, e.Host, what)
+}
+
+func postWebhook(hook config.WebhookConfiguration, e WebhookEvent) error {
+	var (
+		body []byte
+		err  error
+	)
+	switch hook.Format {
+	case "", "json":
+		body, err = json.Marshal(e)
+	case "slack":
+		body, err = json.Marshal(map[string]string{"text": webhookText(e)})
+	default:
+		return fmt.Errorf("unknown webhook format %q (available: json, slack)", hook.Format)
+	}
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write(body)
+		req.Header.Set(WebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := newHTTPClient(false)
+	client.Timeout = webhookTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// NotifyExpiring posts a token.expiring event for each token that expires within the duration, including those
+// already expired, returning the number of tokens reported.  Run from cron, it gives warning of certificates to renew.
+func (c *Core) NotifyExpiring(within time.Duration) (int, error) {
+	certs, err := c.getBackend().Certificates()
+	if err != nil {
+		return 0, err
+	}
+
+	deadline := time.Now().Add(within)
+	n := 0
+	for _, cert := range certs {
+		if cert.NotAfter.After(deadline) {
+			continue
+		}
+		if !c.quiet {
+			fmt.Fprintf(os.Stderr, "%s expires at %s\n", HexEncode(cert.SerialNumber.Bytes()), cert.NotAfter.UTC().Format(time.RFC3339))
+		}
+		c.notify(WebhookTokenExpiring, cert)
+		n++
+	}
+
+	return n, nil
+}
+
+// WebhookTest posts a test event to every configured webhook, whatever the events it subscribes to, failing on the
+// first that cannot be delivered
+func (c *Core) WebhookTest() error {
+	cfg, err := c.readConfig()
+	if err != nil {
+		return classify(ExitConfig, err)
+	}
+	if len(cfg.Webhooks) == 0 {
+		return classify(ExitConfig, errors.New("no webhooks are configured"))
+	}
+
+	e := newWebhookEvent(WebhookTest, nil)
+	for _, hook := range cfg.Webhooks {
+		err = postWebhook(hook, e)
+		if err != nil {
+			return fmt.Errorf("%s: %w", hook.URL, err)
+		}
+		if !c.quiet {
+			fmt.Fprintf(os.Stderr, "Notified %s\n", hook.URL)
+		}
+	}
+
+	return nil
+}
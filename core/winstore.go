@@ -0,0 +1,18 @@
+//go:build !windows
+
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/x509"
+	"errors"
+
+	"github.com/manetu/security-token/config"
+)
+
+func addToWindowsStore(_ config.CngConfiguration, _ []byte, _ []*x509.Certificate, _ WindowsStoreOptions) error {
+	return classify(ExitConfig, errors.New("the Windows certificate store is only available on Windows"))
+}
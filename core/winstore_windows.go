@@ -0,0 +1,145 @@
+//go:build windows
+
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/x509"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"github.com/manetu/security-token/config"
+)
+
+var (
+	crypt32 = syscall.NewLazyDLL("crypt32.dll")
+
+	certOpenStore                     = crypt32.NewProc("CertOpenStore")
+	certCloseStore                    = crypt32.NewProc("CertCloseStore")
+	certAddEncodedCertificateToStore  = crypt32.NewProc("CertAddEncodedCertificateToStore")
+	certSetCertificateContextProperty = crypt32.NewProc("CertSetCertificateContextProperty")
+	certFreeCertificateContext        = crypt32.NewProc("CertFreeCertificateContext")
+)
+
+const (
+	certStoreProvSystem         = 10
+	certSystemStoreCurrentUser  = 1 << 16
+	certSystemStoreLocalMachine = 2 << 16
+	certEncoding                = 0x00010001 // X509_ASN_ENCODING | PKCS_7_ASN_ENCODING
+	certStoreAddReplaceExisting = 3
+	certKeyProvInfoPropID       = 2
+	certFriendlyNamePropID      = 11
+)
+
+// cryptKeyProvInfo is CRYPT_KEY_PROV_INFO; a ProvType of zero names a CNG key storage provider
+type cryptKeyProvInfo struct {
+	ContainerName  *uint16
+	ProvName       *uint16
+	ProvType       uint32
+	Flags          uint32
+	ProvParamCount uint32
+	ProvParam      uintptr
+	KeySpec        uint32
+}
+
+type cryptDataBlob struct {
+	Size uint32
+	Data *uint16
+}
+
+// openSystemStore opens the named system store of the user or machine
+func openSystemStore(name string, machine bool) (uintptr, error) {
+	n, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	flags := uintptr(certSystemStoreCurrentUser)
+	if machine {
+		flags = certSystemStoreLocalMachine
+	}
+	store, _, err := certOpenStore.Call(certStoreProvSystem, 0, 0, flags, uintptr(unsafe.Pointer(n)))
+	if store == 0 {
+		return 0, fmt.Errorf("error opening the %s store: %w", name, err)
+	}
+	return store, nil
+}
+
+// addEncodedCertificate adds cert to store, returning its context, which the caller must free
+func addEncodedCertificate(store uintptr, cert *x509.Certificate) (uintptr, error) {
+	var ctx uintptr
+	r, _, err := certAddEncodedCertificateToStore.Call(store, certEncoding, uintptr(unsafe.Pointer(&cert.Raw[0])),
+		uintptr(len(cert.Raw)), certStoreAddReplaceExisting, uintptr(unsafe.Pointer(&ctx)))
+	if r == 0 {
+		return 0, fmt.Errorf("error adding %s: %w", cert.Subject, err)
+	}
+	return ctx, nil
+}
+
+func addToWindowsStore(cfg config.CngConfiguration, id []byte, chain []*x509.Certificate, opts WindowsStoreOptions) error {
+	provider := orDefault(opts.Provider, orDefault(cfg.Provider, cngDefaultProvider))
+	container := orDefault(opts.Container, cngKeyName(id))
+
+	info := cryptKeyProvInfo{}
+	var err error
+	info.ProvName, err = syscall.UTF16PtrFromString(provider)
+	if err != nil {
+		return err
+	}
+	info.ContainerName, err = syscall.UTF16PtrFromString(container)
+	if err != nil {
+		return err
+	}
+	if cfg.MachineKey && opts.Container == "" {
+		info.Flags = cngMachineKeyFlag
+	}
+
+	my, err := openSystemStore("MY", opts.Machine)
+	if err != nil {
+		return err
+	}
+	defer certCloseStore.Call(my, 0)
+
+	ctx, err := addEncodedCertificate(my, chain[0])
+	if err != nil {
+		return err
+	}
+	defer certFreeCertificateContext.Call(ctx)
+
+	r, _, e := certSetCertificateContextProperty.Call(ctx, certKeyProvInfoPropID, 0, uintptr(unsafe.Pointer(&info)))
+	if r == 0 {
+		return fmt.Errorf("error linking the certificate to the key %s of %s: %v", container, provider, e)
+	}
+
+	friendly, err := syscall.UTF16FromString("Manetu " + ComputeMRN(chain[0]))
+	if err == nil {
+		blob := cryptDataBlob{Size: uint32(len(friendly) * 2), Data: &friendly[0]}
+		_, _, _ = certSetCertificateContextProperty.Call(ctx, certFriendlyNamePropID, 0, uintptr(unsafe.Pointer(&blob)))
+	}
+
+	if len(chain) < 2 {
+		return nil
+	}
+	ca, err := openSystemStore("CA", opts.Machine)
+	if err != nil {
+		return err
+	}
+	defer certCloseStore.Call(ca, 0)
+
+	for _, cert := range chain[1:] {
+		// trust anchors are left for the administrator to install in the Root store
+		if cert.CheckSignatureFrom(cert) == nil {
+			continue
+		}
+		ctx, err := addEncodedCertificate(ca, cert)
+		if err != nil {
+			return err
+		}
+		certFreeCertificateContext.Call(ctx)
+	}
+
+	return nil
+}
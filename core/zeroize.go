@@ -0,0 +1,104 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"math/big"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// Zeroize overwrites b, a buffer that held a PIN, passphrase, key or token, once it is no longer needed, so that the
+// secret lingers neither in core dumps nor in swapped memory.  Go strings cannot be overwritten, so secrets are best
+// kept in byte slices until the moment they are used.
+func Zeroize(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	// keep the writes from being elided as dead stores
+	runtime.KeepAlive(b)
+}
+
+// secretString views b as a string without copying it, for APIs that take a PIN as a string, such as those of the
+// pkcs11 package, so that zeroizing b leaves no copy behind.  The string changes with b, and must not be kept once b
+// is zeroized.  The pkcs11 package copies the PIN into C memory for the duration of each call.
+func secretString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	// #nosec G103 a read-only view of b, used only while b is live
+	return *(*string)(unsafe.Pointer(&b))
+}
+
+// lockedMemoryWarning reports, once, that secrets could not be locked into memory
+var lockedMemoryWarning sync.Once
+
+// LockSecret locks b, a buffer holding a PIN, passphrase, key or shared secret, into memory so that it is never
+// written to swap, returning a function that zeroizes and unlocks it once it is no longer needed.  Locking is best
+// effort: should the platform refuse, such as when RLIMIT_MEMLOCK is exhausted, a warning is printed once and b is
+// still zeroized.  Locking works on whole pages, so unlocking b may unlock a neighbour sharing its page.
+func LockSecret(b []byte) func() {
+	if len(b) == 0 {
+		return func() {}
+	}
+
+	err := lockMemory(b)
+	if err != nil {
+		lockedMemoryWarning.Do(func() {
+			logWarn("unable to lock secrets into memory", "error", err)
+		})
+		return func() {
+			Zeroize(b)
+		}
+	}
+
+	return func() {
+		Zeroize(b)
+		unlockMemory(b)
+	}
+}
+
+// zeroizeKey overwrites the private parts of a software key decoded for a single operation.  Keys held by a backend,
+// such as those of the memory backend, must not be passed, since they remain in use.
+func zeroizeKey(key interface{}) {
+	zeroizeInt := func(n *big.Int) {
+		if n == nil {
+			return
+		}
+		words := n.Bits()
+		for i := range words {
+			words[i] = 0
+		}
+		runtime.KeepAlive(words)
+		n.SetInt64(0)
+	}
+
+	switch k := key.(type) {
+	case pssSigner:
+		zeroizeKey(k.Signer)
+	case *ecdsa.PrivateKey:
+		zeroizeInt(k.D)
+	case *rsa.PrivateKey:
+		// the copies of the key that later versions of Go keep unexported within Precomputed are beyond reach
+		zeroizeInt(k.D)
+		for _, p := range k.Primes {
+			zeroizeInt(p)
+		}
+		zeroizeInt(k.Precomputed.Dp)
+		zeroizeInt(k.Precomputed.Dq)
+		zeroizeInt(k.Precomputed.Qinv)
+		for _, crt := range k.Precomputed.CRTValues {
+			zeroizeInt(crt.Exp)
+			zeroizeInt(crt.Coeff)
+			zeroizeInt(crt.R)
+		}
+	case ed25519.PrivateKey:
+		Zeroize(k)
+	}
+}
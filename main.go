@@ -5,10 +5,18 @@ Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/urfave/cli/v2" // imports as package "cli"
 	"golang.org/x/crypto/ssh/terminal"
@@ -17,103 +25,2516 @@ import (
 	"github.com/manetu/security-token/version"
 )
 
+// maxSecret bounds the length of a secret typed at a prompt, whose buffer is locked before it is read into
+const maxSecret = 1024
+
+// readSecret prompts for a secret, such as a PIN, reading it from the terminal without echo into a buffer that is
+// locked into memory before it is filled.  The returned function zeroizes and unlocks the secret and must always be
+// called.
+func readSecret(prompt string) ([]byte, func(), error) {
+	fmt.Print(prompt)
+	buf := make([]byte, maxSecret)
+	release := st.LockSecret(buf)
+	n, err := readTerminal(int(syscall.Stdin), buf)
+	fmt.Println()
+	if err != nil {
+		release()
+		return nil, nil, fmt.Errorf("error reading password: %w", err)
+	}
+	return buf[:n], release, nil
+}
+
+// readTerminal reads a line from the terminal fd into buf, byte by byte in raw mode so that no copy of it is made on
+// the way, returning its length.  Backspace and Ctrl-U edit the line, and Ctrl-C and Ctrl-D abandon it.
+func readTerminal(fd int, buf []byte) (int, error) {
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = terminal.Restore(fd, state)
+	}()
+
+	var b [1]byte
+	defer st.Zeroize(b[:])
+	n := 0
+	for {
+		_, err = os.Stdin.Read(b[:])
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case '\r', '\n':
+			return n, nil
+		case 0x7f, '\b':
+			if n > 0 {
+				n--
+				buf[n] = 0
+			}
+		case 0x15: // Ctrl-U
+			st.Zeroize(buf[:n])
+			n = 0
+		case 0x03: // Ctrl-C
+			return 0, errors.New("interrupted")
+		case 0x04: // Ctrl-D
+			return 0, io.EOF
+		default:
+			if n == len(buf) {
+				return 0, fmt.Errorf("longer than %d bytes", len(buf))
+			}
+			buf[n] = b[0]
+			n++
+		}
+	}
+}
+
+// readPassword is readSecret for secrets that are passed on as strings
+func readPassword(prompt string) (string, error) {
+	secret, release, err := readSecret(prompt)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return string(secret), nil
+}
+
+// flagPassphrase supplies the passphrase of an encrypted key from the named flag, prompting for it when the flag is
+// not set
+func flagPassphrase(c *cli.Context, name string, env string) st.PassphraseFunc {
+	return func() (string, error) {
+		if c.IsSet(name) {
+			return c.String(name), nil
+		}
+		if !terminal.IsTerminal(int(syscall.Stdin)) {
+			return "", fmt.Errorf("key is encrypted; provide its passphrase with --%s or %s", name, env)
+		}
+		return readPassword("Enter passphrase for key: ")
+	}
+}
+
+// metricsFlag enables the Prometheus metrics of the daemon modes
+var metricsFlag = &cli.StringFlag{
+	Name:    "metrics",
+	Usage:   "Address on which to export Prometheus metrics at /metrics, such as :9100",
+	EnvVars: []string{"MANETU_METRICS"},
+}
+
+// pprofFlag serves the runtime profiles of the daemon modes
+var pprofFlag = &cli.StringFlag{
+	Name:    "pprof",
+	Usage:   "Address on which to serve runtime profiles at /debug/pprof/, such as 127.0.0.1:6060",
+	EnvVars: []string{"MANETU_PPROF"},
+}
+
+// rotationFlags enable the rotation scheduler of the daemon modes
+var rotationFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "rotate-before",
+		Usage:   "Renew or rotate tokens expiring within the duration, such as 30d, checking every hour",
+		EnvVars: []string{"MANETU_ROTATE_BEFORE"},
+	},
+	&cli.StringFlag{
+		Name:    "rotate-mode",
+		Usage:   "Reissue the certificate of the existing key (renew) or generate a new token for the realm (rotate)",
+		Value:   st.RotationRotate,
+		EnvVars: []string{"MANETU_ROTATE_MODE"},
+	},
+}
+
+// setRotation configures the rotation scheduler from rotationFlags
+func setRotation(c *cli.Context, ctx *st.Core) error {
+	if !c.IsSet("rotate-before") {
+		return nil
+	}
+	before, err := st.ParseDuration(c.String("rotate-before"))
+	if err != nil {
+		return err
+	}
+	ctx.SetRotation(st.RotationOptions{Before: before, Mode: c.String("rotate-mode")})
+	return nil
+}
+
+// spiffeFlags are shared by the spiffe subcommands
+var spiffeFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:     "trust-domain",
+		Usage:    "SPIFFE trust domain of the issued SVIDs, such as example.org",
+		EnvVars:  []string{"MANETU_SPIFFE_TRUST_DOMAIN"},
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:     "ca-cert",
+		Usage:    "Path to the PEM encoded certificate of the CA issuing SVIDs, followed by any intermediates and the root",
+		EnvVars:  []string{"MANETU_SPIFFE_CA_CERT"},
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:     "ca-key",
+		Usage:    "Path to the PEM encoded private key of the CA",
+		EnvVars:  []string{"MANETU_SPIFFE_CA_KEY"},
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:    "ca-passphrase",
+		Usage:   "Passphrase for an encrypted CA key (if not passed in, user will be prompted)",
+		EnvVars: []string{"MANETU_SPIFFE_CA_PASSPHRASE"},
+	},
+	&cli.DurationFlag{
+		Name:  "ttl",
+		Usage: "Lifetime of each SVID",
+		Value: time.Hour,
+	},
+}
+
+// tsaFlags are shared by the commands able to timestamp their signatures
+var tsaFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "timestamp",
+		Usage: "Obtain a timestamp over the signature from the TSA configured as tsa.url",
+	},
+	&cli.StringFlag{
+		Name:  "tsa",
+		Usage: "URL of the RFC 3161 time-stamping authority, implying --timestamp",
+	},
+	&cli.StringFlag{
+		Name:  "tsa-ca-cert",
+		Usage: "PEM encoded certificates trusted to issue the certificate of the TSA, defaulting to tsa.caCert",
+	},
+}
+
+// timestampOptions returns the TSA selected by tsaFlags, or nil when no timestamp is wanted
+func timestampOptions(c *cli.Context) *st.TimestampOptions {
+	if !c.Bool("timestamp") && c.String("tsa") == "" {
+		return nil
+	}
+	return &st.TimestampOptions{
+		URL:      c.String("tsa"),
+		CACert:   c.String("tsa-ca-cert"),
+		Insecure: c.Bool("insecure"),
+	}
+}
+
+func spiffeOptions(c *cli.Context) st.SpiffeOptions {
+	return st.SpiffeOptions{
+		TrustDomain: c.String("trust-domain"),
+		CACert:      c.String("ca-cert"),
+		CAKey:       c.String("ca-key"),
+		Passphrase:  flagPassphrase(c, "ca-passphrase", "MANETU_SPIFFE_CA_PASSPHRASE"),
+		TTL:         c.Duration("ttl"),
+	}
+}
+
+// cmpOptions collects the flags of the cmp command, prompting for the secret when a reference number is given without
+// one
+func cmpOptions(c *cli.Context) (st.CMPOptions, error) {
+	secret := c.String("secret")
+	if c.String("reference") != "" && secret == "" {
+		var err error
+		secret, err = readPassword("Enter CMP secret: ")
+		if err != nil {
+			return st.CMPOptions{}, err
+		}
+	}
+	return st.CMPOptions{
+		URL:       c.String("url"),
+		CACert:    c.String("ca-cert"),
+		Reference: c.String("reference"),
+		Secret:    secret,
+		Insecure:  c.Bool("insecure"),
+	}, nil
+}
+
+// readInput reads the file at path or, when path is empty, stdin
+func readInput(path string) ([]byte, error) {
+	if path == "" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// writeOutput writes data to the file at path, readable by its owner only, or, when path is empty, to stdout
+func writeOutput(path string, data []byte) error {
+	if path == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
 func main() {
+	ctx := st.New()
+
+	// jsonErrors reports failures as JSON objects on stderr, selected by --error-format or by --output json
+	jsonErrors := false
+
 	defer func() {
 		if r := recover(); r != nil {
-			_, _ = fmt.Fprint(os.Stderr, "ERROR: ", r)
+			err, ok := r.(error)
+			if !ok {
+				err = fmt.Errorf("%v", r)
+			}
+			code := st.ExitCode(err)
+			if jsonErrors {
+				_, _ = fmt.Fprintln(os.Stderr, st.ErrorJSON(err))
+			} else {
+				_, _ = fmt.Fprint(os.Stderr, "ERROR: ", ctx.FormatError(err))
+			}
+			os.Exit(code)
 		}
 	}()
 
-	ctx := st.New()
+	defer func() {
+		_ = ctx.Close()
+	}()
+
+	var (
+		url      string
+		insecure bool
+		out      string
+		owner    string
+		quiet    bool
+		dryRun   bool
+	)
+
+	// printJWT prints the JWT acquired by login, or writes it to the file selected with --out
+	printJWT := func(jwt string) error {
+		if out == "" {
+			if owner != "" {
+				return fmt.Errorf("--owner requires --out")
+			}
+			fmt.Printf("%s\n", jwt)
+			return nil
+		}
+		data := []byte(jwt + "\n")
+		defer st.Zeroize(data)
+		return st.WriteSecretFile(out, data, owner)
+	}
+
+	app := &cli.App{
+		EnableBashCompletion: true,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "profile",
+				Usage:   "Select a named profile from the configuration file",
+				EnvVars: []string{"MANETU_PROFILE"},
+			},
+			&cli.StringFlag{
+				Name:    "backend",
+				Usage:   fmt.Sprintf("Select the keystore backend, overriding the configuration file (%s)", strings.Join(st.Backends(), ", ")),
+				EnvVars: []string{"MANETU_BACKEND"},
+			},
+			&cli.BoolFlag{
+				Name:    "quiet",
+				Aliases: []string{"q"},
+				Usage:   "Print only the essential result, such as the bare serial or JWT",
+				EnvVars: []string{"MANETU_QUIET"},
+			},
+			&cli.BoolFlag{
+				Name:  "no-color",
+				Usage: "Disable color output, as does setting the NO_COLOR environment variable",
+			},
+			&cli.StringFlag{
+				Name:    "error-format",
+				Usage:   "Report failures as text or as json objects of {code, message, hint} on stderr",
+				Value:   "text",
+				EnvVars: []string{"MANETU_ERROR_FORMAT"},
+			},
+			&cli.BoolFlag{
+				Name:    "dry-run",
+				Usage:   "Report what generate, delete, migrate and pin change would create or remove, without touching the keystore",
+				EnvVars: []string{"MANETU_DRY_RUN"},
+			},
+			&cli.BoolFlag{
+				Name:    "verbose",
+				Usage:   "Log each operation on a token, with its serial, duration and result, to stderr",
+				EnvVars: []string{"MANETU_VERBOSE"},
+			},
+			&cli.BoolFlag{
+				Name:    "debug",
+				Usage:   "Log each step taken against the keystore and each HTTP request as well, as --verbose does operations",
+				EnvVars: []string{"MANETU_DEBUG"},
+			},
+			&cli.BoolFlag{
+				Name:    "fips",
+				Usage:   "Restrict operation to FIPS-approved algorithms and key sizes, as does fips: true in the configuration file",
+				EnvVars: []string{"MANETU_FIPS"},
+			},
+		},
+		Before: func(c *cli.Context) error {
+			switch c.String("error-format") {
+			case "text":
+			case "json":
+				jsonErrors = true
+			default:
+				return fmt.Errorf("unknown error format %q (available: text, json)", c.String("error-format"))
+			}
+			quiet = c.Bool("quiet")
+			ctx.SetQuiet(quiet)
+			dryRun = c.Bool("dry-run")
+			ctx.SetDryRun(dryRun)
+			ctx.SetFIPS(c.Bool("fips"))
+			ctx.SetInteractive(true)
+			switch {
+			case c.Bool("debug"):
+				st.SetLogLevel(st.LogDebug)
+			case c.Bool("verbose"):
+				st.SetLogLevel(st.LogInfo)
+			}
+			ctx.SetColor(!c.Bool("no-color") && os.Getenv("NO_COLOR") == "")
+			ctx.UseProfile(c.String("profile"))
+			ctx.UseBackend(c.String("backend"))
+			return nil
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "version",
+				Usage: "Report version and build information",
+				Action: func(c *cli.Context) error {
+					fmt.Printf("manetu-security-token, git %s, goVersion %s, buildDate %s\n", version.GitCommit, version.GoVersion, version.BuildDate)
+					return nil
+				},
+			},
+			{
+				Name:  "generate",
+				Usage: "Generate a new security token",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "realm",
+						Usage:    "Set the realm id",
+						EnvVars:  []string{"MANETU_REALM"},
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "validity",
+						Usage: "Issue the certificate for the duration, such as 90d, rather than ten years or the maximum of the policy",
+					},
+					&cli.StringFlag{
+						Name:  "label",
+						Usage: "Label the key pair (its CKA_LABEL), by which the token may be selected in place of its serial",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					realm := c.String("realm")
+					var validity time.Duration
+					if c.IsSet("validity") {
+						d, err := st.ParseDuration(c.String("validity"))
+						if err != nil {
+							return fmt.Errorf("error during generate: %w", err)
+						}
+						if d <= 0 {
+							return fmt.Errorf("error during generate: the validity must be positive")
+						}
+						validity = d
+					}
+					cert, err := ctx.GenerateLabeled(realm, c.String("label"), validity)
+					if err != nil {
+						return fmt.Errorf("error during generate: %w", err)
+					}
+					if dryRun {
+						return nil
+					}
+					if quiet {
+						fmt.Println(st.HexEncode(cert.SerialNumber.Bytes()))
+						return nil
+					}
+					fmt.Fprintf(os.Stderr, "Serial: %s\n", st.HexEncode(cert.SerialNumber.Bytes()))
+					fmt.Fprintf(os.Stderr, "MRN: %s\n", st.ComputeMRN(cert))
+					fmt.Printf("%s\n", st.ExportCert(cert))
+
+					return nil
+				},
+			},
+			{
+				Name:  "enroll",
+				Usage: "Generate a new security token and register its identity with a registrar, ready for login",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "realm",
+						Usage:   "Set the realm id of the new token",
+						EnvVars: []string{"MANETU_REALM"},
+					},
+					&cli.StringFlag{
+						Name:  "validity",
+						Usage: "Issue the certificate for the duration, such as 90d, rather than ten years or the maximum of the policy",
+					},
+					&cli.StringFlag{
+						Name:  "label",
+						Usage: "Label the key pair of the new token (its CKA_LABEL), by which it may be selected in place of its serial",
+					},
+					&cli.StringFlag{
+						Name:  "serial",
+						Usage: "Register the existing security token rather than generating one",
+					},
+					&cli.StringFlag{
+						Name:  "registrar",
+						Usage: "Register with the named registrar, defaulting to enroll.registrar or manetu",
+					},
+					&cli.StringFlag{
+						Name:  "url",
+						Usage: "The URL of the registrar, defaulting to enroll.url or MANETU_URL",
+					},
+					&cli.StringFlag{
+						Name:  "token",
+						Usage: "Bearer token authorizing the registration, defaulting to enroll.token or MANETU_ENROLL_TOKEN",
+					},
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "Name of the identity, defaulting to the serial number of the token",
+					},
+					&cli.StringSliceFlag{
+						Name:  "role",
+						Usage: "Role to grant the identity; may be repeated, defaulting to enroll.roles",
+					},
+					&cli.BoolFlag{
+						Name:  "insecure",
+						Usage: "Allow insecure TLS to the registrar",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					var validity time.Duration
+					if c.IsSet("validity") {
+						d, err := st.ParseDuration(c.String("validity"))
+						if err != nil {
+							return fmt.Errorf("error during enroll: %w", err)
+						}
+						if d <= 0 {
+							return fmt.Errorf("error during enroll: the validity must be positive")
+						}
+						validity = d
+					}
+					cert, err := ctx.Enroll(st.EnrollOptions{
+						Serial:    c.String("serial"),
+						Realm:     c.String("realm"),
+						Validity:  validity,
+						Label:     c.String("label"),
+						Registrar: c.String("registrar"),
+						URL:       c.String("url"),
+						Token:     c.String("token"),
+						Roles:     c.StringSlice("role"),
+						Name:      c.String("name"),
+						Insecure:  c.Bool("insecure"),
+					})
+					if err != nil {
+						return fmt.Errorf("error during enroll: %w", err)
+					}
+					if dryRun {
+						return nil
+					}
+					if quiet {
+						fmt.Println(st.HexEncode(cert.SerialNumber.Bytes()))
+						return nil
+					}
+					fmt.Fprintf(os.Stderr, "Serial: %s\n", st.HexEncode(cert.SerialNumber.Bytes()))
+					fmt.Fprintf(os.Stderr, "MRN: %s\n", st.ComputeMRN(cert))
+					fmt.Fprintf(os.Stderr, "Registered\n")
+					fmt.Printf("%s\n", st.ExportCert(cert))
+
+					return nil
+				},
+			},
+			{
+				Name:         "show",
+				BashComplete: completeTokens(ctx),
+				Usage:        "Display the PEM encoded x509 public key for the specified security token",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "serial",
+						Usage: "Security token serial number or label, defaulting to the token selected with use",
+					},
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format: pem, json or text",
+						Value: "pem",
+					},
+					&cli.BoolFlag{
+						Name:  "text",
+						Usage: "Print a human-readable breakdown of the certificate, as --output text",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					output := c.String("output")
+					if c.Bool("text") {
+						output = "text"
+					}
+					jsonErrors = jsonErrors || output == "json"
+					err := ctx.Show(c.String("serial"), output)
+					if err != nil {
+						return fmt.Errorf("error during show: %w", err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:         "export",
+				BashComplete: completeTokens(ctx),
+				Usage:        "Make the certificate of a security token available to other applications",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "serial",
+						Usage: "Security token serial number or label, defaulting to the token selected with use",
+					},
+					&cli.StringFlag{
+						Name:  "cert",
+						Usage: "PEM file holding a certificate issued to the token and its chain, exported in place of the self-signed certificate",
+					},
+					&cli.BoolFlag{
+						Name:  "windows-store",
+						Usage: "Register the certificate in the Windows certificate store, linked to the key of the token",
+					},
+					&cli.BoolFlag{
+						Name:  "machine",
+						Usage: "Use the LocalMachine rather than the CurrentUser certificate store",
+					},
+					&cli.StringFlag{
+						Name:  "provider",
+						Usage: "Key storage provider holding the key, defaulting to that of the cng backend",
+					},
+					&cli.StringFlag{
+						Name:  "container",
+						Usage: "Name of the key within the key storage provider, defaulting to that of the cng backend",
+					},
+					&cli.StringFlag{
+						Name:  "nss-db",
+						Usage: "Import the certificate into the NSS database in the directory, such as a Firefox profile",
+					},
+					&cli.StringFlag{
+						Name:  "nickname",
+						Usage: "Nickname of the certificate in the NSS database",
+					},
+					&cli.StringFlag{
+						Name:  "module",
+						Usage: "Name under which the PKCS#11 module is registered in the NSS database",
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Write the certificate and its chain as a Java keystore: jks or pkcs12-truststore",
+					},
+					&cli.StringFlag{
+						Name:  "out",
+						Usage: "File to which the keystore is written",
+					},
+					&cli.StringFlag{
+						Name:    "password",
+						Usage:   "Password of the keystore",
+						Value:   "changeit",
+						EnvVars: []string{"MANETU_KEYSTORE_PASSWORD"},
+					},
+					&cli.StringFlag{
+						Name:  "alias",
+						Usage: "Alias of the certificate in the keystore",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					var err error
+					switch {
+					case c.Bool("windows-store"):
+						err = ctx.ExportWindowsStore(c.String("serial"), st.WindowsStoreOptions{
+							Machine:     c.Bool("machine"),
+							Certificate: c.String("cert"),
+							Provider:    c.String("provider"),
+							Container:   c.String("container"),
+						})
+					case c.String("nss-db") != "":
+						err = ctx.ExportNSS(c.String("serial"), st.NSSOptions{
+							Dir:         c.String("nss-db"),
+							Certificate: c.String("cert"),
+							Nickname:    c.String("nickname"),
+							Module:      c.String("module"),
+						})
+					case c.String("format") != "":
+						err = ctx.ExportKeystore(c.String("serial"), st.KeystoreOptions{
+							Format:      c.String("format"),
+							Out:         c.String("out"),
+							Password:    c.String("password"),
+							Alias:       c.String("alias"),
+							Certificate: c.String("cert"),
+						})
+					default:
+						return fmt.Errorf("error during export: choose where to export with --windows-store, --nss-db or --format")
+					}
+					if err != nil {
+						return fmt.Errorf("error during export: %w", err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:         "list",
+				BashComplete: completeTokens(ctx),
+				Usage:        "Enumerate available security tokens",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format: table, json or csv",
+						Value: "table",
+					},
+					&cli.StringSliceFlag{
+						Name:  "columns",
+						Usage: "Comma separated columns of table or csv output: serial, label, realm (or provider), mrn, notBefore (or created), notAfter (or expiry), keyType, sha1, sha256",
+					},
+					&cli.StringFlag{
+						Name:    "realm",
+						Aliases: []string{"provider"},
+						Usage:   "Only list tokens for the realm",
+					},
+					&cli.StringFlag{
+						Name:  "expires-within",
+						Usage: "Only list tokens expiring within the duration, such as 30d or 12h",
+					},
+					&cli.StringFlag{
+						Name:  "key-type",
+						Usage: "Only list tokens with keys of the type: ec, rsa or ed25519",
+					},
+					&cli.StringFlag{
+						Name:  "sort",
+						Usage: "Order tokens by created, expiry, provider or serial",
+						Value: "created",
+					},
+					&cli.BoolFlag{
+						Name:  "reverse",
+						Usage: "Reverse the order of tokens",
+					},
+					&cli.BoolFlag{
+						Name:  "fingerprints",
+						Usage: "Include the SHA-256 and SHA-1 certificate fingerprints in the table",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					jsonErrors = jsonErrors || c.String("output") == "json"
+					var expiresWithin time.Duration
+					if c.IsSet("expires-within") {
+						d, err := st.ParseDuration(c.String("expires-within"))
+						if err != nil {
+							return fmt.Errorf("error during list: %w", err)
+						}
+						expiresWithin = d
+					}
+
+					err := ctx.List(st.ListOptions{
+						Output:        c.String("output"),
+						Columns:       c.StringSlice("columns"),
+						Realm:         c.String("realm"),
+						ExpiresWithin: expiresWithin,
+						KeyType:       c.String("key-type"),
+						Sort:          c.String("sort"),
+						Reverse:       c.Bool("reverse"),
+						Fingerprints:  c.Bool("fingerprints"),
+					})
+					if err != nil {
+						return fmt.Errorf("error during list: %w", err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "report",
+				Usage: "Report the tokens across the configuration and all of its profiles: counts, key types and expiry",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format: json or html",
+						Value: "json",
+					},
+					&cli.StringFlag{
+						Name:  "out",
+						Usage: "Write the report to the file rather than stdout",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					w := os.Stdout
+					if c.String("out") != "" {
+						f, err := os.Create(c.String("out"))
+						if err != nil {
+							return fmt.Errorf("error during report: %w", err)
+						}
+						defer f.Close()
+						w = f
+					}
+					jsonErrors = jsonErrors || c.String("output") == "json"
+					err := ctx.Report(c.String("output"), w)
+					if err != nil {
+						return fmt.Errorf("error during report: %w", err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:         "mrn",
+				BashComplete: completeTokens(ctx),
+				Usage:        "Print the MRN of a security token or certificate",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "serial",
+						Usage: "Security token serial number or label, defaulting to the token selected with use",
+					},
+					&cli.StringFlag{
+						Name:  "cert",
+						Usage: "Path to a PEM encoded certificate, instead of a security token",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.IsSet("serial") && c.IsSet("cert") {
+						return fmt.Errorf("only one of serial or cert may be provided")
+					}
+					mrn, err := ctx.MRN(c.String("serial"), c.String("cert"))
+					if err != nil {
+						return fmt.Errorf("error during mrn: %w", err)
+					}
+					fmt.Println(mrn)
+					return nil
+				},
+			},
+			{
+				Name:         "fingerprint",
+				BashComplete: completeTokens(ctx),
+				Usage:        "Print the JWK thumbprint and SPKI SHA-256 fingerprint of the key of a security token or certificate",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "serial",
+						Usage: "Security token serial number or label, defaulting to the token selected with use",
+					},
+					&cli.StringFlag{
+						Name:  "cert",
+						Usage: "Path to a PEM encoded certificate, instead of a security token",
+					},
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output format: text or json",
+						Value: "text",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.IsSet("serial") && c.IsSet("cert") {
+						return fmt.Errorf("only one of serial or cert may be provided")
+					}
+					jsonErrors = jsonErrors || c.String("output") == "json"
+					err := ctx.Fingerprint(c.String("serial"), c.String("cert"), c.String("output"))
+					if err != nil {
+						return fmt.Errorf("error during fingerprint: %w", err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "did",
+				Usage: "Express a security token as a decentralized identifier (DID)",
+				Subcommands: []*cli.Command{
+					{
+						Name:         "export",
+						BashComplete: completeTokens(ctx),
+						Usage:        "Print the DID document holding the public key of a security token",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "serial",
+								Usage: "Security token serial number or label, defaulting to the token selected with use",
+							},
+							&cli.StringFlag{
+								Name:  "method",
+								Usage: "DID method: key, derived from the public key, or web, served by --domain",
+								Value: "key",
+							},
+							&cli.StringFlag{
+								Name:  "domain",
+								Usage: "Host, with an optional port, serving the document of a did:web",
+							},
+							&cli.StringFlag{
+								Name:  "path",
+								Usage: "Path of the document of a did:web below the domain, instead of /.well-known",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							err := ctx.DID(c.String("serial"), st.DIDOptions{
+								Method: c.String("method"),
+								Domain: c.String("domain"),
+								Path:   c.String("path"),
+							})
+							if err != nil {
+								return fmt.Errorf("error during did export: %w", err)
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:      "use",
+				Usage:     "Select the default security token, used when a command is given no serial",
+				ArgsUsage: "[serial|label]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "clear",
+						Usage: "Forget the default security token",
+					},
+				},
+				BashComplete: completeTokens(ctx),
+				Action: func(c *cli.Context) error {
+					if c.Bool("clear") {
+						err := ctx.ClearDefault()
+						if err != nil {
+							return fmt.Errorf("error during use: %w", err)
+						}
+						return nil
+					}
+
+					if c.Args().Present() {
+						err := ctx.Use(c.Args().First())
+						if err != nil {
+							return fmt.Errorf("error during use: %w", err)
+						}
+						return nil
+					}
+
+					serial, err := ctx.DefaultToken()
+					if err != nil {
+						return fmt.Errorf("error during use: %w", err)
+					}
+					if serial == "" {
+						return fmt.Errorf("no default security token selected")
+					}
+					fmt.Println(serial)
+					return nil
+				},
+			},
+			{
+				Name:         "delete",
+				BashComplete: completeTokens(ctx),
+				Usage:        "Remove a security token",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "serial",
+						Usage: "Security token serial number or label, defaulting to the token selected with use",
+					},
+					&cli.StringFlag{
+						Name:    "realm",
+						Aliases: []string{"provider"},
+						Usage:   "Delete every token for the realm",
+					},
+					&cli.BoolFlag{
+						Name:  "expired",
+						Usage: "Delete every token whose certificate has expired",
+					},
+					&cli.BoolFlag{
+						Name:    "force",
+						Aliases: []string{"f"},
+						Usage:   "Delete without asking for confirmation, as required when not running interactively",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "List the tokens that would be deleted without deleting them, as the global --dry-run",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					err := ctx.Delete(st.DeleteOptions{
+						Serial:  c.String("serial"),
+						Realm:   c.String("realm"),
+						Expired: c.Bool("expired"),
+						Force:   c.Bool("force"),
+						DryRun:  c.Bool("dry-run"),
+					})
+					if err != nil {
+						return fmt.Errorf("error during delete: %w", err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:         "acme",
+				BashComplete: completeTokens(ctx),
+				Usage:        "Obtain a certificate for the key of a security token from an ACME server, such as Let's Encrypt",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "serial",
+						Usage: "Security token serial number or label, defaulting to the token selected with use",
+					},
+					&cli.StringFlag{
+						Name:    "directory",
+						Usage:   "Directory URL of the ACME server",
+						EnvVars: []string{"MANETU_ACME_DIRECTORY"},
+						Value:   st.LetsEncryptURL,
+					},
+					&cli.StringSliceFlag{
+						Name:     "domain",
+						Usage:    "DNS name to include in the certificate; may be repeated, the first becoming the common name",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "email",
+						Usage:   "Contact address of the ACME account",
+						EnvVars: []string{"MANETU_ACME_EMAIL"},
+					},
+					&cli.StringFlag{
+						Name:  "challenge",
+						Usage: "Prove control of the domains with http-01, answered by a built-in server, or dns-01, published by hand",
+						Value: "http-01",
+					},
+					&cli.StringFlag{
+						Name:  "http-addr",
+						Usage: "Address on which to answer http-01 challenges",
+						Value: ":80",
+					},
+					&cli.BoolFlag{
+						Name:  "insecure",
+						Usage: "Allow insecure TLS to the ACME server",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					chain, err := ctx.ACME(c.String("serial"), st.ACMEOptions{
+						DirectoryURL: c.String("directory"),
+						Domains:      c.StringSlice("domain"),
+						Email:        c.String("email"),
+						Challenge:    c.String("challenge"),
+						HTTPAddr:     c.String("http-addr"),
+						Insecure:     c.Bool("insecure"),
+					})
+					if err != nil {
+						return fmt.Errorf("error during acme: %w", err)
+					}
+					for _, cert := range chain {
+						fmt.Print(st.ExportCert(cert))
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "est",
+				Usage: "Obtain certificates for the key of a security token from an EST (RFC 7030) server",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "url",
+						Usage:   "URL of the EST server, to which /.well-known/est is appended",
+						EnvVars: []string{"MANETU_EST_URL"},
+					},
+					&cli.StringFlag{
+						Name:  "label",
+						Usage: "Label of the CA, when the server has several",
+					},
+					&cli.StringFlag{
+						Name:  "ca-cert",
+						Usage: "PEM encoded trust anchors of the EST server, defaulting to the system roots",
+					},
+					&cli.BoolFlag{
+						Name:  "insecure",
+						Usage: "Allow insecure TLS to the EST server",
+					},
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:         "enroll",
+						BashComplete: completeTokens(ctx),
+						Usage:        "Request a certificate for the key of a security token with simpleenroll",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "serial",
+								Usage: "Security token serial number or label, defaulting to the token selected with use",
+							},
+							&cli.StringFlag{
+								Name:  "common-name",
+								Usage: "Common name of the certificate, defaulting to the MRN of the token",
+							},
+							&cli.StringSliceFlag{
+								Name:  "dns",
+								Usage: "DNS name to include in the certificate; may be repeated",
+							},
+							&cli.StringFlag{
+								Name:    "username",
+								Usage:   "Authenticate with HTTP basic authentication rather than the token's certificate",
+								EnvVars: []string{"MANETU_EST_USERNAME"},
+							},
+							&cli.StringFlag{
+								Name:    "password",
+								Usage:   "Password for HTTP basic authentication, prompted for when a username is given",
+								EnvVars: []string{"MANETU_EST_PASSWORD"},
+							},
+						},
+						Action: func(c *cli.Context) error {
+							password := c.String("password")
+							if c.String("username") != "" && password == "" {
+								var err error
+								password, err = readPassword("Enter EST password: ")
+								if err != nil {
+									return err
+								}
+							}
+							chain, err := ctx.EST(c.String("serial"), st.ESTOptions{
+								URL:        c.String("url"),
+								Label:      c.String("label"),
+								CACert:     c.String("ca-cert"),
+								Insecure:   c.Bool("insecure"),
+								CommonName: c.String("common-name"),
+								DNSNames:   c.StringSlice("dns"),
+								Username:   c.String("username"),
+								Password:   password,
+							})
+							if err != nil {
+								return fmt.Errorf("error during est enroll: %w", err)
+							}
+							for _, cert := range chain {
+								fmt.Print(st.ExportCert(cert))
+							}
+							return nil
+						},
+					},
+					{
+						Name:         "reenroll",
+						BashComplete: completeTokens(ctx),
+						Usage:        "Renew the certificate previously issued to a security token with simplereenroll",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "serial",
+								Usage: "Security token serial number or label, defaulting to the token selected with use",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							chain, err := ctx.EST(c.String("serial"), st.ESTOptions{
+								URL:      c.String("url"),
+								Label:    c.String("label"),
+								CACert:   c.String("ca-cert"),
+								Insecure: c.Bool("insecure"),
+								Reenroll: true,
+							})
+							if err != nil {
+								return fmt.Errorf("error during est reenroll: %w", err)
+							}
+							for _, cert := range chain {
+								fmt.Print(st.ExportCert(cert))
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "cacerts",
+						Usage: "Print the CA certificates of the EST server",
+						Action: func(c *cli.Context) error {
+							certs, err := ctx.ESTCACerts(st.ESTOptions{
+								URL:      c.String("url"),
+								Label:    c.String("label"),
+								CACert:   c.String("ca-cert"),
+								Insecure: c.Bool("insecure"),
+							})
+							if err != nil {
+								return fmt.Errorf("error during est cacerts: %w", err)
+							}
+							for _, cert := range certs {
+								fmt.Print(st.ExportCert(cert))
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "scep",
+				Usage: "Obtain certificates for the key of a security token from a SCEP server, such as NDES",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "url",
+						Usage:   "URL of the SCEP server, such as http://ndes.example.com/certsrv/mscep/mscep.dll",
+						EnvVars: []string{"MANETU_SCEP_URL"},
+					},
+					&cli.StringFlag{
+						Name:  "identifier",
+						Usage: "Identifier of the CA, when the server has several",
+					},
+					&cli.StringFlag{
+						Name:  "ca-fingerprint",
+						Usage: "SHA-256 fingerprint of a CA certificate of the server, authenticating a server reached over HTTP",
+					},
+					&cli.BoolFlag{
+						Name:  "insecure",
+						Usage: "Allow insecure TLS to the SCEP server",
+					},
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:         "enroll",
+						BashComplete: completeTokens(ctx),
+						Usage:        "Request a certificate for the key of a security token",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "serial",
+								Usage: "Security token serial number or label, defaulting to the token selected with use",
+							},
+							&cli.StringFlag{
+								Name:  "common-name",
+								Usage: "Common name of the certificate, defaulting to the MRN of the token",
+							},
+							&cli.StringSliceFlag{
+								Name:  "dns",
+								Usage: "DNS name to include in the certificate; may be repeated",
+							},
+							&cli.StringFlag{
+								Name:    "challenge",
+								Usage:   "Challenge password authorizing the request, prompted for when the server requires one",
+								EnvVars: []string{"MANETU_SCEP_CHALLENGE"},
+							},
+							&cli.BoolFlag{
+								Name:  "renew",
+								Usage: "Request a new certificate for the subject of the certificate previously issued to the token",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							chain, err := ctx.SCEP(c.String("serial"), st.SCEPOptions{
+								URL:           c.String("url"),
+								Identifier:    c.String("identifier"),
+								CAFingerprint: c.String("ca-fingerprint"),
+								Insecure:      c.Bool("insecure"),
+								CommonName:    c.String("common-name"),
+								DNSNames:      c.StringSlice("dns"),
+								Challenge:     c.String("challenge"),
+								Renew:         c.Bool("renew"),
+							})
+							if err != nil {
+								return fmt.Errorf("error during scep enroll: %w", err)
+							}
+							for _, cert := range chain {
+								fmt.Print(st.ExportCert(cert))
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "cacerts",
+						Usage: "Print the CA and RA certificates of the SCEP server",
+						Action: func(c *cli.Context) error {
+							certs, err := ctx.SCEPCACerts(st.SCEPOptions{
+								URL:           c.String("url"),
+								Identifier:    c.String("identifier"),
+								CAFingerprint: c.String("ca-fingerprint"),
+								Insecure:      c.Bool("insecure"),
+							})
+							if err != nil {
+								return fmt.Errorf("error during scep cacerts: %w", err)
+							}
+							for _, cert := range certs {
+								fmt.Print(st.ExportCert(cert))
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "cmp",
+				Usage: "Manage certificates for the key of a security token with a CMP (RFC 4210) server",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "url",
+						Usage:   "URL of the CMP server, such as http://ca.example.com:8080/ejbca/publicweb/cmp/alias",
+						EnvVars: []string{"MANETU_CMP_URL"},
+					},
+					&cli.StringFlag{
+						Name:  "ca-cert",
+						Usage: "PEM encoded certificates of the CA, authenticating signed responses",
+					},
+					&cli.StringFlag{
+						Name:  "reference",
+						Usage: "Reference number issued by the CA, protecting messages with a password-based MAC",
+					},
+					&cli.StringFlag{
+						Name:    "secret",
+						Usage:   "Secret issued by the CA with the reference number, prompted for when a reference is given",
+						EnvVars: []string{"MANETU_CMP_SECRET"},
+					},
+					&cli.BoolFlag{
+						Name:  "insecure",
+						Usage: "Allow insecure TLS to the CMP server",
+					},
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:         "ir",
+						BashComplete: completeTokens(ctx),
+						Usage:        "Request the first certificate for the key of a security token (initial registration)",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "serial",
+								Usage: "Security token serial number or label, defaulting to the token selected with use",
+							},
+							&cli.StringFlag{
+								Name:  "common-name",
+								Usage: "Common name of the certificate, defaulting to the MRN of the token",
+							},
+							&cli.StringSliceFlag{
+								Name:  "dns",
+								Usage: "DNS name to include in the certificate; may be repeated",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							opts, err := cmpOptions(c)
+							if err != nil {
+								return err
+							}
+							opts.CommonName = c.String("common-name")
+							opts.DNSNames = c.StringSlice("dns")
+							chain, err := ctx.CMP(c.String("serial"), "ir", opts)
+							if err != nil {
+								return fmt.Errorf("error during cmp ir: %w", err)
+							}
+							for _, cert := range chain {
+								fmt.Print(st.ExportCert(cert))
+							}
+							return nil
+						},
+					},
+					{
+						Name:         "kur",
+						BashComplete: completeTokens(ctx),
+						Usage:        "Update the certificate previously issued to a security token (key update)",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "serial",
+								Usage: "Security token serial number or label, defaulting to the token selected with use",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							opts, err := cmpOptions(c)
+							if err != nil {
+								return err
+							}
+							chain, err := ctx.CMP(c.String("serial"), "kur", opts)
+							if err != nil {
+								return fmt.Errorf("error during cmp kur: %w", err)
+							}
+							for _, cert := range chain {
+								fmt.Print(st.ExportCert(cert))
+							}
+							return nil
+						},
+					},
+					{
+						Name:         "rr",
+						BashComplete: completeTokens(ctx),
+						Usage:        "Revoke the certificate previously issued to a security token (revocation request)",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "serial",
+								Usage: "Security token serial number or label, defaulting to the token selected with use",
+							},
+							&cli.IntFlag{
+								Name:  "reason",
+								Usage: "CRL reason code of the revocation, such as 1 (keyCompromise) or 4 (superseded)",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							opts, err := cmpOptions(c)
+							if err != nil {
+								return err
+							}
+							opts.Reason = c.Int("reason")
+							_, err = ctx.CMP(c.String("serial"), "rr", opts)
+							if err != nil {
+								return fmt.Errorf("error during cmp rr: %w", err)
+							}
+							if !quiet {
+								fmt.Println("Revoked")
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "ssh",
+				Usage: "Use security tokens for SSH access",
+				Subcommands: []*cli.Command{
+					{
+						Name:         "pubkey",
+						BashComplete: completeTokens(ctx),
+						Usage:        "Print the public key of a security token in the authorized_keys format",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "serial",
+								Usage: "Security token serial number or label, defaulting to the token selected with use",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							key, err := ctx.SSHPublicKey(c.String("serial"))
+							if err != nil {
+								return fmt.Errorf("error during ssh pubkey: %w", err)
+							}
+							fmt.Print(key)
+							return nil
+						},
+					},
+					{
+						Name:         "certify",
+						BashComplete: completeTokens(ctx),
+						Usage:        "Mint an OpenSSH certificate, signed by the key of a CA security token",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "ca-serial",
+								Usage:    "Serial number of the security token acting as the SSH certificate authority",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:  "serial",
+								Usage: "Security token whose key is certified, defaulting to the token selected with use",
+							},
+							&cli.StringFlag{
+								Name:  "key",
+								Usage: "Path to an SSH public key to certify instead of a security token, such as id_ed25519.pub",
+							},
+							&cli.StringSliceFlag{
+								Name:     "principal",
+								Usage:    "User, or host name with --host, for which the certificate is valid; may be repeated",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:  "identity",
+								Usage: "Key identity recorded in server logs, defaulting to the MRN of the token or the comment of the key",
+							},
+							&cli.BoolFlag{
+								Name:  "host",
+								Usage: "Issue a host certificate rather than a user certificate",
+							},
+							&cli.DurationFlag{
+								Name:  "validity",
+								Usage: "Lifetime of the certificate",
+								Value: 24 * time.Hour,
+							},
+						},
+						Action: func(c *cli.Context) error {
+							opts := st.SSHCertOptions{
+								CASerial:   c.String("ca-serial"),
+								Serial:     c.String("serial"),
+								Host:       c.Bool("host"),
+								KeyID:      c.String("identity"),
+								Principals: c.StringSlice("principal"),
+								Validity:   c.Duration("validity"),
+							}
+							if path := c.String("key"); path != "" {
+								if opts.Serial != "" {
+									return fmt.Errorf("--serial and --key are mutually exclusive")
+								}
+								key, err := os.ReadFile(path)
+								if err != nil {
+									return fmt.Errorf("error during ssh certify: %w", err)
+								}
+								opts.PublicKey = key
+							}
+
+							cert, err := ctx.SSHCertify(opts)
+							if err != nil {
+								return fmt.Errorf("error during ssh certify: %w", err)
+							}
+							fmt.Print(cert)
+							return nil
+						},
+					},
+					{
+						Name:  "agent",
+						Usage: "Serve the keys of every security token over the ssh-agent protocol",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "socket",
+								Usage: "Path of the socket, defaulting to a socket within $XDG_RUNTIME_DIR or $HOME/.manetu",
+							},
+							&cli.StringSliceFlag{
+								Name:  "certificate",
+								Usage: "Path to an OpenSSH certificate of a token's key, offered alongside the key; may be repeated",
+							},
+							metricsFlag,
+							pprofFlag,
+						},
+						Action: func(c *cli.Context) error {
+							ctx.SetMetrics(c.String("metrics"))
+							ctx.SetProfiling(c.String("pprof"))
+							err := ctx.SSHAgent(c.String("socket"), c.StringSlice("certificate"))
+							if err != nil {
+								return fmt.Errorf("error during ssh agent: %w", err)
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "spiffe",
+				Usage: "Issue SPIFFE X.509-SVIDs identifying security tokens",
+				Subcommands: []*cli.Command{
+					{
+						Name:         "svid",
+						BashComplete: completeTokens(ctx),
+						Usage:        "Print an X.509-SVID for the key of a security token, followed by the chain of the CA",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:  "serial",
+								Usage: "Security token serial number or label, defaulting to the token selected with use",
+							},
+						}, spiffeFlags...),
+						Action: func(c *cli.Context) error {
+							svid, err := ctx.SVID(c.String("serial"), spiffeOptions(c))
+							if err != nil {
+								return fmt.Errorf("error during spiffe svid: %w", err)
+							}
+							fmt.Print(svid)
+							return nil
+						},
+					},
+					{
+						Name:  "serve",
+						Usage: "Serve X.509-SVIDs for every security token over the SPIFFE Workload API",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:  "socket",
+								Usage: "Path of the Workload API socket, defaulting to a socket within $XDG_RUNTIME_DIR or $HOME/.manetu",
+							},
+							metricsFlag,
+							pprofFlag,
+						}, spiffeFlags...),
+						Action: func(c *cli.Context) error {
+							ctx.SetMetrics(c.String("metrics"))
+							ctx.SetProfiling(c.String("pprof"))
+							err := ctx.WorkloadAPI(c.String("socket"), spiffeOptions(c))
+							if err != nil {
+								return fmt.Errorf("error during spiffe serve: %w", err)
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "serve",
+				Usage: "Serve the keystore to sidecars and other languages over gRPC, secured by mutual TLS",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "grpc",
+						Usage:   "Address on which to serve the gRPC API, such as :8443",
+						EnvVars: []string{"MANETU_SERVE_GRPC"},
+					},
+					&cli.StringFlag{
+						Name:     "cert",
+						Usage:    "Path to the PEM encoded certificate of the server",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "key",
+						Usage:    "Path to the PEM encoded private key of the server",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "client-ca",
+						Usage:    "Path to the PEM encoded CA certificates that client certificates must be issued by",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "insecure",
+						Usage: "Allow insecure TLS for logins requested through the server",
+					},
+					metricsFlag,
+					pprofFlag,
+				}, rotationFlags...),
+				Action: func(c *cli.Context) error {
+					ctx.SetMetrics(c.String("metrics"))
+					ctx.SetProfiling(c.String("pprof"))
+					err := setRotation(c, ctx)
+					if err != nil {
+						return fmt.Errorf("error during serve: %w", err)
+					}
+					err = ctx.Serve(st.ServeOptions{
+						Address:  c.String("grpc"),
+						Cert:     c.String("cert"),
+						Key:      c.String("key"),
+						ClientCA: c.String("client-ca"),
+						Insecure: c.Bool("insecure"),
+					})
+					if err != nil {
+						return fmt.Errorf("error during serve: %w", err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "agent",
+				Usage: "Hold the keystore open and serve it to other processes over a Unix socket, as ssh-agent does",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "socket",
+						Usage:   "Path of the socket, defaulting to agent.socket from the configuration file, or a socket within $XDG_RUNTIME_DIR or $HOME/.manetu",
+						EnvVars: []string{st.AgentSocketEnv},
+					},
+					&cli.BoolFlag{
+						Name:  "insecure",
+						Usage: "Allow insecure TLS for logins requested through the agent",
+					},
+					metricsFlag,
+					pprofFlag,
+				}, rotationFlags...),
+				Action: func(c *cli.Context) error {
+					ctx.SetMetrics(c.String("metrics"))
+					ctx.SetProfiling(c.String("pprof"))
+					err := setRotation(c, ctx)
+					if err != nil {
+						return fmt.Errorf("error during agent: %w", err)
+					}
+					err = ctx.Agent(c.String("socket"), c.Bool("insecure"))
+					if err != nil {
+						return fmt.Errorf("error during agent: %w", err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "gc",
+				Usage: "Remove private keys without certificates and certificates without keys, left behind by interrupted operations",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "force",
+						Aliases: []string{"f"},
+						Usage:   "Remove without asking for confirmation, as required when not running interactively",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					err := ctx.GC(c.Bool("force"))
+					if err != nil {
+						return fmt.Errorf("error during gc: %w", err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "audit",
+				Usage: "Inspect the tamper-evident log of token operations",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "show",
+						Usage: "Print every recorded generate, delete, login and sign",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "output",
+								Usage: "Output format: table or json (one entry per line)",
+								Value: "table",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							err := ctx.AuditShow(c.String("output"))
+							if err != nil {
+								return fmt.Errorf("error during audit show: %w", err)
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "verify",
+						Usage: "Check that no entry of the log has been altered, removed or reordered",
+						Action: func(c *cli.Context) error {
+							n, head, err := ctx.AuditVerify()
+							if err != nil {
+								return fmt.Errorf("error during audit verify: %w", err)
+							}
+							if quiet {
+								fmt.Println(head)
+								return nil
+							}
+							fmt.Printf("%d entries verified; head %s\n", n, head)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "policy",
+				Usage: "Inspect the local policy restricting operations on security tokens",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "show",
+						Usage: "Print the rules of the policy in force",
+						Action: func(c *cli.Context) error {
+							err := ctx.PolicyShow()
+							if err != nil {
+								return fmt.Errorf("error during policy show: %w", err)
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "webhook",
+				Usage: "Notify the configured webhooks of token lifecycle events",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "expiring",
+						Usage: "Notify webhooks of each token expiring within the duration, for running from cron",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "within",
+								Usage: "Report tokens expiring within the duration, such as 30d or 12h, including those already expired",
+								Value: "30d",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							within, err := st.ParseDuration(c.String("within"))
+							if err != nil {
+								return fmt.Errorf("error during webhook expiring: %w", err)
+							}
+							n, err := ctx.NotifyExpiring(within)
+							if err != nil {
+								return fmt.Errorf("error during webhook expiring: %w", err)
+							}
+							if !quiet {
+								fmt.Printf("%d expiring token(s) reported\n", n)
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "test",
+						Usage: "Post a test event to every configured webhook",
+						Action: func(c *cli.Context) error {
+							err := ctx.WebhookTest()
+							if err != nil {
+								return fmt.Errorf("error during webhook test: %w", err)
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "monitor",
+				Usage: "Watch the expiry of certificates and JWTs, raising alerts as thresholds are crossed",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "threshold",
+						Usage: "Time before expiry at which to raise an alert, such as 30d; may be repeated (default: 30d, 7d, 1d)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "jwt",
+						Usage: "File holding a JWT, such as written by login --out, whose expiry to watch; may be repeated",
+					},
+					&cli.StringFlag{
+						Name:  "interval",
+						Usage: "Time between checks",
+						Value: "1h",
+					},
+					&cli.BoolFlag{
+						Name:  "syslog",
+						Usage: "Send alerts to the system log as well as stderr",
+					},
+					&cli.BoolFlag{
+						Name:  "once",
+						Usage: "Check once, exiting with status 6 when an alert is raised",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					var thresholds []time.Duration
+					for _, s := range c.StringSlice("threshold") {
+						t, err := st.ParseDuration(s)
+						if err != nil {
+							return fmt.Errorf("error during monitor: %w", err)
+						}
+						thresholds = append(thresholds, t)
+					}
+					interval, err := st.ParseDuration(c.String("interval"))
+					if err != nil {
+						return fmt.Errorf("error during monitor: %w", err)
+					}
+					err = ctx.Monitor(st.MonitorOptions{
+						Thresholds: thresholds,
+						JWTs:       c.StringSlice("jwt"),
+						Interval:   interval,
+						Syslog:     c.Bool("syslog"),
+						Once:       c.Bool("once"),
+					})
+					if err != nil {
+						return fmt.Errorf("error during monitor: %w", err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "migrate",
+				Usage: "Move security tokens between keystore backends",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "from",
+						Usage:    "The backend to migrate tokens from",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "to",
+						Usage:    "The backend to migrate tokens to",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "move",
+						Usage: "Remove tokens from the source backend once migrated",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					err := ctx.Migrate(c.String("from"), c.String("to"), c.Bool("move"))
+					if err != nil {
+						return fmt.Errorf("error during migrate: %w", err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "doctor",
+				Usage: "Diagnose the HSM configuration and connectivity to the Manetu endpoint",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "url",
+						Usage:       "The URL of the Manetu endpoint",
+						EnvVars:     []string{"MANETU_URL"},
+						Destination: &url,
+					},
+					&cli.BoolFlag{
+						Name:        "insecure",
+						Usage:       "Allow insecure TLS",
+						EnvVars:     []string{"MANETU_INSECURE"},
+						Destination: &insecure,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					err := ctx.Doctor(url, insecure)
+					if err != nil {
+						return fmt.Errorf("error during doctor: %w", err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:         "selftest",
+				BashComplete: completeTokens(ctx),
+				Usage:        "Check that security tokens sign, verify against their certificates and are within their validity periods",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "serial",
+						Usage: "Security token serial number, defaulting to every token",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					err := ctx.SelfTest(c.String("serial"))
+					if err != nil {
+						return fmt.Errorf("error during selftest: %w", err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "hsm",
+				Usage: "Inspect the configured HSM",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "info",
+						Usage: "List slots, tokens, firmware versions and supported mechanisms",
+						Action: func(c *cli.Context) error {
+							err := ctx.HSMInfo()
+							if err != nil {
+								return fmt.Errorf("error during hsm info: %w", err)
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "pin",
+				Usage: "Manage the PIN of the configured HSM token",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "change",
+						Usage: "Change the user PIN (C_SetPIN)",
+						Action: func(c *cli.Context) error {
+							oldPin, release, err := readSecret("Enter current PIN: ")
+							if err != nil {
+								return err
+							}
+							defer release()
+							newPin, release, err := readSecret("Enter new PIN: ")
+							if err != nil {
+								return err
+							}
+							defer release()
+							confirm, release, err := readSecret("Confirm new PIN: ")
+							if err != nil {
+								return err
+							}
+							defer release()
+							if !bytes.Equal(newPin, confirm) {
+								return fmt.Errorf("new PINs do not match")
+							}
+
+							err = ctx.ChangePIN(oldPin, newPin)
+							if err != nil {
+								return fmt.Errorf("error during pin change: %w", err)
+							}
+							if !quiet && !dryRun {
+								fmt.Fprintf(os.Stderr, "PIN changed; remember to update the pin in security-tokens.yml\n")
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:         "sign",
+				BashComplete: completeTokens(ctx),
+				Usage:        "Sign an artifact with a security token",
+				ArgsUsage:    "[ARTIFACT]",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "serial",
+						Usage: "Security token serial number or label, defaulting to the token selected with use",
+					},
+					&cli.StringFlag{
+						Name:  "in",
+						Usage: "The artifact to sign, as an alternative to the argument",
+					},
+					&cli.StringFlag{
+						Name:  "digest",
+						Usage: "Digest of the artifact that is signed: sha256, sha384 or sha512, defaulting to that matched to the key",
+					},
+					&cli.StringFlag{
+						Name:  "encoding",
+						Usage: "Encoding of ECDSA signatures: der, as X.509 and CMS tooling expect, or raw r||s, as JOSE and COSE expect",
+						Value: "der",
+					},
+					&cli.BoolFlag{
+						Name:  "sigstore",
+						Usage: "Produce a Sigstore signature, verifiable with cosign verify-blob",
+					},
+					&cli.StringFlag{
+						Name:    "identity-token",
+						Usage:   "OIDC identity token to exchange with Fulcio for a signing certificate",
+						EnvVars: []string{"SIGSTORE_ID_TOKEN"},
+					},
+					&cli.StringFlag{
+						Name:  "fulcio-url",
+						Usage: "URL of the Fulcio certificate authority",
+						Value: st.SigstoreFulcioURL,
+					},
+					&cli.BoolFlag{
+						Name:  "tlog-upload",
+						Usage: "Record the signature in the Rekor transparency log",
+					},
+					&cli.StringFlag{
+						Name:  "rekor-url",
+						Usage: "URL of the Rekor transparency log",
+						Value: st.SigstoreRekorURL,
+					},
+					&cli.StringFlag{
+						Name:    "output-signature",
+						Aliases: []string{"out"},
+						Usage:   "Write the signature to this file, defaulting to ARTIFACT.sig; base64 encoded with --sigstore",
+					},
+					&cli.StringFlag{
+						Name:  "output-certificate",
+						Usage: "Write the Fulcio certificate chain to this file, defaulting to ARTIFACT.pem",
+					},
+					&cli.StringFlag{
+						Name:  "bundle",
+						Usage: "Write the cosign bundle of a logged signature to this file, defaulting to ARTIFACT.bundle",
+					},
+					&cli.BoolFlag{
+						Name:  "insecure",
+						Usage: "Allow insecure TLS to Fulcio, Rekor and the TSA",
+					},
+				}, tsaFlags...),
+				Action: func(c *cli.Context) error {
+					artifact := c.String("in")
+					if artifact == "" {
+						artifact = c.Args().First()
+					}
+					if artifact == "" {
+						return fmt.Errorf("the artifact to sign must be provided")
+					}
+
+					outputPath := func(name, def string) string {
+						path := c.String(name)
+						if path == "" {
+							path = artifact + def
+						}
+						return path
+					}
+					write := func(path string, data []byte) error {
+						err := os.WriteFile(path, data, 0644)
+						if err != nil {
+							return fmt.Errorf("error during sign: %w", err)
+						}
+						if !quiet {
+							fmt.Fprintf(os.Stderr, "Wrote %s\n", path)
+						}
+						return nil
+					}
+					output := func(name, def string, data []byte) error {
+						return write(outputPath(name, def), data)
+					}
+
+					if !c.Bool("sigstore") {
+						sig, err := ctx.Sign(c.String("serial"), artifact, st.SignOptions{
+							Digest:   c.String("digest"),
+							Encoding: c.String("encoding"),
+						})
+						if err != nil {
+							return fmt.Errorf("error during sign: %w", err)
+						}
+						err = output("output-signature", ".sig", sig)
+						if err != nil {
+							return err
+						}
+
+						tsa := timestampOptions(c)
+						if tsa == nil {
+							return nil
+						}
+						tsr, _, err := ctx.Timestamp(sig, *tsa)
+						if err != nil {
+							return fmt.Errorf("error during sign: %w", err)
+						}
+						return write(outputPath("output-signature", ".sig")+".tsr", tsr)
+					}
+					if timestampOptions(c) != nil {
+						return fmt.Errorf("a Sigstore signature is timestamped by recording it with --tlog-upload")
+					}
+					if c.IsSet("digest") && c.String("digest") != "sha256" {
+						return fmt.Errorf("a Sigstore signature is over the SHA-256 digest of the artifact")
+					}
+					if c.String("encoding") != "der" {
+						return fmt.Errorf("a Sigstore signature is DER encoded")
+					}
+
+					sig, err := ctx.SignSigstore(st.SigstoreOptions{
+						Serial:        c.String("serial"),
+						Artifact:      artifact,
+						IdentityToken: c.String("identity-token"),
+						FulcioURL:     c.String("fulcio-url"),
+						Upload:        c.Bool("tlog-upload"),
+						RekorURL:      c.String("rekor-url"),
+						Insecure:      c.Bool("insecure"),
+					})
+					if err != nil {
+						return fmt.Errorf("error during sign: %w", err)
+					}
 
-	defer func() {
-		_ = ctx.Close()
-	}()
+					err = output("output-signature", ".sig", []byte(base64.StdEncoding.EncodeToString(sig.Signature)))
+					if err != nil {
+						return err
+					}
+					if len(sig.Certificates) > 0 {
+						var chain string
+						for _, cert := range sig.Certificates {
+							chain += st.ExportCert(cert)
+						}
+						err = output("output-certificate", ".pem", []byte(chain))
+						if err != nil {
+							return err
+						}
+					}
+					if sig.Bundle != nil {
+						err = output("bundle", ".bundle", sig.Bundle)
+						if err != nil {
+							return err
+						}
+						if !quiet {
+							fmt.Fprintf(os.Stderr, "Rekor log index: %d\n", sig.LogIndex)
+						}
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "cms",
+				Usage: "Sign CMS (PKCS#7) messages with a security token",
+				Subcommands: []*cli.Command{
+					{
+						Name:         "sign",
+						BashComplete: completeTokens(ctx),
+						Usage:        "Sign content as a CMS SignedData, attached or detached",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:  "serial",
+								Usage: "Security token serial number or label, defaulting to the token selected with use",
+							},
+							&cli.StringFlag{
+								Name:  "in",
+								Usage: "Path to the content, defaulting to stdin",
+							},
+							&cli.StringFlag{
+								Name:  "out",
+								Usage: "Path to the SignedData, defaulting to stdout",
+							},
+							&cli.BoolFlag{
+								Name:  "detached",
+								Usage: "Leave the content out of the SignedData",
+							},
+							&cli.StringFlag{
+								Name:  "digest",
+								Usage: "Digest of the content: sha256, sha384 or sha512, defaulting to that matched to the key",
+							},
+							&cli.StringFlag{
+								Name:  "cert",
+								Usage: "Path to a PEM certificate issued to the token, followed by its chain, instead of the self-signed certificate",
+							},
+							&cli.StringFlag{
+								Name:  "output",
+								Usage: "Output format: der or pem",
+								Value: "der",
+							},
+						}, tsaFlags...),
+						Action: func(c *cli.Context) error {
+							content, err := readInput(c.String("in"))
+							if err != nil {
+								return fmt.Errorf("error during cms sign: %w", err)
+							}
 
-	var (
-		url      string
-		insecure bool
-	)
+							msg, err := ctx.SignCMS(c.String("serial"), content, st.CMSOptions{
+								Detached:    c.Bool("detached"),
+								Digest:      c.String("digest"),
+								Certificate: c.String("cert"),
+								Output:      c.String("output"),
+								Timestamp:   timestampOptions(c),
+							})
+							if err != nil {
+								return fmt.Errorf("error during cms sign: %w", err)
+							}
+							err = writeOutput(c.String("out"), msg)
+							if err != nil {
+								return fmt.Errorf("error during cms sign: %w", err)
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "cose",
+				Usage: "Sign CBOR encoded COSE messages and CWTs with a security token",
+				Subcommands: []*cli.Command{
+					{
+						Name:         "sign",
+						BashComplete: completeTokens(ctx),
+						Usage:        "Sign a payload, or a CWT of the claims given, as a COSE_Sign1 message",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "serial",
+								Usage: "Security token serial number or label, defaulting to the token selected with use",
+							},
+							&cli.StringFlag{
+								Name:  "in",
+								Usage: "Path to the payload, defaulting to stdin",
+							},
+							&cli.StringFlag{
+								Name:  "out",
+								Usage: "Path to the COSE_Sign1 message, defaulting to stdout",
+							},
+							&cli.BoolFlag{
+								Name:  "detached",
+								Usage: "Omit the payload from the message",
+							},
+							&cli.BoolFlag{
+								Name:  "cwt",
+								Usage: "Sign a CWT of the claims given, instead of a payload",
+							},
+							&cli.StringFlag{
+								Name:  "iss",
+								Usage: "Issuer of the CWT",
+							},
+							&cli.StringFlag{
+								Name:  "sub",
+								Usage: "Subject of the CWT, defaulting to the MRN of the token",
+							},
+							&cli.StringFlag{
+								Name:  "aud",
+								Usage: "Audience of the CWT",
+							},
+							&cli.DurationFlag{
+								Name:  "ttl",
+								Usage: "Lifetime of the CWT",
+								Value: time.Hour,
+							},
+							&cli.BoolFlag{
+								Name:  "cwt-tag",
+								Usage: "Wrap the CWT in the CWT tag (61)",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							opts := st.COSEOptions{Detached: c.Bool("detached")}
+							var payload []byte
+							if c.Bool("cwt") {
+								if c.IsSet("in") {
+									return fmt.Errorf("a CWT is signed instead of a payload")
+								}
+								opts.Claims = &st.CWTClaims{
+									Issuer:   c.String("iss"),
+									Subject:  c.String("sub"),
+									Audience: c.String("aud"),
+									TTL:      c.Duration("ttl"),
+								}
+								opts.CWTTag = c.Bool("cwt-tag")
+							} else {
+								var err error
+								payload, err = readInput(c.String("in"))
+								if err != nil {
+									return fmt.Errorf("error during cose sign: %w", err)
+								}
+							}
 
-	app := &cli.App{
-		EnableBashCompletion: true,
-		Commands: []*cli.Command{
+							msg, err := ctx.SignCOSE(c.String("serial"), payload, opts)
+							if err != nil {
+								return fmt.Errorf("error during cose sign: %w", err)
+							}
+							err = writeOutput(c.String("out"), msg)
+							if err != nil {
+								return fmt.Errorf("error during cose sign: %w", err)
+							}
+							return nil
+						},
+					},
+				},
+			},
 			{
-				Name:  "version",
-				Usage: "Report version and build information",
+				Name:  "jws",
+				Usage: "Sign payloads as JSON Web Signatures with a security token",
+				Subcommands: []*cli.Command{
+					{
+						Name:         "sign",
+						BashComplete: completeTokens(ctx),
+						Usage:        "Sign a payload as a compact or general JSON JWS, optionally detached",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "serial",
+								Usage: "Security token serial number or label, defaulting to the token selected with use",
+							},
+							&cli.StringFlag{
+								Name:  "in",
+								Usage: "Path to the payload, defaulting to stdin",
+							},
+							&cli.StringFlag{
+								Name:  "out",
+								Usage: "Path to the JWS, defaulting to stdout",
+							},
+							&cli.StringSliceFlag{
+								Name:  "header",
+								Usage: "Protected header as name=value, the value parsed as JSON where it is valid JSON; may be repeated",
+							},
+							&cli.BoolFlag{
+								Name:  "x5c",
+								Usage: "Include the certificate of the token in the header",
+							},
+							&cli.BoolFlag{
+								Name:  "detached",
+								Usage: "Omit the payload from the JWS",
+							},
+							&cli.BoolFlag{
+								Name:  "unencoded",
+								Usage: "Sign the payload as is rather than base64url encoded (RFC 7797), implying --detached",
+							},
+							&cli.StringFlag{
+								Name:  "format",
+								Usage: "Serialization: compact or json",
+								Value: "compact",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							headers := map[string]interface{}{}
+							for _, h := range c.StringSlice("header") {
+								name, value, ok := strings.Cut(h, "=")
+								if !ok || name == "" {
+									return fmt.Errorf("headers are given as name=value, not %q", h)
+								}
+								var v interface{}
+								if json.Unmarshal([]byte(value), &v) != nil {
+									v = value
+								}
+								headers[name] = v
+							}
+							payload, err := readInput(c.String("in"))
+							if err != nil {
+								return fmt.Errorf("error during jws sign: %w", err)
+							}
+
+							jws, err := ctx.SignJWS(c.String("serial"), payload, st.JWSOptions{
+								Headers:   headers,
+								X5C:       c.Bool("x5c"),
+								Detached:  c.Bool("detached"),
+								Unencoded: c.Bool("unencoded"),
+								Format:    c.String("format"),
+							})
+							if err != nil {
+								return fmt.Errorf("error during jws sign: %w", err)
+							}
+							err = writeOutput(c.String("out"), []byte(jws+"\n"))
+							if err != nil {
+								return fmt.Errorf("error during jws sign: %w", err)
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:         "verify",
+				BashComplete: completeTokens(ctx),
+				Usage:        "Verify the signature of an artifact produced by sign",
+				ArgsUsage:    "[ARTIFACT]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "cert",
+						Usage: "Path to the PEM encoded certificate of the signer",
+					},
+					&cli.StringFlag{
+						Name:  "serial",
+						Usage: "Security token serial number of the signer, instead of a certificate",
+					},
+					&cli.StringFlag{
+						Name:  "in",
+						Usage: "The signed artifact, as an alternative to the argument",
+					},
+					&cli.StringFlag{
+						Name:  "sig",
+						Usage: "Path to the signature, defaulting to ARTIFACT.sig",
+					},
+					&cli.StringFlag{
+						Name:  "digest",
+						Usage: "Digest of the artifact that was signed: sha256, sha384 or sha512, defaulting to that matched to the key",
+					},
+				},
 				Action: func(c *cli.Context) error {
-					fmt.Printf("manetu-security-token, git %s, goVersion %s, buildDate %s\n", version.GitCommit, version.GoVersion, version.BuildDate)
+					if c.IsSet("serial") && c.IsSet("cert") {
+						return fmt.Errorf("only one of serial or cert may be provided")
+					}
+					artifact := c.String("in")
+					if artifact == "" {
+						artifact = c.Args().First()
+					}
+					if artifact == "" {
+						return fmt.Errorf("the signed artifact must be provided")
+					}
+					sigPath := c.String("sig")
+					if sigPath == "" {
+						sigPath = artifact + ".sig"
+					}
+					sig, err := os.ReadFile(sigPath)
+					if err != nil {
+						return fmt.Errorf("error during verify: %w", err)
+					}
+
+					cert, err := ctx.Verify(c.String("serial"), c.String("cert"), artifact, sig, st.SignOptions{Digest: c.String("digest")})
+					if err != nil {
+						return fmt.Errorf("error during verify: %w", err)
+					}
+					if len(cert.Subject.Organization) > 0 {
+						fmt.Printf("Verified OK, signed by %s\n", st.ComputeMRN(cert))
+					} else {
+						fmt.Println("Verified OK")
+					}
 					return nil
 				},
 			},
 			{
-				Name:  "generate",
-				Usage: "Generate a new security token",
+				Name:         "ecdh",
+				BashComplete: completeTokens(ctx),
+				Usage:        "Agree a symmetric key with a peer by ECDH with the key of a security token, printed in hex",
 				Flags: []cli.Flag{
 					&cli.StringFlag{
-						Name:     "realm",
-						Usage:    "Set the realm id",
-						EnvVars:  []string{"MANETU_REALM"},
+						Name:  "serial",
+						Usage: "Security token serial number or label, defaulting to the token selected with use",
+					},
+					&cli.StringFlag{
+						Name:     "peer",
+						Usage:    "Path to the PEM encoded certificate or public key of the peer",
 						Required: true,
 					},
+					&cli.StringFlag{
+						Name:  "salt",
+						Usage: "HKDF salt, agreed with the peer",
+					},
+					&cli.StringFlag{
+						Name:  "info",
+						Usage: "HKDF info, binding the key to its purpose",
+					},
+					&cli.IntFlag{
+						Name:  "length",
+						Usage: "Size of the key in bytes",
+						Value: 32,
+					},
 				},
 				Action: func(c *cli.Context) error {
-					realm := c.String("realm")
-					cert, err := ctx.Generate(realm)
+					data, err := os.ReadFile(c.String("peer"))
 					if err != nil {
-						return fmt.Errorf("error during generate: %v", err)
+						return fmt.Errorf("error during ecdh: %w", err)
+					}
+					peer, err := st.ParsePublicKey(data)
+					if err != nil {
+						return fmt.Errorf("error during ecdh: %s: %w", c.String("peer"), err)
 					}
-					fmt.Fprintf(os.Stderr, "Serial: %s\n", st.HexEncode(cert.SerialNumber.Bytes()))
-					fmt.Fprintf(os.Stderr, "MRN: %s\n", st.ComputeMRN(cert))
-					fmt.Printf("%s\n", st.ExportCert(cert))
 
+					key, err := ctx.ECDH(c.String("serial"), peer, st.ECDHOptions{
+						Salt:   []byte(c.String("salt")),
+						Info:   []byte(c.String("info")),
+						Length: c.Int("length"),
+					})
+					if err != nil {
+						return fmt.Errorf("error during ecdh: %w", err)
+					}
+					defer st.LockSecret(key)()
+					fmt.Println(hex.EncodeToString(key))
 					return nil
 				},
 			},
 			{
-				Name:  "show",
-				Usage: "Display the PEM encoded x509 public key for the specified security token",
+				Name:  "encrypt",
+				Usage: "Encrypt a small payload, such as a secret, to a security token",
 				Flags: []cli.Flag{
 					&cli.StringFlag{
-						Name:  "serial",
-						Usage: "Security token serial number",
+						Name:     "to",
+						Usage:    "Path to the PEM encoded certificate or public key of the recipient",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "in",
+						Usage: "Path to the payload, defaulting to stdin",
+					},
+					&cli.StringFlag{
+						Name:  "out",
+						Usage: "Path to the encrypted message, defaulting to stdout",
 					},
 				},
 				Action: func(c *cli.Context) error {
-					err := ctx.Show(c.String("serial"))
+					data, err := os.ReadFile(c.String("to"))
+					if err != nil {
+						return fmt.Errorf("error during encrypt: %w", err)
+					}
+					to, err := st.ParsePublicKey(data)
 					if err != nil {
-						return fmt.Errorf("error during show: %v", err)
+						return fmt.Errorf("error during encrypt: %s: %w", c.String("to"), err)
+					}
+					plaintext, err := readInput(c.String("in"))
+					if err != nil {
+						return fmt.Errorf("error during encrypt: %w", err)
+					}
+
+					message, err := st.Encrypt(to, plaintext)
+					if err != nil {
+						return fmt.Errorf("error during encrypt: %w", err)
+					}
+					err = writeOutput(c.String("out"), message)
+					if err != nil {
+						return fmt.Errorf("error during encrypt: %w", err)
 					}
 					return nil
 				},
 			},
 			{
-				Name:  "list",
-				Usage: "Enumerate available security tokens",
+				Name:         "decrypt",
+				BashComplete: completeTokens(ctx),
+				Usage:        "Decrypt a message encrypted to a security token",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "serial",
+						Usage: "Security token serial number or label, defaulting to the token selected with use",
+					},
+					&cli.StringFlag{
+						Name:  "in",
+						Usage: "Path to the encrypted message, defaulting to stdin",
+					},
+					&cli.StringFlag{
+						Name:  "out",
+						Usage: "Path to the payload, defaulting to stdout",
+					},
+				},
 				Action: func(c *cli.Context) error {
-					err := ctx.List()
+					message, err := readInput(c.String("in"))
 					if err != nil {
-						return fmt.Errorf("error during list: %v", err)
+						return fmt.Errorf("error during decrypt: %w", err)
+					}
+
+					plaintext, err := ctx.Decrypt(c.String("serial"), message)
+					if err != nil {
+						return fmt.Errorf("error during decrypt: %w", err)
+					}
+					defer st.Zeroize(plaintext)
+					err = writeOutput(c.String("out"), plaintext)
+					if err != nil {
+						return fmt.Errorf("error during decrypt: %w", err)
 					}
 					return nil
 				},
 			},
 			{
-				Name:  "delete",
-				Usage: "Remove a security token",
+				Name:         "vault-login",
+				BashComplete: completeTokens(ctx),
+				Usage:        "Authenticate to HashiCorp Vault with a security token and print the Vault token",
 				Flags: []cli.Flag{
 					&cli.StringFlag{
-						Name:     "serial",
-						Usage:    "Security token serial number",
-						Required: true,
+						Name:  "serial",
+						Usage: "Security token serial number or label, defaulting to the token selected with use",
+					},
+					&cli.StringFlag{
+						Name:  "address",
+						Usage: "Address of the Vault server, defaulting to vault.address of the configuration file, then VAULT_ADDR",
+					},
+					&cli.StringFlag{
+						Name:  "namespace",
+						Usage: "Vault Enterprise namespace, defaulting to vault.namespace of the configuration file, then VAULT_NAMESPACE",
+					},
+					&cli.StringFlag{
+						Name:  "ca-cert",
+						Usage: "PEM encoded CA certificates of the Vault server, defaulting to VAULT_CACERT or the system roots",
+					},
+					&cli.BoolFlag{
+						Name:  "insecure",
+						Usage: "Allow insecure TLS to Vault and Manetu",
+					},
+					&cli.StringFlag{
+						Name:  "method",
+						Usage: "Auth method: cert, presenting the token's certificate over TLS, or jwt",
+						Value: "cert",
+					},
+					&cli.StringFlag{
+						Name:  "mount",
+						Usage: "Path of the auth method, defaulting to the name of the method",
+					},
+					&cli.StringFlag{
+						Name:  "role",
+						Usage: "Vault role to log in as; required by the jwt method",
+					},
+					&cli.StringFlag{
+						Name:    "url",
+						Usage:   "With the jwt method, present an access token acquired from this Manetu endpoint rather than a self-signed JWT",
+						EnvVars: []string{"MANETU_URL"},
+					},
+					&cli.StringFlag{
+						Name:  "audience",
+						Usage: "Audience of the self-signed JWT, matching bound_audiences of the role",
+						Value: "vault",
+					},
+					&cli.StringFlag{
+						Name:  "out",
+						Usage: "Write the Vault token atomically to the file, readable only by its owner, rather than to stdout",
+					},
+					&cli.StringFlag{
+						Name:  "owner",
+						Usage: "Set the owner of the --out file, as user[:group]",
 					},
 				},
 				Action: func(c *cli.Context) error {
-					err := ctx.Delete(c.String("serial"))
+					token, err := ctx.VaultLogin(c.String("serial"), st.VaultLoginOptions{
+						Address:   c.String("address"),
+						Namespace: c.String("namespace"),
+						CACert:    c.String("ca-cert"),
+						Insecure:  c.Bool("insecure"),
+						Method:    c.String("method"),
+						Mount:     c.String("mount"),
+						Role:      c.String("role"),
+						ManetuURL: c.String("url"),
+						Audience:  c.String("audience"),
+					})
 					if err != nil {
-						return fmt.Errorf("error during delete: %v", err)
+						return fmt.Errorf("error during vault-login: %w", err)
 					}
-					return nil
+					if c.String("out") == "" {
+						if c.String("owner") != "" {
+							return fmt.Errorf("--owner requires --out")
+						}
+						fmt.Println(token)
+						return nil
+					}
+					return st.WriteSecretFile(c.String("out"), []byte(token+"\n"), c.String("owner"))
 				},
 			},
 			{
@@ -132,24 +2553,41 @@ func main() {
 						EnvVars:     []string{"MANETU_INSECURE"},
 						Destination: &insecure,
 					},
+					&cli.StringFlag{
+						Name:        "out",
+						Usage:       "Write the JWT atomically to the file, readable only by its owner, rather than to stdout",
+						Destination: &out,
+					},
+					&cli.StringFlag{
+						Name:        "owner",
+						Usage:       "Set the owner of the --out file, as user[:group]",
+						Destination: &owner,
+					},
+					&cli.StringFlag{
+						Name:  "digest",
+						Usage: "Digest of the signed assertion: sha256, sha384 or sha512, defaulting to that matched to the key; EC keys accept only that of their curve",
+					},
+				},
+				Before: func(c *cli.Context) error {
+					return ctx.SetAssertionDigest(c.String("digest"))
 				},
 				Subcommands: []*cli.Command{
 					{
-						Name:  "hsm",
-						Usage: "HSM based login",
+						Name:         "hsm",
+						Usage:        "HSM based login",
+						BashComplete: completeTokens(ctx),
 						Flags: []cli.Flag{
 							&cli.StringFlag{
 								Name:  "serial",
-								Usage: "HSM serial number",
+								Usage: "HSM serial number, defaulting to the token selected with use",
 							},
 						},
 						Action: func(c *cli.Context) error {
 							jwt, err := ctx.LoginPKCS11(url, insecure, c.String("serial"))
 							if err != nil {
-								return fmt.Errorf("error during HSM login: %v", err)
+								return fmt.Errorf("error during HSM login: %w", err)
 							}
-							fmt.Printf("%s\n", jwt)
-							return nil
+							return printJWT(jwt)
 						},
 					},
 					{
@@ -176,26 +2614,37 @@ func main() {
 								Name:  "password",
 								Usage: "Password for .p12 file (if not passed in, user will be prompted)",
 							},
+							&cli.StringFlag{
+								Name:    "passphrase",
+								Usage:   "Passphrase for an encrypted key (if not passed in, user will be prompted)",
+								EnvVars: []string{"MANETU_KEY_PASSPHRASE"},
+							},
+							&cli.StringFlag{
+								Name:  "alg",
+								Usage: "Sign the assertion with RS256 or PS256 when the key is RSA",
+								Value: "RS256",
+							},
+							&cli.BoolFlag{
+								Name:  "chain",
+								Usage: "Include the certificates of --cert, leaf first, in the x5c header of the assertion",
+							},
 						},
 						Action: func(c *cli.Context) error {
 							if c.String("p12") != "" {
 								password := c.String("password")
 								if password == "" {
-									fmt.Print("Enter password for PKCS#12 file: ")
-									bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
+									var err error
+									password, err = readPassword("Enter password for PKCS#12 file: ")
 									if err != nil {
-										return fmt.Errorf("error reading password: %v", err)
+										return err
 									}
-									password = string(bytePassword)
-									fmt.Println()
 								}
 
 								jwt, err := ctx.LoginPKCS12(url, insecure, c.String("p12"), password, c.Bool("path"))
 								if err != nil {
-									return fmt.Errorf("error during PKCS#12 login: %v", err)
+									return fmt.Errorf("error during PKCS#12 login: %w", err)
 								}
-								fmt.Printf("%s\n", jwt)
-								return nil
+								return printJWT(jwt)
 							}
 
 							key := c.String("key")
@@ -205,21 +2654,45 @@ func main() {
 								return fmt.Errorf("both key and cert must be provided for PEM login")
 							}
 
-							jwt, err := ctx.LoginX509(url, insecure, key, cert, c.Bool("path"))
+							jwt, err := ctx.LoginX509(url, insecure, st.X509LoginOptions{
+								Key:        key,
+								Cert:       cert,
+								Path:       c.Bool("path"),
+								Passphrase: flagPassphrase(c, "passphrase", "MANETU_KEY_PASSPHRASE"),
+								Algorithm:  c.String("alg"),
+								Chain:      c.Bool("chain"),
+							})
 							if err != nil {
-								return fmt.Errorf("error during PEM login: %v", err)
+								return fmt.Errorf("error during PEM login: %w", err)
 							}
-							fmt.Printf("%s\n", jwt)
-							return nil
+							return printJWT(jwt)
 						},
 					},
 				},
 			},
+			{
+				Name:      "completion",
+				Usage:     "Print a shell completion script for bash, zsh or fish",
+				ArgsUsage: "bash|zsh|fish",
+				Action: func(c *cli.Context) error {
+					err := printCompletion(c.App.Name, c.Args().First())
+					if err != nil {
+						return fmt.Errorf("error during completion: %w", err)
+					}
+					return nil
+				},
+			},
 		},
 	}
 
 	err := app.Run(os.Args)
 	if err != nil {
-		log.Fatal(err)
+		if jsonErrors {
+			fmt.Fprintln(os.Stderr, st.ErrorJSON(err))
+		} else {
+			log.Print(ctx.FormatError(err))
+		}
+		_ = ctx.Close()
+		os.Exit(st.ExitCode(err))
 	}
 }
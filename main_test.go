@@ -0,0 +1,60 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/manetu/security-token/testutil"
+)
+
+// TestCLI runs the generate, list and delete commands of the CLI upon a SoftHSM2 token, as a user would
+func TestCLI(t *testing.T) {
+	h := testutil.StartSoftHSM(t)
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go command is needed to build the CLI")
+	}
+
+	bin := filepath.Join(t.TempDir(), "manetu-security-token")
+	// #nosec G204 the arguments are those of the test
+	out, err := exec.Command(goTool, "build", "-o", bin, ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("go build: %v: %s", err, out)
+	}
+
+	home := t.TempDir()
+	run := func(args ...string) string {
+		t.Helper()
+
+		// #nosec G204 the arguments are those of the test
+		cmd := exec.Command(bin, args...)
+		// the CLI reads the security-tokens.yml of the token from its working directory
+		cmd.Dir = h.Dir
+		cmd.Env = append(h.Env(), "HOME="+home)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: %v", strings.Join(args, " "), err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	serial := run("--quiet", "generate", "--realm", "acme")
+	if serial == "" {
+		t.Fatal("generate printed no serial")
+	}
+	if list := run("list", "--output", "json"); !strings.Contains(list, serial) {
+		t.Errorf("list = %s; want the token %s", list, serial)
+	}
+	run("delete", "--serial", serial, "--force")
+	if list := run("list", "--output", "json"); strings.Contains(list, serial) {
+		t.Errorf("list after delete = %s; want no token %s", list, serial)
+	}
+}
@@ -0,0 +1,20 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package testutil
+
+import (
+	"github.com/manetu/security-token/config"
+	"github.com/manetu/security-token/core"
+)
+
+// SimulatedCore returns a Core whose keystore is the pkcs11sim backend, a PKCS#11 token simulated in process memory,
+// for unit tests that must run quickly on machines without any PKCS#11 module.  Each Core has a token of its own.
+func SimulatedCore() (*core.Core, error) {
+	backend, err := core.NewBackend("pkcs11sim", &config.Configuration{Pkcs11: config.Pkcs11Configuration{TokenLabel: "simulated"}})
+	if err != nil {
+		return nil, err
+	}
+	return core.NewWithBackend(backend), nil
+}
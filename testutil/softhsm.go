@@ -0,0 +1,209 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+// Package testutil provisions throwaway keystores for end-to-end tests of the security token, both of this
+// repository and of programs built upon its core package.
+package testutil
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/manetu/security-token/config"
+	"github.com/manetu/security-token/core"
+)
+
+// ErrSoftHSMNotInstalled is returned by NewSoftHSM when SoftHSM2 cannot be found on the host
+var ErrSoftHSMNotInstalled = errors.New("SoftHSM2 is not installed")
+
+// softHSMLibraries are the places where the SoftHSM2 library is commonly installed, after that named by
+// SOFTHSM2_LIB
+var softHSMLibraries = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib/aarch64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+	"/usr/local/opt/softhsm/lib/softhsm/libsofthsm2.so",
+}
+
+// SoftHSM is a SoftHSM2 token initialized in a temporary directory with a random PIN, along with a configuration
+// file selecting it.  SoftHSM2 reads the location of its tokens from SOFTHSM2_CONF when the library is initialized,
+// which NewSoftHSM sets for the whole process, so only one SoftHSM may be in use at a time.
+type SoftHSM struct {
+	// Dir holds the token, the configuration of SoftHSM2 and security-tokens.yml, and is removed by Close
+	Dir string
+	// Library is the path of the SoftHSM2 PKCS#11 library
+	Library string
+	// Label is the label of the token
+	Label string
+	// PIN is the user PIN of the token
+	PIN string
+	// ConfigFile is the path of a security-tokens.yml selecting the token.  The CLI reads it when run within Dir.
+	ConfigFile string
+	// Configuration is the configuration written to ConfigFile
+	Configuration config.Configuration
+
+	softhsmConf    string
+	prevConf       string
+	prevConfWasSet bool
+}
+
+// NewSoftHSM initializes a SoftHSM2 token in a new temporary directory, failing with ErrSoftHSMNotInstalled when
+// neither softhsm2-util nor the library, which may be named by SOFTHSM2_LIB, is found.  Close removes it.
+func NewSoftHSM() (*SoftHSM, error) {
+	util, err := exec.LookPath("softhsm2-util")
+	if err != nil {
+		return nil, ErrSoftHSMNotInstalled
+	}
+	library := findSoftHSMLibrary()
+	if library == "" {
+		return nil, ErrSoftHSMNotInstalled
+	}
+
+	dir, err := os.MkdirTemp("", "manetu-softhsm-")
+	if err != nil {
+		return nil, err
+	}
+
+	h := &SoftHSM{
+		Dir:         dir,
+		Library:     library,
+		Label:       "manetu-test",
+		ConfigFile:  filepath.Join(dir, "security-tokens.yml"),
+		softhsmConf: filepath.Join(dir, "softhsm2.conf"),
+	}
+	err = h.init(util)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	return h, nil
+}
+
+// StartSoftHSM returns a SoftHSM for the test, skipping it when SoftHSM2 is not installed and removing the token
+// when it completes
+func StartSoftHSM(t testing.TB) *SoftHSM {
+	t.Helper()
+
+	h, err := NewSoftHSM()
+	if errors.Is(err, ErrSoftHSMNotInstalled) {
+		t.Skip("SoftHSM2 is not installed; set SOFTHSM2_LIB if its library is in an unusual place")
+	}
+	if err != nil {
+		t.Fatalf("unable to provision a SoftHSM2 token: %v", err)
+	}
+	t.Cleanup(func() {
+		err := h.Close()
+		if err != nil {
+			t.Errorf("unable to remove the SoftHSM2 token: %v", err)
+		}
+	})
+	return h
+}
+
+func (h *SoftHSM) init(util string) error {
+	tokens := filepath.Join(h.Dir, "tokens")
+	err := os.Mkdir(tokens, 0700)
+	if err != nil {
+		return err
+	}
+	conf := fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\nlog.level = ERROR\n", tokens)
+	err = os.WriteFile(h.softhsmConf, []byte(conf), 0600)
+	if err != nil {
+		return err
+	}
+
+	h.PIN, err = randomPIN()
+	if err != nil {
+		return err
+	}
+	soPIN, err := randomPIN()
+	if err != nil {
+		return err
+	}
+
+	// #nosec G204 softhsm2-util is found on the PATH and given no untrusted input
+	cmd := exec.Command(util, "--init-token", "--free", "--label", h.Label, "--pin", h.PIN, "--so-pin", soPIN)
+	cmd.Env = append(os.Environ(), "SOFTHSM2_CONF="+h.softhsmConf)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("softhsm2-util --init-token: %w: %s", err, out)
+	}
+
+	h.Configuration = config.Configuration{
+		Backend: "pkcs11",
+		Pkcs11: config.Pkcs11Configuration{
+			Path:       h.Library,
+			TokenLabel: h.Label,
+			Pin:        []byte(h.PIN),
+		},
+	}
+	yml := fmt.Sprintf("pkcs11:\n  path: %q\n  tokenlabel: %q\n  pin: %q\n", h.Library, h.Label, h.PIN)
+	err = os.WriteFile(h.ConfigFile, []byte(yml), 0600)
+	if err != nil {
+		return err
+	}
+
+	h.prevConf, h.prevConfWasSet = os.LookupEnv("SOFTHSM2_CONF")
+	return os.Setenv("SOFTHSM2_CONF", h.softhsmConf)
+}
+
+// Env returns the environment under which a child process, such as the CLI, finds the token
+func (h *SoftHSM) Env() []string {
+	return append(os.Environ(), "SOFTHSM2_CONF="+h.softhsmConf)
+}
+
+// Core returns a Core using the token, whose Close releases it
+func (h *SoftHSM) Core() (*core.Core, error) {
+	backend, err := core.NewBackend("pkcs11", &h.Configuration)
+	if err != nil {
+		return nil, err
+	}
+	return core.NewWithBackend(backend), nil
+}
+
+// Close removes the token and restores SOFTHSM2_CONF.  Any Core returned by Core should be closed first.
+func (h *SoftHSM) Close() error {
+	var err error
+	if h.prevConfWasSet {
+		err = os.Setenv("SOFTHSM2_CONF", h.prevConf)
+	} else {
+		err = os.Unsetenv("SOFTHSM2_CONF")
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(h.Dir)
+}
+
+func findSoftHSMLibrary() string {
+	candidates := softHSMLibraries
+	if lib := os.Getenv("SOFTHSM2_LIB"); lib != "" {
+		candidates = []string{lib}
+	}
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// randomPIN returns a PIN of 16 hex digits, within the limits of SoftHSM2
+func randomPIN() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,196 @@
+/*
+Copyright © 2021-2022 Manetu Inc. All Rights Reserved.
+*/
+
+package testutil
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/manetu/security-token/core"
+)
+
+// TokenServer is a fake Manetu token endpoint, serving /oauth/token over HTTP.  It grants an access token of
+// "access-token-for-" and the MRN of the identity to each assertion signed by the key of a certificate given to
+// Register, as the real endpoint does for registered identities, and refuses any other with 401.
+type TokenServer struct {
+	*httptest.Server
+
+	sync.Mutex
+	certs  map[string]*x509.Certificate
+	logins int
+}
+
+// NewTokenServer starts a TokenServer, which is closed when the test completes
+func NewTokenServer(t testing.TB) *TokenServer {
+	t.Helper()
+
+	s := &TokenServer{certs: map[string]*x509.Certificate{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/token", s.token)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Register accepts assertions signed by the key of cert, as registering the identity with Manetu does
+func (s *TokenServer) Register(cert *x509.Certificate) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.certs[core.ComputeMRN(cert)] = cert
+}
+
+// Logins returns the number of access tokens granted
+func (s *TokenServer) Logins() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.logins
+}
+
+// AccessToken returns the access token granted to the identity of cert
+func AccessToken(cert *x509.Certificate) string {
+	return "access-token-for-" + core.ComputeMRN(cert)
+}
+
+func (s *TokenServer) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.PostForm.Get("client_assertion_type") != "urn:ietf:params:oauth:client-assertion-type:jwt-bearer" {
+		http.Error(w, "unsupported client_assertion_type", http.StatusBadRequest)
+		return
+	}
+
+	cert, err := s.verify(r.PostForm.Get("client_assertion"), "http://"+r.Host+r.URL.Path)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client", "error_description": err.Error()})
+		return
+	}
+
+	s.Lock()
+	s.logins++
+	s.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": AccessToken(cert),
+		"token_type":   "bearer",
+		"expires_in":   300,
+	})
+}
+
+// verify checks the signature, subject and audience of assertion, returning the certificate of its signer
+func (s *TokenServer) verify(assertion, audience string) (*x509.Certificate, error) {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed assertion")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	var claims struct {
+		Iss string `json:"iss"`
+		Sub string `json:"sub"`
+		Aud string `json:"aud"`
+	}
+	for i, v := range []interface{}{&header, &claims} {
+		b, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(b, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if claims.Sub != claims.Iss {
+		return nil, errors.New("sub differs from iss")
+	}
+	if claims.Aud != audience {
+		return nil, fmt.Errorf("aud %q is not %q", claims.Aud, audience)
+	}
+
+	s.Lock()
+	cert, ok := s.certs[claims.Iss]
+	s.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%s is not registered", claims.Iss)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	err = verifyJWS(cert.PublicKey, header.Alg, []byte(parts[0]+"."+parts[1]), sig)
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// verifyJWS verifies the signature of a JWS of algorithm alg over signed, per RFC7518
+func verifyJWS(pub crypto.PublicKey, alg string, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+	hash, ok := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[2:]]
+	if !ok {
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" || len(sig)%2 != 0 {
+			return fmt.Errorf("alg %s does not match an EC key", alg)
+		}
+		der, err := asn1.Marshal(struct{ R, S *big.Int }{
+			R: new(big.Int).SetBytes(sig[:len(sig)/2]),
+			S: new(big.Int).SetBytes(sig[len(sig)/2:]),
+		})
+		if err != nil {
+			return err
+		}
+		if !ecdsa.VerifyASN1(pub, digest, der) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		case "PS":
+			return rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return fmt.Errorf("alg %s does not match an RSA key", alg)
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+}